@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/openmvcore/pkg/smf"
+)
+
+// chargingClient talks to the OCS, nil when online charging is disabled
+var chargingClient *smf.ChargingClient
+
+// errCreditDenied is returned when the OCS grants no credit for a session
+var errCreditDenied = errors.New("credit denied by the OCS")
+
+// loadChargingClient creates the OCS client from the `charging` configuration
+func loadChargingClient() *smf.ChargingClient {
+	if !config.GetBool("charging.enabled") {
+		return nil
+	}
+	timeout := config.GetDuration("charging.timeout")
+	if timeout <= 0 {
+		timeout = 3 * time.Second
+	}
+	return smf.NewChargingClient(config.GetString("charging.ocs_uri"), timeout)
+}
+
+// chargingRequest returns a charging data request of the session, numbering
+// its invocations
+func chargingRequest(session *Session) *smf.ChargingDataRequest {
+	req := &smf.ChargingDataRequest{
+		SubscriberIdentifier: "imsi-" + session.IMSI,
+		NfConsumerIdentification: smf.NFIdentification{
+			NFName:            config.GetString("service.name"),
+			NodeFunctionality: "SMF",
+		},
+		InvocationTimeStamp:      time.Now(),
+		InvocationSequenceNumber: session.ChargingSeq,
+		DNN:                      session.APN,
+	}
+	session.ChargingSeq++
+	return req
+}
+
+// unitUsage returns the multiple unit usage of the session's rating group,
+// requesting new units unless final is set
+func unitUsage(used []smf.UsedUnitContainer, final bool) []smf.MultipleUnitUsage {
+	usage := smf.MultipleUnitUsage{
+		RatingGroup:       uint32(config.GetInt("charging.rating_group")),
+		UsedUnitContainer: used,
+	}
+	if !final {
+		usage.RequestedUnit = &smf.RequestedUnit{
+			TotalVolume: uint64(config.GetInt64("charging.requested_volume")),
+			Time:        uint32(config.GetInt("charging.requested_time")),
+		}
+	}
+	return []smf.MultipleUnitUsage{usage}
+}
+
+// grantedQuota returns the credit granted in an OCS response. When no credit
+// was granted the final unit indication the OCS sent, if any, comes with
+// errCreditDenied.
+func grantedQuota(res *smf.ChargingDataResponse) (*smf.CreditQuota, *smf.FinalUnitIndication, error) {
+	for i := range res.MultipleUnitInformation {
+		info := &res.MultipleUnitInformation[i]
+		if info.ResultCode != "" && info.ResultCode != smf.ChargingResultSuccess {
+			return nil, info.FinalUnitIndication, fmt.Errorf("%w: %s", errCreditDenied, info.ResultCode)
+		}
+		if q := smf.NewCreditQuota(info, config.GetFloat64("charging.threshold")); q != nil {
+			return q, nil, nil
+		}
+		return nil, info.FinalUnitIndication, fmt.Errorf("%w: no units granted", errCreditDenied)
+	}
+	return nil, nil, fmt.Errorf("%w: no units granted", errCreditDenied)
+}
+
+// chargingFailureTolerated reports whether sessions go on uncharged while
+// the OCS cannot be reached
+func chargingFailureTolerated() bool {
+	return config.GetString("charging.failure_handling") != "terminate"
+}
+
+// startCharging opens the session's charging session on the OCS and sets
+// the first credit it is granted. It fails with errCreditDenied when the
+// subscriber has no credit.
+func startCharging(session *Session) error {
+	if chargingClient == nil {
+		return nil
+	}
+	req := chargingRequest(session)
+	req.MultipleUnitUsage = unitUsage(nil, false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), PFCPRequestTimeout)
+	defer cancel()
+
+	ref, res, err := chargingClient.Create(ctx, req)
+	var rejected *smf.ChargingError
+	switch {
+	case errors.As(err, &rejected):
+		return fmt.Errorf("%w: %v", errCreditDenied, err)
+	case err != nil && chargingFailureTolerated():
+		log.Printf("[SMF] OCS unavailable, serving session of IMSI %s uncharged: %v", session.IMSI, err)
+		return nil
+	case err != nil:
+		return err
+	}
+
+	session.ChargingRef = ref
+	quota, _, err := grantedQuota(res)
+	if err != nil {
+		releaseCharging(session, nil)
+		return err
+	}
+	session.Quota = quota
+	return nil
+}
+
+// handleUsageReports acts on the usage reports of a session's URRs
+func handleUsageReports(_ *smf.UPFNode, seid uint64, reports []*smf.UsageReport) {
+	session, ok := sessionManager.getSessionBySEID(seid)
+	if !ok || !session.lock() {
+		return
+	}
+	defer session.mu.Unlock()
+	for _, r := range reports {
+		if r.URRID == smf.ChargingURRID && session.ChargingRef != "" && session.Quota != nil {
+			reportUsage(session, r)
+		}
+	}
+}
+
+// reportUsage reports the units a session used to the OCS and installs the
+// credit granted in exchange. When the OCS grants no more, the units left
+// are the final ones and their final unit action is applied once they are
+// used up.
+func reportUsage(session *Session, r *smf.UsageReport) {
+	quota := session.Quota
+	if quota.FinalAction != "" && r.QuotaExhausted() {
+		if _, err := chargingUpdate(session, r, true); err != nil {
+			log.Printf("[SMF] Failed to report final usage of IMSI %s: %v", session.IMSI, err)
+		}
+		applyFinalUnitAction(session, quota)
+		return
+	}
+
+	var granted *smf.CreditQuota
+	var fui *smf.FinalUnitIndication
+	res, err := chargingUpdate(session, r, false)
+	if err == nil {
+		granted, fui, err = grantedQuota(res)
+	}
+	switch {
+	case errors.Is(err, errCreditDenied):
+		log.Printf("[SMF] No further credit for IMSI %s: %v", session.IMSI, err)
+		final := *quota
+		final.FinalAction = smf.FinalUnitActionTerminate
+		if fui != nil {
+			final.FinalAction = fui.FinalUnitAction
+		}
+		session.Quota = &final
+		if r.QuotaExhausted() {
+			applyFinalUnitAction(session, &final)
+			return
+		}
+		sessionManager.persist(session)
+		return
+	case err != nil:
+		log.Printf("[SMF] Failed to report usage of IMSI %s: %v", session.IMSI, err)
+		if !r.QuotaExhausted() {
+			return
+		}
+		if !chargingFailureTolerated() {
+			terminateSession(session, releaseChargingFailure)
+			return
+		}
+		// Serve the session on the same credit until the OCS is back
+		if err := pushQuota(session); err != nil {
+			log.Printf("[SMF] Failed to install credit of IMSI %s: %v", session.IMSI, err)
+		}
+		return
+	}
+
+	session.Quota = granted
+	if err := pushQuota(session); err != nil {
+		log.Printf("[SMF] Failed to install credit of IMSI %s: %v", session.IMSI, err)
+	}
+	session.LastUpdated = time.Now()
+	sessionManager.persist(session)
+}
+
+// chargingUpdate sends a usage report to the OCS, asking for more credit
+// unless final is set. An OCS that lost the charging session gets the
+// report in a new one.
+func chargingUpdate(session *Session, r *smf.UsageReport, final bool) (*smf.ChargingDataResponse, error) {
+	req := chargingRequest(session)
+	req.MultipleUnitUsage = unitUsage([]smf.UsedUnitContainer{smf.UsedUnits(r, req.InvocationSequenceNumber)}, final)
+
+	ctx, cancel := context.WithTimeout(context.Background(), PFCPRequestTimeout)
+	defer cancel()
+
+	res, err := chargingClient.Update(ctx, session.ChargingRef, req)
+	var rejected *smf.ChargingError
+	if errors.As(err, &rejected) && rejected.SessionUnknown() {
+		log.Printf("[SMF] OCS lost charging session %s of IMSI %s, opening a new one", session.ChargingRef, session.IMSI)
+		var ref string
+		ref, res, err = chargingClient.Create(ctx, req)
+		if err == nil {
+			session.ChargingRef = ref
+		}
+	}
+	if errors.As(err, &rejected) {
+		return nil, fmt.Errorf("%w: %v", errCreditDenied, err)
+	}
+	return res, err
+}
+
+// pushQuota installs the session's current credit on its UPF
+func pushQuota(session *Session) error {
+	upf, ok := pfcpClient.Pool().Get(session.UPFID)
+	if !ok {
+		return fmt.Errorf("session of IMSI %s has no user plane", session.IMSI)
+	}
+	rules := &smf.SessionRules{Charging: session.Quota}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PFCPRequestTimeout)
+	defer cancel()
+
+	if _, err := pfcpClient.ModifySession(ctx, upf, session.RemoteSEID, rules.URRUpdate()); err != nil {
+		return fmt.Errorf("PFCP session modification on UPF %s failed: %w", upf.ID, err)
+	}
+	return nil
+}
+
+// applyFinalUnitAction terminates a session that used its final units. The
+// UPFs cannot redirect traffic, so REDIRECT is applied as TERMINATE.
+func applyFinalUnitAction(session *Session, quota *smf.CreditQuota) {
+	if quota.FinalAction == smf.FinalUnitActionRedirect {
+		log.Printf("[SMF] Redirect of IMSI %s is not supported, terminating instead", session.IMSI)
+	}
+	log.Printf("[SMF] Credit of IMSI %s exhausted, terminating session %s", session.IMSI, session.ID)
+	terminateSession(session, releaseCreditExhausted)
+}
+
+// releaseCharging reports the final usage of a released session and closes
+// its charging session
+func releaseCharging(session *Session, reports []*smf.UsageReport) {
+	if chargingClient == nil || session.ChargingRef == "" {
+		return
+	}
+	req := chargingRequest(session)
+	var used []smf.UsedUnitContainer
+	for _, r := range reports {
+		if r.URRID == smf.ChargingURRID {
+			used = append(used, smf.UsedUnits(r, req.InvocationSequenceNumber))
+		}
+	}
+	req.MultipleUnitUsage = unitUsage(used, true)
+
+	ctx, cancel := context.WithTimeout(context.Background(), PFCPRequestTimeout)
+	defer cancel()
+
+	if err := chargingClient.Release(ctx, session.ChargingRef, req); err != nil {
+		log.Printf("[SMF] Failed to release charging session of IMSI %s: %v", session.IMSI, err)
+	}
+	session.ChargingRef = ""
+	session.Quota = nil
+}
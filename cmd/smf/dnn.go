@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/openmvcore/pkg/smf"
+	"github.com/wmnsk/go-gtp/gtpv2/ie"
+	"github.com/wmnsk/go-gtp/gtpv2/message"
+)
+
+// dnnCatalogue holds the DNNs sessions can be established to
+var dnnCatalogue *smf.DNNCatalogue
+
+// loadDNNCatalogue builds the DNN catalogue from the `dnns` configuration list
+func loadDNNCatalogue() (*smf.DNNCatalogue, error) {
+	var entries []smf.DNNConfig
+	if err := config.UnmarshalKey("dnns", &entries); err != nil {
+		return nil, fmt.Errorf("invalid dnns configuration: %w", err)
+	}
+	return smf.NewDNNCatalogue(entries)
+}
+
+// capSessionAMBR limits the authorized Session-AMBR to that of the DNN
+func capSessionAMBR(session *Session, dnn *smf.DNN) {
+	if dnn.AMBRUL != 0 && session.QoS.AMBRUL > dnn.AMBRUL {
+		session.QoS.AMBRUL = dnn.AMBRUL
+	}
+	if dnn.AMBRDL != 0 && session.QoS.AMBRDL > dnn.AMBRDL {
+		session.QoS.AMBRDL = dnn.AMBRDL
+	}
+}
+
+// requestPDNType returns the PDN type of a Create Session Request, IPv4 when absent
+func requestPDNType(req *message.CreateSessionRequest) uint8 {
+	if req.PDNType == nil {
+		return smf.PDUSessionTypeIPv4
+	}
+	t, err := req.PDNType.PDNType()
+	if err != nil {
+		return smf.PDUSessionTypeIPv4
+	}
+	return t
+}
+
+// pcoResponseIEs answers the PCO and ePCO of a Create Session Request with
+// the DNS servers, P-CSCFs and MTU of the DNN
+func pcoResponseIEs(req *message.CreateSessionRequest, dnn *smf.DNN) []*ie.IE {
+	var ies []*ie.IE
+	for _, i := range []*ie.IE{req.PCO, req.EPCO} {
+		if i == nil {
+			continue
+		}
+		pco, err := smf.ParsePCO(i.Payload)
+		if err != nil {
+			continue
+		}
+		res := dnn.PCOResponse(pco)
+		if len(res.Containers) > 0 {
+			ies = append(ies, ie.New(i.Type, 0, res.Marshal()))
+		}
+	}
+	return ies
+}
+
+// pdnAddressAllocation returns the PAA of a session, carrying the /64 and
+// the interface identifier of IPv6 sessions
+func pdnAddressAllocation(session *Session) *ie.IE {
+	switch {
+	case session.UEIP != nil && session.UEIPv6 != nil:
+		return ie.NewPDNAddressAllocationDualNetIP(session.UEIP, session.UEIPv6, smf.UEPrefixLength)
+	case session.UEIPv6 != nil:
+		return ie.NewPDNAddressAllocationNetIP(session.UEIPv6, smf.UEPrefixLength)
+	}
+	return ie.NewPDNAddressAllocationNetIP(session.UEIP, 0)
+}
+
+// sessionAddresses describes the UE addresses of a session for logging
+func sessionAddresses(session *Session) string {
+	switch {
+	case session.UEIP != nil && session.UEIPv6 != nil:
+		return fmt.Sprintf("%s and prefix %s", session.UEIP, smf.UEPrefix(session.UEIPv6))
+	case session.UEIPv6 != nil:
+		return fmt.Sprintf("prefix %s", smf.UEPrefix(session.UEIPv6))
+	}
+	return session.UEIP.String()
+}
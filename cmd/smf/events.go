@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/openmvcore/pkg/smf"
+)
+
+// Reasons of session.released events
+const (
+	releaseUERequested     = "ue_requested"
+	releaseOperator        = "operator"
+	releaseInactivity      = "inactivity"
+	releaseSetupTimeout    = "setup_timeout"
+	releasePeerRestart     = "peer_restart"
+	releasePathFailure     = "path_failure"
+	releaseReplaced        = "replaced"
+	releaseCreditExhausted = "credit_exhausted"
+	releaseChargingFailure = "charging_failure"
+)
+
+// eventConn publishes session events on NATS, nil when events are disabled
+var eventConn *nats.Conn
+
+// connectEvents connects to the NATS server of `events.nats_url`. The SMF
+// runs without events when it is unset or unreachable.
+func connectEvents() {
+	url := config.GetString("events.nats_url")
+	if url == "" {
+		return
+	}
+	nc, err := nats.Connect(url)
+	if err != nil {
+		log.Printf("[SMF] Failed to connect to NATS at %s, session events disabled: %v", url, err)
+		return
+	}
+	eventConn = nc
+}
+
+// publishSessionReleased announces a released session and why it was
+// released, to the event subscribers and the interception tasks targeting it
+func publishSessionReleased(session *Session, reason string) {
+	reportIRI(session, smf.IRIPDUSessionRelease, reason, session.LITasks)
+
+	event := map[string]interface{}{
+		"event":      "session.released",
+		"session_id": session.ID,
+		"imsi":       session.IMSI,
+		"dnn":        session.APN,
+		"reason":     reason,
+		"duration":   time.Since(session.CreatedAt).Seconds(),
+		"timestamp":  time.Now(),
+	}
+	if session.UEIP != nil {
+		event["ue_ip"] = session.UEIP.String()
+	}
+	if session.UEIPv6 != nil {
+		event["ue_ipv6"] = session.UEIPv6.String()
+	}
+	publishEvent("session.released", event)
+}
+
+func publishEvent(subject string, event any) {
+	if eventConn == nil {
+		return
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("[SMF] Failed to marshal %s event: %v", subject, err)
+		return
+	}
+	if err := eventConn.Publish(subject, data); err != nil {
+		log.Printf("[SMF] Failed to publish %s event: %v", subject, err)
+	}
+}
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/openmvcore/pkg/smf"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// liBasePath is the API root of the X1 interface the LI administration
+// function activates interception tasks on
+const liBasePath = "/smf-li/v1"
+
+// liTasksKey is the Redis hash of the active tasks by XID, so they survive
+// an SMF restart
+const liTasksKey = "smf:li:tasks"
+
+var (
+	// liTasks holds the active interception tasks, nil when lawful
+	// interception is disabled
+	liTasks *smf.LITaskStore
+
+	// x2Client delivers the IRI of targeted sessions to the mediation
+	// function, nil when no X2 address is set. x3Addr is where the UPFs
+	// deliver their content, nil when no X3 address is set.
+	x2Client *smf.XClient
+	x3Addr   *net.TCPAddr
+)
+
+// startLawfulInterception loads the interception tasks, starts the X2
+// delivery and serves X1 until ctx is done. Lawful interception is enabled
+// with `lawful_interception.enabled`.
+func startLawfulInterception(ctx context.Context, store *sessionStore) error {
+	if !config.GetBool("lawful_interception.enabled") {
+		return nil
+	}
+
+	tasks := smf.NewLITaskStore()
+	var configured []smf.LITask
+	if err := config.UnmarshalKey("lawful_interception.tasks", &configured); err != nil {
+		return fmt.Errorf("invalid interception tasks: %w", err)
+	}
+	loadCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	persisted, err := store.loadLITasks(loadCtx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	for _, t := range append(configured, persisted...) {
+		if _, err := tasks.Set(t); err != nil {
+			return fmt.Errorf("invalid interception task: %w", err)
+		}
+	}
+
+	if addr := config.GetString("lawful_interception.x3_address"); addr != "" {
+		if x3Addr, err = net.ResolveTCPAddr("tcp", addr); err != nil {
+			return fmt.Errorf("invalid X3 address: %w", err)
+		}
+	}
+	if addr := config.GetString("lawful_interception.x2_address"); addr != "" {
+		x2Client = smf.NewXClient(addr)
+		go x2Client.Run(ctx)
+	}
+	liTasks = tasks
+
+	if addr := config.GetString("lawful_interception.x1.addr"); addr != "" {
+		server, err := newX1Server(addr)
+		if err != nil {
+			return err
+		}
+		go serveX1(ctx, server)
+	}
+	return nil
+}
+
+// newX1Server returns the X1 server. X1 is served over mutual TLS only:
+// clients must present a certificate signed by `x1.client_ca_file`.
+func newX1Server(addr string) (*http.Server, error) {
+	certFile := config.GetString("lawful_interception.x1.cert_file")
+	keyFile := config.GetString("lawful_interception.x1.key_file")
+	caFile := config.GetString("lawful_interception.x1.client_ca_file")
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return nil, fmt.Errorf("X1 requires cert_file, key_file and client_ca_file")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load X1 certificate: %w", err)
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read X1 client CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates in X1 client CA %s", caFile)
+	}
+
+	r := chi.NewRouter()
+	r.Use(middleware.Recoverer)
+	r.Route(liBasePath, liRoutes)
+	return &http.Server{
+		Addr:    addr,
+		Handler: r,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}, nil
+}
+
+// serveX1 serves X1 on its own listener until ctx is done
+func serveX1(ctx context.Context, server *http.Server) {
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info().Str("addr", server.Addr).Msg("Starting X1 server")
+	if err := server.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+		logger.Error().Err(err).Msg("X1 server error")
+	}
+}
+
+// liRoutes mounts the X1 task management API. Activating, modifying or
+// deactivating a task applies to the established sessions of its target.
+func liRoutes(r chi.Router) {
+	r.Get("/tasks", handleListLITasks)
+	r.Get("/tasks/{xid}", handleGetLITask)
+	r.Put("/tasks/{xid}", handlePutLITask)
+	r.Delete("/tasks/{xid}", handleDeleteLITask)
+}
+
+func handleListLITasks(w http.ResponseWriter, r *http.Request) {
+	smf.WriteSBIResponse(w, http.StatusOK, smf.ContentTypeJSON, liTasks.Tasks())
+}
+
+func handleGetLITask(w http.ResponseWriter, r *http.Request) {
+	t, ok := liTasks.Get(chi.URLParam(r, "xid"))
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "TASK_NOT_FOUND", "")
+		return
+	}
+	smf.WriteSBIResponse(w, http.StatusOK, smf.ContentTypeJSON, t)
+}
+
+func handlePutLITask(w http.ResponseWriter, r *http.Request) {
+	var t smf.LITask
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		writeProblem(w, http.StatusBadRequest, "INVALID_MSG_FORMAT", err.Error())
+		return
+	}
+	// The path identifies the task
+	t.XID = chi.URLParam(r, "xid")
+
+	_, exists := liTasks.Get(t.XID)
+	t, err := liTasks.Set(t)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "INVALID_TASK", err.Error())
+		return
+	}
+	if err := sessionManager.store.saveLITask(r.Context(), t); err != nil {
+		log.Printf("[LI] Failed to persist task %s: %v", t.XID, err)
+	}
+	applyLITasks()
+
+	status := http.StatusCreated
+	if exists {
+		status = http.StatusOK
+	}
+	smf.WriteSBIResponse(w, status, smf.ContentTypeJSON, t)
+}
+
+func handleDeleteLITask(w http.ResponseWriter, r *http.Request) {
+	t, ok := liTasks.Delete(chi.URLParam(r, "xid"))
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "TASK_NOT_FOUND", "")
+		return
+	}
+	if err := sessionManager.store.deleteLITask(r.Context(), t.XID); err != nil {
+		log.Printf("[LI] Failed to delete persisted task %s: %v", t.XID, err)
+	}
+	applyLITasks()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// interceptSession records the tasks targeting a new session, before its
+// user plane is set up
+func interceptSession(session *Session) {
+	if liTasks == nil {
+		return
+	}
+	session.LITasks, session.X3Tasks = matchLITasks(session)
+	if len(session.LITasks) > 0 && session.LICorrelationID == 0 {
+		session.LICorrelationID = newCorrelationID()
+	}
+}
+
+// matchLITasks returns the XIDs of the tasks targeting a session and of
+// those delivering its content
+func matchLITasks(session *Session) (all, x3 []string) {
+	for _, t := range liTasks.Match(session.IMSI, session.MSISDN, session.PEI) {
+		all = append(all, t.XID)
+		if t.X3() {
+			x3 = append(x3, t.XID)
+		}
+	}
+	return all, x3
+}
+
+// newCorrelationID returns the Correlation ID of the X2 and X3 PDUs of a
+// session, never 0
+func newCorrelationID() uint64 {
+	for {
+		if id := rand.Uint64(); id != 0 {
+			return id
+		}
+	}
+}
+
+// applyLITasks applies the active tasks to all established sessions
+func applyLITasks() {
+	for _, session := range sessionManager.allSessions() {
+		if !session.lock() {
+			continue
+		}
+		if session.State == SessionStateActive {
+			updateInterception(session)
+		}
+		session.mu.Unlock()
+	}
+}
+
+// updateInterception applies activated and deactivated tasks to an
+// established session. Newly targeted sessions are reported to their tasks
+// and the UPF starts or stops duplicating their user plane.
+func updateInterception(session *Session) {
+	all, x3 := matchLITasks(session)
+	if equalStrings(all, session.LITasks) && equalStrings(x3, session.X3Tasks) {
+		return
+	}
+	var started []string
+	for _, xid := range all {
+		if !containsString(session.LITasks, xid) {
+			started = append(started, xid)
+		}
+	}
+	dupChanged := !equalStrings(x3, session.X3Tasks)
+
+	session.LITasks, session.X3Tasks = all, x3
+	if len(all) > 0 && session.LICorrelationID == 0 {
+		session.LICorrelationID = newCorrelationID()
+	}
+	reportIRI(session, smf.IRIStartOfInterception, "", started)
+
+	if dupChanged && x3Addr != nil {
+		if err := updateDuplication(session); err != nil {
+			log.Printf("[LI] Failed to update duplication of session %s: %v", session.ID, err)
+		}
+	}
+	sessionManager.persist(session)
+}
+
+// duplicated reports whether the UPF duplicates the user plane of a session
+func duplicated(session *Session) bool {
+	return x3Addr != nil && len(session.X3Tasks) > 0
+}
+
+// x3Deliveries returns the tasks the UPF duplicates a session's user plane for
+func x3Deliveries(session *Session) []smf.X3Delivery {
+	if !duplicated(session) {
+		return nil
+	}
+	deliveries := make([]smf.X3Delivery, 0, len(session.X3Tasks))
+	for _, xid := range session.X3Tasks {
+		deliveries = append(deliveries, smf.X3Delivery{XID: xid, CorrelationID: session.LICorrelationID, Addr: x3Addr})
+	}
+	return deliveries
+}
+
+// updateDuplication points the forwarding FARs of a session at its tasks,
+// those to every PSA on an uplink classifier
+func updateDuplication(session *Session) error {
+	upf, ok := pfcpClient.Pool().Get(session.UPFID)
+	if !ok {
+		return fmt.Errorf("session of IMSI %s has no user plane", session.IMSI)
+	}
+	rules := &smf.SessionRules{PeerTEID: session.PeerUTEID, PeerAddr: session.PeerUAddr, X3: x3Deliveries(session)}
+	ies := []*ie.IE{rules.DownlinkFARUpdate()}
+	if len(session.AnchorFARs) == 0 {
+		ies = append(ies, rules.UplinkFARUpdate())
+	}
+	for _, id := range session.AnchorFARs {
+		ies = append(ies, rules.DuplicationFARUpdate(id))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PFCPRequestTimeout)
+	defer cancel()
+
+	if _, err := pfcpClient.ModifySession(ctx, upf, session.RemoteSEID, ies...); err != nil {
+		return fmt.Errorf("PFCP session modification on UPF %s failed: %w", upf.ID, err)
+	}
+	return nil
+}
+
+// reportIRI sends an IRI record of a session event to the tasks with the
+// given XIDs that deliver X2
+func reportIRI(session *Session, event, cause string, xids []string) {
+	if liTasks == nil || x2Client == nil || len(xids) == 0 {
+		return
+	}
+	record := &smf.IRIRecord{
+		Event:        event,
+		Timestamp:    time.Now(),
+		SUPI:         "imsi-" + session.IMSI,
+		PEI:          session.PEI,
+		PDUSessionID: session.PDUSessionID,
+		DNN:          session.APN,
+		SNSSAI:       session.SNSSAI,
+		UEIPv4:       session.UEIP,
+		UEIPv6:       session.UEIPv6,
+		Location:     session.TAI,
+		UPF:          session.UPFID,
+		Cause:        cause,
+	}
+	if session.MSISDN != "" {
+		record.GPSI = "msisdn-" + session.MSISDN
+	}
+	if session.PDUSessionID == 0 {
+		record.EPSBearerID = session.BearerID
+	}
+
+	for _, xid := range xids {
+		if t, ok := liTasks.Get(xid); !ok || !t.X2() {
+			continue
+		}
+		pdu, err := record.X2PDU(xid, session.LICorrelationID)
+		if err != nil {
+			log.Printf("[LI] Failed to encode IRI of session %s: %v", session.ID, err)
+			continue
+		}
+		if !x2Client.Send(pdu) {
+			log.Printf("[LI] X2 queue full, dropped IRI of session %s", session.ID)
+		}
+	}
+}
+
+// equalStrings reports whether two lists hold the same strings in order
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// saveLITask persists an interception task
+func (s *sessionStore) saveLITask(ctx context.Context, t smf.LITask) error {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("failed to marshal task: %w", err)
+	}
+	return s.redis.HSet(ctx, liTasksKey, t.XID, data).Err()
+}
+
+// deleteLITask removes a persisted interception task
+func (s *sessionStore) deleteLITask(ctx context.Context, xid string) error {
+	return s.redis.HDel(ctx, liTasksKey, xid).Err()
+}
+
+// loadLITasks returns the persisted interception tasks
+func (s *sessionStore) loadLITasks(ctx context.Context) ([]smf.LITask, error) {
+	values, err := s.redis.HGetAll(ctx, liTasksKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load interception tasks: %w", err)
+	}
+	tasks := make([]smf.LITask, 0, len(values))
+	for xid, data := range values {
+		var t smf.LITask
+		if err := json.Unmarshal([]byte(data), &t); err != nil {
+			log.Printf("[LI] Dropping unreadable task %s: %v", xid, err)
+			continue
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, nil
+}
@@ -4,13 +4,16 @@ import (
 	"context"
 	"database/sql"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -30,22 +33,36 @@ var (
 	config     *viper.Viper
 	logger     *httplog.Logger
 
+	// Session and user plane state
+	sessionManager *SessionManager
+	pfcpClient     *smf.PFCPClient
+	gtpcConn       net.PacketConn
+
 	// Network configuration
 	GTPBindAddress = "0.0.0.0"
 	GTPPort        = 2123
 	IPPoolStart    = "10.0.0.1"
 	IPPoolEnd      = "10.0.0.254"
+	IPv6Pool       = "fd00:10::/48" // /64s delegated to IPv6 sessions
 
 	// Session configuration
-	SessionTimeout = 24 * time.Hour
-	DefaultQCI     = uint8(9)  // Default QoS Class Identifier
-	DefaultARP     = uint8(1)  // Default Allocation and Retention Priority
+	DefaultQCI    = uint8(9)            // Default QoS Class Identifier
+	DefaultARP    = uint8(1)            // Default Allocation and Retention Priority
+	DefaultAMBRUL = uint64(100_000_000) // Default Session-AMBR uplink (bps)
+	DefaultAMBRDL = uint64(200_000_000) // Default Session-AMBR downlink (bps)
 )
 
 // ----- Session Management -----
 type Session struct {
+	// mu serializes the procedures of the session: signalling, PFCP
+	// reports, timers and operator actions. Functions taking a *Session
+	// expect it held.
+	mu sync.Mutex
+
+	ID          string // IMSI for 4G sessions, SM context reference for 5G
 	IMSI        string
-	UEIP        net.IP
+	UEIP        net.IP // nil for IPv6-only sessions
+	UEIPv6      net.IP // address in the session's /64, nil for IPv4-only sessions
 	TEID        uint32
 	PeerAddr    string
 	CreatedAt   time.Time
@@ -54,6 +71,59 @@ type Session struct {
 	BearerID    uint8
 	QCI         uint8
 	ARP         uint8
+	QoS         *smf.SessionQoS // authorized QoS, QCI and ARP are those of the default flow
+
+	// User plane
+	APN        string
+	TAI        string
+	UPFID      string
+	UPFTEID    uint32
+	LocalSEID  uint64
+	RemoteSEID uint64
+	PeerUTEID  uint32
+	PeerUAddr  net.IP
+
+	// PSAs reached over N9 when UPFID is an uplink classifier, and the
+	// classifier FARs forwarding uplink traffic to all PSAs
+	Anchors    []*smf.SessionLeg
+	AnchorFARs []uint32
+
+	// Subscriber identities interception tasks may target: the MSISDN
+	// digits and the PEI ("imei-..." or "imeisv-...")
+	MSISDN string
+	PEI    string
+
+	// Lawful interception: the XIDs of the tasks targeting the session and
+	// of those its user plane is duplicated for, and the Correlation ID of
+	// its X2 and X3 PDUs
+	LITasks         []string
+	X3Tasks         []string
+	LICorrelationID uint64
+
+	// Online charging: the OCS charging session and the credit left
+	ChargingRef string
+	ChargingSeq uint32
+	Quota       *smf.CreditQuota
+
+	// PDN/PDU session type, GTPv2 and 5GSM share the codes
+	PDUSessionType uint8
+
+	// 5G PDU session
+	PDUSessionID uint8
+	SNSSAI       *smf.SNSSAI
+	UpCnxState   string
+	StatusURI    string
+}
+
+// lock takes the session for a procedure. It reports false, leaving the
+// session unlocked, when the session was released in the meantime.
+func (s *Session) lock() bool {
+	s.mu.Lock()
+	if s.State == SessionStateDeleting {
+		s.mu.Unlock()
+		return false
+	}
+	return true
 }
 
 type SessionState string
@@ -66,97 +136,358 @@ const (
 )
 
 type SessionManager struct {
-	sessions    map[string]*Session
-	ipPool      []net.IP
-	nextIPIndex int
-	mu          sync.RWMutex
+	sessions     map[string]*Session
+	defaultPool  *smf.IPPool     // UE addresses of DNNs without their own pool
+	defaultPool6 *smf.PrefixPool // UE prefixes of DNNs without their own pool
+	nextSEID     uint64
+	nextTEID     uint32
+	store        *sessionStore
+	mu           sync.RWMutex
+
+	// count is the number of sessions, read without the lock by overload
+	// control
+	count atomic.Int64
 }
 
-func NewSessionManager() *SessionManager {
-	sm := &SessionManager{
-		sessions: make(map[string]*Session),
+func NewSessionManager(store *sessionStore) (*SessionManager, error) {
+	pool, err := smf.NewIPPoolRange(IPPoolStart, IPPoolEnd)
+	if err != nil {
+		return nil, err
+	}
+	pool6, err := smf.NewPrefixPool(IPv6Pool)
+	if err != nil {
+		return nil, err
 	}
-	sm.initIPPool()
-	return sm
+	return &SessionManager{
+		sessions:     make(map[string]*Session),
+		defaultPool:  pool,
+		defaultPool6: pool6,
+		store:        store,
+	}, nil
 }
 
-func (sm *SessionManager) initIPPool() {
-	start := net.ParseIP(IPoolStart).To4()
-	end := net.ParseIP(IPoolEnd).To4()
-	
-	for ip := start; !ip.Equal(end); ip = nextIP(ip) {
-		sm.ipPool = append(sm.ipPool, append(net.IP(nil), ip...))
+// pool returns the UE address pool of a DNN
+func (sm *SessionManager) pool(dnn string) *smf.IPPool {
+	if d, ok := dnnCatalogue.Resolve(dnn); ok && d.Pool != nil {
+		return d.Pool
 	}
+	return sm.defaultPool
 }
 
-func nextIP(ip net.IP) net.IP {
-	next := make(net.IP, len(ip))
-	copy(next, ip)
-	for i := len(next) - 1; i >= 0; i-- {
-		next[i]++
-		if next[i] != 0 {
-			break
-		}
+// pool6 returns the UE prefix pool of a DNN
+func (sm *SessionManager) pool6(dnn string) *smf.PrefixPool {
+	if d, ok := dnnCatalogue.Resolve(dnn); ok && d.Pool6 != nil {
+		return d.Pool6
 	}
-	return next
+	return sm.defaultPool6
 }
 
-func (sm *SessionManager) allocateIP() net.IP {
+// errSessionExists is returned when a subscriber already has a PDN connection
+var errSessionExists = errors.New("session already exists")
+
+// createSession creates the PDN connection of a subscriber, returned locked
+func (sm *SessionManager) createSession(imsi string, teid uint32, peerAddr, dnn string, pdnType uint8) (*Session, error) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
-	
-	if sm.nextIPIndex >= len(sm.ipPool) {
-		return nil
+
+	if _, ok := sm.sessions[imsi]; ok {
+		return nil, fmt.Errorf("%w for IMSI %s", errSessionExists, imsi)
+	}
+
+	session, err := sm.newSession(imsi, imsi, dnn, pdnType)
+	if err != nil {
+		return nil, err
 	}
-	ip := sm.ipPool[sm.nextIPIndex]
-	sm.nextIPIndex++
-	return ip
+	session.TEID = teid
+	session.PeerAddr = peerAddr
+	return session, nil
 }
 
-func (sm *SessionManager) createSession(imsi string, teid uint32, peerAddr string) (*Session, error) {
+// createSMContext creates the 5G PDU session psi of a subscriber, returned
+// locked
+func (sm *SessionManager) createSMContext(imsi string, psi uint8, dnn string, pduType uint8) (*Session, error) {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	// Check if session already exists
-	if existing, ok := sm.sessions[imsi]; ok {
-		return existing, nil
+	ref := smContextRef(imsi, psi)
+	if _, ok := sm.sessions[ref]; ok {
+		return nil, fmt.Errorf("SM context %s already exists", ref)
 	}
 
-	// Allocate new IP
-	ueIP := sm.allocateIP()
-	if ueIP == nil {
-		return nil, fmt.Errorf("no IPs available in pool")
+	session, err := sm.newSession(ref, imsi, dnn, pduType)
+	if err != nil {
+		return nil, err
+	}
+	session.PDUSessionID = psi
+	return session, nil
+}
+
+// newSession allocates the resources of a session and adds it locked, must
+// be called with sm.mu held
+func (sm *SessionManager) newSession(id, imsi, dnn string, pdnType uint8) (*Session, error) {
+	// Allocate an IPv4 address and/or a /64 from the DNN's pools
+	var ueIP, ueIPv6 net.IP
+	if pdnType != smf.PDUSessionTypeIPv6 {
+		if ueIP = sm.pool(dnn).Allocate(); ueIP == nil {
+			return nil, fmt.Errorf("no IPs available in pool of dnn %q", dnn)
+		}
+	}
+	if pdnType == smf.PDUSessionTypeIPv6 || pdnType == smf.PDUSessionTypeIPv4v6 {
+		if ueIPv6 = sm.pool6(dnn).Allocate(); ueIPv6 == nil {
+			if ueIP != nil {
+				sm.pool(dnn).Release(ueIP)
+			}
+			return nil, fmt.Errorf("no IPv6 prefixes available in pool of dnn %q", dnn)
+		}
 	}
 
+	// Allocate PFCP SEID and uplink TEID on the UPF
+	sm.nextSEID++
+	sm.nextTEID++
+
 	// Create new session
 	session := &Session{
+		ID:          id,
 		IMSI:        imsi,
 		UEIP:        ueIP,
-		TEID:        teid,
-		PeerAddr:    peerAddr,
+		UEIPv6:      ueIPv6,
+		APN:         dnn,
 		CreatedAt:   time.Now(),
 		LastUpdated: time.Now(),
 		State:       SessionStateInitializing,
 		BearerID:    5, // Default EPS Bearer ID
 		QCI:         DefaultQCI,
 		ARP:         DefaultARP,
+		LocalSEID:   sm.nextSEID,
+		UPFTEID:     sm.nextTEID,
+
+		PDUSessionType: pdnType,
 	}
 
-	sm.sessions[imsi] = session
+	session.mu.Lock()
+	sm.insert(session)
 	return session, nil
 }
 
-func (sm *SessionManager) getSession(imsi string) (*Session, bool) {
+// restore adds a persisted session, keeping its UE IP and SEIDs out of the
+// allocators
+func (sm *SessionManager) restore(session *Session) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	sm.insert(session)
+	if session.UEIP != nil && !sm.pool(session.APN).Reserve(session.UEIP) {
+		log.Printf("[SMF] UE IP %s of restored session %s is outside its pool or taken", session.UEIP, session.ID)
+	}
+	if session.UEIPv6 != nil && !sm.pool6(session.APN).Reserve(session.UEIPv6) {
+		log.Printf("[SMF] UE prefix %s of restored session %s is outside its pool or taken", smf.UEPrefix(session.UEIPv6), session.ID)
+	}
+	if session.LocalSEID > sm.nextSEID {
+		sm.nextSEID = session.LocalSEID
+	}
+	for _, leg := range session.Anchors {
+		if leg.LocalSEID > sm.nextSEID {
+			sm.nextSEID = leg.LocalSEID
+		}
+	}
+	if session.UPFTEID > sm.nextTEID {
+		sm.nextTEID = session.UPFTEID
+	}
+}
+
+// insert adds a session to the table, the caller holding sm.mu
+func (sm *SessionManager) insert(session *Session) {
+	if _, ok := sm.sessions[session.ID]; !ok {
+		sm.count.Add(1)
+	}
+	sm.sessions[session.ID] = session
+}
+
+// sessionCount returns the number of sessions
+func (sm *SessionManager) sessionCount() int {
+	return int(sm.count.Load())
+}
+
+// restoreAllocators raises the SEID and TEID allocators to persisted values,
+// covering IDs of tunnels that are not kept in a session
+func (sm *SessionManager) restoreAllocators(nextSEID uint64, nextTEID uint32) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if nextSEID > sm.nextSEID {
+		sm.nextSEID = nextSEID
+	}
+	if nextTEID > sm.nextTEID {
+		sm.nextTEID = nextTEID
+	}
+}
+
+// persist saves the current state of a session so it survives a restart
+func (sm *SessionManager) persist(session *Session) {
+	sm.mu.RLock()
+	nextSEID, nextTEID := sm.nextSEID, sm.nextTEID
+	sm.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := sm.store.save(ctx, session, nextSEID, nextTEID); err != nil {
+		log.Printf("[SMF] Failed to persist session %s: %v", session.ID, err)
+	}
+}
+
+// smContextRef returns the SM context reference of a 5G PDU session
+func smContextRef(imsi string, psi uint8) string {
+	return fmt.Sprintf("imsi-%s-%d", imsi, psi)
+}
+
+// allSessions returns every session ordered by ID
+func (sm *SessionManager) allSessions() []*Session {
 	sm.mu.RLock()
 	defer sm.mu.RUnlock()
-	session, ok := sm.sessions[imsi]
-	return session, ok
+
+	sessions := make([]*Session, 0, len(sm.sessions))
+	for _, session := range sm.sessions {
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+// sessionsOnUPF returns the sessions with a PFCP session on the given UPF.
+// They may have moved by the time the caller locks them.
+func (sm *SessionManager) sessionsOnUPF(upfID string) []*Session {
+	var sessions []*Session
+	for _, session := range sm.allSessions() {
+		session.mu.Lock()
+		if sessionOnUPF(session, upfID) {
+			sessions = append(sessions, session)
+		}
+		session.mu.Unlock()
+	}
+	return sessions
 }
 
-func (sm *SessionManager) deleteSession(imsi string) {
+// allocateSEID reserves a local SEID for an additional PFCP session of a session
+func (sm *SessionManager) allocateSEID() uint64 {
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
-	delete(sm.sessions, imsi)
+	sm.nextSEID++
+	return sm.nextSEID
+}
+
+// allocateTEID reserves a UPF TEID
+func (sm *SessionManager) allocateTEID() uint32 {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.nextTEID++
+	return sm.nextTEID
+}
+
+func (sm *SessionManager) getSession(id string) (*Session, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	session, ok := sm.sessions[id]
+	return session, ok
+}
+
+// getSessionBySEID returns the session with the given local SEID on its
+// primary UPF or on one of its PSAs
+func (sm *SessionManager) getSessionBySEID(seid uint64) (*Session, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	for _, session := range sm.sessions {
+		if session.LocalSEID == seid {
+			return session, true
+		}
+		for _, leg := range session.Anchors {
+			if leg.LocalSEID == seid {
+				return session, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// remoteSEID returns the SEID a UPF allocated to the PFCP session with the
+// local SEID, the SEID of the Session Report Responses sent to it
+func (sm *SessionManager) remoteSEID(node *smf.UPFNode, seid uint64) (uint64, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	for _, session := range sm.sessions {
+		if session.LocalSEID == seid && session.UPFID == node.ID {
+			return session.RemoteSEID, true
+		}
+		for _, leg := range session.Anchors {
+			if leg.LocalSEID == seid && leg.UPFID == node.ID {
+				return leg.RemoteSEID, true
+			}
+		}
+	}
+	return 0, false
+}
+
+func (sm *SessionManager) getSessionByTEID(teid uint32) (*Session, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	for _, session := range sm.sessions {
+		if session.TEID == teid {
+			return session, true
+		}
+	}
+	return nil, false
+}
+
+// sessionsOfPeer returns the GTP-C sessions set up by the peer with the given IP
+func (sm *SessionManager) sessionsOfPeer(host string) []*Session {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	var sessions []*Session
+	for _, session := range sm.sessions {
+		if session.PeerAddr != "" && smf.PeerHost(session.PeerAddr) == host {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// peerHosts returns the IPs of the GTP-C peers that set up sessions
+func (sm *SessionManager) peerHosts() map[string]bool {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	hosts := make(map[string]bool)
+	for _, session := range sm.sessions {
+		if session.PeerAddr != "" {
+			hosts[smf.PeerHost(session.PeerAddr)] = true
+		}
+	}
+	return hosts
+}
+
+// deleteSession removes a session and frees its addresses, the caller
+// holding the session's lock
+func (sm *SessionManager) deleteSession(id string) {
+	sm.mu.Lock()
+	if session, ok := sm.sessions[id]; ok {
+		session.State = SessionStateDeleting
+		if session.UEIP != nil {
+			sm.pool(session.APN).Release(session.UEIP)
+		}
+		if session.UEIPv6 != nil {
+			sm.pool6(session.APN).Release(session.UEIPv6)
+		}
+		delete(sm.sessions, id)
+		sm.count.Add(-1)
+	}
+	sm.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := sm.store.delete(ctx, id); err != nil {
+		log.Printf("[SMF] Failed to delete persisted session %s: %v", id, err)
+	}
 }
 
 func init() {
@@ -193,15 +524,67 @@ func main() {
 	pgDB := initPostgres()
 	defer pgDB.Close()
 
-	// Create session manager
-	sessionManager = NewSessionManager()
+	// Peers learn of this restart from the Restart Counter
+	var err error
+	if restartCounter, err = nextRestartCounter(pgDB, config.GetString("service.name")); err != nil {
+		logger.Fatal().Err(err).Msg("Failed to update restart counter")
+	}
+	logger.Info().Int("restart_counter", int(restartCounter)).Msg("SMF restart counter")
+
+	// Load the DNN catalogue and QoS policies applied to new sessions
+	if dnnCatalogue, err = loadDNNCatalogue(); err != nil {
+		logger.Fatal().Err(err).Msg("Invalid DNN configuration")
+	}
+	if len(dnnCatalogue.DNNs()) == 0 {
+		logger.Warn().Msg("No DNNs configured, every Create Session Request will be rejected")
+	}
+	if policyStore, err = loadQoSPolicies(); err != nil {
+		logger.Fatal().Err(err).Msg("Invalid QoS configuration")
+	}
+	chargingClient = loadChargingClient()
+	connectEvents()
+	loadPeerTimers()
+	if overloadControl, err = loadOverloadControl(); err != nil {
+		logger.Fatal().Err(err).Msg("Invalid overload configuration")
+	}
+
+	// Create session manager and restore the sessions of the last run
+	if sessionManager, err = NewSessionManager(newSessionStore(redisClient)); err != nil {
+		logger.Fatal().Err(err).Msg("Invalid IP pool")
+	}
+	if config.GetBool("features.session_recovery") {
+		if err := restoreSessions(sessionManager.store); err != nil {
+			logger.Fatal().Err(err).Msg("Failed to restore sessions")
+		}
+	}
+
+	// Start PFCP associations with the configured UPFs
+	pfcpClient, err = newPFCPClient()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("Failed to create PFCP client")
+	}
+	defer pfcpClient.Close()
+	pfcpClient.OnUPFDown(failoverSessions)
+	pfcpClient.OnUPFUp(auditUPF)
+	pfcpClient.OnUsageReport(handleUsageReports)
+	pfcpClient.OnInactivityReport(handleInactivityReport)
+	pfcpClient.SetSessionLookup(sessionManager.remoteSEID)
+	if ulclPolicies, err = loadULCLPolicies(pfcpClient.Pool()); err != nil {
+		logger.Fatal().Err(err).Msg("Invalid ULCL configuration")
+	}
+	go pfcpClient.Run(ctx)
+
+	// Start lawful interception of the targeted sessions
+	if err := startLawfulInterception(ctx, sessionManager.store); err != nil {
+		logger.Fatal().Err(err).Msg("Invalid lawful interception configuration")
+	}
 
 	// Create GTP-C server
 	gtpcAddr := fmt.Sprintf("%s:%d",
 		config.GetString("interfaces.gtpc.ip"),
 		config.GetInt("interfaces.gtpc.port"),
 	)
-	gtpcConn, err := net.ListenPacket("udp", gtpcAddr)
+	gtpcConn, err = net.ListenPacket("udp", gtpcAddr)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("Failed to create GTP-C listener")
 	}
@@ -212,6 +595,9 @@ func main() {
 	gtpcServer.AddHandlers(map[uint8]gtpv2.HandlerFunc{
 		message.MsgTypeCreateSessionRequest: handleCreateSessionRequest,
 		message.MsgTypeDeleteSessionRequest: handleDeleteSessionRequest,
+		message.MsgTypeEchoRequest:          handleEchoRequest,
+		message.MsgTypeEchoResponse:         handleEchoResponse,
+		message.MsgTypeDeleteBearerResponse: handleGTPCResponse,
 	})
 
 	// Start GTP-C server
@@ -222,8 +608,19 @@ func main() {
 		}
 	}()
 
-	// Start metrics server (TODO)
-	// Start PFCP server (TODO)
+	// Start the Nsmf_PDUSession service for 5G AMFs
+	go startSBIServer(ctx)
+
+	// Release sessions whose timers expired
+	go runSessionSweeper(ctx)
+
+	// Monitor the paths to GTP-C peers and the load of the SMF
+	go runPathMonitor(ctx)
+	go runLoadMonitor(ctx)
+
+	// Start metrics server and the operator API
+	go startMetricsServer(ctx)
+	go startOpsServer(ctx)
 
 	// Wait for interrupt signal
 	<-ctx.Done()
@@ -234,70 +631,296 @@ func main() {
 func handleCreateSessionRequest(c *gtpv2.Conn, senderAddr net.Addr, msg message.Message) error {
 	req := msg.(*message.CreateSessionRequest)
 	log.Printf("[GTP] Received CreateSessionRequest from %s", senderAddr.String())
+	peerSeen(senderAddr)
 
 	// Extract IMSI from the request
-	imsiIE, err := req.IMSI()
+	if req.IMSI == nil {
+		return &gtpv2.RequiredIEMissingError{Type: ie.IMSI}
+	}
+	imsi, err := req.IMSI.IMSI()
 	if err != nil {
 		return fmt.Errorf("failed to get IMSI: %w", err)
 	}
-	imsi := imsiIE.String()
+
+	// Extract the peer's control plane TEID
+	if req.SenderFTEIDC == nil {
+		return &gtpv2.RequiredIEMissingError{Type: ie.FullyQualifiedTEID}
+	}
+	peerTEID, err := req.SenderFTEIDC.TEID()
+	if err != nil {
+		return fmt.Errorf("failed to get Sender F-TEID: %w", err)
+	}
+
+	// A changed Restart Counter releases the peer's stale sessions first
+	if req.Recovery != nil {
+		if counter, err := req.Recovery.Recovery(); err == nil {
+			checkPeerRestart(senderAddr, counter)
+		}
+	}
+
+	// Shed new sessions while overloaded
+	if !admitSession() {
+		log.Printf("[SMF] Rejecting session for IMSI %s: SMF overloaded", imsi)
+		return rejectCreateSession(c, senderAddr, req, peerTEID, gtpv2.CauseNoResourcesAvailable)
+	}
+
+	// Resolve the requested APN in the DNN catalogue
+	apn := requestAPN(req)
+	dnn, ok := dnnCatalogue.Resolve(apn)
+	if !ok {
+		log.Printf("[SMF] Rejecting session for IMSI %s: unknown APN %q", imsi, apn)
+		return rejectCreateSession(c, senderAddr, req, peerTEID, gtpv2.CauseMissingOrUnknownAPN)
+	}
+	// Dual-stack requests fall back to the address family the APN allows
+	requested := requestPDNType(req)
+	pdnType, downgraded := dnn.SelectPDNType(requested)
+	if pdnType == 0 {
+		log.Printf("[SMF] Rejecting session for IMSI %s: PDN type %d not allowed on APN %s", imsi, requested, dnn.Name)
+		return rejectCreateSession(c, senderAddr, req, peerTEID, gtpv2.CausePreferredPDNTypeNotSupported)
+	}
+
+	cause := gtpv2.CauseRequestAccepted
+	if downgraded {
+		cause = gtpv2.CauseNewPDNTypeDueToNetworkPreference
+	}
+
+	// A retransmitted request is answered again, a new request of a
+	// subscriber with a session replaces the stale one
+	if old, ok := sessionManager.getSession(imsi); ok && old.lock() {
+		if old.State == SessionStateActive && old.TEID == peerTEID && old.PeerAddr == senderAddr.String() {
+			defer old.mu.Unlock()
+			log.Printf("[SMF] Answering retransmitted CreateSessionRequest of IMSI %s", imsi)
+			return respondCreateSession(c, senderAddr, req, old, dnn, cause)
+		}
+		log.Printf("[SMF] Replacing session of IMSI %s", imsi)
+		old.State = SessionStateDeleting
+		releaseUserPlane(old)
+		sessionManager.deleteSession(old.ID)
+		publishSessionReleased(old, releaseReplaced)
+		old.mu.Unlock()
+	}
 
 	// Create new session
-	session, err := sessionManager.createSession(imsi, req.SenderTEID(), senderAddr.String())
+	session, err := sessionManager.createSession(imsi, peerTEID, senderAddr.String(), dnn.Name, pdnType)
 	if err != nil {
-		return fmt.Errorf("failed to create session: %w", err)
+		log.Printf("[SMF] Rejecting session for IMSI %s: %v", imsi, err)
+		if errors.Is(err, errSessionExists) {
+			return rejectCreateSession(c, senderAddr, req, peerTEID, gtpv2.CauseRequestRejectedReasonNotSpecified)
+		}
+		return rejectCreateSession(c, senderAddr, req, peerTEID, gtpv2.CauseAllDynamicAddressesAreOccupied)
+	}
+	defer session.mu.Unlock()
+	session.TAI = requestTAI(req)
+	session.PeerUTEID, session.PeerUAddr = requestAccessFTEID(req)
+	session.MSISDN, session.PEI = requestIdentities(req)
+	interceptSession(session)
+	applyQoSPolicy(session)
+	capSessionAMBR(session, dnn)
+
+	// Get the first credit of the session from the OCS
+	if err := startCharging(session); err != nil {
+		log.Printf("[SMF] Rejecting session for IMSI %s: %v", imsi, err)
+		sessionManager.deleteSession(imsi)
+		cause := gtpv2.CauseNoResourcesAvailable
+		if errors.Is(err, errCreditDenied) {
+			cause = gtpv2.CauseUENotAuthorisedByOCSOrExternalAAAServer
+		}
+		return rejectCreateSession(c, senderAddr, req, peerTEID, cause)
 	}
 
-	// Create response message
-	res := message.NewCreateSessionResponse(
-		req.SenderTEID(), req.Sequence(),
-		ie.NewCause(gtpv2.CauseRequestAccepted, 0, 0, 0, nil),
-		ie.NewIMSI(imsi),
-		ie.NewFullyQualifiedTEID(gtpv2.IFTypeS5S8SGWGTPC, session.TEID, c.LocalAddr().(*net.UDPAddr).IP, nil),
-		ie.NewPDNAddressAllocation(session.UEIP),
-		ie.NewAPNRestriction(gtpv2.APNRestrictionNoExistingContextsorRestrictions),
+	// Select a UPF and install the session's user plane
+	upf, err := establishUserPlane(session, nil)
+	if err != nil {
+		log.Printf("[SMF] Failed to set up user plane for IMSI %s: %v", imsi, err)
+		releaseCharging(session, nil)
+		sessionManager.deleteSession(imsi)
+		return rejectCreateSession(c, senderAddr, req, peerTEID, gtpv2.CauseNoResourcesAvailable)
+	}
+
+	// Send response
+	if err := respondCreateSession(c, senderAddr, req, session, dnn, cause); err != nil {
+		return err
+	}
+
+	// Update session state
+	session.State = SessionStateActive
+	session.LastUpdated = time.Now()
+	sessionManager.persist(session)
+	reportIRI(session, smf.IRIPDUSessionEstablishment, "", session.LITasks)
+
+	log.Printf("[SMF] Created session for IMSI %s with IP %s on UPF %s", imsi, sessionAddresses(session), upf.ID)
+	return nil
+}
+
+// respondCreateSession answers a Create Session Request with the PDN
+// connection set up for it
+func respondCreateSession(c *gtpv2.Conn, senderAddr net.Addr, req *message.CreateSessionRequest, session *Session, dnn *smf.DNN, cause uint8) error {
+	upf, ok := pfcpClient.Pool().Get(session.UPFID)
+	if !ok {
+		return rejectCreateSession(c, senderAddr, req, session.TEID, gtpv2.CauseNoResourcesAvailable)
+	}
+
+	localIP := c.LocalAddr().(*net.UDPAddr).IP
+	ies := []*ie.IE{
+		ie.NewCause(cause, 0, 0, 0, nil),
+		ie.NewFullyQualifiedTEIDNetIP(gtpv2.IFTypeS5S8PGWGTPC, session.TEID, localIP, nil).WithInstance(1),
+		pdnAddressAllocation(session),
+		ie.NewAPNRestriction(gtpv2.APNRestrictionNoExistingContextsorRestriction),
+		ie.NewAggregateMaximumBitRate(apnAMBR(session.QoS.AMBRUL), apnAMBR(session.QoS.AMBRDL)),
 		ie.NewBearerContext(
+			ie.NewCause(gtpv2.CauseRequestAccepted, 0, 0, 0, nil),
 			ie.NewEPSBearerID(session.BearerID),
-			ie.NewBearerQoS(uint8(session.QCI), uint8(session.ARP), 0, 0, 0, 0),
+			ie.NewFullyQualifiedTEIDNetIP(gtpv2.IFTypeS5S8PGWGTPU, session.UPFTEID, upf.N3Address(), nil).WithInstance(2),
+			defaultBearerQoS(session),
 		),
-	)
+		ie.NewRecovery(restartCounter),
+	}
+	ies = append(ies, pcoResponseIEs(req, dnn)...)
+	res := message.NewCreateSessionResponse(session.TEID, req.Sequence(), append(ies, loadControlIEs()...)...)
 
-	// Send response
 	if err := c.RespondTo(senderAddr, req, res); err != nil {
 		return fmt.Errorf("failed to send CreateSessionResponse: %w", err)
 	}
+	return nil
+}
 
-	// Update session state
-	session.State = SessionStateActive
-	session.LastUpdated = time.Now()
+// defaultBearerQoS returns the Bearer QoS of the default bearer. PCC rules
+// of the session are enforced by the UPF within the default bearer.
+func defaultBearerQoS(session *Session) *ie.IE {
+	q := session.QoS.Default.QoS
+	var pci, pvi uint8
+	if !q.PreemptionCap {
+		pci = 1
+	}
+	if !q.PreemptionVuln {
+		pvi = 1
+	}
+	return ie.NewBearerQoS(pci, q.PriorityLevel, pvi, q.QCI, 0, 0, 0, 0)
+}
+
+// apnAMBR converts a bit rate to the kbps of the APN-AMBR IE
+func apnAMBR(bps uint64) uint32 {
+	kbps := bps / 1000
+	if kbps > 0xffffffff {
+		return 0xffffffff
+	}
+	return uint32(kbps)
+}
 
-	log.Printf("[SMF] Created session for IMSI %s with IP %s", imsi, session.UEIP)
+// rejectCreateSession answers a Create Session Request with the given cause
+// and the SMF's load, so peers throttle requests while it is overloaded
+func rejectCreateSession(c *gtpv2.Conn, senderAddr net.Addr, req *message.CreateSessionRequest, peerTEID uint32, cause uint8) error {
+	res := message.NewCreateSessionResponse(
+		peerTEID, req.Sequence(),
+		append([]*ie.IE{ie.NewCause(cause, 0, 0, 0, nil)}, loadControlIEs()...)...,
+	)
+	if err := c.RespondTo(senderAddr, req, res); err != nil {
+		return fmt.Errorf("failed to send CreateSessionResponse: %w", err)
+	}
 	return nil
 }
 
+// requestAPN returns the APN of a Create Session Request
+func requestAPN(req *message.CreateSessionRequest) string {
+	if req.APN == nil {
+		return ""
+	}
+	apn, err := req.APN.AccessPointName()
+	if err != nil {
+		return ""
+	}
+	return apn
+}
+
+// requestTAI returns the tracking area of a Create Session Request as "mcc-mnc-tac"
+func requestTAI(req *message.CreateSessionRequest) string {
+	if req.ULI == nil {
+		return ""
+	}
+	uli, err := req.ULI.UserLocationInformation()
+	if err != nil || uli.TAI == nil {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s-%d", uli.TAI.MCC, uli.TAI.MNC, uli.TAI.TAC)
+}
+
+// requestIdentities returns the MSISDN and the PEI of the UE of a Create
+// Session Request, a 15 digit MEI being an IMEI and a 16 digit one an IMEISV
+func requestIdentities(req *message.CreateSessionRequest) (msisdn, pei string) {
+	if req.MSISDN != nil {
+		msisdn, _ = req.MSISDN.MSISDN()
+	}
+	if req.MEI != nil {
+		if mei, err := req.MEI.MobileEquipmentIdentity(); err == nil && mei != "" {
+			pei = "imei-" + mei
+			if len(mei) == 16 {
+				pei = "imeisv-" + mei
+			}
+		}
+	}
+	return msisdn, pei
+}
+
+// requestAccessFTEID returns the SGW user plane F-TEID of the default bearer
+func requestAccessFTEID(req *message.CreateSessionRequest) (uint32, net.IP) {
+	for _, bc := range req.BearerContextsToBeCreated {
+		children, err := bc.BearerContext()
+		if err != nil {
+			continue
+		}
+		for _, child := range children {
+			if child.Type != ie.FullyQualifiedTEID {
+				continue
+			}
+			if ifType, err := child.InterfaceType(); err != nil || ifType != gtpv2.IFTypeS5S8SGWGTPU {
+				continue
+			}
+			teid, err := child.TEID()
+			if err != nil {
+				continue
+			}
+			ip, err := child.IPv4()
+			if err != nil {
+				continue
+			}
+			return teid, ip
+		}
+	}
+	return 0, nil
+}
+
 // handleDeleteSessionRequest processes incoming Delete Session Requests
 func handleDeleteSessionRequest(c *gtpv2.Conn, senderAddr net.Addr, msg message.Message) error {
 	req := msg.(*message.DeleteSessionRequest)
 	log.Printf("[GTP] Received DeleteSessionRequest from %s", senderAddr.String())
+	peerSeen(senderAddr)
 
-	// Extract IMSI from the request
-	imsiIE, err := req.IMSI()
-	if err != nil {
-		return fmt.Errorf("failed to get IMSI: %w", err)
+	// Look up the session by the TEID the peer addressed
+	session, ok := sessionManager.getSessionByTEID(req.TEID())
+	if ok && !session.lock() {
+		ok = false
 	}
-	imsi := imsiIE.String()
-
-	// Get session
-	session, ok := sessionManager.getSession(imsi)
 	if !ok {
-		return fmt.Errorf("session not found for IMSI: %s", imsi)
+		res := message.NewDeleteSessionResponse(
+			0, req.Sequence(),
+			ie.NewCause(gtpv2.CauseContextNotFound, 0, 0, 0, nil),
+		)
+		if err := c.RespondTo(senderAddr, req, res); err != nil {
+			return fmt.Errorf("failed to send DeleteSessionResponse: %w", err)
+		}
+		return fmt.Errorf("session not found for TEID: %d", req.TEID())
 	}
+	defer session.mu.Unlock()
+	imsi := session.IMSI
+
+	// Release the user plane before confirming the deletion
+	session.State = SessionStateDeleting
+	releaseUserPlane(session)
 
 	// Create response message
 	res := message.NewDeleteSessionResponse(
-		req.SenderTEID(), req.Sequence(),
-		ie.NewCause(gtpv2.CauseRequestAccepted, 0, 0, 0, nil),
-		ie.NewIMSI(imsi),
+		session.TEID, req.Sequence(),
+		append([]*ie.IE{ie.NewCause(gtpv2.CauseRequestAccepted, 0, 0, 0, nil)}, loadControlIEs()...)...,
 	)
 
 	// Send response
@@ -306,7 +929,8 @@ func handleDeleteSessionRequest(c *gtpv2.Conn, senderAddr net.Addr, msg message.
 	}
 
 	// Delete session
-	sessionManager.deleteSession(imsi)
+	sessionManager.deleteSession(session.ID)
+	publishSessionReleased(session, releaseUERequested)
 	log.Printf("[SMF] Deleted session for IMSI %s", imsi)
 	return nil
 }
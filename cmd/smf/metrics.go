@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/openmvcore/pkg/smf"
+)
+
+// startMetricsServer serves the SMF metrics in the Prometheus text format
+// on `metrics.port` until ctx is done
+func startMetricsServer(ctx context.Context) {
+	if !config.GetBool("metrics.enabled") {
+		return
+	}
+	path := config.GetString("metrics.path")
+	if path == "" {
+		path = "/metrics"
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, handleMetrics)
+
+	server := &http.Server{Addr: fmt.Sprintf(":%d", config.GetInt("metrics.port")), Handler: mux}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	logger.Info().Str("addr", server.Addr).Msg("Starting metrics server")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Printf("[SMF] Metrics server error: %v", err)
+	}
+}
+
+// handleMetrics writes the session, load and GTP-C peer metrics
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetricHeader(w, "smf_sessions", "gauge", "Sessions held by the SMF")
+	fmt.Fprintf(w, "smf_sessions %d\n", len(sessionManager.allSessions()))
+
+	load := overloadControl.Status()
+	writeMetricHeader(w, "smf_load_percent", "gauge", "Utilisation of the most loaded SMF resource")
+	fmt.Fprintf(w, "smf_load_percent %d\n", load.Load)
+	writeMetricHeader(w, "smf_overload_reduction_percent", "gauge", "Share of new sessions peers are asked to throttle")
+	fmt.Fprintf(w, "smf_overload_reduction_percent %d\n", load.OverloadMetric)
+
+	peers := gtpcPeers.Statuses()
+	writeMetricHeader(w, "smf_gtpc_peer_up", "gauge", "Whether the path to a GTP-C peer is up")
+	for _, p := range peers {
+		up := 0
+		if p.State == smf.PeerStateUp {
+			up = 1
+		}
+		fmt.Fprintf(w, "smf_gtpc_peer_up{peer=%q} %d\n", p.Host, up)
+	}
+	writeMetricHeader(w, "smf_gtpc_peer_sessions", "gauge", "Sessions set up by a GTP-C peer")
+	for _, p := range peers {
+		fmt.Fprintf(w, "smf_gtpc_peer_sessions{peer=%q} %d\n", p.Host, len(sessionManager.sessionsOfPeer(p.Host)))
+	}
+	writeMetricHeader(w, "smf_gtpc_peer_restarts_total", "counter", "Restarts of a GTP-C peer seen by its Restart Counter")
+	for _, p := range peers {
+		fmt.Fprintf(w, "smf_gtpc_peer_restarts_total{peer=%q} %d\n", p.Host, p.Restarts)
+	}
+	writeMetricHeader(w, "smf_gtpc_peer_path_failures_total", "counter", "Path failures towards a GTP-C peer")
+	for _, p := range peers {
+		fmt.Fprintf(w, "smf_gtpc_peer_path_failures_total{peer=%q} %d\n", p.Host, p.PathFailures)
+	}
+	writeMetricHeader(w, "smf_gtpc_peer_echo_rtt_seconds", "gauge", "Round-trip time of the last Echo Request to a GTP-C peer")
+	for _, p := range peers {
+		fmt.Fprintf(w, "smf_gtpc_peer_echo_rtt_seconds{peer=%q} %g\n", p.Host, p.EchoRTT.Seconds())
+	}
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
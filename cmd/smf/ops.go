@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/openmvcore/pkg/smf"
+	"github.com/wmnsk/go-gtp/gtpv2"
+	"github.com/wmnsk/go-gtp/gtpv2/ie"
+	"github.com/wmnsk/go-gtp/gtpv2/message"
+)
+
+// opsBasePath is the API root of the session inventory for operators
+const opsBasePath = "/smf-ops/v1"
+
+// Page sizes of the session list
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// sessionSummary is a session in the session list
+type sessionSummary struct {
+	ID           string       `json:"id"`
+	IMSI         string       `json:"imsi"`
+	UEIP         net.IP       `json:"ue_ip"`
+	UEIPv6       net.IP       `json:"ue_ipv6,omitempty"`
+	DNN          string       `json:"dnn"`
+	SNSSAI       *smf.SNSSAI  `json:"snssai,omitempty"`
+	PDUSessionID uint8        `json:"pdu_session_id,omitempty"`
+	UPFID        string       `json:"upf_id,omitempty"`
+	State        SessionState `json:"state"`
+	CreatedAt    time.Time    `json:"created_at"`
+	LastUpdated  time.Time    `json:"last_updated"`
+}
+
+// sessionDetail is a session with its bearers, QoS and PFCP rules
+type sessionDetail struct {
+	sessionSummary
+	PeerAddr   string            `json:"peer_addr,omitempty"`
+	TAI        string            `json:"tai,omitempty"`
+	UpCnxState string            `json:"up_cnx_state,omitempty"`
+	AMBRUL     uint64            `json:"ambr_ul,omitempty"` // bps
+	AMBRDL     uint64            `json:"ambr_dl,omitempty"` // bps
+	Bearers    []bearerInfo      `json:"bearers"`
+	PFCP       []pfcpSessionInfo `json:"pfcp_sessions"`
+}
+
+// bearerInfo is an EPS bearer or a QoS flow of a session. Dedicated flows
+// of a 4G session are enforced within its default bearer.
+type bearerInfo struct {
+	EBI       uint8   `json:"ebi,omitempty"`
+	QFI       uint8   `json:"qfi"`
+	Default   bool    `json:"default"`
+	PCCRule   string  `json:"pcc_rule,omitempty"`
+	QoS       smf.QoS `json:"qos"`
+	LocalTEID uint32  `json:"local_teid,omitempty"`
+	PeerTEID  uint32  `json:"peer_teid,omitempty"`
+	PeerAddr  net.IP  `json:"peer_addr,omitempty"`
+}
+
+// pfcpSessionInfo is a PFCP session of a session on one of its UPFs
+type pfcpSessionInfo struct {
+	UPFID      string       `json:"upf_id"`
+	LocalSEID  uint64       `json:"local_seid"`
+	RemoteSEID uint64       `json:"remote_seid"`
+	Rules      *smf.RuleSet `json:"rules,omitempty"`
+}
+
+// sessionPage is a page of the session list
+type sessionPage struct {
+	Total    int              `json:"total"`
+	Offset   int              `json:"offset"`
+	Limit    int              `json:"limit"`
+	Sessions []sessionSummary `json:"sessions"`
+}
+
+// startOpsServer serves the operator and QoS policy APIs on `ops.addr` until
+// ctx is done. They can release sessions and change subscribers' QoS, so
+// they have their own listener, apart from the SBI the AMFs reach, to be
+// bound to the management network.
+func startOpsServer(ctx context.Context) {
+	addr := config.GetString("ops.addr")
+	if addr == "" {
+		return
+	}
+	r := chi.NewRouter()
+	r.Use(middleware.Recoverer)
+	r.Route(opsBasePath, opsRoutes)
+	r.Route(qosBasePath, qosRoutes)
+
+	server := &http.Server{Addr: addr, Handler: r}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info().Str("addr", addr).Msg("Starting operator API server")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error().Err(err).Msg("Operator API server error")
+	}
+}
+
+// opsRoutes mounts the session inventory and GTP-C peer API
+func opsRoutes(r chi.Router) {
+	r.Get("/sessions", handleListSessions)
+	r.Get("/sessions/{id}", handleGetSession)
+	r.Delete("/sessions/{id}", handleForceReleaseSession)
+	r.Get("/peers", handleListPeers)
+	r.Get("/peers/{host}", handleGetPeer)
+	r.Get("/load", handleGetLoad)
+}
+
+// handleListSessions lists sessions filtered by the imsi, ue_ip, dnn, upf and
+// state query parameters, paginated with offset and limit
+func handleListSessions(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	offset, err := queryInt(q.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		writeProblem(w, http.StatusBadRequest, "INVALID_QUERY_PARAM", "invalid offset")
+		return
+	}
+	limit, err := queryInt(q.Get("limit"), defaultPageSize)
+	if err != nil || limit < 1 || limit > maxPageSize {
+		writeProblem(w, http.StatusBadRequest, "INVALID_QUERY_PARAM", fmt.Sprintf("limit must be 1-%d", maxPageSize))
+		return
+	}
+	var ueIP net.IP
+	if v := q.Get("ue_ip"); v != "" {
+		if ueIP = net.ParseIP(v); ueIP == nil {
+			writeProblem(w, http.StatusBadRequest, "INVALID_QUERY_PARAM", "invalid ue_ip")
+			return
+		}
+	}
+
+	page := sessionPage{Offset: offset, Limit: limit, Sessions: []sessionSummary{}}
+	for _, session := range sessionManager.allSessions() {
+		session.mu.Lock()
+		switch {
+		case q.Get("imsi") != "" && session.IMSI != q.Get("imsi"),
+			ueIP != nil && !sessionHasAddress(session, ueIP),
+			q.Get("dnn") != "" && session.APN != q.Get("dnn"),
+			q.Get("upf") != "" && !sessionOnUPF(session, q.Get("upf")),
+			q.Get("state") != "" && string(session.State) != q.Get("state"):
+			session.mu.Unlock()
+			continue
+		}
+		if page.Total >= offset && len(page.Sessions) < limit {
+			page.Sessions = append(page.Sessions, summarizeSession(session))
+		}
+		page.Total++
+		session.mu.Unlock()
+	}
+	smf.WriteSBIResponse(w, http.StatusOK, smf.ContentTypeJSON, page)
+}
+
+// handleGetSession returns a session with its bearers, QoS and PFCP rules
+func handleGetSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := sessionManager.getSession(chi.URLParam(r, "id"))
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "CONTEXT_NOT_FOUND", "")
+		return
+	}
+	session.mu.Lock()
+	details := describeSession(session)
+	session.mu.Unlock()
+	smf.WriteSBIResponse(w, http.StatusOK, smf.ContentTypeJSON, details)
+}
+
+// handleForceReleaseSession releases a session on operator request
+func handleForceReleaseSession(w http.ResponseWriter, r *http.Request) {
+	session, ok := sessionManager.getSession(chi.URLParam(r, "id"))
+	if !ok || !session.lock() {
+		writeProblem(w, http.StatusNotFound, "CONTEXT_NOT_FOUND", "")
+		return
+	}
+	defer session.mu.Unlock()
+
+	terminateSession(session, releaseOperator)
+	log.Printf("[SMF] Force-released session %s of IMSI %s", session.ID, session.IMSI)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// terminateSession releases a session on the network's initiative. The
+// access side is told first, then the PFCP sessions are deleted.
+func terminateSession(session *Session, reason string) {
+	session.State = SessionStateDeleting
+	if session.PDUSessionID != 0 {
+		notifySMContextReleased(session)
+	} else if err := sendDeleteBearerRequest(session); err != nil {
+		log.Printf("[SMF] Delete Bearer Request for IMSI %s failed: %v", session.IMSI, err)
+	}
+	releaseUserPlane(session)
+	sessionManager.deleteSession(session.ID)
+	publishSessionReleased(session, reason)
+}
+
+// sendDeleteBearerRequest asks the SGW to release a PDN connection by
+// deleting its default bearer (TS 29.274 §7.2.9.2) and waits for the
+// answer. A peer that no longer knows the bearer has released it too.
+func sendDeleteBearerRequest(session *Session) error {
+	if session.PeerAddr == "" {
+		return fmt.Errorf("session has no GTP-C peer")
+	}
+	msg, err := exchangeGTPCRequest(session.PeerAddr, message.NewDeleteBearerRequest(session.TEID, 0, ie.NewEPSBearerID(session.BearerID)))
+	if err != nil {
+		return err
+	}
+	res, ok := msg.(*message.DeleteBearerResponse)
+	if !ok {
+		return fmt.Errorf("unexpected %s", msg.MessageTypeName())
+	}
+	if res.Cause == nil {
+		return fmt.Errorf("Delete Bearer Response without cause")
+	}
+	cause, err := res.Cause.Cause()
+	if err != nil {
+		return fmt.Errorf("invalid cause: %w", err)
+	}
+	if cause != gtpv2.CauseRequestAccepted && cause != gtpv2.CauseContextNotFound {
+		return fmt.Errorf("rejected with cause %d", cause)
+	}
+	return nil
+}
+
+// notifySMContextReleased tells the AMF that the SMF released a PDU session
+func notifySMContextReleased(session *Session) {
+	if session.StatusURI == "" {
+		return
+	}
+	body, err := json.Marshal(smf.SmContextStatusNotification{
+		StatusInfo: smf.StatusInfo{ResourceStatus: smf.ResourceStatusReleased},
+	})
+	if err != nil {
+		return
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	res, err := client.Post(session.StatusURI, smf.ContentTypeJSON, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[SMF] Failed to notify release of %s: %v", session.ID, err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		log.Printf("[SMF] Release notification of %s answered with status %d", session.ID, res.StatusCode)
+	}
+}
+
+// sessionOnUPF reports whether the session has a PFCP session on the UPF
+func sessionOnUPF(session *Session, upfID string) bool {
+	if session.UPFID == upfID {
+		return true
+	}
+	for _, leg := range session.Anchors {
+		if leg.UPFID == upfID {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionHasAddress reports whether an address is the IPv4 address of a
+// session or belongs to its /64
+func sessionHasAddress(session *Session, ip net.IP) bool {
+	if session.UEIP.Equal(ip) {
+		return true
+	}
+	prefix := smf.UEPrefix(session.UEIPv6)
+	return prefix != nil && prefix.Contains(ip)
+}
+
+func summarizeSession(session *Session) sessionSummary {
+	return sessionSummary{
+		ID:           session.ID,
+		IMSI:         session.IMSI,
+		UEIP:         session.UEIP,
+		UEIPv6:       session.UEIPv6,
+		DNN:          session.APN,
+		SNSSAI:       session.SNSSAI,
+		PDUSessionID: session.PDUSessionID,
+		UPFID:        session.UPFID,
+		State:        session.State,
+		CreatedAt:    session.CreatedAt,
+		LastUpdated:  session.LastUpdated,
+	}
+}
+
+func describeSession(session *Session) *sessionDetail {
+	d := &sessionDetail{
+		sessionSummary: summarizeSession(session),
+		PeerAddr:       session.PeerAddr,
+		TAI:            session.TAI,
+		UpCnxState:     session.UpCnxState,
+		Bearers:        []bearerInfo{},
+		PFCP:           []pfcpSessionInfo{},
+	}
+
+	if q := session.QoS; q != nil {
+		d.AMBRUL, d.AMBRDL = q.AMBRUL, q.AMBRDL
+		def := bearerInfo{
+			QFI:       q.Default.QFI,
+			Default:   true,
+			QoS:       q.Default.QoS,
+			LocalTEID: session.UPFTEID,
+			PeerTEID:  session.PeerUTEID,
+			PeerAddr:  session.PeerUAddr,
+		}
+		if session.PDUSessionID == 0 {
+			def.EBI = session.BearerID
+		}
+		d.Bearers = append(d.Bearers, def)
+		for _, flow := range q.Flows {
+			d.Bearers = append(d.Bearers, bearerInfo{QFI: flow.QFI, PCCRule: flow.Rule.ID, QoS: flow.QoS})
+		}
+	}
+
+	if session.UPFID != "" {
+		primary := pfcpSessionInfo{UPFID: session.UPFID, LocalSEID: session.LocalSEID, RemoteSEID: session.RemoteSEID}
+		// Rules of a classifier depend on its ULCL policy and are not rebuilt here
+		if len(session.Anchors) == 0 {
+			rules := &smf.SessionRules{
+				UEIP:     session.UEIP,
+				UEIPv6:   session.UEIPv6,
+				DNN:      session.APN,
+				UPFTEID:  session.UPFTEID,
+				PeerTEID: session.PeerUTEID,
+				PeerAddr: session.PeerUAddr,
+				QoS:      session.QoS,
+				Charging: session.Quota,
+
+				InactivityTimeout: inactivityTimeout(),
+			}
+			primary.Rules = rules.Describe()
+		}
+		d.PFCP = append(d.PFCP, primary)
+	}
+	for _, leg := range session.Anchors {
+		d.PFCP = append(d.PFCP, pfcpSessionInfo{UPFID: leg.UPFID, LocalSEID: leg.LocalSEID, RemoteSEID: leg.RemoteSEID})
+	}
+	return d
+}
+
+// queryInt parses an integer query parameter, returning def when it is absent
+func queryInt(v string, def int) (int, error) {
+	if v == "" {
+		return def, nil
+	}
+	return strconv.Atoi(v)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/openmvcore/pkg/smf"
+	"github.com/wmnsk/go-gtp/gtpv2/ie"
+)
+
+// loadSampleInterval is how often the load of the SMF is recomputed
+const loadSampleInterval = time.Second
+
+// overloadControl computes the load of the SMF and admits new sessions
+var overloadControl *smf.OverloadController
+
+// loadOverloadControl creates the overload controller from the `overload`
+// configuration
+func loadOverloadControl() (*smf.OverloadController, error) {
+	var cfg smf.OverloadConfig
+	if err := config.UnmarshalKey("overload", &cfg); err != nil {
+		return nil, fmt.Errorf("invalid overload configuration: %w", err)
+	}
+	return smf.NewOverloadController(cfg), nil
+}
+
+// runLoadMonitor samples the session count, IP pool utilisation and PFCP
+// backlog until ctx is done
+func runLoadMonitor(ctx context.Context) {
+	ticker := time.NewTicker(loadSampleInterval)
+	defer ticker.Stop()
+
+	var overloaded bool
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			overloadControl.Update(sampleLoad())
+			status := overloadControl.Status()
+			if status.OverloadMetric > 0 != overloaded {
+				overloaded = status.OverloadMetric > 0
+				log.Printf("[SMF] Load %d%%, overload reduction metric %d%%", status.Load, status.OverloadMetric)
+			}
+		}
+	}
+}
+
+// sampleLoad returns the current utilisation of the SMF's resources
+func sampleLoad() smf.LoadSample {
+	s := smf.LoadSample{
+		Sessions:    sessionManager.sessionCount(),
+		PFCPBacklog: pfcpClient.Backlog(),
+	}
+	pools := []*smf.IPPool{sessionManager.defaultPool}
+	for _, d := range dnnCatalogue.DNNs() {
+		if d.Pool != nil {
+			pools = append(pools, d.Pool)
+		}
+	}
+	for _, p := range pools {
+		s.PoolSize += p.Size()
+		s.PoolUsed += p.Size() - p.Free()
+	}
+	return s
+}
+
+// admitSession reports whether a new session may be accepted
+func admitSession() bool {
+	return overloadControl.Admit(sessionManager.sessionCount())
+}
+
+// loadControlIEs returns the Load and Overload Control Information sent to
+// MMEs and SGWs, none when `overload.advertise` is off
+func loadControlIEs() []*ie.IE {
+	if !config.GetBool("overload.advertise") {
+		return nil
+	}
+	return overloadControl.ControlIEs()
+}
+
+// handleGetLoad returns the current load of the SMF
+func handleGetLoad(w http.ResponseWriter, r *http.Request) {
+	smf.WriteSBIResponse(w, http.StatusOK, smf.ContentTypeJSON, overloadControl.Status())
+}
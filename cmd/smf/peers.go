@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/openmvcore/pkg/smf"
+	"github.com/wmnsk/go-gtp/gtpv2"
+	"github.com/wmnsk/go-gtp/gtpv2/ie"
+	"github.com/wmnsk/go-gtp/gtpv2/message"
+)
+
+// gtpcPeers tracks the MMEs and SGWs the SMF has sessions with
+var gtpcPeers = smf.NewGTPCPeerTable()
+
+// peerReleases holds the peers whose sessions are being released
+var (
+	peerReleaseMu sync.Mutex
+	peerReleases  = make(map[string]bool)
+)
+
+// loadPeerTimers sets the path monitoring timers from the `gtpc` configuration
+func loadPeerTimers() {
+	if d := config.GetDuration("gtpc.echo_interval"); d > 0 {
+		gtpcPeers.EchoInterval = d
+	}
+	if d := config.GetDuration("gtpc.echo_timeout"); d > 0 {
+		gtpcPeers.EchoTimeout = d
+	}
+	if config.IsSet("gtpc.echo_retries") {
+		gtpcPeers.EchoRetries = config.GetInt("gtpc.echo_retries")
+	}
+}
+
+// peerSeen records a GTP-C message from a peer
+func peerSeen(peer net.Addr) {
+	gtpcPeers.Seen(peer.String(), time.Now())
+}
+
+// checkPeerRestart records a peer's Restart Counter. When it changed the peer
+// has restarted and lost its sessions, so the SMF releases them too.
+func checkPeerRestart(peer net.Addr, counter uint8) {
+	if !gtpcPeers.Recovery(peer.String(), counter) {
+		return
+	}
+	host := smf.PeerHost(peer.String())
+	log.Printf("[GTP] Peer %s restarted (counter %d), releasing its sessions", host, counter)
+	releasePeerSessions(host, releasePeerRestart)
+}
+
+// releasePeerSessions releases in the background the sessions a peer that
+// lost them holds now, unless they are already being released. The peer is
+// not signalled, only the user plane and local state are removed.
+func releasePeerSessions(host, reason string) {
+	peerReleaseMu.Lock()
+	if peerReleases[host] {
+		peerReleaseMu.Unlock()
+		return
+	}
+	peerReleases[host] = true
+	peerReleaseMu.Unlock()
+
+	// Sessions the peer sets up from now on are kept
+	sessions := sessionManager.sessionsOfPeer(host)
+	go func() {
+		defer func() {
+			peerReleaseMu.Lock()
+			delete(peerReleases, host)
+			peerReleaseMu.Unlock()
+		}()
+
+		var released int
+		for _, session := range sessions {
+			if !session.lock() {
+				continue
+			}
+			session.State = SessionStateDeleting
+			releaseUserPlane(session)
+			sessionManager.deleteSession(session.ID)
+			publishSessionReleased(session, reason)
+			session.mu.Unlock()
+			released++
+		}
+		log.Printf("[GTP] Released %d sessions of peer %s (%s)", released, host, reason)
+	}()
+}
+
+// runPathMonitor sends Echo Requests to the GTP-C peers until ctx is done,
+// releases the sessions of peers whose path failed and forgets the peers
+// left without sessions
+func runPathMonitor(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	prune := time.NewTicker(gtpcPeers.EchoInterval)
+	defer prune.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-prune.C:
+			inUse := sessionManager.peerHosts()
+			for _, host := range gtpcPeers.Prune(now, func(host string) bool { return inUse[host] }) {
+				log.Printf("[GTP] Forgot peer %s without sessions", host)
+			}
+		case now := <-ticker.C:
+			echoes, failed := gtpcPeers.Poll(now)
+			for _, addr := range echoes {
+				if err := sendEchoRequest(addr); err != nil {
+					log.Printf("[GTP] Failed to send Echo Request to %s: %v", addr, err)
+				}
+			}
+			for _, host := range failed {
+				log.Printf("[GTP] Path to peer %s failed, no Echo Response after %d retries", host, gtpcPeers.EchoRetries)
+				releasePeerSessions(host, releasePathFailure)
+			}
+		}
+	}
+}
+
+// gtpcSequence numbers the GTP-C requests initiated by the SMF
+var gtpcSequence uint32
+
+// gtpcPending holds the requests awaiting a response by sequence number
+var (
+	gtpcPendingMu sync.Mutex
+	gtpcPending   = make(map[uint32]chan message.Message)
+)
+
+// sendEchoRequest sends an Echo Request with the SMF's Restart Counter
+func sendEchoRequest(addr string) error {
+	return sendGTPCRequest(addr, message.NewEchoRequest(0, ie.NewRecovery(restartCounter)))
+}
+
+// sendGTPCRequest numbers a request the SMF initiates and sends it to a
+// peer from the GTP-C server's socket
+func sendGTPCRequest(addr string, req message.Message) error {
+	raddr, b, err := marshalGTPCRequest(addr, req)
+	if err != nil {
+		return err
+	}
+	if _, err := gtpcConn.WriteTo(b, raddr); err != nil {
+		return fmt.Errorf("failed to send %s: %w", req.MessageTypeName(), err)
+	}
+	return nil
+}
+
+// exchangeGTPCRequest sends a request to a peer and waits for its response.
+// The request is retransmitted every T3-RESPONSE up to N3-REQUESTS times,
+// the timers of the path monitoring (TS 29.274 §7.6).
+func exchangeGTPCRequest(addr string, req message.Message) (message.Message, error) {
+	raddr, b, err := marshalGTPCRequest(addr, req)
+	if err != nil {
+		return nil, err
+	}
+
+	ch := make(chan message.Message, 1)
+	gtpcPendingMu.Lock()
+	gtpcPending[req.Sequence()] = ch
+	gtpcPendingMu.Unlock()
+	defer func() {
+		gtpcPendingMu.Lock()
+		delete(gtpcPending, req.Sequence())
+		gtpcPendingMu.Unlock()
+	}()
+
+	for attempt := 0; attempt <= gtpcPeers.EchoRetries; attempt++ {
+		if _, err := gtpcConn.WriteTo(b, raddr); err != nil {
+			return nil, fmt.Errorf("failed to send %s: %w", req.MessageTypeName(), err)
+		}
+		select {
+		case res := <-ch:
+			return res, nil
+		case <-time.After(gtpcPeers.EchoTimeout):
+		}
+	}
+	return nil, fmt.Errorf("no response to %s from %s after %d retries", req.MessageTypeName(), addr, gtpcPeers.EchoRetries)
+}
+
+// marshalGTPCRequest numbers a request the SMF initiates
+func marshalGTPCRequest(addr string, req message.Message) (*net.UDPAddr, []byte, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid peer address: %w", err)
+	}
+	req.SetSequenceNumber(atomic.AddUint32(&gtpcSequence, 1) & 0xffffff)
+	b, err := message.Marshal(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to marshal %s: %w", req.MessageTypeName(), err)
+	}
+	return raddr, b, nil
+}
+
+// handleGTPCResponse passes a response to the request awaiting it
+func handleGTPCResponse(c *gtpv2.Conn, senderAddr net.Addr, msg message.Message) error {
+	peerSeen(senderAddr)
+	gtpcPendingMu.Lock()
+	ch, ok := gtpcPending[msg.Sequence()]
+	gtpcPendingMu.Unlock()
+	if !ok {
+		return fmt.Errorf("unexpected %s from %s", msg.MessageTypeName(), senderAddr)
+	}
+	select {
+	case ch <- msg:
+	default:
+	}
+	return nil
+}
+
+// handleEchoRequest answers GTP-C Echo Requests with the SMF's Restart
+// Counter and checks the peer's
+func handleEchoRequest(c *gtpv2.Conn, senderAddr net.Addr, msg message.Message) error {
+	req := msg.(*message.EchoRequest)
+	peerSeen(senderAddr)
+	if req.Recovery != nil {
+		if counter, err := req.Recovery.Recovery(); err == nil {
+			checkPeerRestart(senderAddr, counter)
+		}
+	}
+	res := message.NewEchoResponse(req.Sequence(), ie.NewRecovery(restartCounter))
+	if err := c.RespondTo(senderAddr, req, res); err != nil {
+		return fmt.Errorf("failed to send EchoResponse: %w", err)
+	}
+	return nil
+}
+
+// handleEchoResponse keeps the path to a peer up and checks its Restart Counter
+func handleEchoResponse(c *gtpv2.Conn, senderAddr net.Addr, msg message.Message) error {
+	res := msg.(*message.EchoResponse)
+	gtpcPeers.EchoAnswered(senderAddr.String(), time.Now())
+	if res.Recovery != nil {
+		if counter, err := res.Recovery.Recovery(); err == nil {
+			checkPeerRestart(senderAddr, counter)
+		}
+	}
+	return nil
+}
+
+// peerInfo is a GTP-C peer with the number of sessions it holds
+type peerInfo struct {
+	smf.GTPCPeerStatus
+	Sessions int `json:"sessions"`
+}
+
+func describePeer(status smf.GTPCPeerStatus) peerInfo {
+	return peerInfo{GTPCPeerStatus: status, Sessions: len(sessionManager.sessionsOfPeer(status.Host))}
+}
+
+// handleListPeers lists the GTP-C peers
+func handleListPeers(w http.ResponseWriter, r *http.Request) {
+	statuses := gtpcPeers.Statuses()
+	peers := make([]peerInfo, 0, len(statuses))
+	for _, status := range statuses {
+		peers = append(peers, describePeer(status))
+	}
+	smf.WriteSBIResponse(w, http.StatusOK, smf.ContentTypeJSON, peers)
+}
+
+// handleGetPeer returns a GTP-C peer by IP address
+func handleGetPeer(w http.ResponseWriter, r *http.Request) {
+	peer, ok := gtpcPeers.Get(chi.URLParam(r, "host"))
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "PEER_NOT_FOUND", "")
+		return
+	}
+	smf.WriteSBIResponse(w, http.StatusOK, smf.ContentTypeJSON, describePeer(peer.Status()))
+}
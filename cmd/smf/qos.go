@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/openmvcore/pkg/smf"
+	"github.com/spf13/viper"
+)
+
+// qosBasePath is the API root of the local QoS policy management, used to
+// provision PCC rules until a PCF is available
+const qosBasePath = "/smf-qos/v1"
+
+// policyStore holds the QoS policies applied to new sessions
+var policyStore *smf.PolicyStore
+
+// loadQoSPolicies builds the policy store from the `qos` configuration and
+// the optional policy file it references
+func loadQoSPolicies() (*smf.PolicyStore, error) {
+	defaults := smf.QoSPolicy{
+		FiveQI: DefaultQCI,
+		ARP:    &smf.ARP{PriorityLevel: DefaultARP, PreemptionVulnerability: true},
+		AMBRUL: DefaultAMBRUL,
+		AMBRDL: DefaultAMBRDL,
+	}
+	var configured smf.QoSPolicy
+	if err := config.UnmarshalKey("qos.default", &configured); err != nil {
+		return nil, fmt.Errorf("invalid qos default: %w", err)
+	}
+	if err := configured.Validate(); err != nil {
+		return nil, err
+	}
+	if configured.FiveQI != 0 {
+		defaults.FiveQI = configured.FiveQI
+	}
+	if configured.ARP != nil {
+		defaults.ARP = configured.ARP
+	}
+	if configured.AMBRUL != 0 {
+		defaults.AMBRUL = configured.AMBRUL
+	}
+	if configured.AMBRDL != 0 {
+		defaults.AMBRDL = configured.AMBRDL
+	}
+	store := smf.NewPolicyStore(defaults)
+
+	var policies []smf.QoSPolicy
+	if err := config.UnmarshalKey("qos.policies", &policies); err != nil {
+		return nil, fmt.Errorf("invalid qos policies: %w", err)
+	}
+	if file := config.GetString("qos.policy_file"); file != "" {
+		v := viper.New()
+		v.SetConfigFile(file)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("failed to read qos policy file: %w", err)
+		}
+		var filePolicies []smf.QoSPolicy
+		if err := v.UnmarshalKey("policies", &filePolicies); err != nil {
+			return nil, fmt.Errorf("invalid qos policy file: %w", err)
+		}
+		policies = append(policies, filePolicies...)
+	}
+	for _, p := range policies {
+		if err := store.Set(p); err != nil {
+			return nil, err
+		}
+	}
+	return store, nil
+}
+
+// applyQoSPolicy authorizes the QoS of a session from its subscriber and DNN
+func applyQoSPolicy(session *Session) {
+	session.QoS = policyStore.Resolve(session.IMSI, session.APN)
+	session.QCI = session.QoS.Default.QoS.QCI
+	session.ARP = session.QoS.Default.QoS.PriorityLevel
+}
+
+// qosRoutes mounts the QoS policy management API. Changes apply to sessions
+// established afterwards.
+func qosRoutes(r chi.Router) {
+	r.Get("/policies", handleListQoSPolicies)
+	r.Get("/policies/dnns/{dnn}", handleGetQoSPolicy)
+	r.Put("/policies/dnns/{dnn}", handlePutQoSPolicy)
+	r.Delete("/policies/dnns/{dnn}", handleDeleteQoSPolicy)
+	r.Get("/policies/subscribers/{imsi}", handleGetQoSPolicy)
+	r.Put("/policies/subscribers/{imsi}", handlePutQoSPolicy)
+	r.Delete("/policies/subscribers/{imsi}", handleDeleteQoSPolicy)
+	r.Get("/policies/subscribers/{imsi}/dnns/{dnn}", handleGetQoSPolicy)
+	r.Put("/policies/subscribers/{imsi}/dnns/{dnn}", handlePutQoSPolicy)
+	r.Delete("/policies/subscribers/{imsi}/dnns/{dnn}", handleDeleteQoSPolicy)
+}
+
+func handleListQoSPolicies(w http.ResponseWriter, r *http.Request) {
+	smf.WriteSBIResponse(w, http.StatusOK, smf.ContentTypeJSON, policyStore.Policies())
+}
+
+func handleGetQoSPolicy(w http.ResponseWriter, r *http.Request) {
+	p, ok := policyStore.Get(chi.URLParam(r, "imsi"), chi.URLParam(r, "dnn"))
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "POLICY_NOT_FOUND", "")
+		return
+	}
+	smf.WriteSBIResponse(w, http.StatusOK, smf.ContentTypeJSON, p)
+}
+
+func handlePutQoSPolicy(w http.ResponseWriter, r *http.Request) {
+	var p smf.QoSPolicy
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeProblem(w, http.StatusBadRequest, "INVALID_MSG_FORMAT", err.Error())
+		return
+	}
+	// The path identifies the policy
+	p.IMSI, p.DNN = chi.URLParam(r, "imsi"), chi.URLParam(r, "dnn")
+
+	_, exists := policyStore.Get(p.IMSI, p.DNN)
+	if err := policyStore.Set(p); err != nil {
+		writeProblem(w, http.StatusBadRequest, "INVALID_POLICY", err.Error())
+		return
+	}
+	log.Printf("[SMF] Updated QoS policy of IMSI %q DNN %q", p.IMSI, p.DNN)
+
+	status := http.StatusCreated
+	if exists {
+		status = http.StatusOK
+	}
+	smf.WriteSBIResponse(w, status, smf.ContentTypeJSON, p)
+}
+
+func handleDeleteQoSPolicy(w http.ResponseWriter, r *http.Request) {
+	if !policyStore.Delete(chi.URLParam(r, "imsi"), chi.URLParam(r, "dnn")) {
+		writeProblem(w, http.StatusNotFound, "POLICY_NOT_FOUND", "")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/openmvcore/pkg/smf"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis keys of persisted sessions
+const (
+	sessionKeyPrefix = "smf:session:"
+	sessionIndexKey  = "smf:sessions"
+	allocatorsKey    = "smf:allocators"
+)
+
+// restartCounter is the GTP-C Restart Counter of this SMF instance
+var restartCounter uint8
+
+// sessionStore persists sessions in Redis so they survive an SMF restart.
+// The session holds the UE IP and PFCP SEIDs, so IP allocations and SEID
+// mappings are restored with it.
+type sessionStore struct {
+	redis *redis.Client
+}
+
+func newSessionStore(client *redis.Client) *sessionStore {
+	return &sessionStore{redis: client}
+}
+
+// save writes the current state of a session along with the SEID and TEID
+// allocators, which also cover the N9 tunnels of ULCL sessions
+func (s *sessionStore) save(ctx context.Context, session *Session, nextSEID uint64, nextTEID uint32) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+	pipe := s.redis.TxPipeline()
+	pipe.Set(ctx, sessionKeyPrefix+session.ID, data, 0)
+	pipe.SAdd(ctx, sessionIndexKey, session.ID)
+	pipe.HSet(ctx, allocatorsKey, "seid", nextSEID, "teid", nextTEID)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// loadAllocators returns the persisted SEID and TEID allocators
+func (s *sessionStore) loadAllocators(ctx context.Context) (uint64, uint32, error) {
+	values, err := s.redis.HMGet(ctx, allocatorsKey, "seid", "teid").Result()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get allocators: %w", err)
+	}
+	var seid uint64
+	var teid uint32
+	if v, ok := values[0].(string); ok {
+		fmt.Sscan(v, &seid)
+	}
+	if v, ok := values[1].(string); ok {
+		fmt.Sscan(v, &teid)
+	}
+	return seid, teid, nil
+}
+
+// delete removes a session
+func (s *sessionStore) delete(ctx context.Context, id string) error {
+	pipe := s.redis.TxPipeline()
+	pipe.Del(ctx, sessionKeyPrefix+id)
+	pipe.SRem(ctx, sessionIndexKey, id)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// loadAll returns all persisted sessions
+func (s *sessionStore) loadAll(ctx context.Context) ([]*Session, error) {
+	ids, err := s.redis.SMembers(ctx, sessionIndexKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	var sessions []*Session
+	for _, id := range ids {
+		data, err := s.redis.Get(ctx, sessionKeyPrefix+id).Bytes()
+		if err == redis.Nil {
+			// Index entry of a session deleted midway
+			s.redis.SRem(ctx, sessionIndexKey, id)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get session %s: %w", id, err)
+		}
+		var session Session
+		if err := json.Unmarshal(data, &session); err != nil {
+			log.Printf("[SMF] Dropping unreadable session %s: %v", id, err)
+			s.delete(ctx, id)
+			continue
+		}
+		sessions = append(sessions, &session)
+	}
+	return sessions, nil
+}
+
+// nextRestartCounter increments and returns the restart counter of this SMF,
+// kept in PostgreSQL so it survives restarts (TS 23.007 §16.1.1)
+func nextRestartCounter(db *sql.DB, nodeID string) (uint8, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS smf_recovery (
+		node_id         TEXT PRIMARY KEY,
+		restart_counter INTEGER NOT NULL
+	)`); err != nil {
+		return 0, fmt.Errorf("failed to create recovery table: %w", err)
+	}
+
+	var counter int
+	err := db.QueryRowContext(ctx, `INSERT INTO smf_recovery (node_id, restart_counter) VALUES ($1, 0)
+		ON CONFLICT (node_id) DO UPDATE SET restart_counter = (smf_recovery.restart_counter + 1) % 256
+		RETURNING restart_counter`, nodeID).Scan(&counter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to update restart counter: %w", err)
+	}
+	return uint8(counter), nil
+}
+
+// restoreSessions rehydrates the persisted sessions. Their user plane is
+// checked against the UPFs by auditUPF once the associations are up.
+func restoreSessions(store *sessionStore) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	nextSEID, nextTEID, err := store.loadAllocators(ctx)
+	if err != nil {
+		return err
+	}
+	sessionManager.restoreAllocators(nextSEID, nextTEID)
+
+	sessions, err := store.loadAll(ctx)
+	if err != nil {
+		return err
+	}
+	for _, session := range sessions {
+		sessionManager.restore(session)
+	}
+	logger.Info().Int("sessions", len(sessions)).Msg("Restored sessions")
+	return nil
+}
+
+// auditUPF reconciles the sessions the SMF holds on a UPF after an association
+// is set up. Sessions the UPF still has are counted towards its load; sessions
+// it lost are established again.
+func auditUPF(node *smf.UPFNode) {
+	sessions := sessionManager.sessionsOnUPF(node.ID)
+	if len(sessions) == 0 {
+		return
+	}
+
+	var kept, restored, failed int
+	for _, session := range sessions {
+		if !session.lock() {
+			continue
+		}
+		if !sessionOnUPF(session, node.ID) {
+			session.mu.Unlock()
+			continue
+		}
+		legs := append([]*smf.SessionLeg{{
+			UPFID:      session.UPFID,
+			LocalSEID:  session.LocalSEID,
+			RemoteSEID: session.RemoteSEID,
+		}}, session.Anchors...)
+
+		lost := false
+		for _, leg := range legs {
+			if leg.UPFID != node.ID {
+				continue
+			}
+			// An empty modification only checks that the session exists
+			ctx, cancel := context.WithTimeout(context.Background(), PFCPRequestTimeout)
+			_, err := pfcpClient.ModifySession(ctx, node, leg.RemoteSEID)
+			cancel()
+			switch {
+			case err == nil:
+				node.AddSession()
+			case smf.IsSessionNotFound(err):
+				lost = true
+			default:
+				log.Printf("[SMF] Audit of IMSI %s on UPF %s failed: %v", session.IMSI, node.ID, err)
+			}
+		}
+		if !lost {
+			kept++
+			session.mu.Unlock()
+			continue
+		}
+
+		releaseLegs(session, node.ID)
+		if _, err := establishUserPlane(session, nil); err != nil {
+			log.Printf("[SMF] Failed to restore user plane of IMSI %s: %v", session.IMSI, err)
+			session.UPFID = ""
+			session.Anchors, session.AnchorFARs = nil, nil
+			failed++
+		} else {
+			restored++
+		}
+		session.LastUpdated = time.Now()
+		sessionManager.persist(session)
+		session.mu.Unlock()
+	}
+	log.Printf("[SMF] Audit of UPF %s: %d sessions kept, %d restored, %d failed", node.ID, kept, restored, failed)
+}
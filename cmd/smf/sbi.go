@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/go-chi/httplog"
+	"github.com/openmvcore/pkg/smf"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+// sbiBasePath is the API root of the Nsmf_PDUSession service
+const sbiBasePath = "/nsmf-pdusession/v1"
+
+// Content-IDs of the binary parts the SMF sends
+const (
+	n1ContentID = "n1msg"
+	n2ContentID = "n2msg"
+)
+
+// startSBIServer serves Nsmf_PDUSession over HTTP/2 without TLS until ctx is done
+func startSBIServer(ctx context.Context) {
+	addr := fmt.Sprintf("%s:%d",
+		config.GetString("interfaces.sbi.ip"),
+		config.GetInt("interfaces.sbi.port"),
+	)
+
+	r := chi.NewRouter()
+	r.Use(middleware.RealIP)
+	r.Use(httplog.RequestLogger(logger))
+	r.Use(middleware.Recoverer)
+	r.Route(sbiBasePath, func(r chi.Router) {
+		r.Post("/sm-contexts", handleCreateSMContext)
+		r.Post("/sm-contexts/{smContextRef}/modify", handleUpdateSMContext)
+		r.Post("/sm-contexts/{smContextRef}/release", handleReleaseSMContext)
+	})
+
+	server := &http.Server{
+		Addr:    addr,
+		Handler: h2c.NewHandler(r, &http2.Server{}),
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	logger.Info().Str("addr", addr).Msg("Starting Nsmf_PDUSession server")
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error().Err(err).Msg("SBI server error")
+	}
+}
+
+// handleCreateSMContext establishes a 5G PDU session (CreateSMContext)
+func handleCreateSMContext(w http.ResponseWriter, r *http.Request) {
+	var data smf.SmContextCreateData
+	parts, err := smf.ReadSBIRequest(r, &data)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "INVALID_MSG_FORMAT", err.Error())
+		return
+	}
+
+	imsi := strings.TrimPrefix(data.Supi, "imsi-")
+	if imsi == "" || imsi == data.Supi {
+		writeProblem(w, http.StatusBadRequest, "MANDATORY_IE_INCORRECT", "supi must be an IMSI based SUPI")
+		return
+	}
+
+	// The N1 SM container carries the UE's PDU Session Establishment Request
+	psi, pti := data.PduSessionID, uint8(0)
+	var nasReq *smf.PDUSessionEstablishmentRequest
+	if data.N1SmMsg != nil {
+		nasReq, err = smf.ParsePDUSessionEstablishmentRequest(parts[data.N1SmMsg.ContentID])
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, "N1_SM_ERROR", err.Error())
+			return
+		}
+		pti = nasReq.PTI
+		if psi == 0 {
+			psi = nasReq.PDUSessionID
+		}
+	}
+	if psi == 0 {
+		writeProblem(w, http.StatusBadRequest, "MANDATORY_IE_MISSING", "pduSessionId is missing")
+		return
+	}
+
+	// Shed new sessions while overloaded
+	if !admitSession() {
+		log.Printf("[SMF] Rejecting PDU session %d of IMSI %s: SMF overloaded", psi, imsi)
+		rejectCreateSMContext(w, http.StatusServiceUnavailable, "NF_CONGESTION", psi, pti, smf.Cause5GSMInsufficientResources)
+		return
+	}
+
+	dnn, ok := dnnCatalogue.Resolve(data.Dnn)
+	if !ok {
+		log.Printf("[SMF] Rejecting PDU session %d of IMSI %s: unknown DNN %q", psi, imsi, data.Dnn)
+		rejectCreateSMContext(w, http.StatusForbidden, "DNN_DENIED", psi, pti, smf.Cause5GSMMissingOrUnknownDNN)
+		return
+	}
+
+	// Only IP sessions with SSC mode 1 are supported. Without a requested
+	// type the UE gets IPv4, dual-stack falls back to the family the DNN allows.
+	pduType, downgraded := smf.PDUSessionTypeIPv4, false
+	if nasReq != nil {
+		if nasReq.PDUSessionType != 0 {
+			pduType, downgraded = dnn.SelectPDNType(nasReq.PDUSessionType)
+		}
+		if pduType == 0 {
+			rejectCreateSMContext(w, http.StatusForbidden, "PDUTYPE_DENIED", psi, pti, smf.Cause5GSMUnknownPDUSessionType)
+			return
+		}
+		if nasReq.SSCMode > 1 {
+			rejectCreateSMContext(w, http.StatusForbidden, "SSC_DENIED", psi, pti, smf.Cause5GSMNotSupportedSSCMode)
+			return
+		}
+	}
+
+	// A new establishment for a known PDU session replaces the stale context
+	if old, ok := sessionManager.getSession(smContextRef(imsi, psi)); ok && old.lock() {
+		log.Printf("[SMF] Replacing SM context %s", old.ID)
+		old.State = SessionStateDeleting
+		releaseUserPlane(old)
+		sessionManager.deleteSession(old.ID)
+		publishSessionReleased(old, releaseReplaced)
+		old.mu.Unlock()
+	}
+
+	session, err := sessionManager.createSMContext(imsi, psi, dnn.Name, pduType)
+	if err != nil {
+		log.Printf("[SMF] Rejecting PDU session %d of IMSI %s: %v", psi, imsi, err)
+		rejectCreateSMContext(w, http.StatusInternalServerError, "INSUFFICIENT_RESOURCES", psi, pti, smf.Cause5GSMInsufficientResources)
+		return
+	}
+	defer session.mu.Unlock()
+	session.SNSSAI = data.SNssai
+	session.TAI = data.UeLocation.TAI()
+	session.StatusURI = data.SmContextStatusURI
+	session.UpCnxState = smf.UpCnxStateActivating
+	if msisdn, ok := strings.CutPrefix(data.Gpsi, "msisdn-"); ok {
+		session.MSISDN = msisdn
+	}
+	session.PEI = data.Pei
+	interceptSession(session)
+	applyQoSPolicy(session)
+	capSessionAMBR(session, dnn)
+
+	// Get the first credit of the session from the OCS
+	if err := startCharging(session); err != nil {
+		log.Printf("[SMF] Rejecting PDU session %d of IMSI %s: %v", psi, imsi, err)
+		sessionManager.deleteSession(session.ID)
+		if errors.Is(err, errCreditDenied) {
+			rejectCreateSMContext(w, http.StatusForbidden, "QUOTA_EXHAUSTED", psi, pti, smf.Cause5GSMUserAuthenticationFailed)
+			return
+		}
+		rejectCreateSMContext(w, http.StatusInternalServerError, "INSUFFICIENT_RESOURCES", psi, pti, smf.Cause5GSMInsufficientResources)
+		return
+	}
+
+	// Select a UPF and install the session's user plane. Downlink traffic is
+	// buffered until the gNB tunnel arrives with UpdateSMContext.
+	upf, err := establishUserPlane(session, nil)
+	if err != nil {
+		log.Printf("[SMF] Failed to set up user plane for IMSI %s: %v", imsi, err)
+		releaseCharging(session, nil)
+		sessionManager.deleteSession(session.ID)
+		rejectCreateSMContext(w, http.StatusInternalServerError, "INSUFFICIENT_RESOURCES", psi, pti, smf.Cause5GSMInsufficientResources)
+		return
+	}
+
+	accept := &smf.PDUSessionEstablishmentAccept{
+		PDUSessionID:   psi,
+		PTI:            pti,
+		PDUSessionType: session.PDUSessionType,
+		SSCMode:        1,
+		UEIP:           session.UEIP,
+		UEIPv6:         session.UEIPv6,
+		QFI:            session.QoS.Default.QFI,
+		FiveQI:         session.QCI,
+		AMBRUL:         session.QoS.AMBRUL,
+		AMBRDL:         session.QoS.AMBRDL,
+		SNSSAI:         session.SNSSAI,
+		DNN:            session.APN,
+		Flows:          session.QoS.Flows,
+	}
+	if downgraded {
+		accept.Cause = smf.Cause5GSMPDUSessionTypeIPv4OnlyAllowed
+		if pduType == smf.PDUSessionTypeIPv6 {
+			accept.Cause = smf.Cause5GSMPDUSessionTypeIPv6OnlyAllowed
+		}
+	}
+	if nasReq != nil && len(nasReq.ExtendedPCO) > 0 {
+		if pco, err := smf.ParsePCO(nasReq.ExtendedPCO); err == nil {
+			if res := dnn.PCOResponse(pco); len(res.Containers) > 0 {
+				accept.ExtPCO = res.Marshal()
+			}
+		}
+	}
+	setup := &smf.PDUSessionResourceSetupRequest{
+		AMBRUL:         session.QoS.AMBRUL,
+		AMBRDL:         session.QoS.AMBRDL,
+		UPFTEID:        session.UPFTEID,
+		UPFAddr:        upf.N3Address(),
+		PDUSessionType: session.PDUSessionType,
+		QFI:            session.QoS.Default.QFI,
+		FiveQI:         session.QCI,
+		ARPPriority:    session.ARP,
+		Flows:          session.QoS.Flows,
+	}
+
+	session.State = SessionStateActive
+	session.LastUpdated = time.Now()
+	sessionManager.persist(session)
+	reportIRI(session, smf.IRIPDUSessionEstablishment, "", session.LITasks)
+	log.Printf("[SMF] Created PDU session %d for IMSI %s with IP %s on UPF %s", psi, imsi, sessionAddresses(session), upf.ID)
+
+	w.Header().Set("Location", fmt.Sprintf("http://%s%s/sm-contexts/%s", r.Host, sbiBasePath, session.ID))
+	smf.WriteSBIResponse(w, http.StatusCreated, smf.ContentTypeJSON,
+		smf.SmContextCreatedData{
+			PduSessionID: psi,
+			SNssai:       session.SNSSAI,
+			UpCnxState:   session.UpCnxState,
+			N1SmMsg:      &smf.RefToBinaryData{ContentID: n1ContentID},
+			N2SmInfo:     &smf.RefToBinaryData{ContentID: n2ContentID},
+			N2SmInfoType: smf.N2SmInfoTypePDUResSetupReq,
+		},
+		smf.BinaryPart{ContentID: n1ContentID, ContentType: smf.ContentType5GNAS, Data: accept.Marshal()},
+		smf.BinaryPart{ContentID: n2ContentID, ContentType: smf.ContentTypeNGAP, Data: setup.Marshal()},
+	)
+}
+
+// rejectCreateSMContext answers CreateSMContext with an error and the N1
+// PDU Session Establishment Reject for the UE
+func rejectCreateSMContext(w http.ResponseWriter, status int, cause string, psi, pti, nasCause uint8) {
+	smf.WriteSBIResponse(w, status, smf.ContentTypeJSON,
+		smf.SmContextCreateError{
+			Error:   smf.ProblemDetails{Status: status, Cause: cause},
+			N1SmMsg: &smf.RefToBinaryData{ContentID: n1ContentID},
+		},
+		smf.BinaryPart{
+			ContentID:   n1ContentID,
+			ContentType: smf.ContentType5GNAS,
+			Data:        smf.NewPDUSessionEstablishmentReject(psi, pti, nasCause),
+		},
+	)
+}
+
+// handleUpdateSMContext applies access network changes to a PDU session (UpdateSMContext)
+func handleUpdateSMContext(w http.ResponseWriter, r *http.Request) {
+	session, ok := sessionManager.getSession(chi.URLParam(r, "smContextRef"))
+	if !ok || !session.lock() {
+		writeProblem(w, http.StatusNotFound, "CONTEXT_NOT_FOUND", "")
+		return
+	}
+	defer session.mu.Unlock()
+
+	var data smf.SmContextUpdateData
+	parts, err := smf.ReadSBIRequest(r, &data)
+	if err != nil {
+		writeProblem(w, http.StatusBadRequest, "INVALID_MSG_FORMAT", err.Error())
+		return
+	}
+
+	if data.Release {
+		releaseSMContext(session)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if tai := data.UeLocation.TAI(); tai != "" {
+		session.TAI = tai
+	}
+
+	switch data.N2SmInfoType {
+	case smf.N2SmInfoTypePDUResSetupRsp:
+		// The gNB accepted the session and sent its downlink tunnel
+		if data.N2SmInfo == nil {
+			writeProblem(w, http.StatusBadRequest, "MANDATORY_IE_MISSING", "n2SmInfo is missing")
+			return
+		}
+		teid, addr, err := smf.ParsePDUSessionResourceSetupResponse(parts[data.N2SmInfo.ContentID])
+		if err != nil {
+			writeProblem(w, http.StatusBadRequest, "N2_SM_ERROR", err.Error())
+			return
+		}
+		session.PeerUTEID, session.PeerUAddr = teid, addr
+		session.UpCnxState = smf.UpCnxStateActivated
+	case smf.N2SmInfoTypePDUResSetupFail:
+		session.PeerUTEID, session.PeerUAddr = 0, nil
+		session.UpCnxState = smf.UpCnxStateDeactivated
+	}
+
+	// AN release: keep the session and buffer its downlink
+	if data.UpCnxState == smf.UpCnxStateDeactivated {
+		session.PeerUTEID, session.PeerUAddr = 0, nil
+		session.UpCnxState = smf.UpCnxStateDeactivated
+	}
+
+	if data.N2SmInfoType != "" || data.UpCnxState != "" {
+		if err := updateAccessTunnel(session); err != nil {
+			log.Printf("[SMF] Failed to update access tunnel of %s: %v", session.ID, err)
+			writeProblem(w, http.StatusInternalServerError, "SYSTEM_FAILURE", err.Error())
+			return
+		}
+	}
+
+	session.LastUpdated = time.Now()
+	sessionManager.persist(session)
+	reportIRI(session, smf.IRIPDUSessionModification, "", session.LITasks)
+	smf.WriteSBIResponse(w, http.StatusOK, smf.ContentTypeJSON, smf.SmContextUpdatedData{UpCnxState: session.UpCnxState})
+}
+
+// handleReleaseSMContext releases a PDU session (ReleaseSMContext)
+func handleReleaseSMContext(w http.ResponseWriter, r *http.Request) {
+	session, ok := sessionManager.getSession(chi.URLParam(r, "smContextRef"))
+	if !ok || !session.lock() {
+		writeProblem(w, http.StatusNotFound, "CONTEXT_NOT_FOUND", "")
+		return
+	}
+	defer session.mu.Unlock()
+	releaseSMContext(session)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// releaseSMContext removes a 5G PDU session and its user plane
+func releaseSMContext(session *Session) {
+	session.State = SessionStateDeleting
+	releaseUserPlane(session)
+	sessionManager.deleteSession(session.ID)
+	publishSessionReleased(session, releaseUERequested)
+	log.Printf("[SMF] Released PDU session %d of IMSI %s", session.PDUSessionID, session.IMSI)
+}
+
+// writeProblem answers an SBI request with ProblemDetails
+func writeProblem(w http.ResponseWriter, status int, cause, detail string) {
+	smf.WriteSBIResponse(w, status, smf.ContentTypeProblemJSON, smf.ProblemDetails{
+		Status: status,
+		Cause:  cause,
+		Detail: detail,
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/openmvcore/pkg/smf"
+)
+
+// Defaults of the session timers
+const (
+	DefaultSetupTimeout  = time.Minute
+	DefaultSweepInterval = time.Minute
+)
+
+// inactivityTimeout returns how long a session may go without traffic
+// before its UPF reports it idle, 0 when inactivity is not detected
+func inactivityTimeout() time.Duration {
+	if !config.GetBool("features.session_cleanup") {
+		return 0
+	}
+	return config.GetDuration("session.inactivity_timeout")
+}
+
+// setupTimeout returns how long a session may stay being set up
+func setupTimeout() time.Duration {
+	if d := config.GetDuration("session.setup_timeout"); d > 0 {
+		return d
+	}
+	return DefaultSetupTimeout
+}
+
+// runSessionSweeper releases timed out sessions until ctx is done. Sessions
+// are swept only with the session_cleanup feature enabled.
+func runSessionSweeper(ctx context.Context) {
+	if !config.GetBool("features.session_cleanup") {
+		return
+	}
+	interval := config.GetDuration("session.sweep_interval")
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			sweepSessions(now)
+		}
+	}
+}
+
+// sweepSessions releases the sessions stuck in setup. They never reached
+// the access side, so only the state the SMF and UPFs hold is removed.
+// Established sessions are released on their UPF's inactivity reports.
+func sweepSessions(now time.Time) {
+	for _, session := range sessionManager.allSessions() {
+		if !session.lock() {
+			continue
+		}
+		if session.State == SessionStateInitializing && now.Sub(session.CreatedAt) > setupTimeout() {
+			log.Printf("[SMF] Setup of session %s of IMSI %s timed out, releasing it", session.ID, session.IMSI)
+			session.State = SessionStateDeleting
+			releaseUserPlane(session)
+			sessionManager.deleteSession(session.ID)
+			publishSessionReleased(session, releaseSetupTimeout)
+		}
+		session.mu.Unlock()
+	}
+}
+
+// handleInactivityReport releases a session its UPF reported without
+// traffic for the User Plane Inactivity Timer
+func handleInactivityReport(_ *smf.UPFNode, seid uint64) {
+	session, ok := sessionManager.getSessionBySEID(seid)
+	if !ok || !session.lock() {
+		return
+	}
+	defer session.mu.Unlock()
+	if session.State != SessionStateActive {
+		return
+	}
+	log.Printf("[SMF] No traffic on session %s of IMSI %s for %s, releasing it", session.ID, session.IMSI, inactivityTimeout())
+	terminateSession(session, releaseInactivity)
+}
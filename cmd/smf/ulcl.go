@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	"github.com/openmvcore/pkg/smf"
+)
+
+// ulclPolicies maps a DNN to the uplink classifier policy of its sessions
+var ulclPolicies map[string]*smf.ULCLPolicy
+
+// loadULCLPolicies reads the `ulcl` configuration list and checks that the
+// referenced UPFs exist
+func loadULCLPolicies(pool *smf.UPFPool) (map[string]*smf.ULCLPolicy, error) {
+	var entries []smf.ULCLPolicy
+	if err := config.UnmarshalKey("ulcl", &entries); err != nil {
+		return nil, fmt.Errorf("invalid ulcl configuration: %w", err)
+	}
+
+	policies := make(map[string]*smf.ULCLPolicy, len(entries))
+	for i := range entries {
+		policy := &entries[i]
+		if err := policy.Validate(); err != nil {
+			return nil, err
+		}
+		for _, id := range append([]string{policy.ULCL}, policy.Anchors()...) {
+			if _, ok := pool.Get(id); !ok {
+				return nil, fmt.Errorf("ulcl policy of dnn %s references unknown UPF %s", policy.DNN, id)
+			}
+		}
+		policies[policy.DNN] = policy
+	}
+	return policies, nil
+}
+
+// establishULCL creates the PFCP sessions of a session whose uplink traffic is
+// classified on one UPF and anchored on several. UPFs are expected to use the
+// same GTP-U address for N3 and N9. The classifier enforces the session's
+// QoS, credit and inactivity timer and duplicates its traffic for
+// interception.
+func establishULCL(session *Session, policy *smf.ULCLPolicy, exclude []string) (*smf.UPFNode, error) {
+	pool := pfcpClient.Pool()
+	usable := func(id string) (*smf.UPFNode, bool) {
+		node, ok := pool.Get(id)
+		if !ok || !node.Healthy() {
+			return nil, false
+		}
+		for _, x := range exclude {
+			if x == id {
+				return nil, false
+			}
+		}
+		return node, true
+	}
+
+	classifier, ok := usable(policy.ULCL)
+	if !ok {
+		return nil, fmt.Errorf("classifier UPF %s unavailable", policy.ULCL)
+	}
+
+	// Steering rules of an unavailable PSA are dropped, its traffic
+	// takes the default route
+	var anchors []*smf.AnchorTunnel
+	for _, id := range policy.Anchors() {
+		node, ok := usable(id)
+		if !ok {
+			if id == policy.DefaultPSA {
+				return nil, fmt.Errorf("default PSA %s unavailable", id)
+			}
+			log.Printf("[SMF] PSA %s unavailable, steering IMSI %s to the default PSA", id, session.IMSI)
+			continue
+		}
+		anchors = append(anchors, &smf.AnchorTunnel{
+			UPFID:        id,
+			Addr:         node.N3Address(),
+			UplinkTEID:   sessionManager.allocateTEID(),
+			DownlinkTEID: sessionManager.allocateTEID(),
+		})
+	}
+
+	rules := smf.NewULCLSessionRules(policy, session.UEIP, anchors)
+	rules.UEIPv6 = session.UEIPv6
+	rules.ULCLTEID = session.UPFTEID
+	rules.ULCLAddr = classifier.N3Address()
+	rules.PeerTEID = session.PeerUTEID
+	rules.PeerAddr = session.PeerUAddr
+	rules.QoS = session.QoS
+	rules.Charging = session.Quota
+	rules.InactivityTimeout = inactivityTimeout()
+	rules.X3 = x3Deliveries(session)
+
+	ctx, cancel := context.WithTimeout(context.Background(), PFCPRequestTimeout)
+	defer cancel()
+
+	// Anchors first so the classifier never forwards into a missing tunnel
+	var legs []*smf.SessionLeg
+	rollback := func() {
+		for _, leg := range legs {
+			node, _ := pool.Get(leg.UPFID)
+			node.RemoveSession()
+			if _, err := pfcpClient.DeleteSession(ctx, node, leg.RemoteSEID); err != nil {
+				log.Printf("[SMF] Failed to roll back PFCP session of IMSI %s on UPF %s: %v", session.IMSI, node.ID, err)
+			}
+		}
+	}
+	for _, a := range anchors {
+		if a.UPFID == classifier.ID {
+			continue
+		}
+		node, _ := pool.Get(a.UPFID)
+		localSEID := sessionManager.allocateSEID()
+		remoteSEID, err := establishPFCPSession(ctx, node, localSEID, rules.AnchorIEs(a))
+		if err != nil {
+			rollback()
+			return nil, err
+		}
+		node.AddSession()
+		legs = append(legs, &smf.SessionLeg{UPFID: node.ID, LocalSEID: localSEID, RemoteSEID: remoteSEID})
+	}
+
+	remoteSEID, err := establishPFCPSession(ctx, classifier, session.LocalSEID, rules.ClassifierIEs())
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+	classifier.AddSession()
+
+	session.UPFID = classifier.ID
+	session.RemoteSEID = remoteSEID
+	session.Anchors = legs
+	session.AnchorFARs = rules.AnchorFARIDs()
+	return classifier, nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/openmvcore/pkg/smf"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// PFCPRequestTimeout bounds a PFCP procedure triggered by a GTP-C request
+var PFCPRequestTimeout = 10 * time.Second
+
+// upfConfig is an entry of the `upf` list in the SMF configuration
+type upfConfig struct {
+	ID     string       `mapstructure:"id"`
+	IP     string       `mapstructure:"ip"`
+	Port   int          `mapstructure:"port"`
+	N3IP   string       `mapstructure:"n3_ip"`
+	DNN    string       `mapstructure:"dnn"`
+	DNNs   []string     `mapstructure:"dnns"`
+	Slice  *smf.SNSSAI  `mapstructure:"slice"`
+	Slices []smf.SNSSAI `mapstructure:"slices"`
+	TAIs   []string     `mapstructure:"tais"`
+}
+
+// loadUPFPool builds the UPF pool from the `upf` configuration list
+func loadUPFPool() (*smf.UPFPool, error) {
+	var entries []upfConfig
+	if err := config.UnmarshalKey("upf", &entries); err != nil {
+		return nil, fmt.Errorf("invalid upf configuration: %w", err)
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("no UPF configured")
+	}
+
+	nodes := make([]*smf.UPFNode, 0, len(entries))
+	for i, e := range entries {
+		if e.ID == "" {
+			e.ID = fmt.Sprintf("upf%d", i+1)
+		}
+		if e.Port == 0 {
+			e.Port = 8805
+		}
+
+		node := &smf.UPFNode{
+			ID:     e.ID,
+			Host:   e.IP,
+			Port:   e.Port,
+			DNNs:   e.DNNs,
+			Slices: e.Slices,
+			TAIs:   e.TAIs,
+			N3IP:   net.ParseIP(e.N3IP),
+		}
+		if e.DNN != "" {
+			node.DNNs = append(node.DNNs, e.DNN)
+		}
+		if e.Slice != nil {
+			node.Slices = append(node.Slices, *e.Slice)
+		}
+		nodes = append(nodes, node)
+	}
+
+	return smf.NewUPFPool(nodes,
+		config.GetBool("features.dynamic_upf_selection"),
+		config.GetBool("features.load_balancing"),
+	), nil
+}
+
+// newPFCPClient creates the N4 client for the configured UPFs
+func newPFCPClient() (*smf.PFCPClient, error) {
+	pool, err := loadUPFPool()
+	if err != nil {
+		return nil, err
+	}
+
+	pfcpAddr := fmt.Sprintf("%s:%d",
+		config.GetString("interfaces.pfcp.ip"),
+		config.GetInt("interfaces.pfcp.port"),
+	)
+	client, err := smf.NewPFCPClient(pfcpAddr, config.GetString("service.name"), pool)
+	if err != nil {
+		return nil, err
+	}
+	if config.GetBool("features.pfcp_heartbeat") {
+		if interval := config.GetDuration("pfcp.heartbeat_interval"); interval > 0 {
+			client.HeartbeatInterval = interval
+		}
+	} else {
+		// Without heartbeats a lost UPF is only noticed on the next request
+		client.HeartbeatInterval = time.Hour
+	}
+
+	logger.Info().Str("addr", pfcpAddr).Int("upfs", len(pool.Nodes())).Msg("Starting PFCP client")
+	return client, nil
+}
+
+// establishUserPlane selects the UPFs of the session and creates its PFCP sessions.
+// DNNs with a ULCL policy get an uplink classifier and several anchors; when the
+// policy cannot be satisfied the session falls back to a single anchor.
+func establishUserPlane(session *Session, exclude []string) (*smf.UPFNode, error) {
+	// Sessions with dedicated QoS flows, which the classifier does not
+	// enforce, keep a single anchor
+	if policy, ok := ulclPolicies[session.APN]; ok && (session.QoS == nil || len(session.QoS.Flows) == 0) {
+		upf, err := establishULCL(session, policy, exclude)
+		if err == nil {
+			return upf, nil
+		}
+		log.Printf("[SMF] ULCL setup for IMSI %s failed, using a single anchor: %v", session.IMSI, err)
+	}
+
+	upf, err := pfcpClient.Pool().Select(smf.UPFSelectionCriteria{
+		DNN:     session.APN,
+		SNSSAI:  session.SNSSAI,
+		TAI:     session.TAI,
+		Exclude: exclude,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	rules := &smf.SessionRules{
+		UEIP:     session.UEIP,
+		UEIPv6:   session.UEIPv6,
+		DNN:      session.APN,
+		UPFTEID:  session.UPFTEID,
+		UPFAddr:  upf.N3Address(),
+		PeerTEID: session.PeerUTEID,
+		PeerAddr: session.PeerUAddr,
+		QoS:      session.QoS,
+		Charging: session.Quota,
+		X3:       x3Deliveries(session),
+
+		InactivityTimeout: inactivityTimeout(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PFCPRequestTimeout)
+	defer cancel()
+
+	remoteSEID, err := establishPFCPSession(ctx, upf, session.LocalSEID, rules.EstablishmentIEs())
+	if err != nil {
+		return nil, err
+	}
+
+	session.UPFID = upf.ID
+	session.RemoteSEID = remoteSEID
+	session.Anchors, session.AnchorFARs = nil, nil
+	upf.AddSession()
+	return upf, nil
+}
+
+// establishPFCPSession creates a PFCP session on the UPF and returns its SEID
+func establishPFCPSession(ctx context.Context, upf *smf.UPFNode, localSEID uint64, ies []*ie.IE) (uint64, error) {
+	res, err := pfcpClient.EstablishSession(ctx, upf, localSEID, ies...)
+	if err != nil {
+		return 0, fmt.Errorf("PFCP session establishment on UPF %s failed: %w", upf.ID, err)
+	}
+	if res.UPFSEID == nil {
+		return 0, fmt.Errorf("UPF %s did not return an F-SEID", upf.ID)
+	}
+	fseid, err := res.UPFSEID.FSEID()
+	if err != nil {
+		return 0, fmt.Errorf("invalid F-SEID from UPF %s: %w", upf.ID, err)
+	}
+	return fseid.SEID, nil
+}
+
+// updateAccessTunnel points the session's downlink at its current access peer,
+// or buffers downlink traffic while the peer is unknown
+func updateAccessTunnel(session *Session) error {
+	upf, ok := pfcpClient.Pool().Get(session.UPFID)
+	if !ok {
+		return fmt.Errorf("session of IMSI %s has no user plane", session.IMSI)
+	}
+	rules := &smf.SessionRules{PeerTEID: session.PeerUTEID, PeerAddr: session.PeerUAddr, X3: x3Deliveries(session)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), PFCPRequestTimeout)
+	defer cancel()
+
+	if _, err := pfcpClient.ModifySession(ctx, upf, session.RemoteSEID, rules.DownlinkFARUpdate()); err != nil {
+		return fmt.Errorf("PFCP session modification on UPF %s failed: %w", upf.ID, err)
+	}
+	return nil
+}
+
+// releaseUserPlane deletes the session's PFCP sessions on all its UPFs and
+// reports their final usage to the OCS
+func releaseUserPlane(session *Session) {
+	releaseCharging(session, releaseLegs(session, ""))
+}
+
+// releaseLegs deletes the session's PFCP sessions, skipping the given UPF,
+// and returns the usage the UPFs reported last
+func releaseLegs(session *Session, skip string) []*smf.UsageReport {
+	legs := append([]*smf.SessionLeg{{
+		UPFID:      session.UPFID,
+		LocalSEID:  session.LocalSEID,
+		RemoteSEID: session.RemoteSEID,
+	}}, session.Anchors...)
+
+	ctx, cancel := context.WithTimeout(context.Background(), PFCPRequestTimeout)
+	defer cancel()
+
+	var reports []*smf.UsageReport
+	for _, leg := range legs {
+		if leg.UPFID == "" || leg.UPFID == skip {
+			continue
+		}
+		upf, ok := pfcpClient.Pool().Get(leg.UPFID)
+		if !ok {
+			continue
+		}
+		upf.RemoveSession()
+		res, err := pfcpClient.DeleteSession(ctx, upf, leg.RemoteSEID)
+		if err != nil {
+			log.Printf("[SMF] Failed to delete PFCP session of IMSI %s on UPF %s: %v", session.IMSI, upf.ID, err)
+			continue
+		}
+		reports = append(reports, smf.ParseUsageReports(res.UsageReport)...)
+	}
+	return reports
+}
+
+// failoverSessions moves the sessions of a lost UPF to healthy ones.
+// Peers keep the uplink F-TEID they were given, so UPFs backing each other
+// up are expected to share the N3 address configured as n3_ip.
+func failoverSessions(lost *smf.UPFNode) {
+	sessions := sessionManager.sessionsOnUPF(lost.ID)
+	if len(sessions) == 0 {
+		return
+	}
+	log.Printf("[SMF] UPF %s lost, moving %d sessions", lost.ID, len(sessions))
+
+	for _, session := range sessions {
+		if session.lock() {
+			failoverSession(session, lost)
+			session.mu.Unlock()
+		}
+	}
+}
+
+// failoverSession moves a session off a lost UPF
+func failoverSession(session *Session, lost *smf.UPFNode) {
+	if !sessionOnUPF(session, lost.ID) {
+		return
+	}
+	// Legs on surviving UPFs are rebuilt along with the lost one
+	releaseLegs(session, lost.ID)
+
+	upf, err := establishUserPlane(session, []string{lost.ID})
+	if err != nil {
+		log.Printf("[SMF] Failover of IMSI %s failed: %v", session.IMSI, err)
+		session.UPFID = ""
+		session.Anchors, session.AnchorFARs = nil, nil
+		sessionManager.persist(session)
+		return
+	}
+	session.LastUpdated = time.Now()
+	sessionManager.persist(session)
+	log.Printf("[SMF] Moved session of IMSI %s from UPF %s to %s", session.IMSI, lost.ID, upf.ID)
+}
@@ -4,6 +4,7 @@ go 1.21
 
 require (
 	github.com/wmnsk/go-gtp v0.8.0
+	github.com/wmnsk/go-pfcp v0.0.24
 	github.com/free5gc/go-upf v0.0.0-20230801080000-000000000000 // indirect, will be replaced with our fork
 	github.com/redis/go-redis/v9 v9.5.1
 	github.com/lib/pq v1.10.9
@@ -12,6 +13,7 @@ require (
 	github.com/go-playground/validator/v10 v10.19.0
 	github.com/google/uuid v1.6.0
 	github.com/nats-io/nats.go v1.33.1
+	golang.org/x/net v0.21.0
 	google.golang.org/grpc v1.62.1
 	google.golang.org/protobuf v1.33.0
 )
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// chargingBasePath is the Nchf_ConvergedCharging API root
+const chargingBasePath = "/nchf-convergedcharging/v3"
+
+// bytesPerMB converts the MB balances kept in Redis to granted bytes
+const bytesPerMB = 1_000_000
+
+// Result codes and final unit actions (TS 32.291)
+const (
+	resultSuccess           = "SUCCESS"
+	resultQuotaLimitReached = "QUOTA_LIMIT_REACHED"
+	resultUserUnknown       = "USER_UNKNOWN"
+	finalUnitTerminate      = "TERMINATE"
+)
+
+type chargingDataRequest struct {
+	SubscriberIdentifier     string              `json:"subscriberIdentifier"`
+	InvocationSequenceNumber uint32              `json:"invocationSequenceNumber"`
+	MultipleUnitUsage        []multipleUnitUsage `json:"multipleUnitUsage,omitempty"`
+}
+
+type multipleUnitUsage struct {
+	RatingGroup   uint32 `json:"ratingGroup"`
+	RequestedUnit *struct {
+		Time        uint32 `json:"time,omitempty"`
+		TotalVolume uint64 `json:"totalVolume,omitempty"`
+	} `json:"requestedUnit,omitempty"`
+	UsedUnitContainer []struct {
+		TotalVolume uint64 `json:"totalVolume,omitempty"`
+	} `json:"usedUnitContainer,omitempty"`
+}
+
+type chargingDataResponse struct {
+	InvocationTimeStamp      time.Time                 `json:"invocationTimeStamp"`
+	InvocationSequenceNumber uint32                    `json:"invocationSequenceNumber"`
+	MultipleUnitInformation  []multipleUnitInformation `json:"multipleUnitInformation,omitempty"`
+}
+
+type multipleUnitInformation struct {
+	ResultCode          string               `json:"resultCode"`
+	RatingGroup         uint32               `json:"ratingGroup"`
+	GrantedUnit         *grantedUnit         `json:"grantedUnit,omitempty"`
+	FinalUnitIndication *finalUnitIndication `json:"finalUnitIndication,omitempty"`
+}
+
+type grantedUnit struct {
+	Time        uint32 `json:"time,omitempty"`
+	TotalVolume uint64 `json:"totalVolume,omitempty"`
+}
+
+type finalUnitIndication struct {
+	FinalUnitAction string `json:"finalUnitAction"`
+}
+
+// Redis keys of the open charging sessions, which outlive a restart of the
+// OCS: the set of references, a hash per session and the last reference
+const (
+	chargingSessionsKey = "charging:sessions"
+	chargingSessionKey  = "charging:session:"
+	chargingNextRefKey  = "charging:next_ref"
+)
+
+// chargingSession is an open charging session and the bytes it holds
+type chargingSession struct {
+	imsi     string
+	reserved uint64
+}
+
+// ChargingServer grants credit from the Redis balances of subscribers and
+// debits the units the SMF reports
+type ChargingServer struct {
+	publisher *EventPublisher
+
+	mu       sync.Mutex
+	sessions map[string]*chargingSession
+}
+
+// NewChargingServer creates the Nchf server
+func NewChargingServer(publisher *EventPublisher) *ChargingServer {
+	return &ChargingServer{
+		publisher: publisher,
+		sessions:  make(map[string]*chargingSession),
+	}
+}
+
+// Restore loads the charging sessions open before a restart from Redis
+func (s *ChargingServer) Restore() error {
+	refs, err := RedisClient.SMembers(RedisCtx, chargingSessionsKey).Result()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ref := range refs {
+		fields, err := RedisClient.HGetAll(RedisCtx, chargingSessionKey+ref).Result()
+		if err != nil {
+			return err
+		}
+		if fields["imsi"] == "" {
+			RedisClient.SRem(RedisCtx, chargingSessionsKey, ref)
+			continue
+		}
+		reserved, _ := strconv.ParseUint(fields["reserved"], 10, 64)
+		s.sessions[ref] = &chargingSession{imsi: fields["imsi"], reserved: reserved}
+	}
+	log.Printf("✅ [Charging] Restored %d charging sessions", len(s.sessions))
+	return nil
+}
+
+// save writes a charging session to Redis
+func (s *ChargingServer) save(ref string, session *chargingSession) error {
+	pipe := RedisClient.TxPipeline()
+	pipe.HSet(RedisCtx, chargingSessionKey+ref, "imsi", session.imsi, "reserved", session.reserved)
+	pipe.SAdd(RedisCtx, chargingSessionsKey, ref)
+	_, err := pipe.Exec(RedisCtx)
+	return err
+}
+
+// remove deletes a closed charging session from Redis
+func (s *ChargingServer) remove(ref string) error {
+	pipe := RedisClient.TxPipeline()
+	pipe.Del(RedisCtx, chargingSessionKey+ref)
+	pipe.SRem(RedisCtx, chargingSessionsKey, ref)
+	_, err := pipe.Exec(RedisCtx)
+	return err
+}
+
+// Handler returns the routes of the charging server
+func (s *ChargingServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc(chargingBasePath+"/chargingdata", s.handleCreate)
+	mux.HandleFunc(chargingBasePath+"/chargingdata/", s.handleChargingData)
+	return mux
+}
+
+func (s *ChargingServer) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req chargingDataRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, http.StatusBadRequest, "INVALID_MSG_FORMAT")
+		return
+	}
+	imsi := strings.TrimPrefix(req.SubscriberIdentifier, "imsi-")
+	exists, err := RedisClient.Exists(RedisCtx, "quota:"+imsi).Result()
+	if err != nil {
+		log.Printf("❌ [Charging] Redis error: %v", err)
+		writeProblem(w, http.StatusInternalServerError, "SYSTEM_FAILURE")
+		return
+	}
+	if exists == 0 {
+		writeProblem(w, http.StatusNotFound, resultUserUnknown)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// An SMF whose charging session was lost reports its used units in the
+	// new one
+	session := &chargingSession{imsi: imsi}
+	if err := s.debit(session, req.MultipleUnitUsage); err != nil {
+		log.Printf("❌ [Charging] Failed to debit %s: %v", imsi, err)
+		writeProblem(w, http.StatusInternalServerError, "SYSTEM_FAILURE")
+		return
+	}
+	info, err := s.grant(session, req.MultipleUnitUsage)
+	if err != nil {
+		log.Printf("❌ [Charging] Failed to grant credit to %s: %v", imsi, err)
+		writeProblem(w, http.StatusInternalServerError, "SYSTEM_FAILURE")
+		return
+	}
+	if len(info) > 0 && info[0].GrantedUnit == nil {
+		log.Printf("⛔ [Charging] No credit left for %s", imsi)
+		writeProblem(w, http.StatusForbidden, resultQuotaLimitReached)
+		return
+	}
+
+	next, err := RedisClient.Incr(RedisCtx, chargingNextRefKey).Result()
+	if err == nil {
+		err = s.save(strconv.FormatInt(next, 10), session)
+	}
+	if err != nil {
+		log.Printf("❌ [Charging] Failed to store charging session of %s: %v", imsi, err)
+		writeProblem(w, http.StatusInternalServerError, "SYSTEM_FAILURE")
+		return
+	}
+	ref := strconv.FormatInt(next, 10)
+	s.sessions[ref] = session
+	log.Printf("✅ [Charging] Opened charging session %s for %s", ref, imsi)
+
+	w.Header().Set("Location", chargingBasePath+"/chargingdata/"+ref)
+	writeJSON(w, http.StatusCreated, &chargingDataResponse{
+		InvocationTimeStamp:      time.Now(),
+		InvocationSequenceNumber: req.InvocationSequenceNumber,
+		MultipleUnitInformation:  info,
+	})
+}
+
+// handleChargingData serves update and release of a charging session
+func (s *ChargingServer) handleChargingData(w http.ResponseWriter, r *http.Request) {
+	ref, op, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, chargingBasePath+"/chargingdata/"), "/")
+	if r.Method != http.MethodPost || (op != "update" && op != "release") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var req chargingDataRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeProblem(w, http.StatusBadRequest, "INVALID_MSG_FORMAT")
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	session, ok := s.sessions[ref]
+	if !ok {
+		writeProblem(w, http.StatusNotFound, "CHARGING_NOT_APPLICABLE")
+		return
+	}
+	if err := s.debit(session, req.MultipleUnitUsage); err != nil {
+		log.Printf("❌ [Charging] Failed to debit %s: %v", session.imsi, err)
+		writeProblem(w, http.StatusInternalServerError, "SYSTEM_FAILURE")
+		return
+	}
+
+	if op == "release" {
+		delete(s.sessions, ref)
+		if err := s.remove(ref); err != nil {
+			log.Printf("❌ [Charging] Failed to delete charging session %s: %v", ref, err)
+		}
+		log.Printf("✅ [Charging] Closed charging session %s for %s", ref, session.imsi)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	info, err := s.grant(session, req.MultipleUnitUsage)
+	if err == nil {
+		err = s.save(ref, session)
+	}
+	if err != nil {
+		log.Printf("❌ [Charging] Failed to grant credit to %s: %v", session.imsi, err)
+		writeProblem(w, http.StatusInternalServerError, "SYSTEM_FAILURE")
+		return
+	}
+	writeJSON(w, http.StatusOK, &chargingDataResponse{
+		InvocationTimeStamp:      time.Now(),
+		InvocationSequenceNumber: req.InvocationSequenceNumber,
+		MultipleUnitInformation:  info,
+	})
+}
+
+// grant answers the unit requests of a session from the subscriber's
+// balance, less what the subscriber's other sessions hold. When the balance
+// covers less than requested the rest is granted as final units.
+func (s *ChargingServer) grant(session *chargingSession, usage []multipleUnitUsage) ([]multipleUnitInformation, error) {
+	var info []multipleUnitInformation
+	for _, u := range usage {
+		if u.RequestedUnit == nil {
+			continue
+		}
+		remaining, err := RedisClient.HGet(RedisCtx, "quota:"+session.imsi, "remaining").Float64()
+		if err != nil && err != redis.Nil {
+			return nil, err
+		}
+		available := math.Max(remaining*bytesPerMB-float64(s.reservedBy(session.imsi, session)), 0)
+
+		requested := u.RequestedUnit.TotalVolume
+		if requested == 0 {
+			requested = 10 * bytesPerMB
+		}
+		granted := requested
+		if float64(granted) > available {
+			granted = uint64(available)
+		}
+		session.reserved = granted
+
+		mui := multipleUnitInformation{ResultCode: resultSuccess, RatingGroup: u.RatingGroup}
+		if granted > 0 {
+			mui.GrantedUnit = &grantedUnit{TotalVolume: granted, Time: u.RequestedUnit.Time}
+		} else {
+			mui.ResultCode = resultQuotaLimitReached
+		}
+		if granted < requested {
+			mui.FinalUnitIndication = s.finalUnitIndication()
+		}
+		info = append(info, mui)
+	}
+	return info, nil
+}
+
+// reservedBy returns the bytes held by the other sessions of a subscriber
+func (s *ChargingServer) reservedBy(imsi string, except *chargingSession) uint64 {
+	var reserved uint64
+	for _, session := range s.sessions {
+		if session.imsi == imsi && session != except {
+			reserved += session.reserved
+		}
+	}
+	return reserved
+}
+
+// debit takes the used units of a session off the subscriber's balance
+func (s *ChargingServer) debit(session *chargingSession, usage []multipleUnitUsage) error {
+	var used uint64
+	for _, u := range usage {
+		for _, c := range u.UsedUnitContainer {
+			used += c.TotalVolume
+		}
+	}
+	session.reserved = 0
+	if used == 0 {
+		return nil
+	}
+
+	mb := float64(used) / bytesPerMB
+	remaining, err := RedisClient.HIncrByFloat(RedisCtx, "quota:"+session.imsi, "remaining", -mb).Result()
+	if err != nil {
+		return err
+	}
+	RedisClient.HSet(RedisCtx, "quota:"+session.imsi, "updated", time.Now().Unix())
+	if s.publisher != nil {
+		s.publisher.PublishQuotaDeducted(session.imsi, mb, remaining)
+	}
+	log.Printf("💰 [Charging] Debited %.3f MB from %s, %.3f MB left", mb, session.imsi, remaining)
+	return nil
+}
+
+// finalUnitIndication terminates the sessions out of credit; the UPFs
+// cannot redirect them
+func (s *ChargingServer) finalUnitIndication() *finalUnitIndication {
+	return &finalUnitIndication{FinalUnitAction: finalUnitTerminate}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeProblem(w http.ResponseWriter, status int, cause string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"cause":  cause,
+		"detail": fmt.Sprintf("charging request failed: %s", cause),
+	})
+}
@@ -2,7 +2,8 @@ package main
 
 import (
 	"log"
-	"time"
+	"net/http"
+	"os"
 
 	"github.com/nats-io/nats.go"
 )
@@ -21,11 +22,21 @@ func main() {
 		log.Fatal("❌ Failed to create publisher")
 	}
 
-	// Test publish
-	log.Println("🚀 Starting OCS service...")
-	for {
-		publisher.PublishQuotaDeducted("123456789012345", 100, 900)
-		log.Println("✅ Published quota deduction event")
-		time.Sleep(5 * time.Second)
+	// Subscriber balances live in Redis
+	InitRedis()
+	defer RedisClient.Close()
+
+	addr := os.Getenv("OCS_ADDR")
+	if addr == "" {
+		addr = ":8082"
+	}
+
+	log.Printf("🚀 Starting OCS service on %s...", addr)
+	server := NewChargingServer(publisher)
+	if err := server.Restore(); err != nil {
+		log.Fatalf("❌ Failed to restore charging sessions: %v", err)
+	}
+	if err := http.ListenAndServe(addr, server.Handler()); err != nil {
+		log.Fatalf("❌ OCS server failed: %v", err)
 	}
 }
@@ -42,7 +42,7 @@ func (p *EventPublisher) PublishPFCPCreated(sessionID, teid, ueIP string) {
 	p.publish("pfcp.session.created", event)
 }
 
-func (p *EventPublisher) PublishQuotaDeducted(imsi string, amount, remaining int) {
+func (p *EventPublisher) PublishQuotaDeducted(imsi string, amount, remaining float64) {
 	event := map[string]interface{}{
 		"event":     "quota.deducted",
 		"imsi":      imsi,
@@ -0,0 +1,282 @@
+package smf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+)
+
+// ChargingBasePath is the Nchf_ConvergedCharging API root on the OCS
+const ChargingBasePath = "/nchf-convergedcharging/v3"
+
+// Result codes of a unit request (TS 32.291 §6.1.6.3.8)
+const (
+	ChargingResultSuccess              = "SUCCESS"
+	ChargingResultEndUserServiceDenied = "END_USER_SERVICE_DENIED"
+	ChargingResultQuotaLimitReached    = "QUOTA_LIMIT_REACHED"
+	ChargingResultUserUnknown          = "USER_UNKNOWN"
+	ChargingResultRatingFailed         = "RATING_FAILED"
+)
+
+// Charging trigger types reported with used units (TS 32.291 §6.1.6.3.3)
+const (
+	TriggerQuotaThreshold = "QUOTA_THRESHOLD"
+	TriggerQuotaExhausted = "QUOTA_EXHAUSTED"
+	TriggerValidityTime   = "VALIDITY_TIME"
+	TriggerFinal          = "FINAL"
+)
+
+// Final unit actions (TS 32.291 §6.1.6.3.10)
+const (
+	FinalUnitActionTerminate = "TERMINATE"
+	FinalUnitActionRedirect  = "REDIRECT"
+)
+
+// ChargingDataRequest is the body of a charging data create, update or release
+type ChargingDataRequest struct {
+	SubscriberIdentifier     string              `json:"subscriberIdentifier"`
+	NfConsumerIdentification NFIdentification    `json:"nfConsumerIdentification"`
+	InvocationTimeStamp      time.Time           `json:"invocationTimeStamp"`
+	InvocationSequenceNumber uint32              `json:"invocationSequenceNumber"`
+	MultipleUnitUsage        []MultipleUnitUsage `json:"multipleUnitUsage,omitempty"`
+	DNN                      string              `json:"dnnId,omitempty"`
+}
+
+// NFIdentification identifies the charging client
+type NFIdentification struct {
+	NFName            string `json:"nFName,omitempty"`
+	NodeFunctionality string `json:"nodeFunctionality"`
+}
+
+// MultipleUnitUsage requests units of a rating group and reports their use
+type MultipleUnitUsage struct {
+	RatingGroup       uint32              `json:"ratingGroup"`
+	RequestedUnit     *RequestedUnit      `json:"requestedUnit,omitempty"`
+	UsedUnitContainer []UsedUnitContainer `json:"usedUnitContainer,omitempty"`
+}
+
+// RequestedUnit is the credit asked for, in seconds and bytes
+type RequestedUnit struct {
+	Time        uint32 `json:"time,omitempty"`
+	TotalVolume uint64 `json:"totalVolume,omitempty"`
+}
+
+// UsedUnitContainer reports units consumed since the last report
+type UsedUnitContainer struct {
+	Time                uint32    `json:"time,omitempty"`
+	TotalVolume         uint64    `json:"totalVolume,omitempty"`
+	UplinkVolume        uint64    `json:"uplinkVolume,omitempty"`
+	DownlinkVolume      uint64    `json:"downlinkVolume,omitempty"`
+	Triggers            []Trigger `json:"triggers,omitempty"`
+	LocalSequenceNumber uint32    `json:"localSequenceNumber"`
+}
+
+// Trigger is the event that caused used units to be reported
+type Trigger struct {
+	TriggerType     string `json:"triggerType"`
+	TriggerCategory string `json:"triggerCategory"`
+}
+
+// ChargingDataResponse is the OCS answer carrying granted units
+type ChargingDataResponse struct {
+	InvocationTimeStamp      time.Time                 `json:"invocationTimeStamp"`
+	InvocationSequenceNumber uint32                    `json:"invocationSequenceNumber"`
+	MultipleUnitInformation  []MultipleUnitInformation `json:"multipleUnitInformation,omitempty"`
+}
+
+// MultipleUnitInformation is the outcome of a unit request of a rating group
+type MultipleUnitInformation struct {
+	ResultCode           string               `json:"resultCode,omitempty"`
+	RatingGroup          uint32               `json:"ratingGroup"`
+	GrantedUnit          *GrantedUnit         `json:"grantedUnit,omitempty"`
+	ValidityTime         uint32               `json:"validityTime,omitempty"`
+	VolumeQuotaThreshold uint64               `json:"volumeQuotaThreshold,omitempty"`
+	TimeQuotaThreshold   uint32               `json:"timeQuotaThreshold,omitempty"`
+	FinalUnitIndication  *FinalUnitIndication `json:"finalUnitIndication,omitempty"`
+}
+
+// GrantedUnit is the credit granted, in seconds and bytes
+type GrantedUnit struct {
+	Time        uint32 `json:"time,omitempty"`
+	TotalVolume uint64 `json:"totalVolume,omitempty"`
+}
+
+// FinalUnitIndication marks the granted units as the last ones and says
+// what to do once they are used. The redirect server of a REDIRECT is not
+// decoded, such sessions are terminated.
+type FinalUnitIndication struct {
+	FinalUnitAction string `json:"finalUnitAction"`
+}
+
+// ChargingError is an OCS rejection of a charging request
+type ChargingError struct {
+	Status int
+	Cause  string
+}
+
+func (e *ChargingError) Error() string {
+	if e.Cause != "" {
+		return fmt.Sprintf("OCS rejected request with status %d: %s", e.Status, e.Cause)
+	}
+	return fmt.Sprintf("OCS rejected request with status %d", e.Status)
+}
+
+// ChargingCauseNotApplicable is the cause of an OCS that does not know the
+// charging session of a request (TS 32.291 §6.1.7.3)
+const ChargingCauseNotApplicable = "CHARGING_NOT_APPLICABLE"
+
+// SessionUnknown reports whether the OCS rejected the request because it
+// does not know the charging session, as after losing its state
+func (e *ChargingError) SessionUnknown() bool {
+	return e.Status == http.StatusNotFound && e.Cause == ChargingCauseNotApplicable
+}
+
+// ChargingClient is the SMF side of Nchf_ConvergedCharging towards the OCS
+type ChargingClient struct {
+	baseURI string
+	client  *http.Client
+}
+
+// NewChargingClient creates a client for the OCS at baseURI
+func NewChargingClient(baseURI string, timeout time.Duration) *ChargingClient {
+	return &ChargingClient{baseURI: baseURI, client: &http.Client{Timeout: timeout}}
+}
+
+// Create opens a charging session and returns its reference
+func (c *ChargingClient) Create(ctx context.Context, req *ChargingDataRequest) (string, *ChargingDataResponse, error) {
+	res, err := c.post(ctx, ChargingBasePath+"/chargingdata", req)
+	if err != nil {
+		return "", nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusCreated {
+		return "", nil, chargingError(res)
+	}
+	location := res.Header.Get("Location")
+	if location == "" {
+		return "", nil, fmt.Errorf("OCS did not return a charging data reference")
+	}
+	var data ChargingDataResponse
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return "", nil, fmt.Errorf("invalid charging data response: %w", err)
+	}
+	return path.Base(location), &data, nil
+}
+
+// Update reports used units and requests new ones
+func (c *ChargingClient) Update(ctx context.Context, ref string, req *ChargingDataRequest) (*ChargingDataResponse, error) {
+	res, err := c.post(ctx, ChargingBasePath+"/chargingdata/"+ref+"/update", req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, chargingError(res)
+	}
+	var data ChargingDataResponse
+	if err := json.NewDecoder(res.Body).Decode(&data); err != nil {
+		return nil, fmt.Errorf("invalid charging data response: %w", err)
+	}
+	return &data, nil
+}
+
+// Release reports the final used units and closes the charging session
+func (c *ChargingClient) Release(ctx context.Context, ref string, req *ChargingDataRequest) error {
+	res, err := c.post(ctx, ChargingBasePath+"/chargingdata/"+ref+"/release", req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return chargingError(res)
+	}
+	return nil
+}
+
+func (c *ChargingClient) post(ctx context.Context, uri string, v interface{}) (*http.Response, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.baseURI+uri, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", ContentTypeJSON)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("OCS request failed: %w", err)
+	}
+	return res, nil
+}
+
+// chargingError converts a failed OCS response into a ChargingError
+func chargingError(res *http.Response) error {
+	var problem ProblemDetails
+	json.NewDecoder(res.Body).Decode(&problem)
+	return &ChargingError{Status: res.StatusCode, Cause: problem.Cause}
+}
+
+// CreditQuota is the credit of a session's rating group, enforced on the
+// UPF with a URR. Thresholds are the units left when the SMF asks for more.
+type CreditQuota struct {
+	RatingGroup     uint32 `json:"rating_group"`
+	Volume          uint64 `json:"volume,omitempty"` // bytes, 0 when not volume based
+	Time            uint32 `json:"time,omitempty"`   // seconds, 0 when not time based
+	VolumeThreshold uint64 `json:"volume_threshold,omitempty"`
+	TimeThreshold   uint32 `json:"time_threshold,omitempty"`
+	FinalAction     string `json:"final_action,omitempty"` // set when these are the last units
+}
+
+// NewCreditQuota converts granted units into the quota of a session.
+// Thresholds the OCS leaves out default to the given fraction of the grant.
+// It returns nil when nothing was granted.
+func NewCreditQuota(info *MultipleUnitInformation, threshold float64) *CreditQuota {
+	if info.GrantedUnit == nil || (info.GrantedUnit.TotalVolume == 0 && info.GrantedUnit.Time == 0) {
+		return nil
+	}
+	q := &CreditQuota{
+		RatingGroup:     info.RatingGroup,
+		Volume:          info.GrantedUnit.TotalVolume,
+		Time:            info.GrantedUnit.Time,
+		VolumeThreshold: info.VolumeQuotaThreshold,
+		TimeThreshold:   info.TimeQuotaThreshold,
+	}
+	if q.VolumeThreshold == 0 || q.VolumeThreshold >= q.Volume {
+		q.VolumeThreshold = uint64(float64(q.Volume) * threshold)
+	}
+	if q.TimeThreshold == 0 || q.TimeThreshold >= q.Time {
+		q.TimeThreshold = uint32(float64(q.Time) * threshold)
+	}
+	if fui := info.FinalUnitIndication; fui != nil {
+		q.FinalAction = fui.FinalUnitAction
+	}
+	return q
+}
+
+// UsedUnits converts a usage report into the used units reported to the OCS
+func UsedUnits(r *UsageReport, seq uint32) UsedUnitContainer {
+	used := UsedUnitContainer{
+		Time:                uint32(r.Duration / time.Second),
+		TotalVolume:         r.TotalVolume,
+		UplinkVolume:        r.UplinkVolume,
+		DownlinkVolume:      r.DownlinkVolume,
+		LocalSequenceNumber: seq,
+	}
+	switch {
+	case r.QuotaExhausted():
+		used.Triggers = []Trigger{{TriggerType: TriggerQuotaExhausted, TriggerCategory: "IMMEDIATE_REPORT"}}
+	case r.ThresholdReached():
+		used.Triggers = []Trigger{{TriggerType: TriggerQuotaThreshold, TriggerCategory: "IMMEDIATE_REPORT"}}
+	case r.Termination():
+		used.Triggers = []Trigger{{TriggerType: TriggerFinal, TriggerCategory: "IMMEDIATE_REPORT"}}
+	}
+	return used
+}
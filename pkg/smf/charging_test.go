@@ -0,0 +1,122 @@
+package smf
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+func TestNewCreditQuota(t *testing.T) {
+	q := NewCreditQuota(&MultipleUnitInformation{
+		ResultCode:  ChargingResultSuccess,
+		RatingGroup: 10,
+		GrantedUnit: &GrantedUnit{TotalVolume: 10_000_000, Time: 3600},
+	}, 0.2)
+	if q == nil || q.Volume != 10_000_000 || q.VolumeThreshold != 2_000_000 || q.TimeThreshold != 720 {
+		t.Fatalf("NewCreditQuota() = %+v, want 10 MB with 20%% thresholds", q)
+	}
+
+	final := NewCreditQuota(&MultipleUnitInformation{
+		RatingGroup:          10,
+		GrantedUnit:          &GrantedUnit{TotalVolume: 1000},
+		VolumeQuotaThreshold: 100,
+		FinalUnitIndication:  &FinalUnitIndication{FinalUnitAction: FinalUnitActionTerminate},
+	}, 0.2)
+	if final.VolumeThreshold != 100 || final.FinalAction != FinalUnitActionTerminate {
+		t.Errorf("NewCreditQuota() = %+v, want OCS threshold and final action", final)
+	}
+
+	if q := NewCreditQuota(&MultipleUnitInformation{ResultCode: ChargingResultQuotaLimitReached}, 0.2); q != nil {
+		t.Errorf("NewCreditQuota() = %+v without granted units", q)
+	}
+}
+
+func TestSessionRulesCharging(t *testing.T) {
+	rules := &SessionRules{
+		UEIP:     net.IPv4(10, 0, 0, 1),
+		DNN:      "internet",
+		UPFTEID:  1,
+		UPFAddr:  net.IPv4(192, 168, 0, 1),
+		Charging: &CreditQuota{RatingGroup: 10, Volume: 1000, VolumeThreshold: 200},
+	}
+
+	var urrs int
+	for _, i := range rules.EstablishmentIEs() {
+		switch i.Type {
+		case ie.CreateURR:
+			urrs++
+			th, err := i.VolumeThreshold()
+			if err != nil || th.TotalVolume != 800 {
+				t.Errorf("volume threshold = %+v, %v, want 800", th, err)
+			}
+			quota, err := i.VolumeQuota()
+			if err != nil || quota.TotalVolume != 1000 {
+				t.Errorf("volume quota = %+v, %v, want 1000", quota, err)
+			}
+		case ie.CreatePDR:
+			if id, err := i.URRID(); err != nil || id != ChargingURRID {
+				t.Errorf("PDR URR ID = %d, %v, want %d", id, err, ChargingURRID)
+			}
+		}
+	}
+	if urrs != 1 {
+		t.Errorf("URRs = %d, want 1", urrs)
+	}
+}
+
+func TestParseUsageReport(t *testing.T) {
+	i := ie.NewUsageReportWithinSessionReportRequest(
+		ie.NewURRID(ChargingURRID),
+		ie.NewURSEQN(1),
+		ie.NewUsageReportTrigger(usageVOLTH, 0),
+		ie.NewVolumeMeasurement(0x07, 1500, 500, 1000, 0, 0, 0),
+		ie.NewDurationMeasurement(90*time.Second),
+	)
+	r, err := ParseUsageReport(i)
+	if err != nil {
+		t.Fatalf("ParseUsageReport() error = %v", err)
+	}
+	if r.TotalVolume != 1500 || r.UplinkVolume != 500 || r.Duration != 90*time.Second {
+		t.Errorf("ParseUsageReport() = %+v", r)
+	}
+	if !r.ThresholdReached() || r.QuotaExhausted() {
+		t.Errorf("triggers = %x, want threshold only", r.Trigger)
+	}
+
+	used := UsedUnits(r, 3)
+	if used.TotalVolume != 1500 || used.Time != 90 || len(used.Triggers) != 1 ||
+		used.Triggers[0].TriggerType != TriggerQuotaThreshold {
+		t.Errorf("UsedUnits() = %+v", used)
+	}
+}
+
+func TestSessionRulesInactivity(t *testing.T) {
+	rules := &SessionRules{
+		UEIP:              net.IPv4(10, 0, 0, 1),
+		DNN:               "internet",
+		UPFTEID:           1,
+		UPFAddr:           net.IPv4(192, 168, 0, 1),
+		InactivityTimeout: 10 * time.Minute,
+	}
+
+	var timers int
+	for _, i := range rules.EstablishmentIEs() {
+		switch i.Type {
+		case ie.CreateURR:
+			t.Errorf("inactivity detected with a URR")
+		case ie.UserPlaneInactivityTimer:
+			timers++
+			if timer, err := i.UserPlaneInactivityTimer(); err != nil || timer != 10*time.Minute {
+				t.Errorf("User Plane Inactivity Timer = %v, %v, want 10m", timer, err)
+			}
+		}
+	}
+	if timers != 1 {
+		t.Errorf("User Plane Inactivity Timers = %d, want 1", timers)
+	}
+	if set := rules.Describe(); set.InactivityTimer != 600 || len(set.URRs) != 0 {
+		t.Errorf("Describe() = %+v, want the timer and no URR", set)
+	}
+}
@@ -0,0 +1,170 @@
+package smf
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DNNConfig is an entry of the DNN catalogue in the SMF configuration
+type DNNConfig struct {
+	Name     string   `mapstructure:"name" json:"name"`
+	Pool     string   `mapstructure:"pool" json:"pool,omitempty"`   // IPv4 prefix of UE addresses, the default pool when empty
+	Pool6    string   `mapstructure:"pool6" json:"pool6,omitempty"` // IPv6 prefix the UE /64s are delegated from, the default pool when empty
+	DNS      []string `mapstructure:"dns" json:"dns,omitempty"`
+	PCSCF    []string `mapstructure:"pcscf" json:"pcscf,omitempty"`
+	MTU      uint16   `mapstructure:"mtu" json:"mtu,omitempty"`
+	AMBRUL   uint64   `mapstructure:"ambr_ul" json:"ambr_ul,omitempty"`     // bps
+	AMBRDL   uint64   `mapstructure:"ambr_dl" json:"ambr_dl,omitempty"`     // bps
+	PDNTypes []string `mapstructure:"pdn_types" json:"pdn_types,omitempty"` // ipv4, ipv6, ipv4v6
+}
+
+// DNN is a data network sessions can be established to
+type DNN struct {
+	Name   string
+	Pool   *IPPool     // nil for the default pool
+	Pool6  *PrefixPool // nil for the default pool
+	DNS    []net.IP
+	PCSCF  []net.IP
+	MTU    uint16
+	AMBRUL uint64 // bps, 0 when not capped
+	AMBRDL uint64 // bps, 0 when not capped
+
+	// Allowed PDN/PDU session types, all IP types when empty
+	pdnTypes map[uint8]bool
+}
+
+// pdnTypeNames maps configured PDN types to their codes, which GTPv2 and
+// 5GSM share
+var pdnTypeNames = map[string]uint8{
+	"ipv4":   PDUSessionTypeIPv4,
+	"ipv6":   PDUSessionTypeIPv6,
+	"ipv4v6": PDUSessionTypeIPv4v6,
+}
+
+// NewDNN checks a catalogue entry and creates its DNN
+func NewDNN(c DNNConfig) (*DNN, error) {
+	if c.Name == "" {
+		return nil, fmt.Errorf("dnn entry needs a name")
+	}
+	d := &DNN{
+		Name:     NormalizeDNN(c.Name),
+		MTU:      c.MTU,
+		AMBRUL:   c.AMBRUL,
+		AMBRDL:   c.AMBRDL,
+		pdnTypes: make(map[uint8]bool),
+	}
+	if c.Pool != "" {
+		pool, err := NewIPPool(c.Pool)
+		if err != nil {
+			return nil, fmt.Errorf("dnn %s: %w", c.Name, err)
+		}
+		d.Pool = pool
+	}
+	if c.Pool6 != "" {
+		pool, err := NewPrefixPool(c.Pool6)
+		if err != nil {
+			return nil, fmt.Errorf("dnn %s: %w", c.Name, err)
+		}
+		d.Pool6 = pool
+	}
+	for _, s := range c.DNS {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("dnn %s: invalid dns server %q", c.Name, s)
+		}
+		d.DNS = append(d.DNS, ip)
+	}
+	for _, s := range c.PCSCF {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("dnn %s: invalid p-cscf %q", c.Name, s)
+		}
+		d.PCSCF = append(d.PCSCF, ip)
+	}
+	if c.MTU != 0 && c.MTU < 576 {
+		return nil, fmt.Errorf("dnn %s: mtu %d below the IPv4 minimum of 576", c.Name, c.MTU)
+	}
+	for _, name := range c.PDNTypes {
+		t, ok := pdnTypeNames[strings.ToLower(name)]
+		if !ok {
+			return nil, fmt.Errorf("dnn %s: unknown pdn type %q", c.Name, name)
+		}
+		d.pdnTypes[t] = true
+	}
+	return d, nil
+}
+
+// AllowsPDNType reports whether sessions of the given type may be set up
+func (d *DNN) AllowsPDNType(t uint8) bool {
+	if len(d.pdnTypes) == 0 {
+		return t == PDUSessionTypeIPv4 || t == PDUSessionTypeIPv6 || t == PDUSessionTypeIPv4v6
+	}
+	return d.pdnTypes[t]
+}
+
+// SelectPDNType returns the session type granted for a requested one and
+// whether it differs from the request. A dual-stack request falls back to
+// the single address family the DNN allows (TS 23.401 §5.3.1.1).
+func (d *DNN) SelectPDNType(requested uint8) (uint8, bool) {
+	if d.AllowsPDNType(requested) {
+		return requested, false
+	}
+	if requested == PDUSessionTypeIPv4v6 {
+		for _, t := range []uint8{PDUSessionTypeIPv4, PDUSessionTypeIPv6} {
+			if d.AllowsPDNType(t) {
+				return t, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// DNNCatalogue holds the DNNs the SMF serves
+type DNNCatalogue struct {
+	dnns map[string]*DNN
+}
+
+// NewDNNCatalogue creates the catalogue of the configured DNNs
+func NewDNNCatalogue(entries []DNNConfig) (*DNNCatalogue, error) {
+	c := &DNNCatalogue{dnns: make(map[string]*DNN, len(entries))}
+	for _, e := range entries {
+		d, err := NewDNN(e)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := c.dnns[d.Name]; ok {
+			return nil, fmt.Errorf("dnn %s configured twice", d.Name)
+		}
+		c.dnns[d.Name] = d
+	}
+	return c, nil
+}
+
+// Resolve returns the DNN of a requested APN or DNN. The operator
+// identifier of a full APN is ignored.
+func (c *DNNCatalogue) Resolve(apn string) (*DNN, bool) {
+	d, ok := c.dnns[NormalizeDNN(apn)]
+	return d, ok
+}
+
+// DNNs returns the DNNs of the catalogue
+func (c *DNNCatalogue) DNNs() []*DNN {
+	dnns := make([]*DNN, 0, len(c.dnns))
+	for _, d := range c.dnns {
+		dnns = append(dnns, d)
+	}
+	return dnns
+}
+
+// NormalizeDNN returns the network identifier of an APN in lower case,
+// without an "mncXXX.mccYYY.gprs" operator identifier (TS 23.003 §9.1)
+func NormalizeDNN(apn string) string {
+	apn = strings.ToLower(strings.TrimSuffix(apn, "."))
+	labels := strings.Split(apn, ".")
+	if n := len(labels); n > 3 && labels[n-1] == "gprs" &&
+		strings.HasPrefix(labels[n-2], "mcc") && strings.HasPrefix(labels[n-3], "mnc") {
+		labels = labels[:n-3]
+	}
+	return strings.Join(labels, ".")
+}
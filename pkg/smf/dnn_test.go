@@ -0,0 +1,145 @@
+package smf
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestDNNCatalogueResolve(t *testing.T) {
+	c, err := NewDNNCatalogue([]DNNConfig{
+		{Name: "internet", Pool: "10.45.0.0/16", DNS: []string{"8.8.8.8"}},
+		{Name: "IMS", PDNTypes: []string{"ipv4v6"}},
+	})
+	if err != nil {
+		t.Fatalf("NewDNNCatalogue() error = %v", err)
+	}
+
+	for _, apn := range []string{"internet", "Internet", "internet.mnc001.mcc001.gprs"} {
+		if d, ok := c.Resolve(apn); !ok || d.Name != "internet" {
+			t.Errorf("Resolve(%q) = %v, %v, want internet", apn, d, ok)
+		}
+	}
+	if _, ok := c.Resolve(""); ok {
+		t.Error("Resolve(\"\") found a DNN")
+	}
+	if _, ok := c.Resolve("corporate"); ok {
+		t.Error("Resolve(corporate) found a DNN")
+	}
+
+	ims, _ := c.Resolve("ims")
+	if ims.AllowsPDNType(PDUSessionTypeIPv4) || !ims.AllowsPDNType(PDUSessionTypeIPv4v6) {
+		t.Error("ims allows IPv4 or refuses IPv4v6")
+	}
+
+	if _, err := NewDNNCatalogue([]DNNConfig{{Name: "a", PDNTypes: []string{"ethernet"}}}); err == nil {
+		t.Error("unknown PDN type: error = nil")
+	}
+	if _, err := NewDNNCatalogue([]DNNConfig{{Name: "a", Pool: "10.0.0.1/32"}}); err == nil {
+		t.Error("pool without hosts: error = nil")
+	}
+}
+
+func TestIPPool(t *testing.T) {
+	pool, err := NewIPPool("10.0.0.0/30")
+	if err != nil {
+		t.Fatalf("NewIPPool() error = %v", err)
+	}
+	if !pool.Reserve(net.IPv4(10, 0, 0, 1)) {
+		t.Fatal("Reserve(10.0.0.1) = false")
+	}
+	if ip := pool.Allocate(); !ip.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Errorf("Allocate() = %s, want 10.0.0.2", ip)
+	}
+	if ip := pool.Allocate(); ip != nil {
+		t.Errorf("Allocate() = %s from an exhausted pool", ip)
+	}
+	pool.Release(net.IPv4(10, 0, 0, 1))
+	if ip := pool.Allocate(); !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("Allocate() = %s, want the released 10.0.0.1", ip)
+	}
+	if pool.Reserve(net.IPv4(10, 0, 0, 3)) {
+		t.Error("Reserve() of the broadcast address = true")
+	}
+}
+
+func TestPrefixPool(t *testing.T) {
+	pool, err := NewPrefixPool("2001:db8:10::/63")
+	if err != nil {
+		t.Fatalf("NewPrefixPool() error = %v", err)
+	}
+	first := pool.Allocate()
+	if p := UEPrefix(first); p.String() != "2001:db8:10::/64" {
+		t.Errorf("Allocate() = %s, want an address in 2001:db8:10::/64", first)
+	}
+	second := pool.Allocate()
+	if p := UEPrefix(second); p.String() != "2001:db8:10:1::/64" {
+		t.Errorf("Allocate() = %s, want an address in 2001:db8:10:1::/64", second)
+	}
+	if ip := pool.Allocate(); ip != nil {
+		t.Errorf("Allocate() = %s from an exhausted pool", ip)
+	}
+	pool.Release(first)
+	if pool.Free() != 1 || !pool.Reserve(net.ParseIP("2001:db8:10::5")) {
+		t.Error("released prefix cannot be reserved again")
+	}
+	if pool.Reserve(net.ParseIP("2001:db8:11::1")) {
+		t.Error("Reserve() of an address outside the pool = true")
+	}
+
+	for _, cidr := range []string{"10.0.0.0/8", "2001:db8::/72", "2001:db8::/32"} {
+		if _, err := NewPrefixPool(cidr); err == nil {
+			t.Errorf("NewPrefixPool(%s): error = nil", cidr)
+		}
+	}
+}
+
+func TestSelectPDNType(t *testing.T) {
+	iot, err := NewDNN(DNNConfig{Name: "iot", PDNTypes: []string{"ipv6"}})
+	if err != nil {
+		t.Fatalf("NewDNN() error = %v", err)
+	}
+	if got, changed := iot.SelectPDNType(PDUSessionTypeIPv4v6); got != PDUSessionTypeIPv6 || !changed {
+		t.Errorf("SelectPDNType(IPv4v6) = %d, %v, want IPv6, true", got, changed)
+	}
+	if got, _ := iot.SelectPDNType(PDUSessionTypeIPv4); got != 0 {
+		t.Errorf("SelectPDNType(IPv4) = %d, want 0", got)
+	}
+	open, _ := NewDNN(DNNConfig{Name: "internet"})
+	if got, changed := open.SelectPDNType(PDUSessionTypeIPv4v6); got != PDUSessionTypeIPv4v6 || changed {
+		t.Errorf("SelectPDNType(IPv4v6) = %d, %v, want IPv4v6, false", got, changed)
+	}
+}
+
+func TestPCOResponse(t *testing.T) {
+	d, err := NewDNN(DNNConfig{Name: "internet", DNS: []string{"8.8.8.8", "2001:4860:4860::8888", "8.8.4.4"}, MTU: 1400})
+	if err != nil {
+		t.Fatalf("NewDNN() error = %v", err)
+	}
+
+	// DNS IPv4, MTU and an IPCP request for the primary and secondary DNS
+	req, err := ParsePCO([]byte{
+		0x80,
+		0x00, 0x0d, 0x00,
+		0x00, 0x10, 0x00,
+		0x80, 0x21, 0x10, 0x01, 0x00, 0x00, 0x10, 0x81, 0x06, 0, 0, 0, 0, 0x83, 0x06, 0, 0, 0, 0,
+	})
+	if err != nil {
+		t.Fatalf("ParsePCO() error = %v", err)
+	}
+
+	want := []byte{
+		0x80,
+		0x00, 0x0d, 0x04, 8, 8, 8, 8,
+		0x00, 0x0d, 0x04, 8, 8, 4, 4,
+		0x00, 0x10, 0x02, 0x05, 0x78,
+		0x80, 0x21, 0x10, 0x03, 0x00, 0x00, 0x10, 0x81, 0x06, 8, 8, 8, 8, 0x83, 0x06, 8, 8, 4, 4,
+	}
+	if b := d.PCOResponse(req).Marshal(); !bytes.Equal(b, want) {
+		t.Errorf("PCOResponse() = %x, want %x", b, want)
+	}
+
+	if _, err := ParsePCO([]byte{0x80, 0x00, 0x0d, 0x04, 8}); err == nil {
+		t.Error("truncated PCO: error = nil")
+	}
+}
@@ -0,0 +1,266 @@
+package smf
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// PeerState is the path state of a GTP-C peer
+type PeerState string
+
+const (
+	PeerStateUp   PeerState = "UP"
+	PeerStateDown PeerState = "DOWN"
+)
+
+// gtpcPort is where Echo Requests go, whatever port the peer sends from
+// (TS 29.274 §4.2)
+const gtpcPort = "2123"
+
+// GTPCPeer is an MME, SGW or ePDG the SMF exchanges GTP-C messages with.
+// Peers are identified by IP address; addr is where the last message came
+// from.
+type GTPCPeer struct {
+	Host string
+
+	addr           string
+	state          PeerState
+	restartCounter uint8
+	counterKnown   bool
+	restarts       int
+	lastSeen       time.Time
+	lastEcho       time.Time
+	echoRTT        time.Duration
+	echoSent       time.Time // zero when no Echo Request is outstanding
+	echoRetries    int
+	pathFailures   int
+
+	mu sync.RWMutex
+}
+
+// GTPCPeerStatus is a point-in-time snapshot of a GTP-C peer
+type GTPCPeerStatus struct {
+	Host           string        `json:"host"`
+	Addr           string        `json:"addr"`
+	State          PeerState     `json:"state"`
+	RestartCounter uint8         `json:"restart_counter"`
+	Restarts       int           `json:"restarts"`
+	PathFailures   int           `json:"path_failures"`
+	LastSeen       time.Time     `json:"last_seen"`
+	LastEcho       time.Time     `json:"last_echo,omitempty"`
+	EchoRTT        time.Duration `json:"echo_rtt_ns,omitempty"`
+}
+
+// Status returns a snapshot of the peer
+func (p *GTPCPeer) Status() GTPCPeerStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return GTPCPeerStatus{
+		Host:           p.Host,
+		Addr:           p.addr,
+		State:          p.state,
+		RestartCounter: p.restartCounter,
+		Restarts:       p.restarts,
+		PathFailures:   p.pathFailures,
+		LastSeen:       p.lastSeen,
+		LastEcho:       p.lastEcho,
+		EchoRTT:        p.echoRTT,
+	}
+}
+
+// GTPCPeerTable tracks the GTP-C peers of the SMF, their Restart Counters
+// and the state of the paths towards them (TS 23.007 §18, TS 29.274 §7.6).
+// Paths are monitored with Echo Requests sent every EchoInterval; a request
+// unanswered after EchoTimeout is retransmitted up to EchoRetries times
+// before the path is declared down.
+type GTPCPeerTable struct {
+	EchoInterval time.Duration
+	EchoTimeout  time.Duration
+	EchoRetries  int
+
+	peers map[string]*GTPCPeer
+	mu    sync.RWMutex
+}
+
+// NewGTPCPeerTable creates an empty peer table with the default timers
+func NewGTPCPeerTable() *GTPCPeerTable {
+	return &GTPCPeerTable{
+		EchoInterval: 60 * time.Second,
+		EchoTimeout:  3 * time.Second,
+		EchoRetries:  3,
+		peers:        make(map[string]*GTPCPeer),
+	}
+}
+
+// PeerHost returns the IP address of a "host:port" peer address
+func PeerHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// peer returns the peer at addr, adding it when unknown
+func (t *GTPCPeerTable) peer(addr string) *GTPCPeer {
+	host := PeerHost(addr)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	p, ok := t.peers[host]
+	if !ok {
+		p = &GTPCPeer{Host: host, addr: addr, state: PeerStateUp}
+		t.peers[host] = p
+	}
+	return p
+}
+
+// Seen records a message a peer initiated. A peer whose path was down is
+// up again.
+func (t *GTPCPeerTable) Seen(addr string, now time.Time) {
+	p := t.peer(addr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.addr = addr
+	p.lastSeen = now
+	if p.state == PeerStateDown {
+		p.state = PeerStateUp
+		p.echoSent = time.Time{}
+		p.echoRetries = 0
+	}
+}
+
+// Recovery records the Restart Counter a peer sent and reports whether it
+// changed since the last one, meaning the peer restarted and lost its sessions
+func (t *GTPCPeerTable) Recovery(addr string, counter uint8) bool {
+	p := t.peer(addr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	restarted := p.counterKnown && p.restartCounter != counter
+	p.restartCounter = counter
+	p.counterKnown = true
+	if restarted {
+		p.restarts++
+	}
+	return restarted
+}
+
+// EchoAnswered records an Echo Response of a peer
+func (t *GTPCPeerTable) EchoAnswered(addr string, now time.Time) {
+	p := t.peer(addr)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.echoSent.IsZero() {
+		p.echoRTT = now.Sub(p.echoSent)
+	}
+	p.lastEcho = now
+	p.echoSent = time.Time{}
+	p.echoRetries = 0
+	p.state = PeerStateUp
+}
+
+// Poll advances the path monitoring. It returns the GTP-C addresses Echo
+// Requests are due to and the hosts of peers whose path just failed.
+func (t *GTPCPeerTable) Poll(now time.Time) (echoes []string, failed []string) {
+	for _, p := range t.all() {
+		p.mu.Lock()
+		switch {
+		case p.state != PeerStateUp:
+		case !p.echoSent.IsZero() && now.Sub(p.echoSent) >= t.EchoTimeout:
+			if p.echoRetries >= t.EchoRetries {
+				p.state = PeerStateDown
+				p.pathFailures++
+				p.echoSent = time.Time{}
+				p.echoRetries = 0
+				failed = append(failed, p.Host)
+				break
+			}
+			p.echoRetries++
+			p.echoSent = now
+			echoes = append(echoes, net.JoinHostPort(p.Host, gtpcPort))
+		case p.echoSent.IsZero() && now.Sub(p.lastEchoOrSeen()) >= t.EchoInterval:
+			p.echoSent = now
+			echoes = append(echoes, net.JoinHostPort(p.Host, gtpcPort))
+		}
+		p.mu.Unlock()
+	}
+	return echoes, failed
+}
+
+// Prune forgets the peers the SMF holds no sessions with, according to
+// hasSessions, whose path is down or that sent nothing for EchoInterval. It
+// returns their hosts.
+func (t *GTPCPeerTable) Prune(now time.Time, hasSessions func(host string) bool) []string {
+	var idle []*GTPCPeer
+	for _, p := range t.all() {
+		if p.idle(now, t.EchoInterval) && !hasSessions(p.Host) {
+			idle = append(idle, p)
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var pruned []string
+	for _, p := range idle {
+		// Messages received since are kept for the sessions they set up
+		if t.peers[p.Host] == p && p.idle(now, t.EchoInterval) {
+			delete(t.peers, p.Host)
+			pruned = append(pruned, p.Host)
+		}
+	}
+	return pruned
+}
+
+func (p *GTPCPeer) idle(now time.Time, interval time.Duration) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.state == PeerStateDown || now.Sub(p.lastSeen) >= interval
+}
+
+// lastEchoOrSeen returns when the path last proved alive
+func (p *GTPCPeer) lastEchoOrSeen() time.Time {
+	if p.lastEcho.After(p.lastSeen) {
+		return p.lastEcho
+	}
+	return p.lastSeen
+}
+
+// Get returns the peer with the given IP address
+func (t *GTPCPeerTable) Get(host string) (*GTPCPeer, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	p, ok := t.peers[host]
+	return p, ok
+}
+
+// Statuses returns a snapshot of every peer ordered by host
+func (t *GTPCPeerTable) Statuses() []GTPCPeerStatus {
+	peers := t.all()
+	statuses := make([]GTPCPeerStatus, 0, len(peers))
+	for _, p := range peers {
+		statuses = append(statuses, p.Status())
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Host < statuses[j].Host })
+	return statuses
+}
+
+func (t *GTPCPeerTable) all() []*GTPCPeer {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	peers := make([]*GTPCPeer, 0, len(t.peers))
+	for _, p := range t.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
@@ -0,0 +1,109 @@
+package smf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGTPCPeerTableRecovery(t *testing.T) {
+	peers := NewGTPCPeerTable()
+	if peers.Recovery("10.0.0.1:2123", 5) {
+		t.Error("first Restart Counter reported as a restart")
+	}
+	if peers.Recovery("10.0.0.1:2123", 5) {
+		t.Error("same Restart Counter reported as a restart")
+	}
+	if !peers.Recovery("10.0.0.1:2124", 6) {
+		t.Error("changed Restart Counter not reported as a restart")
+	}
+	p, ok := peers.Get("10.0.0.1")
+	if !ok || p.Status().Restarts != 1 || p.Status().RestartCounter != 6 {
+		t.Errorf("peer = %+v, want 1 restart with counter 6", p.Status())
+	}
+}
+
+func TestGTPCPeerTablePathFailure(t *testing.T) {
+	peers := NewGTPCPeerTable()
+	peers.EchoInterval = time.Minute
+	peers.EchoTimeout = 3 * time.Second
+	peers.EchoRetries = 2
+
+	start := time.Now()
+	peers.Seen("10.0.0.1:2123", start)
+
+	if echoes, _ := peers.Poll(start.Add(time.Second)); len(echoes) != 0 {
+		t.Fatalf("echoes = %v before the echo interval", echoes)
+	}
+	now := start.Add(time.Minute)
+	if echoes, _ := peers.Poll(now); len(echoes) != 1 || echoes[0] != "10.0.0.1:2123" {
+		t.Fatalf("echoes = %v, want one to the peer", echoes)
+	}
+
+	// An answered echo keeps the path up
+	peers.EchoAnswered("10.0.0.1:2123", now.Add(10*time.Millisecond))
+	p, _ := peers.Get("10.0.0.1")
+	if st := p.Status(); st.State != PeerStateUp || st.EchoRTT != 10*time.Millisecond {
+		t.Errorf("peer = %+v, want up with 10ms RTT", st)
+	}
+
+	// Unanswered echoes are retransmitted, then the path fails
+	now = now.Add(2 * time.Minute)
+	if echoes, _ := peers.Poll(now); len(echoes) != 1 {
+		t.Fatalf("echoes = %v, want one after the echo interval", echoes)
+	}
+	for i := 0; i < 2; i++ {
+		now = now.Add(3 * time.Second)
+		if echoes, failed := peers.Poll(now); len(echoes) != 1 || len(failed) != 0 {
+			t.Fatalf("retry %d: echoes = %v, failed = %v", i, echoes, failed)
+		}
+	}
+	now = now.Add(3 * time.Second)
+	if _, failed := peers.Poll(now); len(failed) != 1 || failed[0] != "10.0.0.1" {
+		t.Fatalf("failed = %v, want the peer", failed)
+	}
+	if st := p.Status(); st.State != PeerStateDown || st.PathFailures != 1 {
+		t.Errorf("peer = %+v, want down after 1 path failure", st)
+	}
+	if echoes, _ := peers.Poll(now.Add(time.Hour)); len(echoes) != 0 {
+		t.Errorf("echoes = %v to a peer that is down", echoes)
+	}
+
+	// The peer is back once it sends again
+	peers.Seen("10.0.0.1:2123", now.Add(time.Hour))
+	if p.Status().State != PeerStateUp {
+		t.Error("peer still down after sending a message")
+	}
+}
+
+func TestGTPCPeerTableEchoPort(t *testing.T) {
+	peers := NewGTPCPeerTable()
+	start := time.Now()
+	peers.Seen("10.0.0.2:40000", start)
+
+	// Echo Requests go to the GTP-C port, not to the port the peer sent from
+	if echoes, _ := peers.Poll(start.Add(peers.EchoInterval)); len(echoes) != 1 || echoes[0] != "10.0.0.2:2123" {
+		t.Errorf("echoes = %v, want 10.0.0.2:2123", echoes)
+	}
+}
+
+func TestGTPCPeerTablePrune(t *testing.T) {
+	peers := NewGTPCPeerTable()
+	start := time.Now()
+	peers.Seen("10.0.0.1:2123", start)
+	peers.Seen("10.0.0.2:2123", start)
+	hasSessions := func(host string) bool { return host == "10.0.0.1" }
+
+	if pruned := peers.Prune(start.Add(time.Second), hasSessions); len(pruned) != 0 {
+		t.Errorf("pruned %v, want no peer before the echo interval", pruned)
+	}
+	pruned := peers.Prune(start.Add(peers.EchoInterval), hasSessions)
+	if len(pruned) != 1 || pruned[0] != "10.0.0.2" {
+		t.Errorf("pruned %v, want the peer without sessions", pruned)
+	}
+	if _, ok := peers.Get("10.0.0.2"); ok {
+		t.Error("pruned peer still in the table")
+	}
+	if _, ok := peers.Get("10.0.0.1"); !ok {
+		t.Error("peer with sessions pruned")
+	}
+}
@@ -0,0 +1,228 @@
+package smf
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// UEPrefixLength is the length of the IPv6 prefix delegated to each session
+const UEPrefixLength = 64
+
+// maxPrefixPoolBits bounds the number of /64 prefixes a pool tracks
+const maxPrefixPoolBits = 20
+
+// slotPool hands out numbered slots. Released slots are reused once the
+// rest of the pool has been handed out.
+type slotPool struct {
+	used []bool
+	next int
+	free int
+	mu   sync.Mutex
+}
+
+func newSlotPool(size int) slotPool {
+	return slotPool{used: make([]bool, size), free: size}
+}
+
+// allocate returns a free slot, or -1 when the pool is exhausted
+func (p *slotPool) allocate() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.free == 0 {
+		return -1
+	}
+	for i := 0; i < len(p.used); i++ {
+		idx := (p.next + i) % len(p.used)
+		if !p.used[idx] {
+			p.used[idx] = true
+			p.next = idx + 1
+			p.free--
+			return idx
+		}
+	}
+	return -1
+}
+
+func (p *slotPool) reserve(idx int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.used[idx] {
+		return false
+	}
+	p.used[idx] = true
+	p.free--
+	return true
+}
+
+func (p *slotPool) release(idx int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.used[idx] {
+		p.used[idx] = false
+		p.free++
+	}
+}
+
+// Free returns the number of unallocated addresses or prefixes
+func (p *slotPool) Free() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.free
+}
+
+// Size returns the number of addresses or prefixes of the pool
+func (p *slotPool) Size() int {
+	return len(p.used)
+}
+
+// IPPool allocates UE IPv4 addresses from a contiguous range
+type IPPool struct {
+	slotPool
+	first uint32
+}
+
+// NewIPPool creates a pool of the host addresses of an IPv4 prefix
+func NewIPPool(cidr string) (*IPPool, error) {
+	_, prefix, err := net.ParseCIDR(cidr)
+	if err != nil || prefix.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid IPv4 pool %q", cidr)
+	}
+	ones, bits := prefix.Mask.Size()
+	if bits-ones < 2 {
+		return nil, fmt.Errorf("pool %s has no host addresses", cidr)
+	}
+	network := binary.BigEndian.Uint32(prefix.IP.To4())
+	last := network | (1<<uint(bits-ones) - 1)
+	return newIPPool(network+1, last-1), nil
+}
+
+// NewIPPoolRange creates a pool of the addresses from start to end inclusive
+func NewIPPoolRange(start, end string) (*IPPool, error) {
+	s, e := net.ParseIP(start).To4(), net.ParseIP(end).To4()
+	if s == nil || e == nil || binary.BigEndian.Uint32(s) > binary.BigEndian.Uint32(e) {
+		return nil, fmt.Errorf("invalid IPv4 pool range %s-%s", start, end)
+	}
+	return newIPPool(binary.BigEndian.Uint32(s), binary.BigEndian.Uint32(e)), nil
+}
+
+func newIPPool(first, last uint32) *IPPool {
+	return &IPPool{slotPool: newSlotPool(int(last-first) + 1), first: first}
+}
+
+// Allocate returns a free address, or nil when the pool is exhausted
+func (p *IPPool) Allocate() net.IP {
+	idx := p.allocate()
+	if idx < 0 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, p.first+uint32(idx))
+	return ip
+}
+
+// Reserve marks an address as allocated, reporting whether it belongs to
+// the pool and was free
+func (p *IPPool) Reserve(ip net.IP) bool {
+	idx, ok := p.index(ip)
+	return ok && p.reserve(idx)
+}
+
+// Release returns an address to the pool
+func (p *IPPool) Release(ip net.IP) {
+	if idx, ok := p.index(ip); ok {
+		p.release(idx)
+	}
+}
+
+// Contains reports whether an address belongs to the pool
+func (p *IPPool) Contains(ip net.IP) bool {
+	_, ok := p.index(ip)
+	return ok
+}
+
+func (p *IPPool) index(ip net.IP) (int, bool) {
+	v4 := ip.To4()
+	if v4 == nil {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint32(v4)
+	if v < p.first || v-p.first >= uint32(len(p.used)) {
+		return 0, false
+	}
+	return int(v - p.first), true
+}
+
+// PrefixPool delegates a /64 of an IPv6 prefix to each session
+type PrefixPool struct {
+	slotPool
+	prefix net.IPNet
+	bits   int // bits between the pool prefix and the /64
+}
+
+// NewPrefixPool creates a pool of the /64 prefixes of an IPv6 prefix
+func NewPrefixPool(cidr string) (*PrefixPool, error) {
+	_, prefix, err := net.ParseCIDR(cidr)
+	if err != nil || prefix.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid IPv6 pool %q", cidr)
+	}
+	ones, _ := prefix.Mask.Size()
+	bits := UEPrefixLength - ones
+	if bits < 0 || bits > maxPrefixPoolBits {
+		return nil, fmt.Errorf("IPv6 pool %s must be a /%d to /%d", cidr, UEPrefixLength-maxPrefixPoolBits, UEPrefixLength)
+	}
+	return &PrefixPool{slotPool: newSlotPool(1 << uint(bits)), prefix: *prefix, bits: bits}, nil
+}
+
+// Allocate returns a free /64 with a random interface identifier the UE
+// uses for its link-local address, or nil when the pool is exhausted
+func (p *PrefixPool) Allocate() net.IP {
+	idx := p.allocate()
+	if idx < 0 {
+		return nil
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, p.prefix.IP)
+	hi := binary.BigEndian.Uint64(ip[:8]) | uint64(idx)
+	binary.BigEndian.PutUint64(ip[:8], hi)
+	if _, err := rand.Read(ip[8:]); err != nil {
+		ip[15] = 1
+	}
+	return ip
+}
+
+// Reserve marks the /64 of an address as allocated, reporting whether it
+// belongs to the pool and was free
+func (p *PrefixPool) Reserve(ip net.IP) bool {
+	idx, ok := p.index(ip)
+	return ok && p.reserve(idx)
+}
+
+// Release returns the /64 of an address to the pool
+func (p *PrefixPool) Release(ip net.IP) {
+	if idx, ok := p.index(ip); ok {
+		p.release(idx)
+	}
+}
+
+func (p *PrefixPool) index(ip net.IP) (int, bool) {
+	if ip.To4() != nil || len(ip) != net.IPv6len || !p.prefix.Contains(ip) {
+		return 0, false
+	}
+	hi := binary.BigEndian.Uint64(ip[:8])
+	return int(hi & (1<<uint(p.bits) - 1)), true
+}
+
+// UEPrefix returns the /64 delegated to a session from its IPv6 address
+func UEPrefix(ip net.IP) *net.IPNet {
+	if ip == nil || ip.To4() != nil {
+		return nil
+	}
+	mask := net.CIDRMask(UEPrefixLength, 128)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
@@ -0,0 +1,490 @@
+package smf
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// Delivery types of an interception task (ETSI TS 103 221-1 §6.2.1)
+const (
+	LIDeliveryX2Only  = "X2Only"
+	LIDeliveryX3Only  = "X3Only"
+	LIDeliveryX2andX3 = "X2andX3"
+)
+
+// LITask is an interception task activated over X1 (ETSI TS 103 221-1
+// §6.2). It targets one identity of the subscriber: the IMSI, the MSISDN or
+// the IMEI of the UE.
+type LITask struct {
+	XID          string `json:"xid" mapstructure:"xid"`
+	IMSI         string `json:"imsi,omitempty" mapstructure:"imsi"`
+	MSISDN       string `json:"msisdn,omitempty" mapstructure:"msisdn"`
+	IMEI         string `json:"imei,omitempty" mapstructure:"imei"`
+	DeliveryType string `json:"deliveryType" mapstructure:"delivery_type"`
+}
+
+// X2 reports whether the task delivers the IRI of the target's sessions
+func (t *LITask) X2() bool {
+	return t.DeliveryType != LIDeliveryX3Only
+}
+
+// X3 reports whether the task delivers the content of the target's sessions
+func (t *LITask) X3() bool {
+	return t.DeliveryType != LIDeliveryX2Only
+}
+
+// normalize validates a task, putting its XID and identities in the form
+// they are matched in and defaulting to X2 and X3 delivery
+func (t *LITask) normalize() error {
+	xid, err := uuid.Parse(t.XID)
+	if err != nil {
+		return fmt.Errorf("invalid xid %q: %w", t.XID, err)
+	}
+	t.XID = xid.String()
+
+	t.MSISDN = normalizeMSISDN(t.MSISDN)
+	t.IMEI = normalizeIMEI(t.IMEI)
+	targets := 0
+	for _, id := range []string{t.IMSI, t.MSISDN, t.IMEI} {
+		if id != "" {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return fmt.Errorf("task %s needs exactly one of imsi, msisdn and imei", t.XID)
+	}
+
+	switch t.DeliveryType {
+	case "":
+		t.DeliveryType = LIDeliveryX2andX3
+	case LIDeliveryX2Only, LIDeliveryX3Only, LIDeliveryX2andX3:
+	default:
+		return fmt.Errorf("invalid delivery type %q", t.DeliveryType)
+	}
+	return nil
+}
+
+// normalizeMSISDN strips the "msisdn-" GPSI prefix and the "+" of an E.164
+// number
+func normalizeMSISDN(s string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(s, "msisdn-"), "+")
+}
+
+// normalizeIMEI strips the "imei-" or "imeisv-" PEI prefix and keeps the
+// TAC and serial number, so an IMEI matches the IMEISV of the same device
+func normalizeIMEI(s string) string {
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "imeisv-"), "imei-")
+	if len(s) > 14 {
+		s = s[:14]
+	}
+	return s
+}
+
+// LITaskStore holds the active interception tasks by XID
+type LITaskStore struct {
+	tasks map[string]*LITask
+	mu    sync.RWMutex
+}
+
+// NewLITaskStore creates an empty task store
+func NewLITaskStore() *LITaskStore {
+	return &LITaskStore{tasks: make(map[string]*LITask)}
+}
+
+// Set activates a task or modifies the task with its XID and returns it
+// as stored
+func (s *LITaskStore) Set(t LITask) (LITask, error) {
+	if err := t.normalize(); err != nil {
+		return LITask{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tasks[t.XID] = &t
+	return t, nil
+}
+
+// Get returns the task with an XID
+func (s *LITaskStore) Get(xid string) (LITask, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.tasks[canonicalXID(xid)]
+	if !ok {
+		return LITask{}, false
+	}
+	return *t, true
+}
+
+// Delete deactivates the task with an XID
+func (s *LITaskStore) Delete(xid string) (LITask, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	xid = canonicalXID(xid)
+	t, ok := s.tasks[xid]
+	if !ok {
+		return LITask{}, false
+	}
+	delete(s.tasks, xid)
+	return *t, true
+}
+
+// Tasks returns the active tasks ordered by XID
+func (s *LITaskStore) Tasks() []LITask {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tasks := make([]LITask, 0, len(s.tasks))
+	for _, t := range s.tasks {
+		tasks = append(tasks, *t)
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].XID < tasks[j].XID })
+	return tasks
+}
+
+// Match returns the tasks targeting a subscriber's IMSI, MSISDN or IMEI,
+// ordered by XID
+func (s *LITaskStore) Match(imsi, msisdn, imei string) []LITask {
+	msisdn, imei = normalizeMSISDN(msisdn), normalizeIMEI(imei)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var tasks []LITask
+	for _, t := range s.tasks {
+		if (t.IMSI != "" && t.IMSI == imsi) || (t.MSISDN != "" && t.MSISDN == msisdn) || (t.IMEI != "" && t.IMEI == imei) {
+			tasks = append(tasks, *t)
+		}
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].XID < tasks[j].XID })
+	return tasks
+}
+
+// canonicalXID returns the form XIDs are stored in, or xid when it is not
+// a UUID
+func canonicalXID(xid string) string {
+	if u, err := uuid.Parse(xid); err == nil {
+		return u.String()
+	}
+	return xid
+}
+
+// X3Delivery asks the UPF to duplicate the user plane of a session to the
+// mediation function of an interception task. The Duplicating Parameters
+// carry the mediation function's address in the Outer Header Creation and
+// "<XID>/<Correlation ID>" as Forwarding Policy Identifier. The UPF connects
+// to the TCP port given in its UDP/IP form.
+type X3Delivery struct {
+	XID           string
+	CorrelationID uint64
+	Addr          *net.TCPAddr
+}
+
+// duplicatingParameters returns the children of a Duplicating Parameters IE
+func (d *X3Delivery) duplicatingParameters() []*ie.IE {
+	desc, v4, v6 := outerHeaderCreationUDPIPv4, d.Addr.IP.String(), ""
+	if d.Addr.IP.To4() == nil {
+		desc, v4, v6 = outerHeaderCreationUDPIPv6, "", d.Addr.IP.String()
+	}
+	return []*ie.IE{
+		ie.NewDestinationInterface(ie.DstInterfaceLIFunction),
+		ie.NewOuterHeaderCreation(desc, 0, v4, v6, uint16(d.Addr.Port), 0, 0),
+		ie.NewForwardingPolicy(d.XID + "/" + strconv.FormatUint(d.CorrelationID, 10)),
+	}
+}
+
+// X2/X3 PDU types (ETSI TS 103 221-2 §5.2.2)
+const (
+	XPDUTypeX2           uint16 = 1
+	XPDUTypeX3           uint16 = 2
+	XPDUTypeKeepalive    uint16 = 3
+	XPDUTypeKeepaliveAck uint16 = 4
+)
+
+// Payload formats (§5.2.4) and directions (§5.2.5) of X2/X3 PDUs
+const (
+	XPayloadFormatProprietary uint16 = 4
+	XPayloadFormatIPv4        uint16 = 5
+	XPayloadFormatIPv6        uint16 = 6
+	XDirectionNotApplicable   uint16 = 5
+)
+
+// Header fields of an X2/X3 PDU: the version, the fixed part of the header
+// and the types of the conditional attributes sent (§5.3)
+const (
+	xpduVersion        uint16 = 5
+	xpduFixedLen              = 40
+	attrSequenceNumber uint16 = 8
+	attrTimestamp      uint16 = 9
+)
+
+// XPDU is an X2 or X3 PDU (ETSI TS 103 221-2 §5). The sequence number and
+// timestamp are sent as conditional attributes.
+type XPDU struct {
+	Type          uint16
+	PayloadFormat uint16
+	Direction     uint16
+	XID           uuid.UUID
+	CorrelationID uint64
+	Sequence      uint32
+	Timestamp     time.Time
+	Payload       []byte
+}
+
+// Marshal encodes the PDU
+func (p *XPDU) Marshal() []byte {
+	attrs := 0
+	if p.Type == XPDUTypeX2 || p.Type == XPDUTypeX3 {
+		attrs = 8 + 12
+	}
+	b := make([]byte, 0, xpduFixedLen+attrs+len(p.Payload))
+	b = binary.BigEndian.AppendUint16(b, xpduVersion)
+	b = binary.BigEndian.AppendUint16(b, p.Type)
+	b = binary.BigEndian.AppendUint32(b, uint32(xpduFixedLen+attrs))
+	b = binary.BigEndian.AppendUint32(b, uint32(len(p.Payload)))
+	b = binary.BigEndian.AppendUint16(b, p.PayloadFormat)
+	b = binary.BigEndian.AppendUint16(b, p.Direction)
+	b = append(b, p.XID[:]...)
+	b = binary.BigEndian.AppendUint64(b, p.CorrelationID)
+	if attrs > 0 {
+		b = binary.BigEndian.AppendUint16(b, attrSequenceNumber)
+		b = binary.BigEndian.AppendUint16(b, 4)
+		b = binary.BigEndian.AppendUint32(b, p.Sequence)
+		b = binary.BigEndian.AppendUint16(b, attrTimestamp)
+		b = binary.BigEndian.AppendUint16(b, 8)
+		b = binary.BigEndian.AppendUint32(b, uint32(p.Timestamp.Unix()))
+		b = binary.BigEndian.AppendUint32(b, uint32(p.Timestamp.Nanosecond()))
+	}
+	return append(b, p.Payload...)
+}
+
+// ReadXPDU reads a PDU, keeping the sequence number and timestamp of its
+// conditional attributes
+func ReadXPDU(r io.Reader) (*XPDU, error) {
+	header := make([]byte, xpduFixedLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if v := binary.BigEndian.Uint16(header); v != xpduVersion {
+		return nil, fmt.Errorf("unsupported PDU version %d", v)
+	}
+	headerLen := binary.BigEndian.Uint32(header[4:])
+	if headerLen < xpduFixedLen {
+		return nil, fmt.Errorf("invalid PDU header length %d", headerLen)
+	}
+	p := &XPDU{
+		Type:          binary.BigEndian.Uint16(header[2:]),
+		PayloadFormat: binary.BigEndian.Uint16(header[12:]),
+		Direction:     binary.BigEndian.Uint16(header[14:]),
+		CorrelationID: binary.BigEndian.Uint64(header[32:]),
+	}
+	copy(p.XID[:], header[16:32])
+
+	rest := make([]byte, int(headerLen-xpduFixedLen)+int(binary.BigEndian.Uint32(header[8:])))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	attrs := rest[:headerLen-xpduFixedLen]
+	p.Payload = rest[headerLen-xpduFixedLen:]
+	for len(attrs) >= 4 {
+		t, l := binary.BigEndian.Uint16(attrs), int(binary.BigEndian.Uint16(attrs[2:]))
+		if len(attrs) < 4+l {
+			return nil, fmt.Errorf("truncated PDU attribute %d", t)
+		}
+		v := attrs[4 : 4+l]
+		switch {
+		case t == attrSequenceNumber && l == 4:
+			p.Sequence = binary.BigEndian.Uint32(v)
+		case t == attrTimestamp && l == 8:
+			p.Timestamp = time.Unix(int64(binary.BigEndian.Uint32(v)), int64(binary.BigEndian.Uint32(v[4:])))
+		}
+		attrs = attrs[4+l:]
+	}
+	return p, nil
+}
+
+// Events of the IRI records the SMF reports over X2 (TS 33.128 §6.2.3)
+const (
+	IRIPDUSessionEstablishment = "SMFPDUSessionEstablishment"
+	IRIPDUSessionModification  = "SMFPDUSessionModification"
+	IRIPDUSessionRelease       = "SMFPDUSessionRelease"
+	IRIStartOfInterception     = "SMFStartOfInterceptionWithEstablishedPDUSession"
+)
+
+// IRIRecord is the X2 payload of a PDU session event, a JSON rendering of
+// the SMF records of TS 33.128 §6.2.3 sent as a proprietary payload
+type IRIRecord struct {
+	Event        string    `json:"event"`
+	Timestamp    time.Time `json:"timestamp"`
+	SUPI         string    `json:"supi"`
+	GPSI         string    `json:"gpsi,omitempty"`
+	PEI          string    `json:"pei,omitempty"`
+	PDUSessionID uint8     `json:"pduSessionId,omitempty"`
+	EPSBearerID  uint8     `json:"epsBearerId,omitempty"`
+	DNN          string    `json:"dnn,omitempty"`
+	SNSSAI       *SNSSAI   `json:"sNSSAI,omitempty"`
+	UEIPv4       net.IP    `json:"ueIPv4Address,omitempty"`
+	UEIPv6       net.IP    `json:"ueIPv6Address,omitempty"`
+	Location     string    `json:"tai,omitempty"`
+	UPF          string    `json:"upf,omitempty"`
+	Cause        string    `json:"cause,omitempty"`
+}
+
+// X2PDU returns the X2 PDU reporting a record to a task
+func (r *IRIRecord) X2PDU(xid string, correlationID uint64) (*XPDU, error) {
+	id, err := uuid.Parse(xid)
+	if err != nil {
+		return nil, fmt.Errorf("invalid xid %q: %w", xid, err)
+	}
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal IRI record: %w", err)
+	}
+	return &XPDU{
+		Type:          XPDUTypeX2,
+		PayloadFormat: XPayloadFormatProprietary,
+		Direction:     XDirectionNotApplicable,
+		XID:           id,
+		CorrelationID: correlationID,
+		Timestamp:     r.Timestamp,
+		Payload:       payload,
+	}, nil
+}
+
+// The PDUs of a mediation function are queued up to xQueueLen while the
+// connection to it is down or slow. Idle connections are kept alive with
+// Keepalive PDUs.
+const (
+	xQueueLen          = 1024
+	xDialTimeout       = 5 * time.Second
+	xKeepaliveInterval = 30 * time.Second
+	xMaxBackoff        = 30 * time.Second
+)
+
+// XClient delivers X2 PDUs to a mediation function over TCP, in order,
+// numbering them per XID and reconnecting when the connection drops
+type XClient struct {
+	addr    string
+	queue   chan *XPDU
+	dropped atomic.Uint64
+
+	mu  sync.Mutex
+	seq map[uuid.UUID]uint32
+}
+
+// NewXClient creates a client of the mediation function at addr
+func NewXClient(addr string) *XClient {
+	return &XClient{
+		addr:  addr,
+		queue: make(chan *XPDU, xQueueLen),
+		seq:   make(map[uuid.UUID]uint32),
+	}
+}
+
+// Send numbers a PDU and queues it, reporting false when the queue is full
+func (c *XClient) Send(p *XPDU) bool {
+	c.mu.Lock()
+	c.seq[p.XID]++
+	p.Sequence = c.seq[p.XID]
+	c.mu.Unlock()
+	if p.Timestamp.IsZero() {
+		p.Timestamp = time.Now()
+	}
+
+	select {
+	case c.queue <- p:
+		return true
+	default:
+		c.dropped.Add(1)
+		return false
+	}
+}
+
+// Run keeps the connection up and writes the queued PDUs until ctx is done
+func (c *XClient) Run(ctx context.Context) {
+	backoff := time.Second
+	var pending []byte
+	for {
+		var d net.Dialer
+		dialCtx, cancel := context.WithTimeout(ctx, xDialTimeout)
+		conn, err := d.DialContext(dialCtx, "tcp", c.addr)
+		cancel()
+		if err == nil {
+			backoff = time.Second
+			log.Printf("[LI] Connected to mediation function %s", c.addr)
+			pending, err = c.serve(ctx, conn, pending)
+			conn.Close()
+		}
+		if err != nil && ctx.Err() == nil {
+			log.Printf("[LI] Delivery to mediation function %s failed: %v", c.addr, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > xMaxBackoff {
+			backoff = xMaxBackoff
+		}
+	}
+}
+
+// serve writes the queued PDUs to a connection, starting with one whose
+// write failed before, and returns the PDU it failed to write
+func (c *XClient) serve(ctx context.Context, conn net.Conn, pending []byte) ([]byte, error) {
+	acks := make(chan uint64, 1)
+	closed := make(chan error, 1)
+	go func() {
+		for {
+			p, err := ReadXPDU(conn)
+			if err != nil {
+				closed <- err
+				return
+			}
+			if p.Type == XPDUTypeKeepalive {
+				select {
+				case acks <- p.CorrelationID:
+				default:
+				}
+			}
+		}
+	}()
+
+	keepalive := time.NewTicker(xKeepaliveInterval)
+	defer keepalive.Stop()
+	var keepaliveSeq uint64
+	for {
+		if pending != nil {
+			if _, err := conn.Write(pending); err != nil {
+				return pending, err
+			}
+			pending = nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case err := <-closed:
+			return nil, err
+		case p := <-c.queue:
+			pending = p.Marshal()
+		case seq := <-acks:
+			pending = (&XPDU{Type: XPDUTypeKeepaliveAck, CorrelationID: seq}).Marshal()
+		case <-keepalive.C:
+			if n := c.dropped.Swap(0); n > 0 {
+				log.Printf("[LI] Dropped %d PDUs to mediation function %s with the queue full", n, c.addr)
+			}
+			keepaliveSeq++
+			pending = (&XPDU{Type: XPDUTypeKeepalive, CorrelationID: keepaliveSeq}).Marshal()
+		}
+	}
+}
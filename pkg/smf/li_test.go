@@ -0,0 +1,193 @@
+package smf
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+const testXID = "5B2F3C8E-1F4A-4D6B-9C2E-7A1B3C5D7E9F"
+
+func TestLITaskStore(t *testing.T) {
+	s := NewLITaskStore()
+	task, err := s.Set(LITask{XID: testXID, MSISDN: "+33612345678"})
+	if err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	if task.XID != "5b2f3c8e-1f4a-4d6b-9c2e-7a1b3c5d7e9f" || task.MSISDN != "33612345678" || task.DeliveryType != LIDeliveryX2andX3 {
+		t.Errorf("Set() = %+v, want a normalized task", task)
+	}
+	if _, err := s.Set(LITask{XID: uuid.NewString(), IMEI: "imeisv-3569870412345601", DeliveryType: LIDeliveryX2Only}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, bad := range []LITask{
+		{XID: "task-1", IMSI: "001010000000001"},
+		{XID: uuid.NewString()},
+		{XID: uuid.NewString(), IMSI: "001010000000001", MSISDN: "33612345678"},
+		{XID: uuid.NewString(), IMSI: "001010000000001", DeliveryType: "X4"},
+	} {
+		if _, err := s.Set(bad); err == nil {
+			t.Errorf("Set(%+v) succeeded, want an error", bad)
+		}
+	}
+
+	// An IMEI matches the IMEISV of the same device and a GPSI its MSISDN
+	if got := s.Match("001010000000001", "msisdn-33612345678", "35698704123456"); len(got) != 2 {
+		t.Errorf("Match() = %+v, want both tasks", got)
+	}
+	if got := s.Match("001010000000001", "", ""); len(got) != 0 {
+		t.Errorf("Match() = %+v, want none", got)
+	}
+
+	if _, ok := s.Delete(testXID); !ok {
+		t.Fatal("Delete() found no task")
+	}
+	if _, ok := s.Get(testXID); ok || len(s.Tasks()) != 1 {
+		t.Errorf("Tasks() = %+v after Delete()", s.Tasks())
+	}
+}
+
+func TestXPDUMarshal(t *testing.T) {
+	r := &IRIRecord{
+		Event:     IRIPDUSessionEstablishment,
+		Timestamp: time.Unix(1700000000, 123),
+		SUPI:      "imsi-001010000000001",
+		DNN:       "internet",
+		UEIPv4:    net.IPv4(10, 0, 0, 1),
+	}
+	p, err := r.X2PDU(testXID, 42)
+	if err != nil {
+		t.Fatalf("X2PDU() error = %v", err)
+	}
+	p.Sequence = 7
+	b := p.Marshal()
+	if len(b) != xpduFixedLen+20+len(p.Payload) {
+		t.Fatalf("Marshal() = %d bytes", len(b))
+	}
+
+	got, err := ReadXPDU(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("ReadXPDU() error = %v", err)
+	}
+	if got.Type != XPDUTypeX2 || got.PayloadFormat != XPayloadFormatProprietary || got.XID != p.XID ||
+		got.CorrelationID != 42 || got.Sequence != 7 || !got.Timestamp.Equal(r.Timestamp) {
+		t.Errorf("ReadXPDU() = %+v, want %+v", got, p)
+	}
+	var record IRIRecord
+	if err := json.Unmarshal(got.Payload, &record); err != nil || record.Event != IRIPDUSessionEstablishment || record.SUPI != r.SUPI {
+		t.Errorf("payload = %s, %v", got.Payload, err)
+	}
+}
+
+func TestSessionRulesDuplication(t *testing.T) {
+	rules := &SessionRules{
+		UEIP:     net.IPv4(10, 0, 0, 1),
+		DNN:      "internet",
+		UPFTEID:  1,
+		UPFAddr:  net.IPv4(192, 168, 0, 1),
+		PeerTEID: 2,
+		PeerAddr: net.IPv4(192, 168, 0, 2),
+		X3: []X3Delivery{{
+			XID:           "5b2f3c8e-1f4a-4d6b-9c2e-7a1b3c5d7e9f",
+			CorrelationID: 42,
+			Addr:          &net.TCPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 9000},
+		}},
+	}
+
+	var fars int
+	for _, i := range rules.EstablishmentIEs() {
+		if i.Type != ie.CreateFAR {
+			continue
+		}
+		fars++
+		children, err := i.CreateFAR()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var action uint8
+		var policy string
+		var dest uint8
+		for _, c := range children {
+			switch c.Type {
+			case ie.ApplyAction:
+				flags, _ := c.ApplyAction()
+				action = flags[0]
+			case ie.DuplicatingParameters:
+				params, _ := c.DuplicatingParameters()
+				for _, p := range params {
+					switch p.Type {
+					case ie.ForwardingPolicy:
+						policy, _ = p.ForwardingPolicyIdentifier()
+					case ie.DestinationInterface:
+						dest, _ = p.DestinationInterface()
+					}
+				}
+			}
+		}
+		if action != ApplyActionFORW|ApplyActionDUPL || dest != ie.DstInterfaceLIFunction ||
+			policy != "5b2f3c8e-1f4a-4d6b-9c2e-7a1b3c5d7e9f/42" {
+			t.Errorf("FAR action %#x, destination %d, policy %q, want duplication to the LI function", action, dest, policy)
+		}
+	}
+	if fars != 2 {
+		t.Errorf("FARs = %d, want 2", fars)
+	}
+
+	// Without tasks the updates stop the duplication
+	rules.X3 = nil
+	children, err := rules.UplinkFARUpdate().UpdateFAR()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range children {
+		if flags, err := c.ApplyAction(); c.Type == ie.ApplyAction && (err != nil || flags[0] != ApplyActionFORW) {
+			t.Errorf("uplink FAR update action = %v, %v, want FORW", flags, err)
+		}
+		if c.Type == ie.UpdateDuplicatingParameters {
+			t.Error("uplink FAR update duplicates without tasks")
+		}
+	}
+}
+
+func TestXClient(t *testing.T) {
+	mdf, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdf.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	c := NewXClient(mdf.Addr().String())
+	go c.Run(ctx)
+
+	xid := uuid.MustParse(testXID)
+	for i := 0; i < 2; i++ {
+		if !c.Send(&XPDU{Type: XPDUTypeX2, XID: xid, CorrelationID: 1, Payload: []byte("iri")}) {
+			t.Fatal("Send() queue full")
+		}
+	}
+
+	conn, err := mdf.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for want := uint32(1); want <= 2; want++ {
+		p, err := ReadXPDU(conn)
+		if err != nil {
+			t.Fatalf("ReadXPDU() error = %v", err)
+		}
+		if p.Sequence != want || p.XID != xid || string(p.Payload) != "iri" || p.Timestamp.IsZero() {
+			t.Errorf("PDU = %+v, want sequence number %d", p, want)
+		}
+	}
+}
@@ -0,0 +1,361 @@
+package smf
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// 5GS session management messages (TS 24.501 §8.3)
+const (
+	EPD5GSM uint8 = 0x2e
+
+	MsgTypePDUSessionEstablishmentRequest uint8 = 0xc1
+	MsgTypePDUSessionEstablishmentAccept  uint8 = 0xc2
+	MsgTypePDUSessionEstablishmentReject  uint8 = 0xc3
+)
+
+// PDU session types (TS 24.501 §9.11.4.11)
+const (
+	PDUSessionTypeIPv4         uint8 = 1
+	PDUSessionTypeIPv6         uint8 = 2
+	PDUSessionTypeIPv4v6       uint8 = 3
+	PDUSessionTypeUnstructured uint8 = 4
+	PDUSessionTypeEthernet     uint8 = 5
+)
+
+// 5GSM causes (TS 24.501 §9.11.4.2)
+const (
+	Cause5GSMInsufficientResources         uint8 = 26
+	Cause5GSMUserAuthenticationFailed      uint8 = 29
+	Cause5GSMMissingOrUnknownDNN           uint8 = 27
+	Cause5GSMUnknownPDUSessionType         uint8 = 28
+	Cause5GSMRequestRejectedUnspecified    uint8 = 31
+	Cause5GSMPDUSessionTypeIPv4OnlyAllowed uint8 = 50
+	Cause5GSMPDUSessionTypeIPv6OnlyAllowed uint8 = 51
+	Cause5GSMNotSupportedSSCMode           uint8 = 68
+	Cause5GSMInsufficientResourcesForSlice uint8 = 69
+	Cause5GSMInvalidMandatoryInformation   uint8 = 96
+	Cause5GSMProtocolErrorUnspecified      uint8 = 111
+)
+
+// Optional IEIs of the PDU Session Establishment Request and Accept
+const (
+	ieiPDUSessionType      uint8 = 0x90
+	ieiSSCMode             uint8 = 0xa0
+	ieiMaxPacketFilters    uint8 = 0x55
+	ieiPDUAddress          uint8 = 0x29
+	ieiCause5GSM           uint8 = 0x59
+	ieiSNSSAI              uint8 = 0x22
+	ieiQoSFlowDescriptions uint8 = 0x79
+	ieiExtendedPCO         uint8 = 0x7b
+	ieiDNN                 uint8 = 0x25
+)
+
+// ErrInvalidNAS is returned for malformed 5GSM messages
+var ErrInvalidNAS = errors.New("invalid 5GSM message")
+
+// PDUSessionEstablishmentRequest is the UE's request carried in the N1 SM container
+type PDUSessionEstablishmentRequest struct {
+	PDUSessionID   uint8
+	PTI            uint8
+	PDUSessionType uint8 // 0 when not requested
+	SSCMode        uint8 // 0 when not requested
+	ExtendedPCO    []byte
+}
+
+// ParsePDUSessionEstablishmentRequest decodes a PDU Session Establishment Request
+func ParsePDUSessionEstablishmentRequest(b []byte) (*PDUSessionEstablishmentRequest, error) {
+	// EPD, PDU session ID, PTI, message type, integrity protection maximum data rate
+	if len(b) < 6 || b[0] != EPD5GSM || b[3] != MsgTypePDUSessionEstablishmentRequest {
+		return nil, ErrInvalidNAS
+	}
+	req := &PDUSessionEstablishmentRequest{PDUSessionID: b[1], PTI: b[2]}
+
+	for off := 6; off < len(b); {
+		iei := b[off]
+
+		// Type 1 IEs carry their value in the low half-octet
+		if iei >= 0x80 {
+			switch iei & 0xf0 {
+			case ieiPDUSessionType:
+				req.PDUSessionType = iei & 0x07
+			case ieiSSCMode:
+				req.SSCMode = iei & 0x07
+			}
+			off++
+			continue
+		}
+
+		var value []byte
+		switch {
+		case iei == ieiMaxPacketFilters:
+			if off+3 > len(b) {
+				return nil, ErrInvalidNAS
+			}
+			off += 3
+			continue
+		case iei&0xf0 == 0x70:
+			// TLV-E
+			if off+3 > len(b) {
+				return nil, ErrInvalidNAS
+			}
+			l := int(binary.BigEndian.Uint16(b[off+1:]))
+			if off+3+l > len(b) {
+				return nil, ErrInvalidNAS
+			}
+			value = b[off+3 : off+3+l]
+			off += 3 + l
+		default:
+			if off+2 > len(b) {
+				return nil, ErrInvalidNAS
+			}
+			l := int(b[off+1])
+			if off+2+l > len(b) {
+				return nil, ErrInvalidNAS
+			}
+			value = b[off+2 : off+2+l]
+			off += 2 + l
+		}
+
+		if iei == ieiExtendedPCO {
+			req.ExtendedPCO = append([]byte(nil), value...)
+		}
+	}
+	return req, nil
+}
+
+// PDUSessionEstablishmentAccept is the SMF's answer to an accepted establishment
+type PDUSessionEstablishmentAccept struct {
+	PDUSessionID   uint8
+	PTI            uint8
+	PDUSessionType uint8
+	SSCMode        uint8
+	UEIP           net.IP
+	UEIPv6         net.IP // the UE takes its interface identifier from it
+	Cause          uint8  // 5GSM cause when a different session type was granted
+
+	// Default QoS flow
+	QFI    uint8
+	FiveQI uint8
+	AMBRUL uint64 // bps
+	AMBRDL uint64 // bps
+	SNSSAI *SNSSAI
+	DNN    string
+	ExtPCO []byte
+
+	// Dedicated QoS flows authorized at establishment
+	Flows []*QoSFlow
+}
+
+// Marshal encodes the accept message
+func (a *PDUSessionEstablishmentAccept) Marshal() []byte {
+	b := []byte{
+		EPD5GSM, a.PDUSessionID, a.PTI, MsgTypePDUSessionEstablishmentAccept,
+		a.SSCMode<<4 | a.PDUSessionType&0x07,
+	}
+
+	// Authorized QoS rules: the default rule matching all traffic on the
+	// default flow, then one rule per dedicated flow
+	rules := []byte{
+		0x01,       // QoS rule identifier
+		0x00, 0x06, // length of QoS rule
+		0x31,             // create new QoS rule, default rule, one packet filter
+		0x31, 0x01, 0x01, // bidirectional filter 1 matching all packets
+		0xff,         // precedence
+		a.QFI & 0x3f, // QFI
+	}
+	for i, flow := range a.Flows {
+		rules = append(rules, encodeQoSRule(uint8(i+2), flow)...)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rules)))
+	b = append(b, rules...)
+
+	// Session-AMBR in multiples of 1 Mbps
+	b = append(b, 6, 0x06)
+	b = binary.BigEndian.AppendUint16(b, mbps(a.AMBRDL))
+	b = append(b, 0x06)
+	b = binary.BigEndian.AppendUint16(b, mbps(a.AMBRUL))
+
+	if a.Cause != 0 {
+		b = append(b, ieiCause5GSM, a.Cause)
+	}
+	b = append(b, encodePDUAddress(a.UEIP, a.UEIPv6)...)
+	if a.SNSSAI != nil {
+		b = append(b, ieiSNSSAI)
+		b = append(b, encodeSNSSAI(*a.SNSSAI)...)
+	}
+
+	// Authorized QoS flow descriptions carrying the 5QI and bit rates of each flow
+	desc := []byte{a.QFI & 0x3f, 0x20, 0x41, 0x01, 0x01, a.FiveQI}
+	for _, flow := range a.Flows {
+		desc = append(desc, encodeQoSFlowDescription(flow)...)
+	}
+	b = append(b, ieiQoSFlowDescriptions)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(desc)))
+	b = append(b, desc...)
+
+	if len(a.ExtPCO) > 0 {
+		b = append(b, ieiExtendedPCO)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(a.ExtPCO)))
+		b = append(b, a.ExtPCO...)
+	}
+	if a.DNN != "" {
+		dnn := encodeDNN(a.DNN)
+		b = append(b, ieiDNN, uint8(len(dnn)))
+		b = append(b, dnn...)
+	}
+	return b
+}
+
+// encodePDUAddress encodes the PDU address IE (TS 24.501 §9.11.4.10). For
+// IPv6 it carries only the interface identifier; the UE learns its /64
+// from the Router Advertisements of the UPF.
+func encodePDUAddress(v4, v6 net.IP) []byte {
+	ip4 := v4.To4()
+	var iid []byte
+	if v6 != nil && v6.To4() == nil {
+		iid = v6.To16()[8:]
+	}
+	switch {
+	case ip4 != nil && iid != nil:
+		b := []byte{ieiPDUAddress, 13, PDUSessionTypeIPv4v6}
+		return append(append(b, iid...), ip4...)
+	case iid != nil:
+		return append([]byte{ieiPDUAddress, 9, PDUSessionTypeIPv6}, iid...)
+	case ip4 != nil:
+		return append([]byte{ieiPDUAddress, 5, PDUSessionTypeIPv4}, ip4...)
+	}
+	return nil
+}
+
+// NewPDUSessionEstablishmentReject encodes a reject with the given 5GSM cause
+func NewPDUSessionEstablishmentReject(psi, pti, cause uint8) []byte {
+	return []byte{EPD5GSM, psi, pti, MsgTypePDUSessionEstablishmentReject, cause}
+}
+
+// encodeQoSRule encodes the QoS rule binding the packet filters of a
+// dedicated flow's PCC rule to its QFI (TS 24.501 §9.11.4.13)
+func encodeQoSRule(id uint8, flow *QoSFlow) []byte {
+	var filters []byte
+	n := 0
+	for _, fd := range flow.Rule.FlowDescriptions {
+		f, err := parseFlowFilter(fd)
+		if err != nil || n == 15 {
+			continue
+		}
+		n++
+		contents := f.packetFilterComponents()
+		filters = append(filters, 0x30|uint8(n), uint8(len(contents)))
+		filters = append(filters, contents...)
+	}
+
+	precedence := flow.Rule.Precedence
+	if precedence >= 255 {
+		precedence = 254
+	}
+	rule := []byte{0x20 | uint8(n)} // create new QoS rule, not the default rule
+	rule = append(rule, filters...)
+	rule = append(rule, uint8(precedence), flow.QFI&0x3f)
+
+	b := []byte{id}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(rule)))
+	return append(b, rule...)
+}
+
+// packetFilterComponents encodes a flow filter as NAS packet filter components
+func (f *flowFilter) packetFilterComponents() []byte {
+	var b []byte
+	if f.remote != nil {
+		b = append(b, 0x10)
+		b = append(b, f.remote.IP.To4()...)
+		b = append(b, net.IP(f.remote.Mask).To4()...)
+	}
+	if f.protocol != 0 {
+		b = append(b, 0x30, f.protocol)
+	}
+	b = appendPortComponent(b, 0x40, f.localPorts)
+	b = appendPortComponent(b, 0x50, f.remotePorts)
+	if len(b) == 0 {
+		b = append(b, 0x01) // match-all
+	}
+	return b
+}
+
+// appendPortComponent appends a single port or port range component, whose
+// type is the single port type plus one
+func appendPortComponent(b []byte, singleType uint8, ports [2]uint16) []byte {
+	switch {
+	case ports[0] == 0 && ports[1] == 0:
+		return b
+	case ports[0] == ports[1]:
+		return binary.BigEndian.AppendUint16(append(b, singleType), ports[0])
+	default:
+		b = binary.BigEndian.AppendUint16(append(b, singleType+1), ports[0])
+		return binary.BigEndian.AppendUint16(b, ports[1])
+	}
+}
+
+// encodeQoSFlowDescription encodes the description of a dedicated flow with
+// its 5QI and, for GBR flows, its bit rates (TS 24.501 §9.11.4.12)
+func encodeQoSFlowDescription(flow *QoSFlow) []byte {
+	params := []byte{0x01, 0x01, flow.QoS.QCI}
+	n := uint8(1)
+	for _, p := range []struct {
+		id  uint8
+		bps uint64
+	}{
+		{0x02, flow.QoS.GuaranteedBitRateUL},
+		{0x03, flow.QoS.GuaranteedBitRateDL},
+		{0x04, flow.QoS.MaxBitRateUL},
+		{0x05, flow.QoS.MaxBitRateDL},
+	} {
+		if p.bps == 0 {
+			continue
+		}
+		unit, v := nasBitRate(p.bps)
+		params = append(params, p.id, 3, unit)
+		params = binary.BigEndian.AppendUint16(params, v)
+		n++
+	}
+	return append([]byte{flow.QFI & 0x3f, 0x20, 0x40 | n}, params...)
+}
+
+// nasBitRate returns a bit rate in multiples of 1 Kbps, or of 1 Mbps when
+// it does not fit the 16 bit field
+func nasBitRate(bps uint64) (uint8, uint16) {
+	if v := (bps + 999) / 1000; v <= 0xffff {
+		return 0x01, uint16(v)
+	}
+	return 0x06, mbps(bps)
+}
+
+// mbps converts a bit rate to whole Mbps, saturating at the field size
+func mbps(bps uint64) uint16 {
+	v := bps / 1_000_000
+	if v > 0xffff {
+		return 0xffff
+	}
+	return uint16(v)
+}
+
+// encodeSNSSAI returns the length and value of an S-NSSAI IE
+func encodeSNSSAI(s SNSSAI) []byte {
+	sd, err := strconv.ParseUint(s.SD, 16, 24)
+	if err != nil || len(s.SD) != 6 {
+		return []byte{1, s.SST}
+	}
+	return []byte{4, s.SST, byte(sd >> 16), byte(sd >> 8), byte(sd)}
+}
+
+// encodeDNN encodes a DNN as length-prefixed labels (TS 23.003 §9.1)
+func encodeDNN(dnn string) []byte {
+	var b []byte
+	for _, label := range strings.Split(dnn, ".") {
+		b = append(b, uint8(len(label)))
+		b = append(b, label...)
+	}
+	return b
+}
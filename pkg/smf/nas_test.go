@@ -0,0 +1,86 @@
+package smf
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestParsePDUSessionEstablishmentRequest(t *testing.T) {
+	// PSI 5, PTI 1, max data rate, IPv4, SSC mode 1, 5GSM capability, ePCO
+	b := []byte{0x2e, 0x05, 0x01, 0xc1, 0xff, 0xff, 0x91, 0xa1, 0x28, 0x01, 0x00, 0x7b, 0x00, 0x02, 0x80, 0x00}
+	req, err := ParsePDUSessionEstablishmentRequest(b)
+	if err != nil {
+		t.Fatalf("ParsePDUSessionEstablishmentRequest() error = %v", err)
+	}
+	if req.PDUSessionID != 5 || req.PTI != 1 {
+		t.Errorf("PSI/PTI = %d/%d, want 5/1", req.PDUSessionID, req.PTI)
+	}
+	if req.PDUSessionType != PDUSessionTypeIPv4 || req.SSCMode != 1 {
+		t.Errorf("type/SSC = %d/%d, want 1/1", req.PDUSessionType, req.SSCMode)
+	}
+	if !bytes.Equal(req.ExtendedPCO, []byte{0x80, 0x00}) {
+		t.Errorf("ExtendedPCO = %x, want 8000", req.ExtendedPCO)
+	}
+
+	if _, err := ParsePDUSessionEstablishmentRequest(b[:len(b)-1]); err == nil {
+		t.Error("truncated request: error = nil")
+	}
+}
+
+func TestPDUSessionEstablishmentAcceptMarshal(t *testing.T) {
+	accept := &PDUSessionEstablishmentAccept{
+		PDUSessionID:   5,
+		PTI:            1,
+		PDUSessionType: PDUSessionTypeIPv4,
+		SSCMode:        1,
+		UEIP:           []byte{10, 0, 0, 1},
+		QFI:            1,
+		FiveQI:         9,
+		AMBRUL:         100_000_000,
+		AMBRDL:         200_000_000,
+		SNSSAI:         &SNSSAI{SST: 1, SD: "000001"},
+		DNN:            "internet",
+	}
+	b := accept.Marshal()
+
+	header := []byte{0x2e, 0x05, 0x01, 0xc2, 0x11, 0x00, 0x09}
+	if !bytes.HasPrefix(b, header) {
+		t.Fatalf("Marshal() header = %x, want %x", b[:len(header)], header)
+	}
+	ambr := []byte{0x06, 0x06, 0x00, 0xc8, 0x06, 0x00, 0x64}
+	if !bytes.Contains(b, ambr) {
+		t.Errorf("Marshal() = %x, missing Session-AMBR %x", b, ambr)
+	}
+	for name, ie := range map[string][]byte{
+		"PDU address": {0x29, 0x05, 0x01, 10, 0, 0, 1},
+		"S-NSSAI":     {0x22, 0x04, 0x01, 0x00, 0x00, 0x01},
+		"DNN":         append([]byte{0x25, 0x09, 0x08}, "internet"...),
+	} {
+		if !bytes.Contains(b, ie) {
+			t.Errorf("Marshal() = %x, missing %s %x", b, name, ie)
+		}
+	}
+}
+
+func TestEncodePDUAddress(t *testing.T) {
+	v4 := net.IPv4(10, 0, 0, 1)
+	v6 := net.ParseIP("2001:db8:0:1:a:b:c:d")
+	iid := []byte{0, 0x0a, 0, 0x0b, 0, 0x0c, 0, 0x0d}
+
+	tests := []struct {
+		name   string
+		v4, v6 net.IP
+		want   []byte
+	}{
+		{"ipv4", v4, nil, []byte{0x29, 5, 1, 10, 0, 0, 1}},
+		{"ipv6", nil, v6, append([]byte{0x29, 9, 2}, iid...)},
+		{"ipv4v6", v4, v6, append(append([]byte{0x29, 13, 3}, iid...), 10, 0, 0, 1)},
+		{"none", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		if got := encodePDUAddress(tt.v4, tt.v6); !bytes.Equal(got, tt.want) {
+			t.Errorf("%s: encodePDUAddress() = %x, want %x", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package smf
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// NGAP protocol IE identifiers of the PDU session resource transfers (TS 38.413 §9.4)
+const (
+	ngapIDPDUSessionAggregateMaximumBitRate uint16 = 130
+	ngapIDPDUSessionType                    uint16 = 134
+	ngapIDQosFlowSetupRequestList           uint16 = 136
+	ngapIDULNGUUPTNLInformation             uint16 = 139
+)
+
+// NGAP PDUSessionType enumeration, ordered differently from the NAS one
+var ngapPDUSessionType = map[uint8]uint64{
+	PDUSessionTypeIPv4:         0,
+	PDUSessionTypeIPv6:         1,
+	PDUSessionTypeIPv4v6:       2,
+	PDUSessionTypeEthernet:     3,
+	PDUSessionTypeUnstructured: 4,
+}
+
+// ErrInvalidNGAP is returned for N2 SM information the SMF cannot decode
+var ErrInvalidNGAP = errors.New("invalid N2 SM information")
+
+// PDUSessionResourceSetupRequest holds the content of the PDU Session
+// Resource Setup Request Transfer sent to the gNB for a new session
+type PDUSessionResourceSetupRequest struct {
+	AMBRUL         uint64 // bps
+	AMBRDL         uint64 // bps
+	UPFTEID        uint32
+	UPFAddr        net.IP
+	PDUSessionType uint8 // NAS value
+
+	// Default QoS flow
+	QFI         uint8
+	FiveQI      uint8
+	ARPPriority uint8
+
+	// Dedicated QoS flows
+	Flows []*QoSFlow
+}
+
+// Marshal encodes the transfer in ALIGNED PER
+func (r *PDUSessionResourceSetupRequest) Marshal() []byte {
+	var ambr perWriter
+	ambr.putBits(0, 2) // extension, iE-Extensions absent
+	ambr.putBitRate(r.AMBRDL)
+	ambr.putBitRate(r.AMBRUL)
+
+	var tnl perWriter
+	tnl.putBits(0, 1) // gTPTunnel
+	tnl.putGTPTunnel(r.UPFAddr, r.UPFTEID)
+
+	var sessionType perWriter
+	sessionType.putBits(0, 1)
+	sessionType.putBits(ngapPDUSessionType[r.PDUSessionType], 3)
+
+	var flows perWriter
+	flows.putBits(uint64(len(r.Flows)), 6) // number of flows minus one
+	flows.putQoSFlowSetupItem(&QoSFlow{
+		QFI: r.QFI,
+		QoS: QoS{QCI: r.FiveQI, PriorityLevel: r.ARPPriority},
+	})
+	for _, flow := range r.Flows {
+		flows.putQoSFlowSetupItem(flow)
+	}
+
+	var w perWriter
+	w.putBits(0, 1) // extension
+	w.putBytes([]byte{0, 4})
+	w.putProtocolIE(ngapIDPDUSessionAggregateMaximumBitRate, ambr.bytes())
+	w.putProtocolIE(ngapIDULNGUUPTNLInformation, tnl.bytes())
+	w.putProtocolIE(ngapIDPDUSessionType, sessionType.bytes())
+	w.putProtocolIE(ngapIDQosFlowSetupRequestList, flows.bytes())
+	return w.bytes()
+}
+
+// ParsePDUSessionResourceSetupResponse returns the downlink tunnel of the
+// default QoS flow from a PDU Session Resource Setup Response Transfer
+func ParsePDUSessionResourceSetupResponse(b []byte) (uint32, net.IP, error) {
+	r := &perReader{buf: b}
+
+	// Response transfer: extension and four optional IEs
+	r.getBits(5)
+	// QosFlowPerTNLInformation: extension and iE-Extensions
+	r.getBits(2)
+	// UPTransportLayerInformation must be a gTPTunnel
+	if r.getBits(1) != 0 {
+		return 0, nil, ErrInvalidNGAP
+	}
+	return r.getGTPTunnel()
+}
+
+// putQoSFlowSetupItem writes a QosFlowSetupRequestItem with a non-dynamic 5QI,
+// adding the GBR QoS flow information of GBR flows
+func (w *perWriter) putQoSFlowSetupItem(flow *QoSFlow) {
+	priority := flow.QoS.PriorityLevel
+	if priority < 1 || priority > 15 {
+		priority = 15
+	}
+	q := flow.QoS
+	gbr := q.GuaranteedBitRateUL > 0 || q.GuaranteedBitRateDL > 0
+
+	w.putBits(0, 3)                     // extension, e-RAB-ID and iE-Extensions absent
+	w.putBits(uint64(flow.QFI&0x3f), 7) // QoS flow identifier
+	w.putBits(0, 1)                     // QoS flow level parameters extension
+	if gbr {
+		w.putBits(0x4, 4) // gBR-QoS-Information present
+	} else {
+		w.putBits(0, 4)
+	}
+	w.putBits(0, 2) // nonDynamic5QI
+	w.putBits(0, 6) // no optional 5QI descriptor IEs, 5QI in root
+	w.putBytes([]byte{q.QCI})
+	w.putBits(0, 2) // ARP extension, iE-Extensions absent
+	w.putBits(uint64(priority-1), 4)
+	w.putBits(0, 1)
+	w.putBits(boolBit(q.PreemptionCap), 1)
+	w.putBits(0, 1)
+	w.putBits(boolBit(q.PreemptionVuln), 1)
+	if !gbr {
+		return
+	}
+
+	// Maximum and guaranteed flow bit rates, which must not be below the GFBR
+	mfbrDL, mfbrUL := q.MaxBitRateDL, q.MaxBitRateUL
+	if mfbrDL < q.GuaranteedBitRateDL {
+		mfbrDL = q.GuaranteedBitRateDL
+	}
+	if mfbrUL < q.GuaranteedBitRateUL {
+		mfbrUL = q.GuaranteedBitRateUL
+	}
+	w.putBits(0, 5) // extension and optional IEs absent
+	w.putBitRate(mfbrDL)
+	w.putBitRate(mfbrUL)
+	w.putBitRate(q.GuaranteedBitRateDL)
+	w.putBitRate(q.GuaranteedBitRateUL)
+}
+
+func boolBit(b bool) uint64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// perWriter encodes ALIGNED PER (X.691) bit fields
+type perWriter struct {
+	buf  []byte
+	used int // bits used in the last octet
+}
+
+func (w *perWriter) putBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		if w.used == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			w.buf[len(w.buf)-1] |= 0x80 >> uint(w.used)
+		}
+		w.used = (w.used + 1) % 8
+	}
+}
+
+// putBytes writes octet-aligned bytes
+func (w *perWriter) putBytes(b []byte) {
+	w.used = 0
+	w.buf = append(w.buf, b...)
+}
+
+// putOpenType writes a complete encoding preceded by its length
+func (w *perWriter) putOpenType(b []byte) {
+	if len(b) < 128 {
+		w.putBytes([]byte{uint8(len(b))})
+	} else {
+		w.putBytes([]byte{0x80 | uint8(len(b)>>8), uint8(len(b))})
+	}
+	w.putBytes(b)
+}
+
+// putProtocolIE writes a ProtocolIE-Field with criticality reject
+func (w *perWriter) putProtocolIE(id uint16, value []byte) {
+	w.putBytes(binary.BigEndian.AppendUint16(nil, id))
+	w.putBits(0, 2)
+	w.putOpenType(value)
+}
+
+// putBitRate writes a BitRate, INTEGER (0..4000000000000, ...)
+func (w *perWriter) putBitRate(v uint64) {
+	octets := 1
+	for v>>(8*uint(octets)) != 0 {
+		octets++
+	}
+	w.putBits(0, 1)
+	w.putBits(uint64(octets-1), 3)
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	w.putBytes(b[8-octets:])
+}
+
+// putGTPTunnel writes an IPv4 GTPTunnel
+func (w *perWriter) putGTPTunnel(ip net.IP, teid uint32) {
+	addr := ip.To4()
+	if addr == nil {
+		addr = net.IPv4zero.To4()
+	}
+	w.putBits(0, 2)  // extension, iE-Extensions absent
+	w.putBits(0, 1)  // transport layer address size in root
+	w.putBits(31, 8) // 32 bits
+	w.putBytes(addr)
+	w.putBytes(binary.BigEndian.AppendUint32(nil, teid))
+}
+
+func (w *perWriter) bytes() []byte {
+	if len(w.buf) == 0 {
+		return []byte{0}
+	}
+	return w.buf
+}
+
+// perReader decodes ALIGNED PER bit fields
+type perReader struct {
+	buf []byte
+	bit int
+	err error
+}
+
+func (r *perReader) getBits(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		if r.bit/8 >= len(r.buf) {
+			r.err = ErrInvalidNGAP
+			return 0
+		}
+		v = v<<1 | uint64(r.buf[r.bit/8]>>(7-uint(r.bit%8))&1)
+		r.bit++
+	}
+	return v
+}
+
+// getBytes reads octet-aligned bytes
+func (r *perReader) getBytes(n int) []byte {
+	r.bit = (r.bit + 7) / 8 * 8
+	start := r.bit / 8
+	if start+n > len(r.buf) {
+		r.err = ErrInvalidNGAP
+		return nil
+	}
+	r.bit += 8 * n
+	return r.buf[start : start+n]
+}
+
+// getGTPTunnel reads a GTPTunnel, preferring its IPv4 address
+func (r *perReader) getGTPTunnel() (uint32, net.IP, error) {
+	r.getBits(2)
+	if r.getBits(1) != 0 {
+		return 0, nil, ErrInvalidNGAP
+	}
+	size := int(r.getBits(8)) + 1
+	addr := r.getBytes((size + 7) / 8)
+	teid := r.getBytes(4)
+	if r.err != nil {
+		return 0, nil, r.err
+	}
+
+	var ip net.IP
+	switch size {
+	case 32, 160:
+		ip = net.IP(append([]byte(nil), addr[:4]...))
+	case 128:
+		ip = net.IP(append([]byte(nil), addr...))
+	default:
+		return 0, nil, ErrInvalidNGAP
+	}
+	return binary.BigEndian.Uint32(teid), ip, nil
+}
@@ -0,0 +1,52 @@
+package smf
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestParsePDUSessionResourceSetupResponse(t *testing.T) {
+	// gNB tunnel 192.0.2.10 TEID 0x11223344, QFI 1
+	b := []byte{0x00, 0x03, 0xe0, 192, 0, 2, 10, 0x11, 0x22, 0x33, 0x44, 0x00, 0x01}
+	teid, addr, err := ParsePDUSessionResourceSetupResponse(b)
+	if err != nil {
+		t.Fatalf("ParsePDUSessionResourceSetupResponse() error = %v", err)
+	}
+	if teid != 0x11223344 || !addr.Equal(net.ParseIP("192.0.2.10")) {
+		t.Errorf("tunnel = %s/%#x, want 192.0.2.10/0x11223344", addr, teid)
+	}
+
+	if _, _, err := ParsePDUSessionResourceSetupResponse(b[:6]); err == nil {
+		t.Error("truncated transfer: error = nil")
+	}
+}
+
+func TestPDUSessionResourceSetupRequestMarshal(t *testing.T) {
+	req := &PDUSessionResourceSetupRequest{
+		AMBRUL:         100_000_000,
+		AMBRDL:         200_000_000,
+		UPFTEID:        0x01020304,
+		UPFAddr:        net.ParseIP("192.0.2.1"),
+		PDUSessionType: PDUSessionTypeIPv4,
+		QFI:            1,
+		FiveQI:         9,
+		ARPPriority:    1,
+	}
+	b := req.Marshal()
+
+	// Four protocol IEs, the first being the Session-AMBR
+	if !bytes.HasPrefix(b, []byte{0x00, 0x00, 0x04, 0x00, 0x82, 0x00}) {
+		t.Errorf("Marshal() = %x, unexpected container header", b)
+	}
+	// UL NG-U tunnel: id 139, gTPTunnel with a 32 bit address
+	tnl := []byte{0x00, 0x8b, 0x00, 0x0a, 0x01, 0xf0, 192, 0, 2, 1, 0x01, 0x02, 0x03, 0x04}
+	if !bytes.Contains(b, tnl) {
+		t.Errorf("Marshal() = %x, missing UL NG-U UP TNL information %x", b, tnl)
+	}
+	// QoS flow 1 with 5QI 9 and ARP priority 1
+	flows := []byte{0x00, 0x88, 0x00, 0x07, 0x00, 0x01, 0x00, 0x00, 0x09, 0x00, 0x00}
+	if !bytes.Contains(b, flows) {
+		t.Errorf("Marshal() = %x, missing QoS flow setup request list %x", b, flows)
+	}
+}
@@ -0,0 +1,161 @@
+package smf
+
+import (
+	"sync"
+	"time"
+
+	"github.com/wmnsk/go-gtp/gtpv2/ie"
+)
+
+// OverloadConfig sets the capacity of the SMF and when it is overloaded.
+// Limits left at 0 are not part of the load.
+type OverloadConfig struct {
+	MaxSessions      int           `mapstructure:"max_sessions" json:"max_sessions"`
+	MaxPFCPBacklog   int           `mapstructure:"max_pfcp_backlog" json:"max_pfcp_backlog"`
+	OverloadLoad     uint8         `mapstructure:"overload_threshold" json:"overload_threshold"` // load (%) from which MMEs are asked to throttle
+	RejectLoad       uint8         `mapstructure:"reject_threshold" json:"reject_threshold"`     // load (%) from which new sessions are rejected
+	PeriodOfValidity time.Duration `mapstructure:"period_of_validity" json:"period_of_validity"`
+}
+
+// LoadSample is the resource utilisation the load is computed from
+type LoadSample struct {
+	Sessions    int
+	PoolUsed    int // UE addresses allocated over all IPv4 pools
+	PoolSize    int
+	PFCPBacklog int
+}
+
+// LoadStatus is the load the SMF advertises to its peers
+type LoadStatus struct {
+	Load             uint8  `json:"load"`              // %
+	OverloadMetric   uint8  `json:"overload_metric"`   // % of traffic peers should throttle
+	LoadSequence     uint32 `json:"load_sequence"`     // Load Control Sequence Number
+	OverloadSequence uint32 `json:"overload_sequence"` // Overload Control Sequence Number
+	Admitting        bool   `json:"admitting"`
+}
+
+// OverloadController turns resource utilisation into the load and overload
+// metrics of Load and Overload Control Information (TS 29.274 §12.2, §12.3)
+// and decides whether new sessions are admitted
+type OverloadController struct {
+	cfg OverloadConfig
+
+	load          uint8
+	reduction     uint8
+	loadSeq       uint32
+	overloadSeq   uint32
+	overloadUntil time.Time // end of the validity of the last overload report
+
+	mu sync.RWMutex
+}
+
+// NewOverloadController creates a controller, defaulting the thresholds to
+// 80% and 95%. Sequence numbers start from the current time so peers keep
+// accepting them after a restart.
+func NewOverloadController(cfg OverloadConfig) *OverloadController {
+	if cfg.OverloadLoad == 0 || cfg.OverloadLoad > 100 {
+		cfg.OverloadLoad = 80
+	}
+	if cfg.RejectLoad == 0 || cfg.RejectLoad > 100 {
+		cfg.RejectLoad = 95
+	}
+	if cfg.PeriodOfValidity <= 0 {
+		cfg.PeriodOfValidity = time.Minute
+	}
+	seq := uint32(time.Now().Unix())
+	return &OverloadController{cfg: cfg, loadSeq: seq, overloadSeq: seq}
+}
+
+// Update computes the load of a sample. The load is the utilisation of the
+// most used resource; above the overload threshold the reduction metric
+// grows linearly to 100% at full load.
+func (c *OverloadController) Update(s LoadSample) uint8 {
+	load := 0
+	if c.cfg.MaxSessions > 0 {
+		load = max(load, s.Sessions*100/c.cfg.MaxSessions)
+	}
+	if s.PoolSize > 0 {
+		load = max(load, s.PoolUsed*100/s.PoolSize)
+	}
+	if c.cfg.MaxPFCPBacklog > 0 {
+		load = max(load, s.PFCPBacklog*100/c.cfg.MaxPFCPBacklog)
+	}
+	load = min(load, 100)
+
+	reduction := 0
+	if threshold := int(c.cfg.OverloadLoad); load >= threshold && threshold < 100 {
+		reduction = (load - threshold) * 100 / (100 - threshold)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if uint8(load) != c.load {
+		c.load = uint8(load)
+		c.loadSeq++
+	}
+	if uint8(reduction) != c.reduction {
+		c.reduction = uint8(reduction)
+		c.overloadSeq++
+	}
+	if reduction > 0 {
+		c.overloadUntil = time.Now().Add(c.cfg.PeriodOfValidity)
+	}
+	return c.load
+}
+
+// Admit reports whether a new session may be accepted
+func (c *OverloadController) Admit(sessions int) bool {
+	if c.cfg.MaxSessions > 0 && sessions >= c.cfg.MaxSessions {
+		return false
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.load < c.cfg.RejectLoad
+}
+
+// Status returns the current load
+func (c *OverloadController) Status() LoadStatus {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return LoadStatus{
+		Load:             c.load,
+		OverloadMetric:   c.reduction,
+		LoadSequence:     c.loadSeq,
+		OverloadSequence: c.overloadSeq,
+		Admitting:        c.load < c.cfg.RejectLoad,
+	}
+}
+
+// ControlIEs returns the PGW node level Load Control Information and, while
+// overloaded or until a past overload report expires, the Overload Control
+// Information to add to responses towards MMEs and SGWs. An Overload
+// Control Information with a zero metric ends the throttling early.
+func (c *OverloadController) ControlIEs() []*ie.IE {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	ies := []*ie.IE{newGroupedIE(ie.LoadControlInformation,
+		newUint32IE(ie.SequenceNumber, c.loadSeq),
+		ie.New(ie.Metric, 0, []byte{c.load}),
+	)}
+	if c.reduction > 0 || time.Now().Before(c.overloadUntil) {
+		ies = append(ies, newGroupedIE(ie.OverloadControlInformation,
+			newUint32IE(ie.SequenceNumber, c.overloadSeq),
+			ie.New(ie.Metric, 0, []byte{c.reduction}),
+			ie.NewEPCTimer(c.cfg.PeriodOfValidity),
+		))
+	}
+	return ies
+}
+
+// newGroupedIE returns a grouped GTPv2 IE of instance 0
+func newGroupedIE(typ uint8, children ...*ie.IE) *ie.IE {
+	i := ie.New(typ, 0, nil)
+	i.Add(children...)
+	return i
+}
+
+func newUint32IE(typ uint8, v uint32) *ie.IE {
+	return ie.New(typ, 0, []byte{byte(v >> 24), byte(v >> 16), byte(v >> 8), byte(v)})
+}
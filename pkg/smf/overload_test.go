@@ -0,0 +1,81 @@
+package smf
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/wmnsk/go-gtp/gtpv2/ie"
+)
+
+func TestOverloadControllerLoad(t *testing.T) {
+	c := NewOverloadController(OverloadConfig{MaxSessions: 1000, MaxPFCPBacklog: 100})
+
+	if load := c.Update(LoadSample{Sessions: 100, PoolUsed: 50, PoolSize: 100, PFCPBacklog: 10}); load != 50 {
+		t.Errorf("load = %d, want 50 from the IP pool", load)
+	}
+	if st := c.Status(); st.OverloadMetric != 0 || !st.Admitting {
+		t.Errorf("status = %+v, want admitting without overload", st)
+	}
+	if len(c.ControlIEs()) != 1 {
+		t.Error("Overload Control Information sent without overload")
+	}
+
+	seq := c.Status().LoadSequence
+	c.Update(LoadSample{Sessions: 900, PoolSize: 100, PFCPBacklog: 10})
+	st := c.Status()
+	if st.Load != 90 || st.OverloadMetric != 50 || st.LoadSequence != seq+1 || !st.Admitting {
+		t.Errorf("status = %+v, want 90%% load and 50%% reduction", st)
+	}
+	if !c.Admit(900) {
+		t.Error("session rejected below the reject threshold")
+	}
+
+	c.Update(LoadSample{Sessions: 100, PoolSize: 100, PFCPBacklog: 97})
+	if c.Admit(100) {
+		t.Error("session admitted above the reject threshold")
+	}
+	if c.Admit(1000) {
+		t.Error("session admitted at the session limit")
+	}
+}
+
+func TestOverloadControllerIEs(t *testing.T) {
+	c := NewOverloadController(OverloadConfig{MaxSessions: 100, PeriodOfValidity: 30 * time.Second})
+	c.Update(LoadSample{Sessions: 90})
+
+	ies := c.ControlIEs()
+	if len(ies) != 2 || ies[0].Type != ie.LoadControlInformation || ies[1].Type != ie.OverloadControlInformation {
+		t.Fatalf("IEs = %v, want load and overload control information", ies)
+	}
+
+	b, err := ies[1].Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	oci, err := ie.Parse(b)
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	seq, err := oci.FindByType(ie.SequenceNumber, 0)
+	if err != nil || binary.BigEndian.Uint32(seq.Payload) != c.Status().OverloadSequence {
+		t.Errorf("sequence number = %v, %v", seq, err)
+	}
+	metric, err := oci.FindByType(ie.Metric, 0)
+	if err != nil || metric.Payload[0] != 50 {
+		t.Errorf("overload reduction metric = %v, %v, want 50", metric, err)
+	}
+	timer, err := oci.FindByType(ie.EPCTimer, 0)
+	if err != nil {
+		t.Fatalf("period of validity missing: %v", err)
+	}
+	if d, err := timer.EPCTimer(); err != nil || d != 30*time.Second {
+		t.Errorf("period of validity = %v, %v, want 30s", d, err)
+	}
+
+	// The end of an overload is still reported until the last report expires
+	c.Update(LoadSample{Sessions: 10})
+	if ies := c.ControlIEs(); len(ies) != 2 || ies[1].ChildIEs[1].Payload[0] != 0 {
+		t.Errorf("IEs = %v, want overload control information with a zero metric", ies)
+	}
+}
@@ -0,0 +1,173 @@
+package smf
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+// PCO container identifiers, the same in both directions (TS 24.008 §10.5.6.3)
+const (
+	PCOPCSCFIPv6       uint16 = 0x0001
+	PCODNSIPv6         uint16 = 0x0003
+	PCOIPAddressViaNAS uint16 = 0x000a
+	PCOPCSCFIPv4       uint16 = 0x000c
+	PCODNSIPv4         uint16 = 0x000d
+	PCOIPv4LinkMTU     uint16 = 0x0010
+	PCOIPCP            uint16 = 0x8021
+)
+
+// IPCP codes and options carrying DNS servers (RFC 1332, RFC 1877)
+const (
+	ipcpConfigureRequest uint8 = 1
+	ipcpConfigureNak     uint8 = 3
+	ipcpPrimaryDNS       uint8 = 129
+	ipcpSecondaryDNS     uint8 = 131
+)
+
+// pcoHeader is the first octet of a PCO: extension bit and the PPP
+// configuration protocol
+const pcoHeader uint8 = 0x80
+
+// ErrInvalidPCO is returned for malformed protocol configuration options
+var ErrInvalidPCO = errors.New("invalid protocol configuration options")
+
+// PCOContainer is a protocol or container of protocol configuration options
+type PCOContainer struct {
+	ID       uint16
+	Contents []byte
+}
+
+// PCO holds protocol configuration options. The value of an ePCO (GTPv2,
+// 5GSM) is encoded the same way as that of a PCO.
+type PCO struct {
+	Containers []PCOContainer
+}
+
+// ParsePCO decodes the value of a PCO or ePCO IE
+func ParsePCO(b []byte) (*PCO, error) {
+	if len(b) < 1 || b[0]&0x80 == 0 {
+		return nil, ErrInvalidPCO
+	}
+	pco := &PCO{}
+	for off := 1; off < len(b); {
+		if off+3 > len(b) {
+			return nil, ErrInvalidPCO
+		}
+		id := binary.BigEndian.Uint16(b[off:])
+		l := int(b[off+2])
+		if off+3+l > len(b) {
+			return nil, ErrInvalidPCO
+		}
+		pco.Containers = append(pco.Containers, PCOContainer{ID: id, Contents: b[off+3 : off+3+l]})
+		off += 3 + l
+	}
+	return pco, nil
+}
+
+// Marshal encodes the value of a PCO or ePCO IE
+func (p *PCO) Marshal() []byte {
+	b := []byte{pcoHeader}
+	for _, c := range p.Containers {
+		b = binary.BigEndian.AppendUint16(b, c.ID)
+		b = append(b, uint8(len(c.Contents)))
+		b = append(b, c.Contents...)
+	}
+	return b
+}
+
+// Requested reports whether the UE asked for a container
+func (p *PCO) Requested(id uint16) bool {
+	for _, c := range p.Containers {
+		if c.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// PCOResponse answers the options requested by the UE with the DNS servers,
+// P-CSCFs and MTU of the DNN. Options the DNN has no value for are left out.
+func (d *DNN) PCOResponse(req *PCO) *PCO {
+	res := &PCO{}
+	for _, c := range req.Containers {
+		switch c.ID {
+		case PCODNSIPv4:
+			res.addAddresses(PCODNSIPv4, d.DNS, true)
+		case PCODNSIPv6:
+			res.addAddresses(PCODNSIPv6, d.DNS, false)
+		case PCOPCSCFIPv4:
+			res.addAddresses(PCOPCSCFIPv4, d.PCSCF, true)
+		case PCOPCSCFIPv6:
+			res.addAddresses(PCOPCSCFIPv6, d.PCSCF, false)
+		case PCOIPv4LinkMTU:
+			if d.MTU != 0 {
+				res.Containers = append(res.Containers, PCOContainer{
+					ID:       PCOIPv4LinkMTU,
+					Contents: binary.BigEndian.AppendUint16(nil, d.MTU),
+				})
+			}
+		case PCOIPCP:
+			if nak := d.ipcpNak(c.Contents); nak != nil {
+				res.Containers = append(res.Containers, PCOContainer{ID: PCOIPCP, Contents: nak})
+			}
+		}
+	}
+	return res
+}
+
+// addAddresses adds one container per address of the requested family
+func (p *PCO) addAddresses(id uint16, addrs []net.IP, v4 bool) {
+	for _, addr := range addrs {
+		if ip := addr.To4(); v4 && ip != nil {
+			p.Containers = append(p.Containers, PCOContainer{ID: id, Contents: ip})
+		} else if !v4 && ip == nil {
+			p.Containers = append(p.Containers, PCOContainer{ID: id, Contents: addr.To16()})
+		}
+	}
+}
+
+// ipcpNak answers an IPCP Configure-Request for DNS servers with a
+// Configure-Nak carrying the DNN's, as legacy UEs expect
+func (d *DNN) ipcpNak(req []byte) []byte {
+	if len(req) < 4 || req[0] != ipcpConfigureRequest {
+		return nil
+	}
+	var dns []net.IP
+	for _, addr := range d.DNS {
+		if ip := addr.To4(); ip != nil {
+			dns = append(dns, ip)
+		}
+	}
+
+	var opts []byte
+	l := int(binary.BigEndian.Uint16(req[2:]))
+	if l > len(req) {
+		l = len(req)
+	}
+	for off := 4; off+2 <= l; {
+		typ, optLen := req[off], int(req[off+1])
+		if optLen < 2 {
+			break
+		}
+		n := -1
+		switch typ {
+		case ipcpPrimaryDNS:
+			n = 0
+		case ipcpSecondaryDNS:
+			n = 1
+		}
+		if n >= 0 && n < len(dns) {
+			opts = append(opts, typ, 6)
+			opts = append(opts, dns[n]...)
+		}
+		off += optLen
+	}
+	if len(opts) == 0 {
+		return nil
+	}
+
+	b := []byte{ipcpConfigureNak, req[1]}
+	b = binary.BigEndian.AppendUint16(b, uint16(4+len(opts)))
+	return append(b, opts...)
+}
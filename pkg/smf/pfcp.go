@@ -0,0 +1,554 @@
+package smf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+	pfcpmsg "github.com/wmnsk/go-pfcp/message"
+)
+
+// ErrPFCPTimeout is returned when a PFCP peer does not answer a request
+var ErrPFCPTimeout = errors.New("PFCP request timed out")
+
+// PFCPCauseError is returned when a PFCP peer rejects a request
+type PFCPCauseError struct {
+	Cause uint8
+}
+
+func (e *PFCPCauseError) Error() string {
+	return fmt.Sprintf("PFCP request rejected with cause %d", e.Cause)
+}
+
+// IsSessionNotFound reports whether a UPF rejected a request because it has
+// no context for the session
+func IsSessionNotFound(err error) bool {
+	var causeErr *PFCPCauseError
+	return errors.As(err, &causeErr) && causeErr.Cause == ie.CauseSessionContextNotFound
+}
+
+// PFCPClient is the SMF side of the N4 interface. It keeps a PFCP
+// association with every configured UPF, monitors them with heartbeats and
+// sends session related requests.
+type PFCPClient struct {
+	conn       *net.UDPConn
+	nodeID     string
+	localIP    net.IP
+	recoveryTS time.Time
+	pool       *UPFPool
+
+	// Timers, exported so callers can tune them before Run
+	HeartbeatInterval   time.Duration
+	AssociationRetry    time.Duration
+	ResponseTimeout     time.Duration
+	MaxRetries          int
+	MaxMissedHeartbeats int
+
+	seq     uint32
+	pending map[uint32]chan pfcpmsg.Message
+	pendMu  sync.Mutex
+
+	upfDownHandlers     []func(*UPFNode)
+	upfUpHandlers       []func(*UPFNode)
+	usageReportHandlers []func(*UPFNode, uint64, []*UsageReport)
+	inactivityHandlers  []func(*UPFNode, uint64)
+	sessionLookup       func(*UPFNode, uint64) (uint64, bool)
+	handlerMu           sync.RWMutex
+}
+
+// NewPFCPClient creates a PFCP client bound to laddr
+func NewPFCPClient(laddr, nodeID string, pool *UPFPool) (*PFCPClient, error) {
+	addr, err := net.ResolveUDPAddr("udp", laddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PFCP address: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on PFCP: %w", err)
+	}
+
+	localIP := addr.IP
+	if localIP == nil || localIP.IsUnspecified() {
+		localIP = outboundIP()
+	}
+
+	return &PFCPClient{
+		conn:                conn,
+		nodeID:              nodeID,
+		localIP:             localIP,
+		recoveryTS:          time.Now(),
+		pool:                pool,
+		HeartbeatInterval:   5 * time.Second,
+		AssociationRetry:    5 * time.Second,
+		ResponseTimeout:     3 * time.Second,
+		MaxRetries:          3,
+		MaxMissedHeartbeats: 3,
+		pending:             make(map[uint32]chan pfcpmsg.Message),
+	}, nil
+}
+
+// LocalIP returns the address the SMF advertises in F-SEIDs
+func (c *PFCPClient) LocalIP() net.IP {
+	return c.localIP
+}
+
+// Pool returns the UPF pool served by the client
+func (c *PFCPClient) Pool() *UPFPool {
+	return c.pool
+}
+
+// OnUPFDown registers a handler called when the association with a UPF is lost
+func (c *PFCPClient) OnUPFDown(fn func(*UPFNode)) {
+	c.handlerMu.Lock()
+	defer c.handlerMu.Unlock()
+	c.upfDownHandlers = append(c.upfDownHandlers, fn)
+}
+
+// OnUPFUp registers a handler called each time an association with a UPF is set up
+func (c *PFCPClient) OnUPFUp(fn func(*UPFNode)) {
+	c.handlerMu.Lock()
+	defer c.handlerMu.Unlock()
+	c.upfUpHandlers = append(c.upfUpHandlers, fn)
+}
+
+// OnUsageReport registers a handler called with the usage reports a UPF
+// sends for the PFCP session with the given local SEID
+func (c *PFCPClient) OnUsageReport(fn func(node *UPFNode, seid uint64, reports []*UsageReport)) {
+	c.handlerMu.Lock()
+	defer c.handlerMu.Unlock()
+	c.usageReportHandlers = append(c.usageReportHandlers, fn)
+}
+
+// OnInactivityReport registers a handler called when a UPF reports the
+// PFCP session with the given local SEID without traffic for its User Plane
+// Inactivity Timer (TS 29.244 §5.11.3)
+func (c *PFCPClient) OnInactivityReport(fn func(node *UPFNode, seid uint64)) {
+	c.handlerMu.Lock()
+	defer c.handlerMu.Unlock()
+	c.inactivityHandlers = append(c.inactivityHandlers, fn)
+}
+
+// SetSessionLookup sets the function resolving the local SEID of a Session
+// Report Request to the UPF's SEID of the session, which the response is
+// sent with. Reports of sessions it does not know are answered with Session
+// context not found (TS 29.244 §7.5.9).
+func (c *PFCPClient) SetSessionLookup(fn func(node *UPFNode, seid uint64) (remoteSEID uint64, ok bool)) {
+	c.handlerMu.Lock()
+	defer c.handlerMu.Unlock()
+	c.sessionLookup = fn
+}
+
+// remoteSEID returns the UPF's SEID of the session with the local SEID
+func (c *PFCPClient) remoteSEID(node *UPFNode, seid uint64) (uint64, bool) {
+	c.handlerMu.RLock()
+	lookup := c.sessionLookup
+	c.handlerMu.RUnlock()
+	if lookup == nil {
+		return 0, false
+	}
+	return lookup(node, seid)
+}
+
+// Run reads PFCP messages and maintains associations until ctx is cancelled
+func (c *PFCPClient) Run(ctx context.Context) {
+	go c.serve()
+	for _, node := range c.pool.Nodes() {
+		go c.maintainAssociation(ctx, node)
+	}
+	<-ctx.Done()
+}
+
+// Close closes the PFCP socket
+func (c *PFCPClient) Close() error {
+	return c.conn.Close()
+}
+
+// EstablishSession sends a Session Establishment Request to the UPF
+func (c *PFCPClient) EstablishSession(ctx context.Context, node *UPFNode, localSEID uint64, ies ...*ie.IE) (*pfcpmsg.SessionEstablishmentResponse, error) {
+	ies = append([]*ie.IE{
+		ie.NewNodeID(c.localIP.String(), "", ""),
+		ie.NewFSEID(localSEID, c.localIP.To4(), nil),
+	}, ies...)
+	req := pfcpmsg.NewSessionEstablishmentRequest(0, 0, 0, 0, 0, ies...)
+
+	msg, err := c.request(ctx, node, req)
+	if err != nil {
+		return nil, err
+	}
+	res, ok := msg.(*pfcpmsg.SessionEstablishmentResponse)
+	if !ok {
+		return nil, fmt.Errorf("unexpected PFCP message: %T", msg)
+	}
+	c.recordLoad(node, res.LoadControlInformation)
+	if err := checkCause(res.Cause); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// ModifySession sends a Session Modification Request to the UPF
+func (c *PFCPClient) ModifySession(ctx context.Context, node *UPFNode, remoteSEID uint64, ies ...*ie.IE) (*pfcpmsg.SessionModificationResponse, error) {
+	req := pfcpmsg.NewSessionModificationRequest(0, 0, remoteSEID, 0, 0, ies...)
+
+	msg, err := c.request(ctx, node, req)
+	if err != nil {
+		return nil, err
+	}
+	res, ok := msg.(*pfcpmsg.SessionModificationResponse)
+	if !ok {
+		return nil, fmt.Errorf("unexpected PFCP message: %T", msg)
+	}
+	c.recordLoad(node, res.LoadControlInformation)
+	if err := checkCause(res.Cause); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// DeleteSession sends a Session Deletion Request to the UPF
+func (c *PFCPClient) DeleteSession(ctx context.Context, node *UPFNode, remoteSEID uint64) (*pfcpmsg.SessionDeletionResponse, error) {
+	req := pfcpmsg.NewSessionDeletionRequest(0, 0, remoteSEID, 0, 0)
+
+	msg, err := c.request(ctx, node, req)
+	if err != nil {
+		return nil, err
+	}
+	res, ok := msg.(*pfcpmsg.SessionDeletionResponse)
+	if !ok {
+		return nil, fmt.Errorf("unexpected PFCP message: %T", msg)
+	}
+	c.recordLoad(node, res.LoadControlInformation)
+	if err := checkCause(res.Cause); err != nil {
+		return res, err
+	}
+	return res, nil
+}
+
+// maintainAssociation sets up the association with a UPF and monitors it
+// with heartbeats, re-associating after the UPF is lost or restarts.
+func (c *PFCPClient) maintainAssociation(ctx context.Context, node *UPFNode) {
+	for {
+		if node.State() != UPFStateAssociated {
+			if err := c.associate(ctx, node); err != nil {
+				log.Printf("[PFCP] Association with UPF %s failed: %v", node.ID, err)
+			}
+		} else {
+			c.heartbeat(ctx, node)
+		}
+
+		wait := c.HeartbeatInterval
+		if node.State() != UPFStateAssociated {
+			wait = c.AssociationRetry
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// associate sends an Association Setup Request to the UPF
+func (c *PFCPClient) associate(ctx context.Context, node *UPFNode) error {
+	req := pfcpmsg.NewAssociationSetupRequest(0,
+		ie.NewNodeID(c.localIP.String(), "", ""),
+		ie.NewRecoveryTimeStamp(c.recoveryTS),
+	)
+
+	msg, err := c.request(ctx, node, req)
+	if err != nil {
+		return err
+	}
+	res, ok := msg.(*pfcpmsg.AssociationSetupResponse)
+	if !ok {
+		return fmt.Errorf("unexpected PFCP message: %T", msg)
+	}
+	if err := checkCause(res.Cause); err != nil {
+		return err
+	}
+
+	var recoveryTS time.Time
+	if res.RecoveryTimeStamp != nil {
+		recoveryTS, _ = res.RecoveryTimeStamp.RecoveryTimeStamp()
+	}
+
+	node.mu.Lock()
+	node.state = UPFStateAssociated
+	node.recoveryTS = recoveryTS
+	node.lastHeartbeat = time.Now()
+	node.missed = 0
+	node.mu.Unlock()
+
+	log.Printf("[PFCP] Associated with UPF %s (%s)", node.ID, node.Endpoint())
+
+	c.handlerMu.RLock()
+	handlers := append([]func(*UPFNode){}, c.upfUpHandlers...)
+	c.handlerMu.RUnlock()
+	for _, fn := range handlers {
+		go fn(node)
+	}
+	return nil
+}
+
+// heartbeat sends a Heartbeat Request and tracks missed responses and restarts
+func (c *PFCPClient) heartbeat(ctx context.Context, node *UPFNode) {
+	req := pfcpmsg.NewHeartbeatRequest(0, ie.NewRecoveryTimeStamp(c.recoveryTS), nil)
+
+	msg, err := c.request(ctx, node, req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		node.mu.Lock()
+		node.missed++
+		missed := node.missed
+		node.mu.Unlock()
+
+		log.Printf("[PFCP] Heartbeat to UPF %s failed (%d/%d): %v", node.ID, missed, c.MaxMissedHeartbeats, err)
+		if missed >= c.MaxMissedHeartbeats {
+			c.upfDown(node, "heartbeat timeout")
+		}
+		return
+	}
+
+	res, ok := msg.(*pfcpmsg.HeartbeatResponse)
+	if !ok {
+		return
+	}
+
+	restarted := false
+	node.mu.Lock()
+	node.missed = 0
+	node.lastHeartbeat = time.Now()
+	if res.RecoveryTimeStamp != nil {
+		if ts, err := res.RecoveryTimeStamp.RecoveryTimeStamp(); err == nil {
+			restarted = !node.recoveryTS.IsZero() && !ts.Equal(node.recoveryTS)
+		}
+	}
+	node.mu.Unlock()
+
+	if restarted {
+		c.upfDown(node, "UPF restarted")
+	}
+}
+
+// upfDown marks the UPF as lost and notifies the registered handlers
+func (c *PFCPClient) upfDown(node *UPFNode, reason string) {
+	node.mu.Lock()
+	if node.state == UPFStateLost {
+		node.mu.Unlock()
+		return
+	}
+	node.state = UPFStateLost
+	node.sessions = 0
+	node.hasLoadMetric = false
+	node.mu.Unlock()
+
+	log.Printf("[PFCP] Association with UPF %s lost: %s", node.ID, reason)
+
+	c.handlerMu.RLock()
+	handlers := append([]func(*UPFNode){}, c.upfDownHandlers...)
+	c.handlerMu.RUnlock()
+	for _, fn := range handlers {
+		go fn(node)
+	}
+}
+
+// usageReported passes usage reports to the registered handlers
+func (c *PFCPClient) usageReported(node *UPFNode, seid uint64, reports []*UsageReport) {
+	c.handlerMu.RLock()
+	handlers := c.usageReportHandlers
+	c.handlerMu.RUnlock()
+	for _, fn := range handlers {
+		fn(node, seid, reports)
+	}
+}
+
+// inactivityReported passes a User Plane Inactivity Report to the
+// registered handlers
+func (c *PFCPClient) inactivityReported(node *UPFNode, seid uint64) {
+	c.handlerMu.RLock()
+	handlers := c.inactivityHandlers
+	c.handlerMu.RUnlock()
+	for _, fn := range handlers {
+		fn(node, seid)
+	}
+}
+
+// recordLoad updates the UPF load from a Load Control Information IE
+func (c *PFCPClient) recordLoad(node *UPFNode, lci *ie.IE) {
+	if lci == nil {
+		return
+	}
+	metric, err := lci.Metric()
+	if err != nil {
+		return
+	}
+	seq, _ := lci.SequenceNumber()
+	node.UpdateLoad(seq, metric)
+}
+
+// request sends a PFCP request to the UPF and waits for the matching
+// response, retransmitting on timeout.
+func (c *PFCPClient) request(ctx context.Context, node *UPFNode, req pfcpmsg.Message) (pfcpmsg.Message, error) {
+	addr, err := node.Addr()
+	if err != nil {
+		return nil, err
+	}
+
+	seq := c.nextSequence()
+	req.SetSequenceNumber(seq)
+	buf := make([]byte, req.MarshalLen())
+	if err := req.MarshalTo(buf); err != nil {
+		return nil, fmt.Errorf("failed to marshal %s: %w", req.MessageTypeName(), err)
+	}
+
+	ch := make(chan pfcpmsg.Message, 1)
+	c.pendMu.Lock()
+	c.pending[seq] = ch
+	c.pendMu.Unlock()
+	defer func() {
+		c.pendMu.Lock()
+		delete(c.pending, seq)
+		c.pendMu.Unlock()
+	}()
+
+	for attempt := 0; attempt <= c.MaxRetries; attempt++ {
+		if _, err := c.conn.WriteToUDP(buf, addr); err != nil {
+			return nil, fmt.Errorf("failed to send %s: %w", req.MessageTypeName(), err)
+		}
+
+		select {
+		case res := <-ch:
+			return res, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(c.ResponseTimeout):
+		}
+	}
+	return nil, fmt.Errorf("%s to UPF %s: %w", req.MessageTypeName(), node.ID, ErrPFCPTimeout)
+}
+
+// Backlog returns the number of PFCP requests awaiting a response
+func (c *PFCPClient) Backlog() int {
+	c.pendMu.Lock()
+	defer c.pendMu.Unlock()
+	return len(c.pending)
+}
+
+// nextSequence returns the next 24-bit PFCP sequence number
+func (c *PFCPClient) nextSequence() uint32 {
+	return atomic.AddUint32(&c.seq, 1) & 0xFFFFFF
+}
+
+// serve reads PFCP messages from the socket
+func (c *PFCPClient) serve() {
+	buf := make([]byte, 65535)
+	for {
+		n, remoteAddr, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("[PFCP] Read error: %v", err)
+			continue
+		}
+
+		msg, err := pfcpmsg.Parse(buf[:n])
+		if err != nil {
+			log.Printf("[PFCP] Failed to parse message from %s: %v", remoteAddr, err)
+			continue
+		}
+
+		c.handle(msg, remoteAddr)
+	}
+}
+
+// handle dispatches a received PFCP message
+func (c *PFCPClient) handle(msg pfcpmsg.Message, remoteAddr *net.UDPAddr) {
+	switch m := msg.(type) {
+	case *pfcpmsg.HeartbeatRequest:
+		res := pfcpmsg.NewHeartbeatResponse(m.Sequence(), ie.NewRecoveryTimeStamp(c.recoveryTS))
+		c.send(res, remoteAddr)
+	case *pfcpmsg.SessionReportRequest:
+		node, ok := c.pool.GetByAddr(remoteAddr)
+		var remoteSEID uint64
+		if ok {
+			c.recordLoad(node, m.LoadControlInformation)
+			remoteSEID, ok = c.remoteSEID(node, m.SEID())
+		}
+		if !ok {
+			log.Printf("[PFCP] Session Report Request from %s for unknown SEID %d", remoteAddr, m.SEID())
+			res := pfcpmsg.NewSessionReportResponse(0, 0, 0, m.Sequence(), 0,
+				ie.NewCause(ie.CauseSessionContextNotFound),
+			)
+			c.send(res, remoteAddr)
+			return
+		}
+		res := pfcpmsg.NewSessionReportResponse(0, 0, remoteSEID, m.Sequence(), 0,
+			ie.NewCause(ie.CauseRequestAccepted),
+		)
+		c.send(res, remoteAddr)
+		if reports := ParseUsageReports(m.UsageReport); len(reports) > 0 {
+			go c.usageReported(node, m.SEID(), reports)
+		}
+		if m.ReportType != nil && m.ReportType.HasUPIR() {
+			go c.inactivityReported(node, m.SEID())
+		}
+	default:
+		c.pendMu.Lock()
+		ch, ok := c.pending[msg.Sequence()]
+		c.pendMu.Unlock()
+		if !ok {
+			log.Printf("[PFCP] Unexpected %s from %s", msg.MessageTypeName(), remoteAddr)
+			return
+		}
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// send marshals and sends a PFCP message
+func (c *PFCPClient) send(msg pfcpmsg.Message, addr *net.UDPAddr) {
+	buf := make([]byte, msg.MarshalLen())
+	if err := msg.MarshalTo(buf); err != nil {
+		log.Printf("[PFCP] Failed to marshal %s: %v", msg.MessageTypeName(), err)
+		return
+	}
+	if _, err := c.conn.WriteToUDP(buf, addr); err != nil {
+		log.Printf("[PFCP] Failed to send %s: %v", msg.MessageTypeName(), err)
+	}
+}
+
+// checkCause converts a rejecting PFCP Cause IE into an error
+func checkCause(cause *ie.IE) error {
+	if cause == nil {
+		return errors.New("PFCP response without cause")
+	}
+	v, err := cause.Cause()
+	if err != nil {
+		return fmt.Errorf("invalid PFCP cause: %w", err)
+	}
+	if v != ie.CauseRequestAccepted {
+		return &PFCPCauseError{Cause: v}
+	}
+	return nil
+}
+
+// outboundIP returns the preferred outbound IPv4 address of the host
+func outboundIP() net.IP {
+	conn, err := net.Dial("udp", "192.0.2.1:8805")
+	if err != nil {
+		return net.IPv4(127, 0, 0, 1)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
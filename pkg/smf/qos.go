@@ -0,0 +1,390 @@
+package smf
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// QFI of the default QoS flow; dedicated flows are numbered from the next one
+const DefaultQFI uint8 = 1
+
+// ARP is an allocation and retention priority
+type ARP struct {
+	PriorityLevel           uint8 `mapstructure:"priority_level" json:"priority_level"`
+	PreemptionCapability    bool  `mapstructure:"preemption_capability" json:"preemption_capability"`
+	PreemptionVulnerability bool  `mapstructure:"preemption_vulnerability" json:"preemption_vulnerability"`
+}
+
+// PCCRule selects service data flows of a session and gives them their own
+// QoS flow. Flow descriptions use the IPFilterRule syntax of PFCP SDF filters,
+// from the remote address to the UE ("permit out ip from 10.1.0.0/16 to assigned").
+type PCCRule struct {
+	ID               string   `mapstructure:"id" json:"id"`
+	Precedence       uint32   `mapstructure:"precedence" json:"precedence"`
+	FlowDescriptions []string `mapstructure:"flow_descriptions" json:"flow_descriptions,omitempty"`
+	AppID            string   `mapstructure:"app_id" json:"app_id,omitempty"`
+
+	FiveQI uint8  `mapstructure:"five_qi" json:"five_qi"`
+	ARP    *ARP   `mapstructure:"arp" json:"arp,omitempty"`
+	MBRUL  uint64 `mapstructure:"mbr_ul" json:"mbr_ul,omitempty"` // bps
+	MBRDL  uint64 `mapstructure:"mbr_dl" json:"mbr_dl,omitempty"` // bps
+	GBRUL  uint64 `mapstructure:"gbr_ul" json:"gbr_ul,omitempty"` // bps
+	GBRDL  uint64 `mapstructure:"gbr_dl" json:"gbr_dl,omitempty"` // bps
+}
+
+// QoSPolicy is the QoS authorized for the sessions of a DNN, or for the
+// sessions of one subscriber when IMSI is set. Zero values are inherited from
+// the DNN policy and then from the defaults; PCC rules add up.
+type QoSPolicy struct {
+	IMSI   string    `mapstructure:"imsi" json:"imsi,omitempty"`
+	DNN    string    `mapstructure:"dnn" json:"dnn,omitempty"`
+	FiveQI uint8     `mapstructure:"five_qi" json:"five_qi,omitempty"`
+	ARP    *ARP      `mapstructure:"arp" json:"arp,omitempty"`
+	AMBRUL uint64    `mapstructure:"ambr_ul" json:"ambr_ul,omitempty"` // bps
+	AMBRDL uint64    `mapstructure:"ambr_dl" json:"ambr_dl,omitempty"` // bps
+	Rules  []PCCRule `mapstructure:"rules" json:"rules,omitempty"`
+}
+
+// Validate checks the 5QIs, priorities and flow descriptions of the policy
+func (p *QoSPolicy) Validate() error {
+	if p.FiveQI != 0 && IsGBR(p.FiveQI) {
+		return fmt.Errorf("qos policy: default 5QI %d must be non-GBR", p.FiveQI)
+	}
+	if err := p.ARP.validate(); err != nil {
+		return fmt.Errorf("qos policy: %w", err)
+	}
+	seen := make(map[string]bool)
+	for _, r := range p.Rules {
+		if r.ID == "" || seen[r.ID] {
+			return fmt.Errorf("qos policy: PCC rule needs a unique id")
+		}
+		seen[r.ID] = true
+		if len(r.FlowDescriptions) == 0 && r.AppID == "" {
+			return fmt.Errorf("PCC rule %s needs flow descriptions or an app id", r.ID)
+		}
+		for _, fd := range r.FlowDescriptions {
+			if _, err := parseFlowFilter(fd); err != nil {
+				return fmt.Errorf("PCC rule %s: %w", r.ID, err)
+			}
+		}
+		if r.FiveQI == 0 {
+			return fmt.Errorf("PCC rule %s has no 5QI", r.ID)
+		}
+		if IsGBR(r.FiveQI) != (r.GBRUL > 0 || r.GBRDL > 0) {
+			return fmt.Errorf("PCC rule %s: GBR must be set exactly for GBR 5QIs", r.ID)
+		}
+		if err := r.ARP.validate(); err != nil {
+			return fmt.Errorf("PCC rule %s: %w", r.ID, err)
+		}
+	}
+	return nil
+}
+
+func (a *ARP) validate() error {
+	if a != nil && (a.PriorityLevel < 1 || a.PriorityLevel > 15) {
+		return fmt.Errorf("ARP priority level %d out of range 1-15", a.PriorityLevel)
+	}
+	return nil
+}
+
+// IsGBR reports whether a standardized 5QI has a guaranteed bit rate (TS 23.501 Table 5.7.4-1)
+func IsGBR(fiveQI uint8) bool {
+	switch {
+	case fiveQI >= 1 && fiveQI <= 4,
+		fiveQI >= 65 && fiveQI <= 67,
+		fiveQI >= 71 && fiveQI <= 76,
+		fiveQI >= 82 && fiveQI <= 90:
+		return true
+	}
+	return false
+}
+
+// QoSFlow is a QoS flow of a session. The QoS of the default flow applies to
+// all traffic not matched by a PCC rule.
+type QoSFlow struct {
+	QFI  uint8
+	Rule *PCCRule // nil for the default flow
+	QoS  QoS
+}
+
+// SessionQoS is the QoS authorized for one session
+type SessionQoS struct {
+	AMBRUL  uint64 // bps
+	AMBRDL  uint64 // bps
+	Default QoSFlow
+
+	// Dedicated flows in precedence order
+	Flows []*QoSFlow
+}
+
+// PolicyStore holds the locally configured QoS policies the SMF applies
+// in place of a PCF
+type PolicyStore struct {
+	defaults    QoSPolicy
+	dnns        map[string]*QoSPolicy
+	subscribers map[string]*QoSPolicy // by IMSI and DNN
+	mu          sync.RWMutex
+}
+
+// NewPolicyStore creates a store applying defaults to sessions without a
+// policy. The defaults must set a 5QI, an ARP and the Session-AMBR.
+func NewPolicyStore(defaults QoSPolicy) *PolicyStore {
+	return &PolicyStore{
+		defaults:    defaults,
+		dnns:        make(map[string]*QoSPolicy),
+		subscribers: make(map[string]*QoSPolicy),
+	}
+}
+
+func subscriberKey(imsi, dnn string) string {
+	return imsi + "/" + dnn
+}
+
+// Set adds or replaces a policy. Policies with an IMSI apply to that
+// subscriber, on the given DNN or on all DNNs when it is empty.
+func (s *PolicyStore) Set(p QoSPolicy) error {
+	if p.IMSI == "" && p.DNN == "" {
+		return fmt.Errorf("qos policy needs a dnn or an imsi")
+	}
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p.IMSI != "" {
+		s.subscribers[subscriberKey(p.IMSI, p.DNN)] = &p
+	} else {
+		s.dnns[p.DNN] = &p
+	}
+	return nil
+}
+
+// Get returns the policy stored for a subscriber or, with an empty IMSI, a DNN
+func (s *PolicyStore) Get(imsi, dnn string) (QoSPolicy, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	p, ok := s.dnns[dnn]
+	if imsi != "" {
+		p, ok = s.subscribers[subscriberKey(imsi, dnn)]
+	}
+	if !ok {
+		return QoSPolicy{}, false
+	}
+	return *p, true
+}
+
+// Delete removes the policy of a subscriber or, with an empty IMSI, a DNN
+func (s *PolicyStore) Delete(imsi, dnn string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m, key := s.dnns, dnn
+	if imsi != "" {
+		m, key = s.subscribers, subscriberKey(imsi, dnn)
+	}
+	if _, ok := m[key]; !ok {
+		return false
+	}
+	delete(m, key)
+	return true
+}
+
+// Policies returns all stored policies, DNN policies first
+func (s *PolicyStore) Policies() []QoSPolicy {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	policies := make([]QoSPolicy, 0, len(s.dnns)+len(s.subscribers))
+	for _, p := range s.dnns {
+		policies = append(policies, *p)
+	}
+	for _, p := range s.subscribers {
+		policies = append(policies, *p)
+	}
+	sort.SliceStable(policies, func(i, j int) bool {
+		if (policies[i].IMSI == "") != (policies[j].IMSI == "") {
+			return policies[i].IMSI == ""
+		}
+		return subscriberKey(policies[i].IMSI, policies[i].DNN) < subscriberKey(policies[j].IMSI, policies[j].DNN)
+	})
+	return policies
+}
+
+// Resolve merges the policies of a session's subscriber and DNN over the
+// defaults and maps its PCC rules to QoS flows
+func (s *PolicyStore) Resolve(imsi, dnn string) *SessionQoS {
+	s.mu.RLock()
+	layers := []*QoSPolicy{&s.defaults, s.dnns[dnn], s.subscribers[subscriberKey(imsi, "")], s.subscribers[subscriberKey(imsi, dnn)]}
+	s.mu.RUnlock()
+
+	merged := QoSPolicy{}
+	rules := make(map[string]PCCRule)
+	for _, p := range layers {
+		if p == nil {
+			continue
+		}
+		if p.FiveQI != 0 {
+			merged.FiveQI = p.FiveQI
+		}
+		if p.ARP != nil {
+			merged.ARP = p.ARP
+		}
+		if p.AMBRUL != 0 {
+			merged.AMBRUL = p.AMBRUL
+		}
+		if p.AMBRDL != 0 {
+			merged.AMBRDL = p.AMBRDL
+		}
+		// A more specific policy overrides rules with the same ID
+		for _, r := range p.Rules {
+			rules[r.ID] = r
+		}
+	}
+
+	arp := ARP{PriorityLevel: 15}
+	if merged.ARP != nil {
+		arp = *merged.ARP
+	}
+	q := &SessionQoS{
+		AMBRUL: merged.AMBRUL,
+		AMBRDL: merged.AMBRDL,
+		Default: QoSFlow{
+			QFI: DefaultQFI,
+			QoS: newQoS(merged.FiveQI, arp),
+		},
+	}
+
+	ordered := make([]PCCRule, 0, len(rules))
+	for _, r := range rules {
+		ordered = append(ordered, r)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].Precedence != ordered[j].Precedence {
+			return ordered[i].Precedence < ordered[j].Precedence
+		}
+		return ordered[i].ID < ordered[j].ID
+	})
+	for i := range ordered {
+		// QFIs are six bits wide
+		if int(DefaultQFI)+1+i > 63 {
+			break
+		}
+		r := &ordered[i]
+		flowARP := arp
+		if r.ARP != nil {
+			flowARP = *r.ARP
+		}
+		qos := newQoS(r.FiveQI, flowARP)
+		qos.MaxBitRateUL, qos.MaxBitRateDL = r.MBRUL, r.MBRDL
+		qos.GuaranteedBitRateUL, qos.GuaranteedBitRateDL = r.GBRUL, r.GBRDL
+		q.Flows = append(q.Flows, &QoSFlow{
+			QFI:  DefaultQFI + 1 + uint8(i),
+			Rule: r,
+			QoS:  qos,
+		})
+	}
+	return q
+}
+
+func newQoS(fiveQI uint8, arp ARP) QoS {
+	return QoS{
+		QCI:            fiveQI,
+		ARP:            arp.PriorityLevel,
+		PriorityLevel:  arp.PriorityLevel,
+		PreemptionCap:  arp.PreemptionCapability,
+		PreemptionVuln: arp.PreemptionVulnerability,
+	}
+}
+
+// flowFilter is the part of an IPFilterRule that NAS packet filters can express
+type flowFilter struct {
+	protocol    uint8 // 0 for any
+	remote      *net.IPNet
+	remotePorts [2]uint16 // first and last, zero for any
+	localPorts  [2]uint16
+}
+
+// parseFlowFilter parses "permit out <proto> from <remote> [ports] to <ue> [ports]"
+func parseFlowFilter(s string) (*flowFilter, error) {
+	fields := strings.Fields(s)
+	if len(fields) < 6 || fields[0] != "permit" || fields[1] != "out" || fields[3] != "from" {
+		return nil, fmt.Errorf("invalid flow description %q", s)
+	}
+
+	f := &flowFilter{}
+	switch fields[2] {
+	case "ip":
+	case "tcp":
+		f.protocol = 6
+	case "udp":
+		f.protocol = 17
+	case "icmp":
+		f.protocol = 1
+	default:
+		proto, err := strconv.ParseUint(fields[2], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protocol in flow description %q", s)
+		}
+		f.protocol = uint8(proto)
+	}
+
+	rest := fields[4:]
+	var err error
+	if f.remote, err = parseFlowAddress(rest[0]); err != nil {
+		return nil, fmt.Errorf("flow description %q: %w", s, err)
+	}
+	rest = rest[1:]
+	if len(rest) > 0 && rest[0] != "to" {
+		if f.remotePorts, err = parseFlowPorts(rest[0]); err != nil {
+			return nil, fmt.Errorf("flow description %q: %w", s, err)
+		}
+		rest = rest[1:]
+	}
+	if len(rest) < 2 || rest[0] != "to" {
+		return nil, fmt.Errorf("invalid flow description %q", s)
+	}
+	// The UE side is the session's own address
+	if len(rest) > 2 {
+		if f.localPorts, err = parseFlowPorts(rest[2]); err != nil {
+			return nil, fmt.Errorf("flow description %q: %w", s, err)
+		}
+	}
+	return f, nil
+}
+
+// parseFlowAddress parses an address or prefix, returning nil for any
+func parseFlowAddress(s string) (*net.IPNet, error) {
+	if s == "any" || s == "assigned" {
+		return nil, nil
+	}
+	if !strings.Contains(s, "/") {
+		s += "/32"
+	}
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil || prefix.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid IPv4 address %q", s)
+	}
+	return prefix, nil
+}
+
+// parseFlowPorts parses a port or a port range
+func parseFlowPorts(s string) ([2]uint16, error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	first, err := strconv.ParseUint(lo, 10, 16)
+	if err != nil {
+		return [2]uint16{}, fmt.Errorf("invalid port %q", s)
+	}
+	last := first
+	if isRange {
+		if last, err = strconv.ParseUint(hi, 10, 16); err != nil || last < first {
+			return [2]uint16{}, fmt.Errorf("invalid port range %q", s)
+		}
+	}
+	return [2]uint16{uint16(first), uint16(last)}, nil
+}
@@ -0,0 +1,169 @@
+package smf
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+func testPolicyStore(t *testing.T) *PolicyStore {
+	t.Helper()
+	store := NewPolicyStore(QoSPolicy{
+		FiveQI: 9,
+		ARP:    &ARP{PriorityLevel: 8},
+		AMBRUL: 100_000_000,
+		AMBRDL: 200_000_000,
+	})
+	policies := []QoSPolicy{
+		{
+			DNN:    "ims",
+			FiveQI: 5,
+			Rules: []PCCRule{{
+				ID:               "voice",
+				Precedence:       10,
+				FlowDescriptions: []string{"permit out udp from 10.45.0.0/16 50000-50100 to assigned"},
+				FiveQI:           1,
+				GBRUL:            128_000,
+				GBRDL:            128_000,
+			}},
+		},
+		{IMSI: "001010000000001", AMBRDL: 1_000_000_000},
+		{
+			IMSI: "001010000000001",
+			DNN:  "ims",
+			Rules: []PCCRule{{
+				ID:         "video",
+				Precedence: 5,
+				AppID:      "video",
+				FiveQI:     7,
+			}},
+		},
+	}
+	for _, p := range policies {
+		if err := store.Set(p); err != nil {
+			t.Fatalf("Set(%+v) error = %v", p, err)
+		}
+	}
+	return store
+}
+
+func TestPolicyStoreResolve(t *testing.T) {
+	store := testPolicyStore(t)
+
+	q := store.Resolve("001010000000002", "internet")
+	if q.Default.QoS.QCI != 9 || q.Default.QoS.PriorityLevel != 8 || len(q.Flows) != 0 {
+		t.Errorf("defaults: 5QI %d ARP %d flows %d, want 9/8/0", q.Default.QoS.QCI, q.Default.QoS.PriorityLevel, len(q.Flows))
+	}
+
+	q = store.Resolve("001010000000001", "ims")
+	if q.Default.QoS.QCI != 5 {
+		t.Errorf("default 5QI = %d, want 5 from the DNN policy", q.Default.QoS.QCI)
+	}
+	if q.AMBRUL != 100_000_000 || q.AMBRDL != 1_000_000_000 {
+		t.Errorf("AMBR = %d/%d, want 100M/1G", q.AMBRUL, q.AMBRDL)
+	}
+	if len(q.Flows) != 2 {
+		t.Fatalf("flows = %d, want 2", len(q.Flows))
+	}
+	// Flows are numbered in precedence order
+	if q.Flows[0].Rule.ID != "video" || q.Flows[0].QFI != 2 || q.Flows[1].Rule.ID != "voice" || q.Flows[1].QFI != 3 {
+		t.Errorf("flows = %s/%d, %s/%d, want video/2, voice/3",
+			q.Flows[0].Rule.ID, q.Flows[0].QFI, q.Flows[1].Rule.ID, q.Flows[1].QFI)
+	}
+	if q.Flows[1].QoS.GuaranteedBitRateDL != 128_000 || q.Flows[1].QoS.PriorityLevel != 8 {
+		t.Errorf("voice flow QoS = %+v", q.Flows[1].QoS)
+	}
+}
+
+func TestQoSPolicyValidate(t *testing.T) {
+	for name, p := range map[string]QoSPolicy{
+		"GBR default":      {DNN: "a", FiveQI: 1},
+		"ARP out of range": {DNN: "a", ARP: &ARP{PriorityLevel: 16}},
+		"rule without 5QI": {DNN: "a", Rules: []PCCRule{{ID: "r", AppID: "x"}}},
+		"GBR without rate": {DNN: "a", Rules: []PCCRule{{ID: "r", AppID: "x", FiveQI: 1}}},
+		"bad flow":         {DNN: "a", Rules: []PCCRule{{ID: "r", FiveQI: 9, FlowDescriptions: []string{"permit in ip"}}}},
+		"no filter":        {DNN: "a", Rules: []PCCRule{{ID: "r", FiveQI: 9}}},
+	} {
+		if err := p.Validate(); err == nil {
+			t.Errorf("%s: Validate() error = nil", name)
+		}
+	}
+}
+
+func TestSessionRulesQoS(t *testing.T) {
+	rules := &SessionRules{
+		UEIP:    net.IPv4(10, 0, 0, 1),
+		DNN:     "ims",
+		UPFTEID: 1,
+		UPFAddr: net.IPv4(192, 168, 0, 1),
+		QoS:     testPolicyStore(t).Resolve("001010000000002", "ims"),
+	}
+
+	var qers, pdrs int
+	for _, i := range rules.EstablishmentIEs() {
+		switch i.Type {
+		case ie.CreateQER:
+			qers++
+		case ie.CreatePDR:
+			pdrs++
+			children, _ := i.CreatePDR()
+			var ids int
+			for _, c := range children {
+				if c.Type == ie.QERID {
+					ids++
+				}
+			}
+			if ids != 2 {
+				t.Errorf("PDR has %d QER IDs, want session and flow QER", ids)
+			}
+		}
+	}
+	// Session-AMBR, default flow and voice flow
+	if qers != 3 || pdrs != 4 {
+		t.Errorf("QERs/PDRs = %d/%d, want 3/4", qers, pdrs)
+	}
+}
+
+func TestSessionRulesDescribe(t *testing.T) {
+	rules := &SessionRules{
+		UEIP:    net.IPv4(10, 0, 0, 1),
+		DNN:     "ims",
+		UPFTEID: 1,
+		UPFAddr: net.IPv4(192, 168, 0, 1),
+		QoS:     testPolicyStore(t).Resolve("001010000000002", "ims"),
+	}
+
+	set := rules.Describe()
+	if len(set.PDRs) != 4 || len(set.FARs) != 2 || len(set.QERs) != 3 {
+		t.Fatalf("PDRs/FARs/QERs = %d/%d/%d, want 4/2/3", len(set.PDRs), len(set.FARs), len(set.QERs))
+	}
+	if set.FARs[1].Action != "BUFF|NOCP" {
+		t.Errorf("downlink FAR action = %s before the peer is known, want BUFF|NOCP", set.FARs[1].Action)
+	}
+	voice := set.PDRs[2]
+	if voice.ID != flowPDRBase || voice.Precedence != 10 || len(voice.Filters) != 1 || voice.QERIDs[1] != flowQERBase {
+		t.Errorf("voice uplink PDR = %+v", voice)
+	}
+	if set.QERs[2].GBRDL != 128 {
+		t.Errorf("voice QER GBR = %d kbps, want 128", set.QERs[2].GBRDL)
+	}
+}
+
+func TestEncodeQoSRule(t *testing.T) {
+	q := testPolicyStore(t).Resolve("001010000000002", "ims")
+	b := encodeQoSRule(2, q.Flows[0])
+	want := []byte{
+		0x02, 0x00, 0x15, // rule 2, length
+		0x21,       // create, one filter
+		0x31, 0x10, // bidirectional filter 1, length
+		0x10, 10, 45, 0, 0, 255, 255, 0, 0, // remote address
+		0x30, 17, // UDP
+		0x51, 0xc3, 0x50, 0xc3, 0xb4, // remote port range
+		10, 2, // precedence, QFI
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("encodeQoSRule() = %x, want %x", b, want)
+	}
+}
@@ -0,0 +1,433 @@
+package smf
+
+import (
+	"net"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// Apply Action flags (TS 29.244 §8.2.26)
+const (
+	ApplyActionDROP uint8 = 0x01
+	ApplyActionFORW uint8 = 0x02
+	ApplyActionBUFF uint8 = 0x04
+	ApplyActionNOCP uint8 = 0x08
+	ApplyActionDUPL uint8 = 0x10
+)
+
+// Outer header and address flags used in PFCP rules
+const (
+	outerHeaderCreationGTPUIPv4 uint16 = 0x0100
+	outerHeaderCreationUDPIPv4  uint16 = 0x0400
+	outerHeaderCreationUDPIPv6  uint16 = 0x0800
+	outerHeaderRemovalGTPUIPv4  uint8  = 0
+	fteidFlagV4                 uint8  = 0x01
+	ueIPFlagV6                  uint8  = 0x01
+	ueIPFlagV4                  uint8  = 0x02
+	ueIPFlagSD                  uint8  = 0x04
+	ueIPFlagIP6PL               uint8  = 0x40
+)
+
+// Default rule identifiers of a PDN session
+const (
+	uplinkPDRID   uint16 = 1
+	downlinkPDRID uint16 = 2
+	uplinkFARID   uint32 = 1
+	downlinkFARID uint32 = 2
+)
+
+// QoS enforcement rule identifiers. Each dedicated QoS flow gets a QER and
+// an uplink and downlink PDR numbered from the bases.
+const (
+	sessionQERID     uint32 = 1
+	defaultFlowQERID uint32 = 2
+	flowQERBase      uint32 = 10
+	flowPDRBase      uint16 = 200
+)
+
+// SessionRules describes the user plane of a session on its UPF
+type SessionRules struct {
+	UEIP   net.IP // nil for IPv6-only sessions
+	UEIPv6 net.IP // address in the delegated /64, nil for IPv4-only sessions
+	DNN    string
+
+	// UPF side of the access tunnel (uplink)
+	UPFTEID uint32
+	UPFAddr net.IP
+
+	// Access side of the tunnel (downlink), unknown until the bearer is set up
+	PeerTEID uint32
+	PeerAddr net.IP
+
+	// Authorized QoS enforced with QERs, nil to forward without policing
+	QoS *SessionQoS
+
+	// Credit granted by the OCS and measured with a URR, nil when not charged
+	Charging *CreditQuota
+
+	// Time without traffic after which the UPF reports the session idle
+	// with its User Plane Inactivity Timer, 0 to not detect inactivity
+	InactivityTimeout time.Duration
+
+	// Interception tasks the forwarded packets are duplicated for
+	X3 []X3Delivery
+}
+
+// EstablishmentIEs returns the Create PDR/FAR/QER IEs of a Session Establishment Request
+func (r *SessionRules) EstablishmentIEs() []*ie.IE {
+	ies := []*ie.IE{
+		ie.NewCreatePDR(append([]*ie.IE{
+			ie.NewPDRID(uplinkPDRID),
+			ie.NewPrecedence(255),
+			r.uplinkPDI(),
+			ie.NewOuterHeaderRemoval(outerHeaderRemovalGTPUIPv4, 0),
+			ie.NewFARID(uplinkFARID),
+		}, append(r.qerIDs(defaultFlowQERID), r.urrIDs()...)...)...),
+		ie.NewCreatePDR(append([]*ie.IE{
+			ie.NewPDRID(downlinkPDRID),
+			ie.NewPrecedence(255),
+			r.downlinkPDI(),
+			ie.NewFARID(downlinkFARID),
+		}, append(r.qerIDs(defaultFlowQERID), r.urrIDs()...)...)...),
+		ie.NewCreateFAR(append([]*ie.IE{
+			ie.NewFARID(uplinkFARID),
+			ie.NewApplyAction(r.forwardAction()),
+			ie.NewForwardingParameters(
+				ie.NewDestinationInterface(ie.DstInterfaceCore),
+				ie.NewNetworkInstance(r.DNN),
+			),
+		}, r.duplicatingParameters(false)...)...),
+		r.downlinkFAR(),
+	}
+	if r.QoS != nil {
+		ies = append(ies, r.qosIEs()...)
+	}
+	if r.Charging != nil {
+		ies = append(ies, ie.NewCreateURR(r.Charging.urrIEs()...))
+	}
+	if r.InactivityTimeout > 0 {
+		ies = append(ies, ie.NewUserPlaneInactivityTimer(r.InactivityTimeout))
+	}
+	return ies
+}
+
+// uplinkPDI matches uplink traffic of the access tunnel
+func (r *SessionRules) uplinkPDI(extra ...*ie.IE) *ie.IE {
+	return ie.NewPDI(append([]*ie.IE{
+		ie.NewSourceInterface(ie.SrcInterfaceAccess),
+		ie.NewFTEID(fteidFlagV4, r.UPFTEID, r.UPFAddr.To4(), nil, 0),
+		ie.NewNetworkInstance(r.DNN),
+		ueIPAddress(r.UEIP, r.UEIPv6, 0),
+	}, extra...)...)
+}
+
+// downlinkPDI matches downlink traffic to the UE from the data network
+func (r *SessionRules) downlinkPDI(extra ...*ie.IE) *ie.IE {
+	return ie.NewPDI(append([]*ie.IE{
+		ie.NewSourceInterface(ie.SrcInterfaceCore),
+		ie.NewNetworkInstance(r.DNN),
+		ueIPAddress(r.UEIP, r.UEIPv6, ueIPFlagSD),
+	}, extra...)...)
+}
+
+// ueIPAddress returns the UE IP Address IE of a session's addresses. The
+// IPv6 address stands for the /64 delegated to the UE, which the UPF
+// matches on instead of the full address.
+func ueIPAddress(v4, v6 net.IP, flags uint8) *ie.IE {
+	var s4, s6 string
+	if v4 != nil {
+		flags |= ueIPFlagV4
+		s4 = v4.String()
+	}
+	if v6 != nil {
+		flags |= ueIPFlagV6 | ueIPFlagIP6PL
+		s6 = v6.String()
+	}
+	return ie.NewUEIPAddress(flags, s4, s6, 0, UEPrefixLength)
+}
+
+// qerIDs returns the QER IDs enforced on a PDR of the given QoS flow: the
+// Session-AMBR and the flow's own QER. Sessions without QoS have none.
+func (r *SessionRules) qerIDs(flowQERID uint32) []*ie.IE {
+	if r.QoS == nil {
+		return nil
+	}
+	return []*ie.IE{ie.NewQERID(sessionQERID), ie.NewQERID(flowQERID)}
+}
+
+// sessionQERs returns the QERs of the Session-AMBR and the default QoS flow
+func (r *SessionRules) sessionQERs() []*ie.IE {
+	return []*ie.IE{
+		ie.NewCreateQER(
+			ie.NewQERID(sessionQERID),
+			ie.NewGateStatus(ie.GateStatusOpen, ie.GateStatusOpen),
+			ie.NewMBR(kbps(r.QoS.AMBRUL), kbps(r.QoS.AMBRDL)),
+		),
+		ie.NewCreateQER(
+			ie.NewQERID(defaultFlowQERID),
+			ie.NewGateStatus(ie.GateStatusOpen, ie.GateStatusOpen),
+			ie.NewQFI(r.QoS.Default.QFI),
+		),
+	}
+}
+
+// qosIEs returns the QERs of the session and the PDRs steering the service
+// data flows of its PCC rules into their dedicated QoS flows
+func (r *SessionRules) qosIEs() []*ie.IE {
+	ies := r.sessionQERs()
+	for i, flow := range r.QoS.Flows {
+		qerID := flowQERBase + uint32(i)
+		qer := []*ie.IE{
+			ie.NewQERID(qerID),
+			ie.NewGateStatus(ie.GateStatusOpen, ie.GateStatusOpen),
+			ie.NewQFI(flow.QFI),
+		}
+		if flow.QoS.MaxBitRateUL > 0 || flow.QoS.MaxBitRateDL > 0 {
+			qer = append(qer, ie.NewMBR(kbps(flow.QoS.MaxBitRateUL), kbps(flow.QoS.MaxBitRateDL)))
+		}
+		if flow.QoS.GuaranteedBitRateUL > 0 || flow.QoS.GuaranteedBitRateDL > 0 {
+			qer = append(qer, ie.NewGBR(kbps(flow.QoS.GuaranteedBitRateUL), kbps(flow.QoS.GuaranteedBitRateDL)))
+		}
+		ies = append(ies, ie.NewCreateQER(qer...))
+
+		// The same service data flow filters select the flow in both directions
+		var filters []*ie.IE
+		for _, fd := range flow.Rule.FlowDescriptions {
+			filters = append(filters, ie.NewSDFFilter(fd, "", "", "", 0))
+		}
+		if flow.Rule.AppID != "" {
+			filters = append(filters, ie.NewApplicationID(flow.Rule.AppID))
+		}
+		precedence := flow.Rule.Precedence
+		if precedence >= 255 {
+			precedence = 254
+		}
+		pdrID := flowPDRBase + 2*uint16(i)
+		ies = append(ies,
+			ie.NewCreatePDR(append([]*ie.IE{
+				ie.NewPDRID(pdrID),
+				ie.NewPrecedence(precedence),
+				r.uplinkPDI(filters...),
+				ie.NewOuterHeaderRemoval(outerHeaderRemovalGTPUIPv4, 0),
+				ie.NewFARID(uplinkFARID),
+			}, append(r.qerIDs(qerID), r.urrIDs()...)...)...),
+			ie.NewCreatePDR(append([]*ie.IE{
+				ie.NewPDRID(pdrID + 1),
+				ie.NewPrecedence(precedence),
+				r.downlinkPDI(filters...),
+				ie.NewFARID(downlinkFARID),
+			}, append(r.qerIDs(qerID), r.urrIDs()...)...)...),
+		)
+	}
+	return ies
+}
+
+// kbps converts a bit rate to the kilobits per second used by PFCP, rounding up
+func kbps(bps uint64) uint64 {
+	return (bps + 999) / 1000
+}
+
+// downlinkFAR forwards to the access peer once known and buffers until then
+func (r *SessionRules) downlinkFAR() *ie.IE {
+	if r.PeerAddr == nil {
+		return ie.NewCreateFAR(
+			ie.NewFARID(downlinkFARID),
+			ie.NewApplyAction(ApplyActionBUFF|ApplyActionNOCP),
+		)
+	}
+	return ie.NewCreateFAR(append([]*ie.IE{
+		ie.NewFARID(downlinkFARID),
+		ie.NewApplyAction(r.forwardAction()),
+		ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceAccess),
+			ie.NewOuterHeaderCreation(outerHeaderCreationGTPUIPv4, r.PeerTEID, r.PeerAddr.String(), "", 0, 0, 0),
+		),
+	}, r.duplicatingParameters(false)...)...)
+}
+
+// DownlinkFARUpdate returns the Update FAR IE of a Session Modification Request
+// pointing the downlink at the current access peer, buffering while it is unknown
+func (r *SessionRules) DownlinkFARUpdate() *ie.IE {
+	if r.PeerAddr == nil {
+		return ie.NewUpdateFAR(
+			ie.NewFARID(downlinkFARID),
+			ie.NewApplyAction(ApplyActionBUFF|ApplyActionNOCP),
+		)
+	}
+	return ie.NewUpdateFAR(append([]*ie.IE{
+		ie.NewFARID(downlinkFARID),
+		ie.NewApplyAction(r.forwardAction()),
+		ie.NewUpdateForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceAccess),
+			ie.NewOuterHeaderCreation(outerHeaderCreationGTPUIPv4, r.PeerTEID, r.PeerAddr.String(), "", 0, 0, 0),
+		),
+	}, r.duplicatingParameters(true)...)...)
+}
+
+// UplinkFARUpdate returns the Update FAR IE of a Session Modification
+// Request starting or stopping the duplication of the uplink
+func (r *SessionRules) UplinkFARUpdate() *ie.IE {
+	return r.DuplicationFARUpdate(uplinkFARID)
+}
+
+// DuplicationFARUpdate returns the Update FAR IE starting or stopping the
+// duplication of the packets a forwarding FAR forwards, such as the anchor
+// FARs of an uplink classifier
+func (r *SessionRules) DuplicationFARUpdate(farID uint32) *ie.IE {
+	return ie.NewUpdateFAR(append([]*ie.IE{
+		ie.NewFARID(farID),
+		ie.NewApplyAction(r.forwardAction()),
+	}, r.duplicatingParameters(true)...)...)
+}
+
+// forwardAction is the Apply Action of the FARs forwarding the session,
+// duplicating its packets while it is intercepted
+func (r *SessionRules) forwardAction() uint8 {
+	if len(r.X3) > 0 {
+		return ApplyActionFORW | ApplyActionDUPL
+	}
+	return ApplyActionFORW
+}
+
+// duplicatingParameters returns the Duplicating Parameters IEs of the
+// forwarding FARs, or their Update Duplicating Parameters which replace all
+// of them
+func (r *SessionRules) duplicatingParameters(update bool) []*ie.IE {
+	ies := make([]*ie.IE, 0, len(r.X3))
+	for i := range r.X3 {
+		if update {
+			ies = append(ies, ie.NewUpdateDuplicatingParameters(r.X3[i].duplicatingParameters()...))
+		} else {
+			ies = append(ies, ie.NewDuplicatingParameters(r.X3[i].duplicatingParameters()...))
+		}
+	}
+	return ies
+}
+
+// PDRInfo, FARInfo, QERInfo and URRInfo describe the rules of a session for operators
+type PDRInfo struct {
+	ID         uint16   `json:"id"`
+	Precedence uint32   `json:"precedence"`
+	Source     string   `json:"source"`
+	TEID       uint32   `json:"teid,omitempty"`
+	Filters    []string `json:"filters,omitempty"`
+	AppID      string   `json:"app_id,omitempty"`
+	FARID      uint32   `json:"far_id"`
+	QERIDs     []uint32 `json:"qer_ids,omitempty"`
+	URRIDs     []uint32 `json:"urr_ids,omitempty"`
+}
+
+type FARInfo struct {
+	ID          uint32 `json:"id"`
+	Action      string `json:"action"`
+	Destination string `json:"destination,omitempty"`
+	PeerTEID    uint32 `json:"peer_teid,omitempty"`
+	PeerAddr    net.IP `json:"peer_addr,omitempty"`
+}
+
+type QERInfo struct {
+	ID    uint32 `json:"id"`
+	QFI   uint8  `json:"qfi,omitempty"`
+	MBRUL uint64 `json:"mbr_ul,omitempty"` // kbps
+	MBRDL uint64 `json:"mbr_dl,omitempty"` // kbps
+	GBRUL uint64 `json:"gbr_ul,omitempty"` // kbps
+	GBRDL uint64 `json:"gbr_dl,omitempty"` // kbps
+}
+
+type URRInfo struct {
+	ID              uint32 `json:"id"`
+	RatingGroup     uint32 `json:"rating_group,omitempty"`
+	VolumeQuota     uint64 `json:"volume_quota,omitempty"`     // bytes
+	VolumeThreshold uint64 `json:"volume_threshold,omitempty"` // bytes
+	TimeQuota       uint32 `json:"time_quota,omitempty"`       // seconds
+	TimeThreshold   uint32 `json:"time_threshold,omitempty"`   // seconds
+}
+
+// RuleSet lists the PDRs, FARs, QERs and URRs installed by EstablishmentIEs
+type RuleSet struct {
+	PDRs []PDRInfo `json:"pdrs"`
+	FARs []FARInfo `json:"fars"`
+	QERs []QERInfo `json:"qers,omitempty"`
+	URRs []URRInfo `json:"urrs,omitempty"`
+
+	InactivityTimer uint32 `json:"inactivity_timer,omitempty"` // seconds
+}
+
+// Describe returns the rules the session has on its UPF. Duplication for
+// lawful interception is left out.
+func (r *SessionRules) Describe() *RuleSet {
+	defaultQERs := r.qerIDList(defaultFlowQERID)
+	urrs := r.urrIDList()
+	set := &RuleSet{
+		PDRs: []PDRInfo{
+			{ID: uplinkPDRID, Precedence: 255, Source: "access", TEID: r.UPFTEID, FARID: uplinkFARID, QERIDs: defaultQERs, URRIDs: urrs},
+			{ID: downlinkPDRID, Precedence: 255, Source: "core", FARID: downlinkFARID, QERIDs: defaultQERs, URRIDs: urrs},
+		},
+		FARs: []FARInfo{{ID: uplinkFARID, Action: "FORW", Destination: "core"}},
+	}
+	if q := r.Charging; q != nil {
+		set.URRs = []URRInfo{{
+			ID:              ChargingURRID,
+			RatingGroup:     q.RatingGroup,
+			VolumeQuota:     q.Volume,
+			VolumeThreshold: q.VolumeThreshold,
+			TimeQuota:       q.Time,
+			TimeThreshold:   q.TimeThreshold,
+		}}
+	}
+	set.InactivityTimer = uint32(r.InactivityTimeout / time.Second)
+	if r.PeerAddr == nil {
+		set.FARs = append(set.FARs, FARInfo{ID: downlinkFARID, Action: "BUFF|NOCP"})
+	} else {
+		set.FARs = append(set.FARs, FARInfo{
+			ID: downlinkFARID, Action: "FORW", Destination: "access",
+			PeerTEID: r.PeerTEID, PeerAddr: r.PeerAddr,
+		})
+	}
+	if r.QoS == nil {
+		return set
+	}
+
+	set.QERs = []QERInfo{
+		{ID: sessionQERID, MBRUL: kbps(r.QoS.AMBRUL), MBRDL: kbps(r.QoS.AMBRDL)},
+		{ID: defaultFlowQERID, QFI: r.QoS.Default.QFI},
+	}
+	for i, flow := range r.QoS.Flows {
+		qerID := flowQERBase + uint32(i)
+		set.QERs = append(set.QERs, QERInfo{
+			ID:    qerID,
+			QFI:   flow.QFI,
+			MBRUL: kbps(flow.QoS.MaxBitRateUL),
+			MBRDL: kbps(flow.QoS.MaxBitRateDL),
+			GBRUL: kbps(flow.QoS.GuaranteedBitRateUL),
+			GBRDL: kbps(flow.QoS.GuaranteedBitRateDL),
+		})
+
+		precedence := flow.Rule.Precedence
+		if precedence >= 255 {
+			precedence = 254
+		}
+		pdrID := flowPDRBase + 2*uint16(i)
+		pdr := PDRInfo{
+			Precedence: precedence,
+			Filters:    flow.Rule.FlowDescriptions,
+			AppID:      flow.Rule.AppID,
+			QERIDs:     r.qerIDList(qerID),
+			URRIDs:     urrs,
+		}
+		ul, dl := pdr, pdr
+		ul.ID, ul.Source, ul.TEID, ul.FARID = pdrID, "access", r.UPFTEID, uplinkFARID
+		dl.ID, dl.Source, dl.FARID = pdrID+1, "core", downlinkFARID
+		set.PDRs = append(set.PDRs, ul, dl)
+	}
+	return set
+}
+
+// qerIDList is qerIDs as plain IDs
+func (r *SessionRules) qerIDList(flowQERID uint32) []uint32 {
+	if r.QoS == nil {
+		return nil
+	}
+	return []uint32{sessionQERID, flowQERID}
+}
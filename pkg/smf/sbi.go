@@ -0,0 +1,258 @@
+package smf
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// Nsmf_PDUSession data types (TS 29.502 §6.1.6)
+
+// Content types of the binary parts of Nsmf_PDUSession messages
+const (
+	ContentTypeJSON        = "application/json"
+	ContentTypeProblemJSON = "application/problem+json"
+	ContentType5GNAS       = "application/vnd.3gpp.5gnas"
+	ContentTypeNGAP        = "application/vnd.3gpp.ngap"
+)
+
+// N2 SM information types
+const (
+	N2SmInfoTypePDUResSetupReq  = "PDU_RES_SETUP_REQ"
+	N2SmInfoTypePDUResSetupRsp  = "PDU_RES_SETUP_RSP"
+	N2SmInfoTypePDUResSetupFail = "PDU_RES_SETUP_FAIL"
+	N2SmInfoTypePDUResRelRsp    = "PDU_RES_REL_RSP"
+)
+
+// User plane connection states
+const (
+	UpCnxStateActivated   = "ACTIVATED"
+	UpCnxStateDeactivated = "DEACTIVATED"
+	UpCnxStateActivating  = "ACTIVATING"
+)
+
+// PlmnID identifies a PLMN
+type PlmnID struct {
+	Mcc string `json:"mcc"`
+	Mnc string `json:"mnc"`
+}
+
+// Tai is a 5GS tracking area identity
+type Tai struct {
+	PlmnID PlmnID `json:"plmnId"`
+	Tac    string `json:"tac"`
+}
+
+// NrLocation is the NR part of UserLocation
+type NrLocation struct {
+	Tai Tai `json:"tai"`
+}
+
+// UserLocation is where the UE is attached
+type UserLocation struct {
+	NrLocation *NrLocation `json:"nrLocation,omitempty"`
+}
+
+// TAI returns the tracking area in the "mcc-mnc-tac" notation used for UPF
+// selection, with the hexadecimal TAC converted to decimal as in GTPv2-C
+func (l *UserLocation) TAI() string {
+	if l == nil || l.NrLocation == nil {
+		return ""
+	}
+	tai := l.NrLocation.Tai
+	tac, err := strconv.ParseUint(tai.Tac, 16, 24)
+	if err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s-%d", tai.PlmnID.Mcc, tai.PlmnID.Mnc, tac)
+}
+
+// RefToBinaryData references a binary part of a multipart message by Content-ID
+type RefToBinaryData struct {
+	ContentID string `json:"contentId"`
+}
+
+// SmContextCreateData is the body of a CreateSMContext request
+type SmContextCreateData struct {
+	Supi               string           `json:"supi,omitempty"`
+	Pei                string           `json:"pei,omitempty"`
+	Gpsi               string           `json:"gpsi,omitempty"`
+	PduSessionID       uint8            `json:"pduSessionId,omitempty"`
+	Dnn                string           `json:"dnn,omitempty"`
+	SNssai             *SNSSAI          `json:"sNssai,omitempty"`
+	ServingNfID        string           `json:"servingNfId"`
+	ServingNetwork     *PlmnID          `json:"servingNetwork,omitempty"`
+	AnType             string           `json:"anType"`
+	RatType            string           `json:"ratType,omitempty"`
+	UeLocation         *UserLocation    `json:"ueLocation,omitempty"`
+	SmContextStatusURI string           `json:"smContextStatusUri"`
+	N1SmMsg            *RefToBinaryData `json:"n1SmMsg,omitempty"`
+}
+
+// SmContextCreatedData is the body of a successful CreateSMContext response.
+// The SMF returns the N1 PDU Session Establishment Accept and the N2 resource
+// setup request with it instead of a separate N1N2MessageTransfer to the AMF.
+type SmContextCreatedData struct {
+	PduSessionID uint8            `json:"pduSessionId,omitempty"`
+	SNssai       *SNSSAI          `json:"sNssai,omitempty"`
+	UpCnxState   string           `json:"upCnxState,omitempty"`
+	N1SmMsg      *RefToBinaryData `json:"n1SmMsg,omitempty"`
+	N2SmInfo     *RefToBinaryData `json:"n2SmInfo,omitempty"`
+	N2SmInfoType string           `json:"n2SmInfoType,omitempty"`
+}
+
+// SmContextUpdateData is the body of an UpdateSMContext request
+type SmContextUpdateData struct {
+	UpCnxState   string           `json:"upCnxState,omitempty"`
+	AnType       string           `json:"anType,omitempty"`
+	UeLocation   *UserLocation    `json:"ueLocation,omitempty"`
+	N2SmInfo     *RefToBinaryData `json:"n2SmInfo,omitempty"`
+	N2SmInfoType string           `json:"n2SmInfoType,omitempty"`
+	Release      bool             `json:"release,omitempty"`
+	Cause        string           `json:"cause,omitempty"`
+}
+
+// SmContextUpdatedData is the body of a successful UpdateSMContext response
+type SmContextUpdatedData struct {
+	UpCnxState string `json:"upCnxState,omitempty"`
+}
+
+// SmContextReleaseData is the body of a ReleaseSMContext request
+type SmContextReleaseData struct {
+	Cause      string        `json:"cause,omitempty"`
+	UeLocation *UserLocation `json:"ueLocation,omitempty"`
+}
+
+// Resource statuses of an SM context status notification
+const (
+	ResourceStatusReleased    = "RELEASED"
+	ResourceStatusUnchanged   = "UNCHANGED"
+	ResourceStatusTransferred = "TRANSFERRED"
+)
+
+// StatusInfo is the status of an SM context
+type StatusInfo struct {
+	ResourceStatus string `json:"resourceStatus"`
+	Cause          string `json:"cause,omitempty"`
+}
+
+// SmContextStatusNotification tells the AMF that the SMF changed an SM
+// context on its own, e.g. released it (TS 29.502 §6.1.6.2.8)
+type SmContextStatusNotification struct {
+	StatusInfo StatusInfo `json:"statusInfo"`
+}
+
+// ProblemDetails describes an SBI error (TS 29.571 §5.2.4.1)
+type ProblemDetails struct {
+	Title  string `json:"title,omitempty"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Cause  string `json:"cause,omitempty"`
+}
+
+// SmContextCreateError is the body of a failed CreateSMContext response
+type SmContextCreateError struct {
+	Error   ProblemDetails   `json:"error"`
+	N1SmMsg *RefToBinaryData `json:"n1SmMsg,omitempty"`
+}
+
+// BinaryPart is a binary part of a multipart/related message
+type BinaryPart struct {
+	ContentID   string
+	ContentType string
+	Data        []byte
+}
+
+// ReadSBIRequest decodes the JSON body of an application/json or
+// multipart/related request into v and returns its binary parts by Content-ID
+func ReadSBIRequest(r *http.Request, v interface{}) (map[string][]byte, error) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid content type: %w", err)
+	}
+
+	if mediaType != "multipart/related" {
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+			return nil, fmt.Errorf("invalid JSON body: %w", err)
+		}
+		return nil, nil
+	}
+
+	parts := make(map[string][]byte)
+	reader := multipart.NewReader(r.Body, params["boundary"])
+	for first := true; ; first = false {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid multipart body: %w", err)
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid multipart body: %w", err)
+		}
+
+		// The JSON part comes first and carries no Content-ID
+		if first {
+			if err := json.Unmarshal(data, v); err != nil {
+				return nil, fmt.Errorf("invalid JSON part: %w", err)
+			}
+			continue
+		}
+		id := strings.Trim(part.Header.Get("Content-Id"), "<>")
+		parts[id] = data
+	}
+	return parts, nil
+}
+
+// WriteSBIResponse writes v as JSON, or as the first part of a
+// multipart/related body when binary parts are attached
+func WriteSBIResponse(w http.ResponseWriter, status int, contentType string, v interface{}, parts ...BinaryPart) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if len(parts) == 0 {
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		_, err = w.Write(body)
+		return err
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Type", contentType)
+	pw, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	pw.Write(body)
+
+	for _, p := range parts {
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Type", p.ContentType)
+		header.Set("Content-Id", p.ContentID)
+		pw, err := mw.CreatePart(header)
+		if err != nil {
+			return err
+		}
+		pw.Write(p.Data)
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", fmt.Sprintf(`multipart/related; type="%s"; boundary=%s`, contentType, mw.Boundary()))
+	w.WriteHeader(status)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
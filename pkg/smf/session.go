@@ -132,7 +132,9 @@ func (sm *SessionManager) DeleteSession(ctx context.Context, imsi string) error
 	return sm.redis.Del(ctx, key).Err()
 }
 
-// storeSession stores a session in Redis
+// storeSession stores a session in Redis. The key does not expire: an
+// expired key would drop the session without releasing its UPF state and
+// UE IP, so idle sessions are released through DeleteSession instead.
 func (sm *SessionManager) storeSession(ctx context.Context, session *Session) error {
 	data, err := json.Marshal(session)
 	if err != nil {
@@ -140,7 +142,7 @@ func (sm *SessionManager) storeSession(ctx context.Context, session *Session) er
 	}
 
 	key := fmt.Sprintf("session:%s", session.IMSI)
-	return sm.redis.Set(ctx, key, data, 24*time.Hour).Err()
+	return sm.redis.Set(ctx, key, data, 0).Err()
 }
 
 // HandleCreateSessionRequest processes a Create Session Request
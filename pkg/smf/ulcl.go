@@ -0,0 +1,344 @@
+package smf
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// Rule identifier ranges of sessions with an uplink classifier
+const (
+	steeringPDRBase    uint16 = 10
+	anchorDLPDRBase    uint16 = 100
+	anchorFARBase      uint32 = 10
+	steeringPrecedence uint32 = 100
+)
+
+// SteeringRule steers uplink traffic to a PDU Session Anchor other than the
+// default one. Traffic matches when its destination is in Prefixes, its UE
+// source address is in SourcePrefixes (multi-homing branching point) or it
+// is classified as one of AppIDs.
+type SteeringRule struct {
+	Name           string   `mapstructure:"name" json:"name"`
+	PSA            string   `mapstructure:"psa" json:"psa"`
+	Prefixes       []string `mapstructure:"prefixes" json:"prefixes,omitempty"`
+	SourcePrefixes []string `mapstructure:"source_prefixes" json:"source_prefixes,omitempty"`
+	AppIDs         []string `mapstructure:"app_ids" json:"app_ids,omitempty"`
+}
+
+// ULCLPolicy inserts an uplink classifier UPF into the sessions of a DNN
+type ULCLPolicy struct {
+	DNN        string         `mapstructure:"dnn" json:"dnn"`
+	ULCL       string         `mapstructure:"ulcl" json:"ulcl"`
+	DefaultPSA string         `mapstructure:"default_psa" json:"default_psa"`
+	Rules      []SteeringRule `mapstructure:"rules" json:"rules"`
+}
+
+// Validate checks that the policy is complete and its prefixes parse
+func (p *ULCLPolicy) Validate() error {
+	if p.DNN == "" || p.ULCL == "" || p.DefaultPSA == "" {
+		return fmt.Errorf("ulcl policy needs dnn, ulcl and default_psa")
+	}
+	for _, r := range p.Rules {
+		if r.PSA == "" {
+			return fmt.Errorf("steering rule %q of dnn %s has no psa", r.Name, p.DNN)
+		}
+		for _, prefix := range append(append([]string{}, r.Prefixes...), r.SourcePrefixes...) {
+			if _, _, err := net.ParseCIDR(prefix); err != nil {
+				return fmt.Errorf("steering rule %q: invalid prefix %q", r.Name, prefix)
+			}
+		}
+	}
+	return nil
+}
+
+// Anchors returns the UPF IDs of all PSAs of the policy, default first
+func (p *ULCLPolicy) Anchors() []string {
+	anchors := []string{p.DefaultPSA}
+	seen := map[string]bool{p.DefaultPSA: true}
+	for _, r := range p.Rules {
+		if !seen[r.PSA] {
+			seen[r.PSA] = true
+			anchors = append(anchors, r.PSA)
+		}
+	}
+	return anchors
+}
+
+// SessionLeg is the PFCP session a PDU session has on one UPF
+type SessionLeg struct {
+	UPFID      string `json:"upf_id"`
+	LocalSEID  uint64 `json:"local_seid"`
+	RemoteSEID uint64 `json:"remote_seid"`
+}
+
+// AnchorTunnel is the N9 tunnel between the classifier and a PSA
+type AnchorTunnel struct {
+	UPFID string
+	Addr  net.IP
+
+	// UplinkTEID receives uplink traffic on the PSA,
+	// DownlinkTEID receives the PSA's downlink traffic on the classifier
+	UplinkTEID   uint32
+	DownlinkTEID uint32
+
+	index int
+}
+
+// local reports whether the PSA is co-located with the classifier
+func (a *AnchorTunnel) local(ulcl string) bool {
+	return a.UPFID == ulcl
+}
+
+// ULCLSessionRules describes a session spanning an uplink classifier and
+// one or more PDU Session Anchors
+type ULCLSessionRules struct {
+	UEIP   net.IP
+	UEIPv6 net.IP
+	DNN    string
+	Policy *ULCLPolicy
+
+	// Access tunnel terminating on the classifier
+	ULCLTEID uint32
+	ULCLAddr net.IP
+	PeerTEID uint32
+	PeerAddr net.IP
+
+	Anchors []*AnchorTunnel
+
+	// Session-AMBR and default QoS flow, credit and User Plane Inactivity
+	// Timer enforced on the classifier, which all packets of the session
+	// cross. Dedicated QoS flows are not supported.
+	QoS               *SessionQoS
+	Charging          *CreditQuota
+	InactivityTimeout time.Duration
+
+	// Interception tasks the classifier duplicates the forwarded packets for
+	X3 []X3Delivery
+}
+
+// NewULCLSessionRules prepares the rules of a session for the given anchors.
+// Anchors must be in the order returned by ULCLPolicy.Anchors.
+func NewULCLSessionRules(policy *ULCLPolicy, ueIP net.IP, anchors []*AnchorTunnel) *ULCLSessionRules {
+	for i, a := range anchors {
+		a.index = i
+	}
+	return &ULCLSessionRules{
+		UEIP:    ueIP,
+		DNN:     policy.DNN,
+		Policy:  policy,
+		Anchors: anchors,
+	}
+}
+
+// anchor returns the tunnel of the given PSA
+func (r *ULCLSessionRules) anchor(upfID string) *AnchorTunnel {
+	for _, a := range r.Anchors {
+		if a.UPFID == upfID {
+			return a
+		}
+	}
+	return nil
+}
+
+// ClassifierIEs returns the rules installed on the uplink classifier UPF
+func (r *ULCLSessionRules) ClassifierIEs() []*ie.IE {
+	access := r.sessionRules()
+	ies := []*ie.IE{
+		// Default uplink route to the default PSA
+		r.classifierPDR(
+			ie.NewPDRID(uplinkPDRID),
+			ie.NewPrecedence(255),
+			r.accessPDI(),
+			ie.NewOuterHeaderRemoval(outerHeaderRemovalGTPUIPv4, 0),
+			ie.NewFARID(r.anchorFARID(r.anchor(r.Policy.DefaultPSA))),
+		),
+		access.downlinkFAR(),
+	}
+
+	// Steering rules take precedence over the default route, in order
+	pdrID := steeringPDRBase
+	for i, rule := range r.Policy.Rules {
+		a := r.anchor(rule.PSA)
+		if a == nil {
+			continue
+		}
+		precedence := steeringPrecedence + uint32(i)
+
+		var filters []*ie.IE
+		for _, prefix := range rule.Prefixes {
+			filters = append(filters, ie.NewSDFFilter(fmt.Sprintf("permit out ip from %s to assigned", prefix), "", "", "", 0))
+		}
+		for _, prefix := range rule.SourcePrefixes {
+			filters = append(filters, ie.NewSDFFilter(fmt.Sprintf("permit out ip from any to %s", prefix), "", "", "", 0))
+		}
+		if len(filters) > 0 {
+			ies = append(ies, r.classifierPDR(
+				ie.NewPDRID(pdrID),
+				ie.NewPrecedence(precedence),
+				r.accessPDI(filters...),
+				ie.NewOuterHeaderRemoval(outerHeaderRemovalGTPUIPv4, 0),
+				ie.NewFARID(r.anchorFARID(a)),
+			))
+			pdrID++
+		}
+		for _, app := range rule.AppIDs {
+			ies = append(ies, r.classifierPDR(
+				ie.NewPDRID(pdrID),
+				ie.NewPrecedence(precedence),
+				r.accessPDI(ie.NewApplicationID(app)),
+				ie.NewOuterHeaderRemoval(outerHeaderRemovalGTPUIPv4, 0),
+				ie.NewFARID(r.anchorFARID(a)),
+			))
+			pdrID++
+		}
+	}
+
+	for _, a := range r.Anchors {
+		// Uplink towards the PSA: N6 when co-located, N9 otherwise
+		if a.local(r.Policy.ULCL) {
+			ies = append(ies,
+				ie.NewCreateFAR(append([]*ie.IE{
+					ie.NewFARID(r.anchorFARID(a)),
+					ie.NewApplyAction(access.forwardAction()),
+					ie.NewForwardingParameters(
+						ie.NewDestinationInterface(ie.DstInterfaceCore),
+						ie.NewNetworkInstance(r.DNN),
+					),
+				}, access.duplicatingParameters(false)...)...),
+				r.classifierPDR(
+					ie.NewPDRID(downlinkPDRID),
+					ie.NewPrecedence(255),
+					ie.NewPDI(
+						ie.NewSourceInterface(ie.SrcInterfaceCore),
+						ie.NewNetworkInstance(r.DNN),
+						ueIPAddress(r.UEIP, r.UEIPv6, ueIPFlagSD),
+					),
+					ie.NewFARID(downlinkFARID),
+				),
+			)
+			continue
+		}
+
+		ies = append(ies,
+			ie.NewCreateFAR(append([]*ie.IE{
+				ie.NewFARID(r.anchorFARID(a)),
+				ie.NewApplyAction(access.forwardAction()),
+				ie.NewForwardingParameters(
+					ie.NewDestinationInterface(ie.DstInterfaceCore),
+					ie.NewOuterHeaderCreation(outerHeaderCreationGTPUIPv4, a.UplinkTEID, a.Addr.String(), "", 0, 0, 0),
+				),
+			}, access.duplicatingParameters(false)...)...),
+			// Downlink from the PSA over N9, forwarded to the access peer
+			r.classifierPDR(
+				ie.NewPDRID(anchorDLPDRBase+uint16(a.index)),
+				ie.NewPrecedence(255),
+				ie.NewPDI(
+					ie.NewSourceInterface(ie.SrcInterfaceCore),
+					ie.NewFTEID(fteidFlagV4, a.DownlinkTEID, r.ULCLAddr.To4(), nil, 0),
+				),
+				ie.NewOuterHeaderRemoval(outerHeaderRemovalGTPUIPv4, 0),
+				ie.NewFARID(downlinkFARID),
+			),
+		)
+	}
+
+	if r.QoS != nil {
+		ies = append(ies, access.sessionQERs()...)
+	}
+	if r.Charging != nil {
+		ies = append(ies, ie.NewCreateURR(r.Charging.urrIEs()...))
+	}
+	if r.InactivityTimeout > 0 {
+		ies = append(ies, ie.NewUserPlaneInactivityTimer(r.InactivityTimeout))
+	}
+	return ies
+}
+
+// classifierPDR returns a Create PDR of the classifier, enforcing the
+// session's QERs and URR
+func (r *ULCLSessionRules) classifierPDR(ies ...*ie.IE) *ie.IE {
+	session := r.sessionRules()
+	ies = append(ies, session.qerIDs(defaultFlowQERID)...)
+	return ie.NewCreatePDR(append(ies, session.urrIDs()...)...)
+}
+
+// sessionRules returns the rules of the access tunnel and the session-wide
+// enforcement on the classifier
+func (r *ULCLSessionRules) sessionRules() *SessionRules {
+	return &SessionRules{PeerTEID: r.PeerTEID, PeerAddr: r.PeerAddr, QoS: r.QoS, Charging: r.Charging, X3: r.X3}
+}
+
+// AnchorFARIDs returns the IDs of the classifier FARs forwarding uplink
+// traffic to the anchors
+func (r *ULCLSessionRules) AnchorFARIDs() []uint32 {
+	ids := make([]uint32, 0, len(r.Anchors))
+	for _, a := range r.Anchors {
+		ids = append(ids, r.anchorFARID(a))
+	}
+	return ids
+}
+
+// AnchorIEs returns the rules installed on a PSA reached over N9
+func (r *ULCLSessionRules) AnchorIEs(a *AnchorTunnel) []*ie.IE {
+	return []*ie.IE{
+		ie.NewCreatePDR(
+			ie.NewPDRID(uplinkPDRID),
+			ie.NewPrecedence(255),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceAccess),
+				ie.NewFTEID(fteidFlagV4, a.UplinkTEID, a.Addr.To4(), nil, 0),
+				ie.NewNetworkInstance(r.DNN),
+				ueIPAddress(r.UEIP, r.UEIPv6, 0),
+			),
+			ie.NewOuterHeaderRemoval(outerHeaderRemovalGTPUIPv4, 0),
+			ie.NewFARID(uplinkFARID),
+		),
+		ie.NewCreatePDR(
+			ie.NewPDRID(downlinkPDRID),
+			ie.NewPrecedence(255),
+			ie.NewPDI(
+				ie.NewSourceInterface(ie.SrcInterfaceCore),
+				ie.NewNetworkInstance(r.DNN),
+				ueIPAddress(r.UEIP, r.UEIPv6, ueIPFlagSD),
+			),
+			ie.NewFARID(downlinkFARID),
+		),
+		ie.NewCreateFAR(
+			ie.NewFARID(uplinkFARID),
+			ie.NewApplyAction(ApplyActionFORW),
+			ie.NewForwardingParameters(
+				ie.NewDestinationInterface(ie.DstInterfaceCore),
+				ie.NewNetworkInstance(r.DNN),
+			),
+		),
+		ie.NewCreateFAR(
+			ie.NewFARID(downlinkFARID),
+			ie.NewApplyAction(ApplyActionFORW),
+			ie.NewForwardingParameters(
+				ie.NewDestinationInterface(ie.DstInterfaceAccess),
+				ie.NewOuterHeaderCreation(outerHeaderCreationGTPUIPv4, a.DownlinkTEID, r.ULCLAddr.String(), "", 0, 0, 0),
+			),
+		),
+	}
+}
+
+// accessPDI returns the PDI matching uplink traffic of the access tunnel
+func (r *ULCLSessionRules) accessPDI(extra ...*ie.IE) *ie.IE {
+	ies := []*ie.IE{
+		ie.NewSourceInterface(ie.SrcInterfaceAccess),
+		ie.NewFTEID(fteidFlagV4, r.ULCLTEID, r.ULCLAddr.To4(), nil, 0),
+		ueIPAddress(r.UEIP, r.UEIPv6, 0),
+	}
+	return ie.NewPDI(append(ies, extra...)...)
+}
+
+// anchorFARID returns the classifier FAR forwarding uplink traffic to a PSA
+func (r *ULCLSessionRules) anchorFARID(a *AnchorTunnel) uint32 {
+	if a == nil {
+		return uplinkFARID
+	}
+	return anchorFARBase + uint32(a.index)
+}
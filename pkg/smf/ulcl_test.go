@@ -0,0 +1,249 @@
+package smf
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// describeRules summarizes the Create PDR and Create FAR IEs of a session:
+// a PDR as its ID, precedence, source interface, F-TEID, SDF filter or
+// application and FAR, a FAR as its ID, destination interface and outer
+// header TEID
+func describeRules(t *testing.T, ies []*ie.IE) []string {
+	t.Helper()
+
+	var rules []string
+	for _, i := range ies {
+		switch i.Type {
+		case ie.CreatePDR:
+			id, _ := i.PDRID()
+			precedence, _ := i.Precedence()
+			src, _ := i.SourceInterface()
+			far, err := i.FARID()
+			if err != nil {
+				t.Fatalf("PDR %d has no FAR: %v", id, err)
+			}
+			rule := fmt.Sprintf("PDR %d %d src %d", id, precedence, src)
+			children, _ := i.CreatePDR()
+			for _, c := range children {
+				if c.Type != ie.PDI {
+					continue
+				}
+				if fteid, err := c.FTEID(); err == nil {
+					rule += fmt.Sprintf(" teid %d", fteid.TEID)
+				}
+			}
+			if filter, err := i.SDFFilter(); err == nil {
+				rule += fmt.Sprintf(" %q", filter.FlowDescription)
+			}
+			if app, err := i.ApplicationID(); err == nil {
+				rule += " app " + app
+			}
+			rules = append(rules, fmt.Sprintf("%s -> FAR %d", rule, far))
+		case ie.CreateFAR:
+			id, _ := i.FARID()
+			rule := fmt.Sprintf("FAR %d", id)
+			children, _ := i.CreateFAR()
+			for _, c := range children {
+				if c.Type != ie.ForwardingParameters {
+					continue
+				}
+				dst, _ := c.DestinationInterface()
+				rule += fmt.Sprintf(" dst %d", dst)
+				if ohc, err := c.OuterHeaderCreation(); err == nil {
+					rule += fmt.Sprintf(" teid %d", ohc.TEID)
+				}
+			}
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+func ulclRules(policy *ULCLPolicy, anchors ...*AnchorTunnel) *ULCLSessionRules {
+	r := NewULCLSessionRules(policy, net.IPv4(10, 0, 0, 1), anchors)
+	r.ULCLTEID, r.ULCLAddr = 1, net.IPv4(192, 168, 0, 1)
+	r.PeerTEID, r.PeerAddr = 500, net.IPv4(192, 168, 1, 1)
+	return r
+}
+
+func TestULCLClassifierIEs(t *testing.T) {
+	local := &AnchorTunnel{UPFID: "ulcl"}
+	remote := func() *AnchorTunnel {
+		return &AnchorTunnel{UPFID: "edge", Addr: net.IPv4(192, 168, 0, 2), UplinkTEID: 7, DownlinkTEID: 8}
+	}
+
+	tests := []struct {
+		name    string
+		policy  *ULCLPolicy
+		anchors []*AnchorTunnel
+		want    []string
+	}{
+		{
+			name:    "co-located default PSA",
+			policy:  &ULCLPolicy{DNN: "internet", ULCL: "ulcl", DefaultPSA: "ulcl"},
+			anchors: []*AnchorTunnel{local},
+			want: []string{
+				"PDR 1 255 src 0 teid 1 -> FAR 10",
+				"FAR 2 dst 0 teid 500",
+				"FAR 10 dst 1",
+				"PDR 2 255 src 1 -> FAR 2",
+			},
+		},
+		{
+			name: "prefix steered to a remote PSA",
+			policy: &ULCLPolicy{DNN: "internet", ULCL: "ulcl", DefaultPSA: "ulcl", Rules: []SteeringRule{
+				{Name: "edge", PSA: "edge", Prefixes: []string{"10.100.0.0/16"}},
+			}},
+			anchors: []*AnchorTunnel{local, remote()},
+			want: []string{
+				"PDR 1 255 src 0 teid 1 -> FAR 10",
+				"FAR 2 dst 0 teid 500",
+				`PDR 10 100 src 0 teid 1 "permit out ip from 10.100.0.0/16 to assigned" -> FAR 11`,
+				"FAR 10 dst 1",
+				"PDR 2 255 src 1 -> FAR 2",
+				"FAR 11 dst 1 teid 7",
+				"PDR 101 255 src 1 teid 8 -> FAR 2",
+			},
+		},
+		{
+			name: "multi-homing and application steering",
+			policy: &ULCLPolicy{DNN: "internet", ULCL: "ulcl", DefaultPSA: "edge", Rules: []SteeringRule{
+				{Name: "home", PSA: "ulcl", SourcePrefixes: []string{"10.0.0.0/24"}},
+				{Name: "video", PSA: "edge", AppIDs: []string{"video"}},
+			}},
+			anchors: []*AnchorTunnel{remote(), local},
+			want: []string{
+				"PDR 1 255 src 0 teid 1 -> FAR 10",
+				"FAR 2 dst 0 teid 500",
+				`PDR 10 100 src 0 teid 1 "permit out ip from any to 10.0.0.0/24" -> FAR 11`,
+				"PDR 11 101 src 0 teid 1 app video -> FAR 10",
+				"FAR 10 dst 1 teid 7",
+				"PDR 100 255 src 1 teid 8 -> FAR 2",
+				"FAR 11 dst 1",
+				"PDR 2 255 src 1 -> FAR 2",
+			},
+		},
+		{
+			name: "rule of an unknown PSA",
+			policy: &ULCLPolicy{DNN: "internet", ULCL: "ulcl", DefaultPSA: "ulcl", Rules: []SteeringRule{
+				{Name: "edge", PSA: "edge", Prefixes: []string{"10.100.0.0/16"}},
+			}},
+			anchors: []*AnchorTunnel{local},
+			want: []string{
+				"PDR 1 255 src 0 teid 1 -> FAR 10",
+				"FAR 2 dst 0 teid 500",
+				"FAR 10 dst 1",
+				"PDR 2 255 src 1 -> FAR 2",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := describeRules(t, ulclRules(tt.policy, tt.anchors...).ClassifierIEs())
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ClassifierIEs() =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestULCLAnchorIEs(t *testing.T) {
+	policy := &ULCLPolicy{DNN: "internet", ULCL: "ulcl", DefaultPSA: "ulcl", Rules: []SteeringRule{
+		{Name: "edge", PSA: "edge", Prefixes: []string{"10.100.0.0/16"}},
+	}}
+	edge := &AnchorTunnel{UPFID: "edge", Addr: net.IPv4(192, 168, 0, 2), UplinkTEID: 7, DownlinkTEID: 8}
+	r := ulclRules(policy, &AnchorTunnel{UPFID: "ulcl"}, edge)
+
+	want := []string{
+		"PDR 1 255 src 0 teid 7 -> FAR 1",
+		"PDR 2 255 src 1 -> FAR 2",
+		"FAR 1 dst 1",
+		"FAR 2 dst 0 teid 8",
+	}
+	if got := describeRules(t, r.AnchorIEs(edge)); !reflect.DeepEqual(got, want) {
+		t.Errorf("AnchorIEs() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestULCLClassifierEnforcement(t *testing.T) {
+	policy := &ULCLPolicy{DNN: "internet", ULCL: "ulcl", DefaultPSA: "ulcl", Rules: []SteeringRule{
+		{Name: "edge", PSA: "edge", Prefixes: []string{"10.100.0.0/16"}},
+	}}
+	edge := &AnchorTunnel{UPFID: "edge", Addr: net.IPv4(192, 168, 0, 2), UplinkTEID: 7, DownlinkTEID: 8}
+	r := ulclRules(policy, &AnchorTunnel{UPFID: "ulcl"}, edge)
+	r.QoS = testPolicyStore(t).Resolve("001010000000002", "internet")
+	r.Charging = &CreditQuota{RatingGroup: 10, Volume: 1000}
+	r.InactivityTimeout = 10 * time.Minute
+
+	// Every packet of the session crosses a classifier PDR enforcing the
+	// Session-AMBR, the default QoS flow and the credit
+	counts := make(map[uint16]int)
+	for _, i := range r.ClassifierIEs() {
+		counts[i.Type]++
+		if i.Type != ie.CreatePDR {
+			continue
+		}
+		id, _ := i.PDRID()
+		children, _ := i.CreatePDR()
+		var qers, urrs int
+		for _, c := range children {
+			switch c.Type {
+			case ie.QERID:
+				qers++
+			case ie.URRID:
+				urrs++
+			}
+		}
+		if qers != 2 || urrs != 1 {
+			t.Errorf("PDR %d has %d QERs and %d URRs, want 2 and 1", id, qers, urrs)
+		}
+	}
+	if counts[ie.CreateQER] != 2 || counts[ie.CreateURR] != 1 || counts[ie.UserPlaneInactivityTimer] != 1 {
+		t.Errorf("classifier has %d QERs, %d URRs and %d inactivity timers, want 2, 1 and 1",
+			counts[ie.CreateQER], counts[ie.CreateURR], counts[ie.UserPlaneInactivityTimer])
+	}
+
+	// Anchors only forward
+	for _, i := range r.AnchorIEs(edge) {
+		if i.Type == ie.CreateQER || i.Type == ie.CreateURR {
+			t.Errorf("anchor got IE type %d, want only PDRs and FARs", i.Type)
+		}
+	}
+}
+
+func TestULCLClassifierDuplication(t *testing.T) {
+	policy := &ULCLPolicy{DNN: "internet", ULCL: "ulcl", DefaultPSA: "ulcl", Rules: []SteeringRule{
+		{Name: "edge", PSA: "edge", Prefixes: []string{"10.100.0.0/16"}},
+	}}
+	edge := &AnchorTunnel{UPFID: "edge", Addr: net.IPv4(192, 168, 0, 2), UplinkTEID: 7, DownlinkTEID: 8}
+	r := ulclRules(policy, &AnchorTunnel{UPFID: "ulcl"}, edge)
+	r.X3 = []X3Delivery{{XID: testXID, CorrelationID: 42, Addr: &net.TCPAddr{IP: net.IPv4(192, 168, 1, 10), Port: 9000}}}
+
+	// The downlink FAR and the FARs to both anchors duplicate
+	duplicating := make(map[uint32]bool)
+	for _, i := range r.ClassifierIEs() {
+		if i.Type != ie.CreateFAR {
+			continue
+		}
+		id, _ := i.FARID()
+		children, _ := i.CreateFAR()
+		for _, c := range children {
+			if c.Type == ie.DuplicatingParameters {
+				duplicating[id] = true
+			}
+		}
+	}
+	want := map[uint32]bool{downlinkFARID: true, anchorFARBase: true, anchorFARBase + 1: true}
+	if !reflect.DeepEqual(duplicating, want) {
+		t.Errorf("duplicating FARs = %v, want %v", duplicating, want)
+	}
+	if ids := r.AnchorFARIDs(); !reflect.DeepEqual(ids, []uint32{anchorFARBase, anchorFARBase + 1}) {
+		t.Errorf("AnchorFARIDs() = %v, want %d and %d", ids, anchorFARBase, anchorFARBase+1)
+	}
+}
@@ -0,0 +1,371 @@
+package smf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoUPFAvailable is returned when no associated UPF matches the selection criteria
+var ErrNoUPFAvailable = errors.New("no UPF available")
+
+// SNSSAI identifies a network slice (Slice/Service Type and Slice Differentiator)
+type SNSSAI struct {
+	SST uint8  `json:"sst" mapstructure:"sst"`
+	SD  string `json:"sd,omitempty" mapstructure:"sd"`
+}
+
+// String returns the slice in "sst-sd" notation
+func (s SNSSAI) String() string {
+	if s.SD == "" {
+		return strconv.Itoa(int(s.SST))
+	}
+	return fmt.Sprintf("%d-%s", s.SST, s.SD)
+}
+
+// Matches reports whether the slice serves the requested one.
+// An empty SD on either side acts as a wildcard.
+func (s SNSSAI) Matches(other SNSSAI) bool {
+	if s.SST != other.SST {
+		return false
+	}
+	return s.SD == "" || other.SD == "" || strings.EqualFold(s.SD, other.SD)
+}
+
+// UPFState represents the PFCP association state of a UPF
+type UPFState string
+
+const (
+	UPFStateDisconnected UPFState = "DISCONNECTED"
+	UPFStateAssociated   UPFState = "ASSOCIATED"
+	UPFStateLost         UPFState = "LOST"
+)
+
+// UPFNode is a UPF known to the SMF
+type UPFNode struct {
+	ID     string
+	Host   string
+	Port   int
+	DNNs   []string
+	Slices []SNSSAI
+	TAIs   []string
+
+	// N3IP is the GTP-U address of the UPF, defaults to its PFCP address
+	N3IP net.IP
+
+	state         UPFState
+	addr          *net.UDPAddr
+	sessions      int
+	loadMetric    uint8
+	hasLoadMetric bool
+	loadSeq       uint32
+	lastHeartbeat time.Time
+	recoveryTS    time.Time
+	missed        int
+
+	mu sync.RWMutex
+}
+
+// UPFStatus is a point-in-time snapshot of a UPF
+type UPFStatus struct {
+	ID            string    `json:"id"`
+	Addr          string    `json:"addr"`
+	State         UPFState  `json:"state"`
+	Sessions      int       `json:"sessions"`
+	LoadMetric    uint8     `json:"load_metric"`
+	LastHeartbeat time.Time `json:"last_heartbeat"`
+	RecoveryTS    time.Time `json:"recovery_ts"`
+}
+
+// Endpoint returns the configured PFCP endpoint of the UPF
+func (n *UPFNode) Endpoint() string {
+	return net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+}
+
+// Addr returns the resolved PFCP address of the UPF, resolving it on first use
+func (n *UPFNode) Addr() (*net.UDPAddr, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.addr != nil {
+		return n.addr, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", n.Endpoint())
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve UPF %s: %w", n.ID, err)
+	}
+	n.addr = addr
+	return addr, nil
+}
+
+// N3Address returns the GTP-U address access peers send uplink traffic to
+func (n *UPFNode) N3Address() net.IP {
+	if n.N3IP != nil {
+		return n.N3IP
+	}
+	addr, err := n.Addr()
+	if err != nil {
+		return nil
+	}
+	return addr.IP
+}
+
+// State returns the association state of the UPF
+func (n *UPFNode) State() UPFState {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.state
+}
+
+// Healthy reports whether new sessions may be placed on the UPF
+func (n *UPFNode) Healthy() bool {
+	return n.State() == UPFStateAssociated
+}
+
+// Status returns a snapshot of the UPF
+func (n *UPFNode) Status() UPFStatus {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	addr := n.Endpoint()
+	if n.addr != nil {
+		addr = n.addr.String()
+	}
+	return UPFStatus{
+		ID:            n.ID,
+		Addr:          addr,
+		State:         n.state,
+		Sessions:      n.sessions,
+		LoadMetric:    n.loadMetric,
+		LastHeartbeat: n.lastHeartbeat,
+		RecoveryTS:    n.recoveryTS,
+	}
+}
+
+// ServesDNN reports whether the UPF serves the given DNN.
+// A UPF without configured DNNs serves any DNN.
+func (n *UPFNode) ServesDNN(dnn string) bool {
+	if dnn == "" || len(n.DNNs) == 0 {
+		return true
+	}
+	for _, d := range n.DNNs {
+		if strings.EqualFold(d, dnn) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServesSlice reports whether the UPF serves the given slice.
+// A UPF without configured slices serves any slice.
+func (n *UPFNode) ServesSlice(snssai *SNSSAI) bool {
+	if snssai == nil || len(n.Slices) == 0 {
+		return true
+	}
+	for _, s := range n.Slices {
+		if s.Matches(*snssai) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServesTAI reports whether the UPF is configured for the given tracking area
+func (n *UPFNode) ServesTAI(tai string) bool {
+	if tai == "" {
+		return false
+	}
+	for _, t := range n.TAIs {
+		if t == tai {
+			return true
+		}
+	}
+	return false
+}
+
+// upfLoad is the load of a UPF when it is selected: the metric of its Load
+// Control Information, when it sends any, and the local session count
+type upfLoad struct {
+	metric    uint8
+	hasMetric bool
+	sessions  int
+}
+
+func (n *UPFNode) load() upfLoad {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return upfLoad{metric: n.loadMetric, hasMetric: n.hasLoadMetric, sessions: n.sessions}
+}
+
+// less reports whether l is less loaded than o. Metrics are compared only
+// when both UPFs report one; otherwise the metric is unknown rather than
+// idle and the session counts decide.
+func (l upfLoad) less(o upfLoad) bool {
+	if l.hasMetric && o.hasMetric && l.metric != o.metric {
+		return l.metric < o.metric
+	}
+	return l.sessions < o.sessions
+}
+
+// UpdateLoad records a Load Control Information report from the UPF.
+// Reports with a sequence number older than the last one are ignored.
+func (n *UPFNode) UpdateLoad(seq uint32, metric uint8) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.hasLoadMetric && seq != 0 && seq < n.loadSeq {
+		return
+	}
+	n.loadSeq = seq
+	n.loadMetric = metric
+	n.hasLoadMetric = true
+}
+
+// AddSession increments the number of sessions placed on the UPF
+func (n *UPFNode) AddSession() {
+	n.mu.Lock()
+	n.sessions++
+	n.mu.Unlock()
+}
+
+// RemoveSession decrements the number of sessions placed on the UPF
+func (n *UPFNode) RemoveSession() {
+	n.mu.Lock()
+	if n.sessions > 0 {
+		n.sessions--
+	}
+	n.mu.Unlock()
+}
+
+// UPFSelectionCriteria describes the session a UPF is selected for
+type UPFSelectionCriteria struct {
+	DNN    string
+	SNSSAI *SNSSAI
+	TAI    string
+
+	// Exclude lists UPF IDs that must not be selected, e.g. the one that just failed
+	Exclude []string
+}
+
+func (c UPFSelectionCriteria) excludes(id string) bool {
+	for _, x := range c.Exclude {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
+
+// UPFPool holds the UPFs configured for the SMF and selects one per session
+type UPFPool struct {
+	nodes         []*UPFNode
+	dynamic       bool
+	loadBalancing bool
+	mu            sync.RWMutex
+}
+
+// NewUPFPool creates a pool from the configured UPFs.
+// With dynamic selection disabled the first associated UPF is always used;
+// with load balancing disabled ties are broken by configuration order.
+func NewUPFPool(nodes []*UPFNode, dynamic, loadBalancing bool) *UPFPool {
+	for _, n := range nodes {
+		if n.state == "" {
+			n.state = UPFStateDisconnected
+		}
+	}
+	return &UPFPool{
+		nodes:         nodes,
+		dynamic:       dynamic,
+		loadBalancing: loadBalancing,
+	}
+}
+
+// Nodes returns all configured UPFs
+func (p *UPFPool) Nodes() []*UPFNode {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*UPFNode(nil), p.nodes...)
+}
+
+// Get returns the UPF with the given ID
+func (p *UPFPool) Get(id string) (*UPFNode, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, n := range p.nodes {
+		if n.ID == id {
+			return n, true
+		}
+	}
+	return nil, false
+}
+
+// GetByAddr returns the UPF with the given resolved PFCP address
+func (p *UPFPool) GetByAddr(addr *net.UDPAddr) (*UPFNode, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, n := range p.nodes {
+		n.mu.RLock()
+		match := n.addr != nil && n.addr.IP.Equal(addr.IP) && n.addr.Port == addr.Port
+		n.mu.RUnlock()
+		if match {
+			return n, true
+		}
+	}
+	return nil, false
+}
+
+// Select picks a UPF for a new session
+func (p *UPFPool) Select(c UPFSelectionCriteria) (*UPFNode, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var candidates []*UPFNode
+	for _, n := range p.nodes {
+		if !n.Healthy() || c.excludes(n.ID) {
+			continue
+		}
+		if p.dynamic && (!n.ServesDNN(c.DNN) || !n.ServesSlice(c.SNSSAI)) {
+			continue
+		}
+		candidates = append(candidates, n)
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("%w for dnn %q", ErrNoUPFAvailable, c.DNN)
+	}
+	if !p.dynamic {
+		return candidates[0], nil
+	}
+
+	// Prefer UPFs serving the UE's tracking area
+	best := candidates[:0:0]
+	bestTier := 2
+	for _, n := range candidates {
+		tier := 1
+		if n.ServesTAI(c.TAI) {
+			tier = 0
+		}
+		if tier < bestTier {
+			best, bestTier = best[:0], tier
+		}
+		if tier == bestTier {
+			best = append(best, n)
+		}
+	}
+
+	if !p.loadBalancing {
+		return best[0], nil
+	}
+
+	selected := best[0]
+	selLoad := selected.load()
+	for _, n := range best[1:] {
+		if load := n.load(); load.less(selLoad) {
+			selected, selLoad = n, load
+		}
+	}
+	return selected, nil
+}
@@ -0,0 +1,108 @@
+package smf
+
+import (
+	"errors"
+	"testing"
+)
+
+func associatedNode(id string, dnns ...string) *UPFNode {
+	return &UPFNode{ID: id, Host: "127.0.0.1", Port: 8805, DNNs: dnns, state: UPFStateAssociated}
+}
+
+func TestUPFPoolSelectStatic(t *testing.T) {
+	a := associatedNode("a", "ims")
+	b := associatedNode("b", "internet")
+	pool := NewUPFPool([]*UPFNode{a, b}, false, false)
+
+	// Without dynamic selection the first healthy UPF is used regardless of DNN
+	got, err := pool.Select(UPFSelectionCriteria{DNN: "internet"})
+	if err != nil {
+		t.Fatalf("Select() error = %v", err)
+	}
+	if got != a {
+		t.Errorf("Select() = %s, want a", got.ID)
+	}
+
+	a.state = UPFStateLost
+	got, err = pool.Select(UPFSelectionCriteria{DNN: "internet"})
+	if err != nil {
+		t.Fatalf("Select() error = %v", err)
+	}
+	if got != b {
+		t.Errorf("Select() after loss = %s, want b", got.ID)
+	}
+}
+
+func TestUPFPoolSelectDynamic(t *testing.T) {
+	ims := associatedNode("ims", "ims")
+	central := associatedNode("central", "internet")
+	central.Slices = []SNSSAI{{SST: 1, SD: "000001"}}
+	edge := associatedNode("edge", "internet")
+	edge.Slices = []SNSSAI{{SST: 1}}
+	edge.TAIs = []string{"001-01-1"}
+	pool := NewUPFPool([]*UPFNode{ims, central, edge}, true, false)
+
+	tests := []struct {
+		name     string
+		criteria UPFSelectionCriteria
+		want     string
+	}{
+		{"by DNN", UPFSelectionCriteria{DNN: "ims"}, "ims"},
+		{"by slice", UPFSelectionCriteria{DNN: "internet", SNSSAI: &SNSSAI{SST: 1, SD: "000001"}}, "central"},
+		{"by TAI", UPFSelectionCriteria{DNN: "internet", TAI: "001-01-1"}, "edge"},
+		{"config order", UPFSelectionCriteria{DNN: "internet"}, "central"},
+		{"exclude", UPFSelectionCriteria{DNN: "internet", Exclude: []string{"central"}}, "edge"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pool.Select(tt.criteria)
+			if err != nil {
+				t.Fatalf("Select() error = %v", err)
+			}
+			if got.ID != tt.want {
+				t.Errorf("Select() = %s, want %s", got.ID, tt.want)
+			}
+		})
+	}
+
+	if _, err := pool.Select(UPFSelectionCriteria{DNN: "iot"}); !errors.Is(err, ErrNoUPFAvailable) {
+		t.Errorf("Select(unknown DNN) error = %v, want ErrNoUPFAvailable", err)
+	}
+}
+
+func TestUPFPoolSelectLoadBalancing(t *testing.T) {
+	a := associatedNode("a")
+	b := associatedNode("b")
+	pool := NewUPFPool([]*UPFNode{a, b}, true, true)
+
+	a.AddSession()
+	a.AddSession()
+	b.AddSession()
+	if got, _ := pool.Select(UPFSelectionCriteria{}); got != b {
+		t.Errorf("Select() by session count = %s, want b", got.ID)
+	}
+
+	// A reported load metric takes precedence over the session count
+	a.UpdateLoad(1, 10)
+	b.UpdateLoad(1, 80)
+	if got, _ := pool.Select(UPFSelectionCriteria{}); got != a {
+		t.Errorf("Select() by load metric = %s, want a", got.ID)
+	}
+
+	// Stale load reports are ignored
+	a.UpdateLoad(2, 90)
+	a.UpdateLoad(1, 5)
+	if got, _ := pool.Select(UPFSelectionCriteria{}); got != b {
+		t.Errorf("Select() after stale report = %s, want b", got.ID)
+	}
+
+	// A UPF without a metric is not taken for idle
+	c := associatedNode("c")
+	for i := 0; i < 3; i++ {
+		c.AddSession()
+	}
+	pool = NewUPFPool([]*UPFNode{c, a}, true, true)
+	if got, _ := pool.Select(UPFSelectionCriteria{}); got != a {
+		t.Errorf("Select() against a UPF without metric = %s, want a with fewer sessions", got.ID)
+	}
+}
@@ -0,0 +1,161 @@
+package smf
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// ChargingURRID is the URR measuring the traffic of the session's rating
+// group
+const ChargingURRID uint32 = 1
+
+// Reporting Triggers of the charging URR (TS 29.244 §8.2.19)
+const (
+	reportingVOLTH uint8 = 0x02 // octet 5
+	reportingTIMTH uint8 = 0x04 // octet 5
+	reportingVOLQU uint8 = 0x01 // octet 6
+	reportingTIMQU uint8 = 0x02 // octet 6
+)
+
+// Usage Report Trigger flags (TS 29.244 §8.2.41)
+const (
+	usageVOLTH uint8 = 0x02 // octet 5
+	usageTIMTH uint8 = 0x04 // octet 5
+	usageVOLQU uint8 = 0x01 // octet 6
+	usageTIMQU uint8 = 0x02 // octet 6
+	usageTERMR uint8 = 0x08 // octet 6
+)
+
+// volumeFlagTOVOL selects the total volume of volume thresholds and quotas
+const volumeFlagTOVOL uint8 = 0x01
+
+// UsageReport is a usage report of a URR sent by a UPF
+type UsageReport struct {
+	URRID          uint32
+	Trigger        [2]byte
+	TotalVolume    uint64 // bytes
+	UplinkVolume   uint64
+	DownlinkVolume uint64
+	Duration       time.Duration
+}
+
+// ThresholdReached reports whether a volume or time threshold was crossed
+func (r *UsageReport) ThresholdReached() bool {
+	return r.Trigger[0]&(usageVOLTH|usageTIMTH) != 0
+}
+
+// QuotaExhausted reports whether the volume or time quota is used up
+func (r *UsageReport) QuotaExhausted() bool {
+	return r.Trigger[1]&(usageVOLQU|usageTIMQU) != 0
+}
+
+// Termination reports whether the report is the final one of a deleted session
+func (r *UsageReport) Termination() bool {
+	return r.Trigger[1]&usageTERMR != 0
+}
+
+// ParseUsageReport reads a Usage Report IE of a Session Report Request,
+// Session Modification Response or Session Deletion Response
+func ParseUsageReport(i *ie.IE) (*UsageReport, error) {
+	children, err := i.UsageReport()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &UsageReport{}
+	for _, c := range children {
+		switch c.Type {
+		case ie.URRID:
+			r.URRID, err = c.URRID()
+		case ie.UsageReportTrigger:
+			var trigger []byte
+			if trigger, err = c.UsageReportTrigger(); err == nil {
+				copy(r.Trigger[:], trigger)
+			}
+		case ie.VolumeMeasurement:
+			var vol *ie.VolumeMeasurementFields
+			if vol, err = c.VolumeMeasurement(); err == nil {
+				r.TotalVolume, r.UplinkVolume, r.DownlinkVolume = vol.TotalVolume, vol.UplinkVolume, vol.DownlinkVolume
+			}
+		case ie.DurationMeasurement:
+			r.Duration, err = c.DurationMeasurement()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid usage report: %w", err)
+		}
+	}
+	if r.URRID == 0 {
+		return nil, fmt.Errorf("invalid usage report: missing URR ID")
+	}
+	return r, nil
+}
+
+// ParseUsageReports reads a list of Usage Report IEs, skipping invalid ones
+func ParseUsageReports(ies []*ie.IE) []*UsageReport {
+	var reports []*UsageReport
+	for _, i := range ies {
+		if r, err := ParseUsageReport(i); err == nil {
+			reports = append(reports, r)
+		}
+	}
+	return reports
+}
+
+// urrIEs returns the thresholds, quotas and triggers of the charging URR.
+// The UPF reports when the threshold is crossed, leaving the remaining
+// units to be used while the OCS is asked for more, and stops forwarding
+// once the quota is used.
+func (q *CreditQuota) urrIEs() []*ie.IE {
+	var ies []*ie.IE
+	var triggers [2]uint8
+	volume, duration := 0, 0
+	if q.Volume > 0 {
+		volume = 1
+		triggers[0] |= reportingVOLTH
+		triggers[1] |= reportingVOLQU
+		ies = append(ies,
+			ie.NewVolumeThreshold(volumeFlagTOVOL, q.Volume-q.VolumeThreshold, 0, 0),
+			ie.NewVolumeQuota(volumeFlagTOVOL, q.Volume, 0, 0),
+		)
+	}
+	if q.Time > 0 {
+		duration = 1
+		triggers[0] |= reportingTIMTH
+		triggers[1] |= reportingTIMQU
+		ies = append(ies,
+			ie.NewTimeThreshold(time.Duration(q.Time-q.TimeThreshold)*time.Second),
+			ie.NewTimeQuota(time.Duration(q.Time)*time.Second),
+		)
+	}
+	return append([]*ie.IE{
+		ie.NewURRID(ChargingURRID),
+		ie.NewMeasurementMethod(0, volume, duration),
+		ie.NewReportingTriggers(triggers[0], triggers[1]),
+	}, ies...)
+}
+
+// urrIDList returns the IDs of the URRs measuring the session's PDRs
+func (r *SessionRules) urrIDList() []uint32 {
+	var ids []uint32
+	if r.Charging != nil {
+		ids = append(ids, ChargingURRID)
+	}
+	return ids
+}
+
+// urrIDs returns the URR ID IEs of the session's PDRs
+func (r *SessionRules) urrIDs() []*ie.IE {
+	var ies []*ie.IE
+	for _, id := range r.urrIDList() {
+		ies = append(ies, ie.NewURRID(id))
+	}
+	return ies
+}
+
+// URRUpdate returns the Update URR IE of a Session Modification Request
+// installing newly granted credit
+func (r *SessionRules) URRUpdate() *ie.IE {
+	return ie.NewUpdateURR(r.Charging.urrIEs()...)
+}
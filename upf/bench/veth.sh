@@ -0,0 +1,86 @@
+#!/bin/bash
+# Benchmarks the UPF data plane between network namespaces joined by veth
+# pairs, pktgen style:
+#
+#   gnb (10.100.1.2) --N3-- (10.100.1.1) upf (10.100.2.1) --N6-- (10.100.2.2) dn
+#
+# Usage: bench/veth.sh setup|run|teardown
+#
+# run takes SESSIONS, SIZE, RATE (G-PDUs/s, 0 for unlimited), DURATION and
+# WORKERS from the environment. XDP=1 offloads the sessions to
+# bpf/upf_xdp.c, built with clang, in XDP_MODE (xdpgeneric by default, as
+# native XDP on veth needs a program on the peer too).
+set -e
+
+cd "$(dirname "$0")/.."
+
+BIN=${BIN:-/tmp/gtpbench}
+SESSIONS=${SESSIONS:-1000}
+SIZE=${SIZE:-1400}
+RATE=${RATE:-0}
+DURATION=${DURATION:-10s}
+WORKERS=${WORKERS:-0}
+XDP_MODE=${XDP_MODE:-xdpgeneric}
+UE_POOL=10.60.0.0/16
+
+setup() {
+  echo "🔧 Creating namespaces gnb, upf and dn..."
+  for ns in gnb upf dn; do
+    ip netns add $ns
+    ip -n $ns link set lo up
+  done
+
+  ip link add gnb0 netns gnb type veth peer name n3 netns upf
+  ip link add n6 netns upf type veth peer name dn0 netns dn
+
+  ip -n gnb addr add 10.100.1.2/24 dev gnb0
+  ip -n upf addr add 10.100.1.1/24 dev n3
+  ip -n upf addr add 10.100.2.1/24 dev n6
+  ip -n dn addr add 10.100.2.2/24 dev dn0
+  ip -n gnb link set gnb0 up
+  ip -n upf link set n3 up
+  ip -n upf link set n6 up
+  ip -n dn link set dn0 up
+
+  # Replies to UEs go back through the UPF
+  ip -n dn route add $UE_POOL via 10.100.2.1
+  ip netns exec upf sysctl -qw net.ipv4.ip_forward=1
+  ip netns exec upf sysctl -qw net.ipv4.conf.all.rp_filter=0
+  ip netns exec upf sysctl -qw net.ipv4.conf.default.rp_filter=0
+  echo "✅ Namespaces ready"
+}
+
+run() {
+  go build -o "$BIN" ./cmd/gtpbench
+
+  upf_args=(-mode upf -pfcp 10.100.1.1:8805 -gtpu 10.100.1.1:2152 -routes $UE_POOL -workers "$WORKERS")
+  if [ "$XDP" = 1 ]; then
+    clang -O2 -g -target bpf -c bpf/upf_xdp.c -o /tmp/upf_xdp.o
+    upf_args+=(-xdp /tmp/upf_xdp.o -xdp-dev n3,n6 -xdp-mode "$XDP_MODE")
+  fi
+
+  ip netns exec upf "$BIN" "${upf_args[@]}" &
+  upf_pid=$!
+  ip netns exec dn "$BIN" -mode sink -listen 10.100.2.2:9000 -reflect &
+  sink_pid=$!
+  trap 'kill $upf_pid $sink_pid 2>/dev/null' EXIT
+  sleep 1
+
+  echo "🚀 $SESSIONS sessions, $SIZE byte packets at $RATE pps (0 is unlimited) for $DURATION"
+  ip netns exec gnb "$BIN" -mode gnb -pfcp 10.100.1.1:8805 -gtpu 10.100.1.1:2152 -local 10.100.1.2 \
+    -sessions "$SESSIONS" -size "$SIZE" -rate "$RATE" -duration "$DURATION" -dst 10.100.2.2:9000
+}
+
+teardown() {
+  for ns in gnb upf dn; do
+    ip netns del $ns 2>/dev/null || true
+  done
+  echo "✅ Namespaces removed"
+}
+
+case "$1" in
+  setup) setup ;;
+  run) run ;;
+  teardown) teardown ;;
+  *) echo "usage: $0 setup|run|teardown" >&2; exit 1 ;;
+esac
@@ -0,0 +1,304 @@
+/*
+ * XDP GTP-U offload of the UPF (TS 29.281).
+ *
+ * Decapsulates the G-PDUs of the TEIDs in uplink_teids and encapsulates the
+ * packets of the UEs in downlink_ues, forwarding both with bpf_fib_lookup
+ * and bpf_redirect. The UPF programs the maps for the sessions it can
+ * offload; everything else, and packets whose next hop is not resolved yet,
+ * is passed to the kernel and takes the UPF's own data plane. IPv4 only.
+ *
+ * Self-contained so it builds without libbpf headers:
+ *
+ *   clang -O2 -g -target bpf -c upf_xdp.c -o upf_xdp.o
+ */
+#include <linux/bpf.h>
+#include <linux/if_ether.h>
+#include <linux/in.h>
+#include <linux/ip.h>
+#include <linux/udp.h>
+
+#define SEC(name) __attribute__((section(name), used))
+#define __uint(name, val) int (*name)[val]
+#define __type(name, val) typeof(val) *name
+#undef __always_inline
+#define __always_inline inline __attribute__((always_inline))
+
+#if __BYTE_ORDER__ == __ORDER_LITTLE_ENDIAN__
+#define bpf_htons(x) __builtin_bswap16(x)
+#define bpf_ntohs(x) __builtin_bswap16(x)
+#else
+#define bpf_htons(x) (x)
+#define bpf_ntohs(x) (x)
+#endif
+
+static void *(*bpf_map_lookup_elem)(void *map, const void *key) = (void *)BPF_FUNC_map_lookup_elem;
+static long (*bpf_redirect)(__u32 ifindex, __u64 flags) = (void *)BPF_FUNC_redirect;
+static long (*bpf_xdp_adjust_head)(struct xdp_md *ctx, int delta) = (void *)BPF_FUNC_xdp_adjust_head;
+static long (*bpf_fib_lookup)(void *ctx, struct bpf_fib_lookup *params, int plen, __u32 flags) = (void *)BPF_FUNC_fib_lookup;
+
+#define AF_INET 2
+#define GTPU_PORT 2152
+#define GTPU_TPDU 255
+#define GTPU_HDR_LEN 8
+#define GTPU_PDU_SESSION_CONTAINER 0x85
+#define GTPU_PDU_SESSION_LEN 8 /* optional fields and a one word container */
+
+struct gtpu_hdr {
+	__u8 flags;
+	__u8 type;
+	__be16 length;
+	__be32 teid;
+};
+
+/* Keys and values are in network byte order, as the UPF writes them */
+struct uplink_tunnel {
+	__be32 ue_addr;    /* anti-spoofing: the inner source */
+	__be32 local_addr; /* F-TEID address */
+};
+
+struct downlink_tunnel {
+	__be32 teid;
+	__be32 gnb_addr;
+	__be32 local_addr;
+	__u8 qfi; /* 0 sends no PDU Session Container */
+	__u8 pad[3];
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 65536);
+	__type(key, __be32); /* TEID */
+	__type(value, struct uplink_tunnel);
+} uplink_teids SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_HASH);
+	__uint(max_entries, 65536);
+	__type(key, __be32); /* UE address */
+	__type(value, struct downlink_tunnel);
+} downlink_ues SEC(".maps");
+
+enum {
+	STAT_UPLINK,
+	STAT_DOWNLINK,
+	STAT_PASSED,
+	STAT_MAX,
+};
+
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, STAT_MAX);
+	__type(key, __u32);
+	__type(value, __u64);
+} stats SEC(".maps");
+
+static __always_inline void count(__u32 stat)
+{
+	__u64 *n = bpf_map_lookup_elem(&stats, &stat);
+
+	if (n)
+		*n += 1;
+}
+
+static __always_inline __u16 ip_checksum(struct iphdr *ip)
+{
+	__u16 *p = (__u16 *)ip;
+	__u32 sum = 0;
+
+#pragma unroll
+	for (int i = 0; i < (int)sizeof(*ip) / 2; i++)
+		sum += p[i];
+	sum = (sum & 0xffff) + (sum >> 16);
+	sum = (sum & 0xffff) + (sum >> 16);
+	return ~sum;
+}
+
+/* ip_decrease_ttl of the kernel, RFC 1624 */
+static __always_inline void decrease_ttl(struct iphdr *ip)
+{
+	__u32 check = ip->check;
+
+	check += bpf_htons(0x0100);
+	ip->check = (__u16)(check + (check >= 0xffff));
+	ip->ttl--;
+}
+
+static __always_inline int route(struct xdp_md *ctx, struct bpf_fib_lookup *fib,
+				 __be32 src, __be32 dst, __u8 protocol, __u16 len)
+{
+	fib->family = AF_INET;
+	fib->l4_protocol = protocol;
+	fib->tot_len = len;
+	fib->ipv4_src = src;
+	fib->ipv4_dst = dst;
+	fib->ifindex = ctx->ingress_ifindex;
+	return bpf_fib_lookup(ctx, fib, sizeof(*fib), 0) == BPF_FIB_LKUP_RET_SUCCESS;
+}
+
+static __always_inline int set_ethernet(struct xdp_md *ctx, struct bpf_fib_lookup *fib)
+{
+	void *data = (void *)(long)ctx->data;
+	void *data_end = (void *)(long)ctx->data_end;
+	struct ethhdr *eth = data;
+
+	if ((void *)(eth + 1) > data_end)
+		return 0;
+	__builtin_memcpy(eth->h_dest, fib->dmac, ETH_ALEN);
+	__builtin_memcpy(eth->h_source, fib->smac, ETH_ALEN);
+	eth->h_proto = bpf_htons(ETH_P_IP);
+	return 1;
+}
+
+/* decap forwards a G-PDU of an offloaded TEID to the N6 next hop */
+static __always_inline int decap(struct xdp_md *ctx, struct iphdr *ip, void *data_end)
+{
+	struct gtpu_hdr *gtp = (void *)(ip + 1) + sizeof(struct udphdr);
+	struct bpf_fib_lookup fib = {};
+	struct uplink_tunnel *tun;
+	struct iphdr *inner;
+	int hlen = GTPU_HDR_LEN;
+
+	if ((void *)(gtp + 1) > data_end || gtp->type != GTPU_TPDU)
+		return XDP_PASS;
+	if (gtp->flags == 0x34) {
+		/* The PDU Session Container gNBs send with every packet */
+		__u8 *ext = (void *)(gtp + 1);
+
+		if ((void *)(ext + GTPU_PDU_SESSION_LEN) > data_end ||
+		    ext[3] != GTPU_PDU_SESSION_CONTAINER || ext[4] != 1 || ext[7] != 0)
+			return XDP_PASS;
+		hlen += GTPU_PDU_SESSION_LEN;
+	} else if (gtp->flags != 0x30) {
+		return XDP_PASS;
+	}
+
+	tun = bpf_map_lookup_elem(&uplink_teids, &gtp->teid);
+	if (!tun || ip->daddr != tun->local_addr)
+		return XDP_PASS;
+	inner = (void *)gtp + hlen;
+	if ((void *)(inner + 1) > data_end || inner->version != 4 ||
+	    inner->saddr != tun->ue_addr || inner->ttl <= 1)
+		return XDP_PASS;
+	/* Traffic between UEs takes the UPF's data plane */
+	if (bpf_map_lookup_elem(&downlink_ues, &inner->daddr))
+		return XDP_PASS;
+	if (!route(ctx, &fib, inner->saddr, inner->daddr, inner->protocol, bpf_ntohs(inner->tot_len))) {
+		count(STAT_PASSED);
+		return XDP_PASS;
+	}
+
+	decrease_ttl(inner);
+	if (bpf_xdp_adjust_head(ctx, (int)sizeof(struct iphdr) + (int)sizeof(struct udphdr) + hlen))
+		return XDP_ABORTED;
+	if (!set_ethernet(ctx, &fib))
+		return XDP_ABORTED;
+	count(STAT_UPLINK);
+	return bpf_redirect(fib.ifindex, 0);
+}
+
+/* encap forwards a packet to an offloaded UE into its access tunnel */
+static __always_inline int encap(struct xdp_md *ctx, struct iphdr *ip)
+{
+	struct bpf_fib_lookup fib = {};
+	struct downlink_tunnel *tun;
+	struct downlink_tunnel t;
+	struct iphdr *outer;
+	struct udphdr *udp;
+	struct gtpu_hdr *gtp;
+	void *data, *data_end;
+	__u16 len;
+	int hlen;
+
+	tun = bpf_map_lookup_elem(&downlink_ues, &ip->daddr);
+	if (!tun || ip->ttl <= 1)
+		return XDP_PASS;
+	t = *tun;
+	len = bpf_ntohs(ip->tot_len);
+	hlen = t.qfi ? GTPU_HDR_LEN + GTPU_PDU_SESSION_LEN : GTPU_HDR_LEN;
+	if (!route(ctx, &fib, t.local_addr, t.gnb_addr, IPPROTO_UDP,
+		   len + sizeof(struct iphdr) + sizeof(struct udphdr) + hlen)) {
+		count(STAT_PASSED);
+		return XDP_PASS;
+	}
+
+	decrease_ttl(ip);
+	if (bpf_xdp_adjust_head(ctx, -((int)sizeof(struct iphdr) + (int)sizeof(struct udphdr) + hlen)))
+		return XDP_ABORTED;
+	if (!set_ethernet(ctx, &fib))
+		return XDP_ABORTED;
+
+	data = (void *)(long)ctx->data;
+	data_end = (void *)(long)ctx->data_end;
+	outer = data + sizeof(struct ethhdr);
+	udp = (void *)(outer + 1);
+	gtp = (void *)(udp + 1);
+	/* The inner header follows, so the container fits too */
+	if ((void *)(gtp + 1) + GTPU_PDU_SESSION_LEN > data_end)
+		return XDP_ABORTED;
+
+	outer->version = 4;
+	outer->ihl = 5;
+	outer->tos = 0;
+	outer->tot_len = bpf_htons(len + sizeof(struct iphdr) + sizeof(struct udphdr) + hlen);
+	outer->id = 0;
+	outer->frag_off = 0;
+	outer->ttl = 64;
+	outer->protocol = IPPROTO_UDP;
+	outer->saddr = t.local_addr;
+	outer->daddr = t.gnb_addr;
+	outer->check = 0;
+	outer->check = ip_checksum(outer);
+
+	udp->source = bpf_htons(GTPU_PORT);
+	udp->dest = bpf_htons(GTPU_PORT);
+	udp->len = bpf_htons(len + sizeof(struct udphdr) + hlen);
+	udp->check = 0;
+
+	gtp->flags = t.qfi ? 0x34 : 0x30;
+	gtp->type = GTPU_TPDU;
+	gtp->length = bpf_htons(len + hlen - GTPU_HDR_LEN);
+	gtp->teid = t.teid;
+	if (t.qfi) {
+		/* DL PDU Session Information (TS 38.415 §5.5.2.1) */
+		__u8 *ext = (void *)(gtp + 1);
+
+		ext[0] = 0;
+		ext[1] = 0;
+		ext[2] = 0;
+		ext[3] = GTPU_PDU_SESSION_CONTAINER;
+		ext[4] = 1;
+		ext[5] = 0;
+		ext[6] = t.qfi & 0x3f;
+		ext[7] = 0;
+	}
+	count(STAT_DOWNLINK);
+	return bpf_redirect(fib.ifindex, 0);
+}
+
+SEC("xdp")
+int upf_xdp(struct xdp_md *ctx)
+{
+	void *data = (void *)(long)ctx->data;
+	void *data_end = (void *)(long)ctx->data_end;
+	struct ethhdr *eth = data;
+	struct iphdr *ip;
+	struct udphdr *udp;
+
+	if ((void *)(eth + 1) > data_end || eth->h_proto != bpf_htons(ETH_P_IP))
+		return XDP_PASS;
+	ip = (void *)(eth + 1);
+	/* Options and fragments are left to the kernel */
+	if ((void *)(ip + 1) > data_end || ip->ihl != 5 || (ip->frag_off & bpf_htons(0x3fff)))
+		return XDP_PASS;
+
+	if (ip->protocol == IPPROTO_UDP) {
+		udp = (void *)(ip + 1);
+		if ((void *)(udp + 1) > data_end)
+			return XDP_PASS;
+		if (udp->dest == bpf_htons(GTPU_PORT))
+			return decap(ctx, ip, data_end);
+	}
+	return encap(ctx, ip);
+}
+
+char _license[] SEC("license") = "Dual BSD/GPL";
@@ -0,0 +1,432 @@
+// Command gtpbench measures the GTP-U throughput of the UPF, pktgen style.
+//
+// It runs in one of three modes, usually each in its own network namespace
+// (see bench/veth.sh):
+//
+//	upf   runs the UPF data plane
+//	gnb   establishes sessions as the SMF would, then blasts G-PDUs at the
+//	      UPF as a gNB and counts the G-PDUs it gets back
+//	sink  counts the packets leaving N6, reflecting them with -reflect so
+//	      the downlink is measured too
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/openmvcore/upf/pkg/upf"
+	"github.com/wmnsk/go-pfcp/ie"
+	pfcpmsg "github.com/wmnsk/go-pfcp/message"
+	"golang.org/x/net/ipv4"
+)
+
+const (
+	gtpuPort  = 2152
+	batchSize = 64
+)
+
+func main() {
+	mode := flag.String("mode", "gnb", "upf, gnb or sink")
+
+	// upf
+	pfcpAddr := flag.String("pfcp", "127.0.0.1:8805", "PFCP address of the UPF")
+	gtpuAddr := flag.String("gtpu", "127.0.0.1:2152", "GTP-U address of the UPF")
+	tun := flag.String("tun", "upfgtp", "N6 TUN interface of the UPF")
+	routes := flag.String("routes", "10.60.0.0/16", "comma separated UE pools routed into the TUN interface")
+	workers := flag.Int("workers", 0, "packet workers, one per CPU when 0")
+	xdpObject := flag.String("xdp", "", "compiled bpf/upf_xdp.c to offload sessions to")
+	xdpDevices := flag.String("xdp-dev", "", "comma separated N3 and N6 devices to attach XDP to")
+	xdpMode := flag.String("xdp-mode", "", "xdp, xdpdrv or xdpgeneric")
+	logLevel := flag.String("log", "warn", "log level of the UPF")
+
+	// gnb
+	local := flag.String("local", "127.0.0.1", "gNB and SMF address")
+	sessions := flag.Int("sessions", 1000, "PDU sessions to establish")
+	ueBase := flag.String("ue", "10.60.0.1", "address of the first UE")
+	dst := flag.String("dst", "10.100.2.2:9000", "N6 destination of the uplink packets")
+	size := flag.Int("size", 1400, "inner IP packet size")
+	rate := flag.Int("rate", 0, "G-PDUs per second, unlimited when 0")
+	duration := flag.Duration("duration", 10*time.Second, "how long to send")
+
+	// sink
+	listen := flag.String("listen", ":9000", "address the sink listens on")
+	reflect := flag.Bool("reflect", false, "send received packets back to their source")
+	flag.Parse()
+
+	var err error
+	switch *mode {
+	case "upf":
+		err = runUPF(*pfcpAddr, *gtpuAddr, *tun, split(*routes), *workers, *xdpObject, split(*xdpDevices), *xdpMode, *logLevel)
+	case "gnb":
+		err = runGNB(*pfcpAddr, *gtpuAddr, *local, *ueBase, *dst, *sessions, *size, *rate, *duration)
+	case "sink":
+		err = runSink(*listen, *reflect)
+	default:
+		err = fmt.Errorf("unknown mode %q", *mode)
+	}
+	if err != nil {
+		log.Fatalf("[gtpbench] %v", err)
+	}
+}
+
+func split(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// runUPF runs the UPF until interrupted, logging its packet rates
+func runUPF(pfcpAddr, gtpuAddr, tun string, routes []string, workers int, xdpObject string, xdpDevices []string, xdpMode, logLevel string) error {
+	cfg := &upf.Config{EnablePFCP: true, EnableGTP: true, EnableUPlane: true, LogLevel: logLevel}
+	cfg.PFCP.Addr = pfcpAddr
+	cfg.GTP.Addr = gtpuAddr
+	cfg.TUN.Name = tun
+	cfg.TUN.Routes = routes
+	cfg.FastPath.Workers = workers
+	cfg.FastPath.XDP.Object = xdpObject
+	cfg.FastPath.XDP.Devices = xdpDevices
+	cfg.FastPath.XDP.Mode = xdpMode
+
+	u := upf.NewUPF(cfg)
+	if err := u.Run(); err != nil {
+		return err
+	}
+	defer u.Close()
+	log.Printf("[gtpbench] UPF running, PFCP %s, GTP-U %s", pfcpAddr, gtpuAddr)
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	var last upf.DataPlaneStats
+	for {
+		select {
+		case <-sig:
+			return nil
+		case <-ticker.C:
+			s := u.DataPlaneStats()
+			log.Printf("[gtpbench] received %d pps, sent %d pps, queue drops %d",
+				s.Received-last.Received, s.Sent-last.Sent, s.QueueDrops-last.QueueDrops)
+			last = s
+		}
+	}
+}
+
+// runGNB establishes the sessions, sends G-PDUs for a duration and reports
+// the rates achieved
+func runGNB(pfcpAddr, gtpuAddr, local, ueBase, dst string, sessions, size, rate int, duration time.Duration) error {
+	localIP := net.ParseIP(local).To4()
+	first := net.ParseIP(ueBase).To4()
+	if localIP == nil || first == nil {
+		return fmt.Errorf("IPv4 addresses expected, got %q and %q", local, ueBase)
+	}
+	dstAddr, err := net.ResolveUDPAddr("udp4", dst)
+	if err != nil {
+		return err
+	}
+	upfAddr, err := net.ResolveUDPAddr("udp4", gtpuAddr)
+	if err != nil {
+		return err
+	}
+	if size < 28 {
+		size = 28
+	}
+
+	smf, err := newSMF(pfcpAddr, localIP)
+	if err != nil {
+		return err
+	}
+	defer smf.conn.Close()
+	if err := smf.associate(); err != nil {
+		return err
+	}
+	ues := make([]net.IP, sessions)
+	seids := make([]uint64, 0, sessions)
+	defer func() {
+		for _, seid := range seids {
+			smf.release(seid)
+		}
+	}()
+	for i := range ues {
+		ues[i] = addIP(first, uint32(i))
+		seid, err := smf.establish(uint64(i+1), uint32(i+1), ues[i], upfAddr.IP, localIP)
+		if err != nil {
+			return fmt.Errorf("session %d: %w", i+1, err)
+		}
+		seids = append(seids, seid)
+	}
+	log.Printf("[gtpbench] Established %d sessions", sessions)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: localIP, Port: gtpuPort})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	pc := ipv4.NewPacketConn(conn)
+
+	var received atomic.Uint64
+	go func() {
+		msgs := make([]ipv4.Message, batchSize)
+		for i := range msgs {
+			msgs[i].Buffers = [][]byte{make([]byte, 65535)}
+		}
+		for {
+			n, err := pc.ReadBatch(msgs, 0)
+			if err != nil {
+				return
+			}
+			received.Add(uint64(n))
+		}
+	}()
+
+	gpdus := make([][]byte, sessions)
+	for i, ue := range ues {
+		gpdus[i] = gpdu(uint32(i+1), ue, dstAddr, size)
+	}
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = make([][]byte, 1)
+		msgs[i].Addr = upfAddr
+	}
+
+	log.Printf("[gtpbench] Sending %d byte packets to %s for %s", size, dst, duration)
+	start := time.Now()
+	var sent uint64
+	for next := 0; time.Since(start) < duration; {
+		for i := range msgs {
+			msgs[i].Buffers[0] = gpdus[next]
+			next = (next + 1) % len(gpdus)
+		}
+		n, err := pc.WriteBatch(msgs, 0)
+		if err != nil {
+			return err
+		}
+		sent += uint64(n)
+		if rate > 0 {
+			if ahead := time.Duration(sent)*time.Second/time.Duration(rate) - time.Since(start); ahead > 0 {
+				time.Sleep(ahead)
+			}
+		}
+	}
+	elapsed := time.Since(start).Seconds()
+	// Let the downlink drain
+	time.Sleep(500 * time.Millisecond)
+
+	log.Printf("[gtpbench] Uplink: %d G-PDUs, %.0f pps, %.2f Gbps", sent,
+		float64(sent)/elapsed, float64(sent)*float64(size)*8/elapsed/1e9)
+	down := received.Load()
+	log.Printf("[gtpbench] Downlink: %d G-PDUs, %.0f pps, %.2f Gbps", down,
+		float64(down)/elapsed, float64(down)*float64(size)*8/elapsed/1e9)
+	return nil
+}
+
+// runSink counts the packets it receives until interrupted
+func runSink(listen string, reflect bool) error {
+	addr, err := net.ResolveUDPAddr("udp4", listen)
+	if err != nil {
+		return err
+	}
+	conn, err := net.ListenUDP("udp4", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	pc := ipv4.NewPacketConn(conn)
+
+	var packets, bytes atomic.Uint64
+	go func() {
+		var lastPackets, lastBytes uint64
+		for range time.Tick(time.Second) {
+			p, b := packets.Load(), bytes.Load()
+			log.Printf("[gtpbench] %d pps, %.2f Gbps", p-lastPackets, float64(b-lastBytes)*8/1e9)
+			lastPackets, lastBytes = p, b
+		}
+	}()
+	log.Printf("[gtpbench] Sink listening on %s", conn.LocalAddr())
+
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, 65535)}
+	}
+	for {
+		n, err := pc.ReadBatch(msgs, 0)
+		if err != nil {
+			return err
+		}
+		packets.Add(uint64(n))
+		for _, m := range msgs[:n] {
+			bytes.Add(uint64(m.N))
+		}
+		if reflect {
+			out := make([]ipv4.Message, n)
+			for i, m := range msgs[:n] {
+				out[i] = ipv4.Message{Buffers: [][]byte{m.Buffers[0][:m.N]}, Addr: m.Addr}
+			}
+			pc.WriteBatch(out, 0)
+		}
+	}
+}
+
+// gpdu returns a G-PDU of a UE carrying an IPv4/UDP packet of size bytes
+func gpdu(teid uint32, ue net.IP, dst *net.UDPAddr, size int) []byte {
+	b := make([]byte, 8+size)
+	b[0], b[1] = 0x30, 0xff
+	binary.BigEndian.PutUint16(b[2:], uint16(size))
+	binary.BigEndian.PutUint32(b[4:], teid)
+
+	ip := b[8:]
+	ip[0], ip[8], ip[9] = 0x45, 64, 17
+	binary.BigEndian.PutUint16(ip[2:], uint16(size))
+	copy(ip[12:16], ue)
+	copy(ip[16:20], dst.IP.To4())
+	binary.BigEndian.PutUint16(ip[10:], checksum(ip[:20]))
+
+	udp := ip[20:]
+	binary.BigEndian.PutUint16(udp[0:], 10000+uint16(teid%50000))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(size-20))
+	return b
+}
+
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+func addIP(ip net.IP, n uint32) net.IP {
+	out := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(out, binary.BigEndian.Uint32(ip)+n)
+	return out
+}
+
+// smf sets up the sessions of the benchmark over PFCP
+type smf struct {
+	conn *net.UDPConn
+	addr net.IP
+	seq  uint32
+	buf  []byte
+}
+
+func newSMF(pfcpAddr string, addr net.IP) (*smf, error) {
+	raddr, err := net.ResolveUDPAddr("udp4", pfcpAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp4", &net.UDPAddr{IP: addr}, raddr)
+	if err != nil {
+		return nil, err
+	}
+	return &smf{conn: conn, addr: addr, buf: make([]byte, 65535)}, nil
+}
+
+// request sends a PFCP request and returns its response, an error unless
+// the request was accepted
+func (s *smf) request(msg pfcpmsg.Message) (pfcpmsg.Message, error) {
+	b := make([]byte, msg.MarshalLen())
+	if err := msg.MarshalTo(b); err != nil {
+		return nil, err
+	}
+	if _, err := s.conn.Write(b); err != nil {
+		return nil, err
+	}
+	s.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := s.conn.Read(s.buf)
+	if err != nil {
+		return nil, err
+	}
+	res, err := pfcpmsg.Parse(s.buf[:n])
+	if err != nil {
+		return nil, err
+	}
+	var cause *ie.IE
+	switch res := res.(type) {
+	case *pfcpmsg.AssociationSetupResponse:
+		cause = res.Cause
+	case *pfcpmsg.SessionEstablishmentResponse:
+		cause = res.Cause
+	case *pfcpmsg.SessionDeletionResponse:
+		cause = res.Cause
+	default:
+		return nil, fmt.Errorf("unexpected %s", res.MessageTypeName())
+	}
+	if cause == nil {
+		return nil, fmt.Errorf("%s without a Cause", res.MessageTypeName())
+	}
+	if c, err := cause.Cause(); err != nil || c != ie.CauseRequestAccepted {
+		return nil, fmt.Errorf("%s with cause %d", res.MessageTypeName(), c)
+	}
+	return res, nil
+}
+
+func (s *smf) nextSeq() uint32 {
+	s.seq++
+	return s.seq
+}
+
+func (s *smf) associate() error {
+	_, err := s.request(pfcpmsg.NewAssociationSetupRequest(s.nextSeq(),
+		ie.NewNodeID(s.addr.String(), "", ""),
+		ie.NewRecoveryTimeStamp(time.Now()),
+	))
+	return err
+}
+
+// establish creates a session whose uplink arrives on teid at the UPF and
+// whose downlink is tunnelled to the same TEID at the gNB, and returns the
+// SEID the UPF chose
+func (s *smf) establish(seid uint64, teid uint32, ue, upfAddr, gnbAddr net.IP) (uint64, error) {
+	res, err := s.request(pfcpmsg.NewSessionEstablishmentRequest(0, 0, 0, s.nextSeq(), 0,
+		ie.NewNodeID(s.addr.String(), "", ""),
+		ie.NewFSEID(seid, s.addr, nil),
+		ie.NewCreatePDR(ie.NewPDRID(1), ie.NewPrecedence(255), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceAccess),
+			ie.NewFTEID(0x01, teid, upfAddr, nil, 0),
+			ie.NewUEIPAddress(0x02, ue.String(), "", 0, 0),
+		), ie.NewOuterHeaderRemoval(0, 0), ie.NewFARID(1)),
+		ie.NewCreatePDR(ie.NewPDRID(2), ie.NewPrecedence(255), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceCore),
+			ie.NewUEIPAddress(0x06, ue.String(), "", 0, 0),
+		), ie.NewFARID(2)),
+		ie.NewCreateFAR(ie.NewFARID(1), ie.NewApplyAction(upf.ApplyActionFORW), ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceCore),
+		)),
+		ie.NewCreateFAR(ie.NewFARID(2), ie.NewApplyAction(upf.ApplyActionFORW), ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceAccess),
+			ie.NewOuterHeaderCreation(0x0100, teid, gnbAddr.String(), "", 0, 0, 0),
+		)),
+	))
+	if err != nil {
+		return 0, err
+	}
+	fseid := res.(*pfcpmsg.SessionEstablishmentResponse).UPFSEID
+	if fseid == nil {
+		return 0, fmt.Errorf("no UP F-SEID in the response")
+	}
+	f, err := fseid.FSEID()
+	if err != nil {
+		return 0, err
+	}
+	return f.SEID, nil
+}
+
+func (s *smf) release(seid uint64) {
+	if _, err := s.request(pfcpmsg.NewSessionDeletionRequest(0, 0, seid, s.nextSeq(), 0)); err != nil {
+		log.Printf("[gtpbench] Failed to delete session %d: %v", seid, err)
+	}
+}
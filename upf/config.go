@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/openmvcore/upf/pkg/upf"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the configuration file of the upf binary
+type Config struct {
+	LogLevel string `yaml:"log_level"`
+	// NodeID is the FQDN or address the UPF identifies itself with to the
+	// SMFs, by default the PFCP address
+	NodeID string `yaml:"node_id"`
+
+	PFCP struct {
+		Addr     string `yaml:"addr"`
+		NodeAddr string `yaml:"node_addr"` // address of the F-SEIDs
+	} `yaml:"pfcp"`
+
+	GTP struct {
+		Addr         string        `yaml:"addr"`
+		N3Addr       string        `yaml:"n3_addr"`
+		N9Addr       string        `yaml:"n9_addr"`
+		EchoInterval time.Duration `yaml:"echo_interval"`
+		EchoTimeout  time.Duration `yaml:"echo_timeout"`
+		EchoRetries  int           `yaml:"echo_retries"`
+	} `yaml:"gtp"`
+
+	// N6 is the TUN interface towards the data networks
+	N6 struct {
+		Enabled   bool   `yaml:"enabled"`
+		Interface string `yaml:"interface"`
+		MTU       int    `yaml:"mtu"`
+		LinkMTU   uint16 `yaml:"link_mtu"` // advertised to IPv6 UEs
+	} `yaml:"n6"`
+
+	// DNNs list the UE address pools of each data network, routed into the
+	// N6 interface
+	DNNs []struct {
+		Name   string   `yaml:"name"`
+		Routes []string `yaml:"routes"`
+	} `yaml:"dnns"`
+
+	// UEPools are the pools the UPF allocates from when the SMF asks it to
+	// choose UE addresses
+	UEPools []string `yaml:"ue_pools"`
+
+	DSCP map[uint8]uint8 `yaml:"dscp"`
+
+	// Applications define the Application IDs PDRs detect by flow
+	// descriptions and DNS domains
+	Applications map[string]struct {
+		Flows   []string `yaml:"flows"`
+		Domains []string `yaml:"domains"`
+	} `yaml:"applications"`
+
+	FastPath struct {
+		Workers int `yaml:"workers"`
+		Batch   int `yaml:"batch"`
+		XDP     struct {
+			Object  string   `yaml:"object"`
+			Devices []string `yaml:"devices"`
+			PinPath string   `yaml:"pin_path"`
+			Mode    string   `yaml:"mode"`
+		} `yaml:"xdp"`
+	} `yaml:"fast_path"`
+
+	Buffer struct {
+		Packets int `yaml:"packets"`
+		Bytes   int `yaml:"bytes"`
+	} `yaml:"buffer"`
+
+	// API serves the capture API, disabled when Addr is empty. Capture
+	// files are written to Capture.Dir.
+	API struct {
+		Addr string `yaml:"addr"`
+	} `yaml:"api"`
+	Capture struct {
+		Dir string `yaml:"dir"`
+	} `yaml:"capture"`
+
+	Redis RedisConfig `yaml:"redis"`
+
+	NATS struct {
+		URL          string `yaml:"url"`
+		UsageSubject string `yaml:"usage_subject"`
+	} `yaml:"nats"`
+}
+
+// RedisConfig is where the sessions are persisted, disabled when Addr is
+// empty
+type RedisConfig struct {
+	Addr      string `yaml:"addr"`
+	Password  string `yaml:"password"`
+	DB        int    `yaml:"db"`
+	KeyPrefix string `yaml:"key_prefix"` // "upf:" when empty
+}
+
+// loadConfig reads the configuration file, filling in the defaults
+func loadConfig(path string) (*Config, error) {
+	cfg := &Config{LogLevel: "info"}
+	cfg.PFCP.Addr = "0.0.0.0:8805"
+	cfg.GTP.Addr = "0.0.0.0:2152"
+	cfg.N6.Enabled = true
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(data, cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// upfConfig returns the configuration of the UPF
+func (c *Config) upfConfig() *upf.Config {
+	cfg := &upf.Config{
+		EnableGTP:    true,
+		EnablePFCP:   true,
+		EnableUPlane: c.N6.Enabled,
+		ReportNotify: true,
+		LogLevel:     c.LogLevel,
+		LinkMTU:      c.N6.LinkMTU,
+		NodeID:       c.NodeID,
+		NodeAddr:     c.PFCP.NodeAddr,
+		N3Addr:       c.GTP.N3Addr,
+		N9Addr:       c.GTP.N9Addr,
+		UEPools:      c.UEPools,
+		DSCP:         c.DSCP,
+	}
+	cfg.PFCP.Addr = c.PFCP.Addr
+	cfg.GTP.Addr = c.GTP.Addr
+	cfg.GTP.EchoInterval = c.GTP.EchoInterval
+	cfg.GTP.EchoTimeout = c.GTP.EchoTimeout
+	cfg.GTP.EchoRetries = c.GTP.EchoRetries
+	cfg.TUN.Name = c.N6.Interface
+	cfg.TUN.MTU = c.N6.MTU
+	for _, dnn := range c.DNNs {
+		cfg.TUN.Routes = append(cfg.TUN.Routes, dnn.Routes...)
+	}
+	cfg.FastPath.Workers = c.FastPath.Workers
+	cfg.FastPath.Batch = c.FastPath.Batch
+	cfg.FastPath.XDP.Object = c.FastPath.XDP.Object
+	cfg.FastPath.XDP.Devices = c.FastPath.XDP.Devices
+	cfg.FastPath.XDP.PinPath = c.FastPath.XDP.PinPath
+	cfg.FastPath.XDP.Mode = c.FastPath.XDP.Mode
+	cfg.Buffer.Packets = c.Buffer.Packets
+	cfg.Buffer.Bytes = c.Buffer.Bytes
+	cfg.Capture.Dir = c.Capture.Dir
+	cfg.NATS.URL = c.NATS.URL
+	cfg.NATS.UsageSubject = c.NATS.UsageSubject
+	if len(c.Applications) > 0 {
+		cfg.Applications = make(map[string]upf.Application, len(c.Applications))
+		for id, app := range c.Applications {
+			cfg.Applications[id] = upf.Application{Flows: app.Flows, Domains: app.Domains}
+		}
+	}
+	return cfg
+}
@@ -3,19 +3,25 @@ module github.com/openmvcore/upf
 go 1.21
 
 require (
+	github.com/nats-io/nats.go v1.33.1
 	github.com/redis/go-redis/v9 v9.8.0
 	github.com/sirupsen/logrus v1.6.0
 	github.com/stretchr/testify v1.4.0
 	github.com/wmnsk/go-gtp v0.8.0
 	github.com/wmnsk/go-pfcp v0.0.24
+	golang.org/x/net v0.21.0
+	golang.org/x/sys v0.17.0
+	gopkg.in/yaml.v2 v2.4.0
 )
 
 require (
 	github.com/cespare/xxhash/v2 v2.3.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/klauspost/compress v1.17.2 // indirect
 	github.com/konsorten/go-windows-terminal-sequences v1.0.3 // indirect
+	github.com/nats-io/nkeys v0.4.7 // indirect
+	github.com/nats-io/nuid v1.0.1 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
-	golang.org/x/sys v0.13.0 // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	golang.org/x/crypto v0.19.0 // indirect
 )
@@ -1,25 +1,73 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
+
+	"github.com/openmvcore/upf/pkg/upf"
 )
 
+// statusInterval is how often the number of sessions is logged
+const statusInterval = 30 * time.Second
+
 func main() {
+	configFile := flag.String("config", "config.yaml", "path to the configuration file")
+	flag.Parse()
+
 	log.Println("📡 UPF Booting...")
 
-	// Step 1: Connect to Redis
-	InitRedis()
+	cfg, err := loadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("❌ %v", err)
+	}
+	upfCfg := cfg.upfConfig()
 
-	// Step 2: Start PFCP listener (stub)
-	StartPFCPAgent()
+	// Sessions are persisted to Redis so a restart keeps forwarding them
+	if cfg.Redis.Addr != "" {
+		if err := InitRedis(cfg.Redis); err != nil {
+			log.Fatalf("❌ %v", err)
+		}
+		defer RedisClient.Close()
+		upfCfg.Store = newRedisStore(RedisClient, cfg.Redis.KeyPrefix)
+	}
 
-	// Step 3: Setup GTP tunnels (stub)
-	SetupTunnels()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	u := upf.NewUPF(upfCfg)
+	if err := u.Run(); err != nil {
+		u.Close()
+		log.Fatalf("❌ Failed to start UPF: %v", err)
+	}
+	log.Printf("✅ UPF running (PFCP %s, GTP-U %s)", upfCfg.PFCP.Addr, upfCfg.GTP.Addr)
+
+	if cfg.API.Addr != "" {
+		api := &http.Server{Addr: cfg.API.Addr, Handler: u.CaptureHandler()}
+		go func() {
+			log.Printf("🔎 Capture API listening on %s", cfg.API.Addr)
+			if err := api.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("❌ Capture API failed: %v", err)
+			}
+		}()
+		defer api.Close()
+	}
 
-	// Simulate running state
+	ticker := time.NewTicker(statusInterval)
+	defer ticker.Stop()
 	for {
-		log.Println("💡 UPF active and waiting for PFCP/TEID setup...")
-		time.Sleep(15 * time.Second)
+		select {
+		case <-ctx.Done():
+			log.Println("🛑 Shutting down UPF...")
+			u.Close()
+			return
+		case <-ticker.C:
+			log.Printf("💡 UPF active with %d sessions", u.GetSessionCount())
+		}
 	}
 }
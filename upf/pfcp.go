@@ -1,8 +0,0 @@
-package main
-
-import "log"
-
-func StartPFCPAgent() {
-	log.Println("▶️ Starting PFCP agent... (stub)")
-	// PFCP handling stub
-}
@@ -0,0 +1,384 @@
+package upf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// F-TEID and UE IP Address flags (TS 29.244 §8.2.3, §8.2.62)
+const (
+	fteidFlagV4   uint8 = 0x01
+	fteidFlagV6   uint8 = 0x02
+	ueIPFlagV6    uint8 = 0x01
+	ueIPFlagV4    uint8 = 0x02
+	ueIPFlagSD    uint8 = 0x04
+	maxPoolBlocks       = 1 << 24
+)
+
+// errNoResources is returned when a TEID or UE address pool is exhausted
+var errNoResources = errors.New("no resources available")
+
+// allocator hands out the local F-TEIDs and UE addresses the SMF asks the
+// UPF to choose with the CH and CHV4/CHV6 flags (TS 29.244 §5.5.3, §5.21).
+// TEIDs are unique over all interfaces as every tunnel ends on the same
+// GTP-U socket.
+type allocator struct {
+	n3Addr net.IP
+	n9Addr net.IP
+
+	mu       sync.Mutex
+	nextTEID uint32
+	teids    map[uint32]bool
+	pools    []*uePool
+}
+
+// uePool allocates IPv4 addresses or IPv6 /64 prefixes from a CIDR
+type uePool struct {
+	prefix *net.IPNet
+	v6     bool
+	size   uint64 // number of addresses or /64s
+	next   uint64
+	used   map[uint64]bool
+}
+
+func newAllocator(n3, n9 net.IP) *allocator {
+	if n9 == nil {
+		n9 = n3
+	}
+	return &allocator{
+		n3Addr:   n3,
+		n9Addr:   n9,
+		nextTEID: rand.Uint32() | 1,
+		teids:    make(map[uint32]bool),
+	}
+}
+
+// addPools adds the UE address pools, IPv4 CIDRs or IPv6 CIDRs of /64 or
+// shorter
+func (a *allocator) addPools(cidrs []string) error {
+	for _, cidr := range cidrs {
+		_, prefix, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid UE pool %q: %w", cidr, err)
+		}
+		ones, bits := prefix.Mask.Size()
+		pool := &uePool{prefix: prefix, v6: bits == 128, used: make(map[uint64]bool)}
+		hostBits := bits - ones
+		if pool.v6 {
+			if ones > 64 {
+				return fmt.Errorf("invalid UE pool %q: IPv6 pools delegate /64s", cidr)
+			}
+			hostBits = 64 - ones
+		}
+		pool.size = maxPoolBlocks
+		if hostBits < 24 {
+			pool.size = 1 << hostBits
+		}
+		if !pool.v6 && pool.size > 2 {
+			// Leave out the network and broadcast addresses
+			pool.used[0] = true
+			pool.used[pool.size-1] = true
+		}
+		a.mu.Lock()
+		a.pools = append(a.pools, pool)
+		a.mu.Unlock()
+	}
+	return nil
+}
+
+// assign chooses the F-TEIDs and UE addresses of new PDRs that ask for
+// them. PDRs with the same Choose ID get the same F-TEID, and a session
+// gets a single address per family. What is allocated is recorded in the
+// session so it is released with it, and returned at once when the PDRs
+// cannot all be given theirs; the caller holds the session's lock or the
+// session is not shared yet.
+func (a *allocator) assign(session *Session, pdrs []*PDR) (err error) {
+	teids, ueIP, uePrefix := len(session.chosenTEIDs), session.chosenUEIP, session.chosenUEPrefix
+	defer func() {
+		if err == nil || a == nil {
+			return
+		}
+		var ips []net.IP
+		if ueIP == nil {
+			ips = append(ips, session.chosenUEIP)
+		}
+		if uePrefix == nil {
+			ips = append(ips, chosenPrefixIP(session))
+		}
+		a.free(session.chosenTEIDs[teids:], ips...)
+		session.chosenTEIDs, session.chosenUEIP, session.chosenUEPrefix = session.chosenTEIDs[:teids], ueIP, uePrefix
+	}()
+
+	chosen := make(map[uint8]uint32)
+	for _, pdr := range pdrs {
+		if pdr.ChooseTEID {
+			if a == nil {
+				return fmt.Errorf("PDR %d asks the UPF to choose an F-TEID", pdr.ID)
+			}
+			teid, ok := chosen[pdr.ChooseID]
+			if !ok || pdr.ChooseID == 0 {
+				var err error
+				if teid, err = a.allocateTEID(); err != nil {
+					return err
+				}
+				session.chosenTEIDs = append(session.chosenTEIDs, teid)
+				if pdr.ChooseID != 0 {
+					chosen[pdr.ChooseID] = teid
+				}
+			}
+			pdr.TEID = teid
+			pdr.TEIDAddr = a.addrFor(pdr.SourceInterface)
+		}
+
+		if pdr.ChooseUEIPv4 {
+			if a == nil {
+				return fmt.Errorf("PDR %d asks the UPF to choose an IPv4 address", pdr.ID)
+			}
+			if session.chosenUEIP == nil {
+				ip, err := a.allocateUE(false)
+				if err != nil {
+					return err
+				}
+				session.chosenUEIP = ip
+			}
+			pdr.UEIP = session.chosenUEIP
+		}
+		if pdr.ChooseUEIPv6 {
+			if a == nil {
+				return fmt.Errorf("PDR %d asks the UPF to choose an IPv6 prefix", pdr.ID)
+			}
+			if session.chosenUEPrefix == nil {
+				ip, err := a.allocateUE(true)
+				if err != nil {
+					return err
+				}
+				session.chosenUEPrefix = &net.IPNet{IP: ip, Mask: net.CIDRMask(64, 128)}
+			}
+			pdr.UEPrefix = session.chosenUEPrefix
+		}
+	}
+	return nil
+}
+
+// release returns what was allocated to a session
+func (a *allocator) release(session *Session) {
+	if a == nil {
+		return
+	}
+	a.free(session.chosenTEIDs, session.chosenUEIP, chosenPrefixIP(session))
+	session.chosenTEIDs, session.chosenUEIP, session.chosenUEPrefix = nil, nil, nil
+}
+
+// releaseUnused returns what was allocated to a session that none of its
+// PDRs uses any more, as after a Session Modification removed the PDRs
+// that asked for it. The caller holds the session's lock.
+func (a *allocator) releaseUnused(session *Session, pdrs []*PDR) {
+	if a == nil {
+		return
+	}
+	used := make(map[uint32]bool)
+	var ueIP, uePrefix bool
+	for _, pdr := range pdrs {
+		used[pdr.TEID] = true
+		ueIP = ueIP || (session.chosenUEIP != nil && pdr.UEIP.Equal(session.chosenUEIP))
+		uePrefix = uePrefix || (session.chosenUEPrefix != nil && pdr.UEPrefix != nil && pdr.UEPrefix.IP.Equal(session.chosenUEPrefix.IP))
+	}
+
+	var kept, unused []uint32
+	for _, teid := range session.chosenTEIDs {
+		if used[teid] {
+			kept = append(kept, teid)
+		} else {
+			unused = append(unused, teid)
+		}
+	}
+	var ips []net.IP
+	if !ueIP && session.chosenUEIP != nil {
+		ips = append(ips, session.chosenUEIP)
+		session.chosenUEIP = nil
+	}
+	if !uePrefix && session.chosenUEPrefix != nil {
+		ips = append(ips, session.chosenUEPrefix.IP)
+		session.chosenUEPrefix = nil
+	}
+	a.free(unused, ips...)
+	session.chosenTEIDs = kept
+}
+
+// free returns TEIDs and UE addresses or prefixes to the pools
+func (a *allocator) free(teids []uint32, ips ...net.IP) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, teid := range teids {
+		delete(a.teids, teid)
+	}
+	for _, ip := range ips {
+		if ip == nil {
+			continue
+		}
+		for _, pool := range a.pools {
+			if pool.prefix.Contains(ip) {
+				delete(pool.used, pool.index(ip))
+				break
+			}
+		}
+	}
+}
+
+// reserve marks what was allocated to a restored session as used
+func (a *allocator) reserve(session *Session) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, teid := range session.chosenTEIDs {
+		if a.teids[teid] {
+			return fmt.Errorf("TEID %d is allocated twice", teid)
+		}
+	}
+	for _, teid := range session.chosenTEIDs {
+		a.teids[teid] = true
+	}
+	for _, ip := range []net.IP{session.chosenUEIP, chosenPrefixIP(session)} {
+		if ip == nil {
+			continue
+		}
+		for _, pool := range a.pools {
+			if pool.prefix.Contains(ip) {
+				pool.used[pool.index(ip)] = true
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func chosenPrefixIP(session *Session) net.IP {
+	if session.chosenUEPrefix == nil {
+		return nil
+	}
+	return session.chosenUEPrefix.IP
+}
+
+// allocateTEID returns an unused TEID, never 0
+func (a *allocator) allocateTEID() (uint32, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for i := 0; i < len(a.teids)+1; i++ {
+		teid := a.nextTEID
+		a.nextTEID++
+		if a.nextTEID == 0 {
+			a.nextTEID = 1
+		}
+		if !a.teids[teid] {
+			a.teids[teid] = true
+			return teid, nil
+		}
+	}
+	return 0, fmt.Errorf("%w: no TEID left", errNoResources)
+}
+
+// allocateUE returns an unused address or /64 from the first pool of the
+// family with room left
+func (a *allocator) allocateUE(v6 bool) (net.IP, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, pool := range a.pools {
+		if pool.v6 != v6 {
+			continue
+		}
+		if ip, ok := pool.allocate(); ok {
+			return ip, nil
+		}
+	}
+	if v6 {
+		return nil, fmt.Errorf("%w: no IPv6 UE prefix left", errNoResources)
+	}
+	return nil, fmt.Errorf("%w: no IPv4 UE address left", errNoResources)
+}
+
+// addrFor returns the address of the F-TEIDs of an interface: N9 for
+// tunnels from another UPF, N3 for the access network
+func (a *allocator) addrFor(sourceInterface uint8) net.IP {
+	if sourceInterface == ie.SrcInterfaceCore {
+		return a.n9Addr
+	}
+	return a.n3Addr
+}
+
+func (p *uePool) allocate() (net.IP, bool) {
+	for n := uint64(0); n < p.size; n++ {
+		i := (p.next + n) % p.size
+		if !p.used[i] {
+			p.used[i] = true
+			p.next = i + 1
+			return p.address(i), true
+		}
+	}
+	return nil, false
+}
+
+// address returns the i-th address or /64 of the pool
+func (p *uePool) address(i uint64) net.IP {
+	if !p.v6 {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(p.prefix.IP.To4())+uint32(i))
+		return ip
+	}
+	ip := make(net.IP, net.IPv6len)
+	binary.BigEndian.PutUint64(ip, binary.BigEndian.Uint64(p.prefix.IP.To16())+i)
+	return ip
+}
+
+// index returns the position of an address or /64 in the pool
+func (p *uePool) index(ip net.IP) uint64 {
+	if !p.v6 {
+		return uint64(binary.BigEndian.Uint32(ip.To4()) - binary.BigEndian.Uint32(p.prefix.IP.To4()))
+	}
+	return binary.BigEndian.Uint64(ip.To16()) - binary.BigEndian.Uint64(p.prefix.IP.To16())
+}
+
+// createdPDRs returns the Created PDR IEs reporting the F-TEIDs and UE
+// addresses chosen by the UPF
+func createdPDRs(pdrs []*PDR) []*ie.IE {
+	var ies []*ie.IE
+	for _, pdr := range pdrs {
+		if !pdr.ChooseTEID && !pdr.ChooseUEIPv4 && !pdr.ChooseUEIPv6 {
+			continue
+		}
+		children := []*ie.IE{ie.NewPDRID(pdr.ID)}
+		if pdr.ChooseTEID {
+			if v4 := pdr.TEIDAddr.To4(); v4 != nil {
+				children = append(children, ie.NewFTEID(fteidFlagV4, pdr.TEID, v4, nil, 0))
+			} else {
+				children = append(children, ie.NewFTEID(fteidFlagV6, pdr.TEID, nil, pdr.TEIDAddr, 0))
+			}
+		}
+		if pdr.ChooseUEIPv4 || pdr.ChooseUEIPv6 {
+			var flags uint8
+			var v4, v6 string
+			if pdr.ChooseUEIPv4 {
+				flags |= ueIPFlagV4
+				v4 = pdr.UEIP.String()
+			}
+			if pdr.ChooseUEIPv6 {
+				flags |= ueIPFlagV6
+				v6 = pdr.UEPrefix.IP.String()
+			}
+			if pdr.UEIPIsDestination {
+				flags |= ueIPFlagSD
+			}
+			children = append(children, ie.NewUEIPAddress(flags, v4, v6, 0, 0))
+		}
+		ies = append(ies, ie.NewCreatedPDR(children...))
+	}
+	return ies
+}
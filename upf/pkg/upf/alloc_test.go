@@ -0,0 +1,163 @@
+package upf
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/wmnsk/go-pfcp/ie"
+	pfcpmsg "github.com/wmnsk/go-pfcp/message"
+)
+
+// chooseRules returns the rules of a session whose uplink and downlink PDRs
+// ask the UPF to choose the access F-TEID, with Choose ID 1, and the UE's
+// IPv4 address
+func chooseRules() (pdrs, fars []*ie.IE) {
+	pdrs = []*ie.IE{
+		ie.NewCreatePDR(ie.NewPDRID(1), ie.NewPrecedence(255), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceAccess),
+			ie.NewFTEID(0x0c, 0, nil, nil, 1),
+			ie.NewUEIPAddress(0x10, "", "", 0, 0),
+		), ie.NewFARID(1)),
+		ie.NewCreatePDR(ie.NewPDRID(2), ie.NewPrecedence(100), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceAccess),
+			ie.NewFTEID(0x0c, 0, nil, nil, 1),
+			ie.NewUEIPAddress(0x10, "", "", 0, 0),
+			ie.NewSDFFilter("permit out 17 from any to assigned", "", "", "", 0),
+		), ie.NewFARID(1)),
+	}
+	fars = []*ie.IE{
+		ie.NewCreateFAR(ie.NewFARID(1), ie.NewApplyAction(ApplyActionFORW), ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceCore),
+		)),
+	}
+	return pdrs, fars
+}
+
+func TestAllocatorChoose(t *testing.T) {
+	u := NewUPF(&Config{N3Addr: "192.0.2.10", UEPools: []string{"10.45.0.0/30"}})
+	if err := u.alloc.addPools(u.cfg.UEPools); err != nil {
+		t.Fatalf("addPools() error = %v", err)
+	}
+
+	pdrs, fars := chooseRules()
+	session := &Session{}
+	if err := u.createRules(session, pdrs, fars, nil, nil); err != nil {
+		t.Fatalf("createRules() error = %v", err)
+	}
+	if session.TEID == 0 || !session.UEIP.Equal(net.ParseIP("10.45.0.1")) {
+		t.Fatalf("session TEID/UEIP = %d/%s, want a TEID and 10.45.0.1", session.TEID, session.UEIP)
+	}
+	for _, pdr := range session.PDRs {
+		if pdr.TEID != session.TEID || !pdr.TEIDAddr.Equal(net.ParseIP("192.0.2.10")) {
+			t.Errorf("PDR %d F-TEID = %d@%s, want the shared %d@192.0.2.10", pdr.ID, pdr.TEID, pdr.TEIDAddr, session.TEID)
+		}
+	}
+
+	created := createdPDRs(session.PDRs)
+	if len(created) != 2 {
+		t.Fatalf("createdPDRs() = %d IEs, want 2", len(created))
+	}
+	children, err := created[0].CreatedPDR()
+	if err != nil {
+		t.Fatalf("CreatedPDR() error = %v", err)
+	}
+	var fteid *ie.FTEIDFields
+	var ueip *ie.UEIPAddressFields
+	for _, c := range children {
+		switch c.Type {
+		case ie.FTEID:
+			fteid, _ = c.FTEID()
+		case ie.UEIPAddress:
+			ueip, _ = c.UEIPAddress()
+		}
+	}
+	if fteid == nil || fteid.TEID != session.TEID || !fteid.IPv4Address.Equal(net.ParseIP("192.0.2.10")) {
+		t.Errorf("Created PDR F-TEID = %+v", fteid)
+	}
+	if ueip == nil || !ueip.IPv4Address.Equal(net.ParseIP("10.45.0.1")) {
+		t.Errorf("Created PDR UE IP Address = %+v", ueip)
+	}
+
+	// The /30 has a single other host address
+	second := &Session{}
+	if err := u.createRules(second, pdrs, fars, nil, nil); err != nil {
+		t.Fatalf("createRules() error = %v", err)
+	}
+	if second.TEID == session.TEID || !second.UEIP.Equal(net.ParseIP("10.45.0.2")) {
+		t.Errorf("second session TEID/UEIP = %d/%s, want another TEID and 10.45.0.2", second.TEID, second.UEIP)
+	}
+	if err := u.createRules(&Session{}, pdrs, fars, nil, nil); !errors.Is(err, errNoResources) {
+		t.Errorf("createRules() on an exhausted pool error = %v, want errNoResources", err)
+	}
+
+	// Released addresses are handed out again
+	u.alloc.release(session)
+	third := &Session{}
+	if err := u.createRules(third, pdrs, fars, nil, nil); err != nil || !third.UEIP.Equal(net.ParseIP("10.45.0.1")) {
+		t.Errorf("after release: UEIP = %s, error = %v, want 10.45.0.1", third.UEIP, err)
+	}
+}
+
+func TestUEPoolIPv6(t *testing.T) {
+	a := newAllocator(net.ParseIP("192.0.2.10"), nil)
+	if err := a.addPools([]string{"2001:db8:1::/126"}); err == nil {
+		t.Error("addPools() accepted an IPv6 pool longer than /64")
+	}
+	if err := a.addPools([]string{"2001:db8:1::/48"}); err != nil {
+		t.Fatalf("addPools() error = %v", err)
+	}
+	first, _ := a.allocateUE(true)
+	second, _ := a.allocateUE(true)
+	if !first.Equal(net.ParseIP("2001:db8:1::")) || !second.Equal(net.ParseIP("2001:db8:1:1::")) {
+		t.Errorf("allocateUE() = %s, %s, want consecutive /64s", first, second)
+	}
+	if _, err := a.allocateUE(false); !errors.Is(err, errNoResources) {
+		t.Errorf("allocateUE(IPv4) without a pool error = %v", err)
+	}
+}
+
+func TestAllocatorModification(t *testing.T) {
+	u := NewUPF(&Config{N3Addr: "192.0.2.10", UEPools: []string{"10.45.0.0/30"}})
+	if err := u.alloc.addPools(u.cfg.UEPools); err != nil {
+		t.Fatalf("addPools() error = %v", err)
+	}
+	pdrs, fars := chooseRules()
+	session := &Session{}
+	if err := u.createRules(session, pdrs, fars, nil, nil); err != nil {
+		t.Fatalf("createRules() error = %v", err)
+	}
+	old := session.TEID
+
+	// A request failing validation allocates nothing
+	choose := ie.NewCreatePDR(ie.NewPDRID(3), ie.NewPrecedence(50), ie.NewPDI(
+		ie.NewSourceInterface(ie.SrcInterfaceAccess),
+		ie.NewFTEID(0x0c, 0, nil, nil, 0),
+	), ie.NewFARID(9))
+	if _, err := session.modifyRules(pfcpmsg.NewSessionModificationRequest(0, 0, 1, 1, 0, choose), u.alloc); err == nil {
+		t.Fatal("modifyRules() with an unknown FAR error = nil")
+	}
+	if len(u.alloc.teids) != 1 || len(session.chosenTEIDs) != 1 {
+		t.Errorf("after a failed request: %d TEIDs allocated, %d to the session, want 1", len(u.alloc.teids), len(session.chosenTEIDs))
+	}
+
+	// Removing the PDRs that share the F-TEID and the UE address returns
+	// them
+	created, err := session.modifyRules(pfcpmsg.NewSessionModificationRequest(0, 0, 1, 1, 0,
+		ie.NewRemovePDR(ie.NewPDRID(1)),
+		ie.NewRemovePDR(ie.NewPDRID(2)),
+		ie.NewCreatePDR(ie.NewPDRID(3), ie.NewPrecedence(50), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceAccess),
+			ie.NewFTEID(0x0c, 0, nil, nil, 0),
+		), ie.NewFARID(1)),
+	), u.alloc)
+	if err != nil {
+		t.Fatalf("modifyRules() error = %v", err)
+	}
+	if len(created) != 1 || created[0].TEID == 0 || created[0].TEID == old {
+		t.Fatalf("created = %+v, want PDR 3 with a new F-TEID", created)
+	}
+	if len(u.alloc.teids) != 1 || u.alloc.teids[old] || session.chosenUEIP != nil {
+		t.Errorf("TEIDs %v and UE address %s allocated, want only %d", u.alloc.teids, session.chosenUEIP, created[0].TEID)
+	}
+}
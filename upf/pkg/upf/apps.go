@@ -0,0 +1,278 @@
+package upf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsPort is the port of the DNS servers UEs query
+const dnsPort = 53
+
+// Addresses learnt from DNS responses are kept for their TTL, at least
+// minDNSTTL as UEs cache answers longer than asked, and up to
+// maxLearntAddrs per application and session. A UE may have maxDNSQueries
+// queries waiting dnsQueryTimeout for their answer.
+const (
+	minDNSTTL       = time.Minute
+	maxLearntAddrs  = 1024
+	maxDNSQueries   = 256
+	dnsQueryTimeout = 10 * time.Second
+)
+
+// Application defines the traffic of an Application ID PDRs detect
+// (TS 29.244 §5.4): the flows it uses, and the domains whose addresses are
+// learnt from the DNS responses sent to the UEs. A domain covers its
+// subdomains.
+type Application struct {
+	Flows   []string // flow descriptions, as in SDF filters
+	Domains []string
+}
+
+// appTable matches packets against the configured applications
+type appTable struct {
+	filters map[string][]*SDFFilter
+	domains map[string][]string // application IDs by domain
+}
+
+// dnsQuery identifies a DNS query of a UE by its ID, the server it was sent
+// to and the UE port it was sent from
+type dnsQuery struct {
+	id     uint16
+	server string
+	port   uint16
+}
+
+// sessionDNS is what a session learnt from DNS: the queries of its UE
+// waiting for an answer, and the addresses the answers resolved the domains
+// of the applications to. Only answers to the UE's own queries are learnt,
+// so neither another UE nor a spoofed response can make a session's
+// traffic match an application.
+type sessionDNS struct {
+	mu      sync.Mutex
+	queries map[dnsQuery]time.Time          // expiry of the outstanding queries
+	learnt  map[string]map[string]time.Time // expiry by application and address
+}
+
+// newAppTable parses the application definitions
+func newAppTable(apps map[string]Application) (*appTable, error) {
+	t := &appTable{
+		filters: make(map[string][]*SDFFilter),
+		domains: make(map[string][]string),
+	}
+	for id, app := range apps {
+		for _, fd := range app.Flows {
+			f, err := ParseFlowDescription(fd)
+			if err != nil {
+				return nil, fmt.Errorf("application %s: %w", id, err)
+			}
+			t.filters[id] = append(t.filters[id], f)
+		}
+		for _, domain := range app.Domains {
+			domain = strings.ToLower(strings.Trim(domain, "."))
+			if domain == "" {
+				return nil, fmt.Errorf("application %s: empty domain", id)
+			}
+			t.domains[domain] = append(t.domains[domain], id)
+		}
+	}
+	return t, nil
+}
+
+// loadApplications parses the configured applications
+func (u *UPF) loadApplications() error {
+	if len(u.cfg.Applications) == 0 {
+		return nil
+	}
+	apps, err := newAppTable(u.cfg.Applications)
+	if err != nil {
+		return err
+	}
+	u.apps = apps
+	return nil
+}
+
+// match reports whether a packet of a session belongs to an application, by
+// its flows or by an address the session learnt for its domains
+func (t *appTable) match(appID string, dns *sessionDNS, protocol uint8, remote, ue net.IP, remotePort, uePort uint16) bool {
+	if t == nil {
+		return false
+	}
+	for _, f := range t.filters[appID] {
+		if f.Match(protocol, remote, ue, remotePort, uePort) {
+			return true
+		}
+	}
+	if len(t.domains) == 0 || dns == nil {
+		return false
+	}
+
+	dns.mu.Lock()
+	expires, ok := dns.learnt[appID][string(remote.To16())]
+	dns.mu.Unlock()
+	return ok && time.Now().Before(expires)
+}
+
+// sniffQuery records a DNS query the UE of a session sent, the uplink
+// packet p to port 53
+func (t *appTable) sniffQuery(dns *sessionDNS, p *Packet, packet []byte, now time.Time) {
+	if t == nil || len(t.domains) == 0 {
+		return
+	}
+	_, _, payload, ok := parseTransport(packet, protoUDP)
+	if !ok || len(payload) < 12 || payload[2]&0x80 != 0 {
+		return
+	}
+	q := dnsQuery{id: binary.BigEndian.Uint16(payload), server: string(p.Dst.To16()), port: p.SrcPort}
+
+	dns.mu.Lock()
+	defer dns.mu.Unlock()
+	if dns.queries == nil {
+		dns.queries = make(map[dnsQuery]time.Time)
+	}
+	if len(dns.queries) >= maxDNSQueries {
+		for k, e := range dns.queries {
+			if now.After(e) {
+				delete(dns.queries, k)
+			}
+		}
+		if len(dns.queries) >= maxDNSQueries {
+			return
+		}
+	}
+	dns.queries[q] = now.Add(dnsQueryTimeout)
+}
+
+// answered reports whether a response answers an outstanding query of the
+// UE, which it then no longer is
+func (dns *sessionDNS) answered(q dnsQuery, now time.Time) bool {
+	dns.mu.Lock()
+	defer dns.mu.Unlock()
+	expires, ok := dns.queries[q]
+	if !ok {
+		return false
+	}
+	delete(dns.queries, q)
+	return now.Before(expires)
+}
+
+// sniffDNS learns the addresses a DNS response resolves the domains of the
+// applications to, the downlink packet p from port 53 answering a query of
+// the session's UE
+func (t *appTable) sniffDNS(dns *sessionDNS, p *Packet, packet []byte, now time.Time) {
+	if t == nil || len(t.domains) == 0 {
+		return
+	}
+	_, _, payload, ok := parseTransport(packet, protoUDP)
+	if !ok {
+		return
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(payload)
+	if err != nil || !header.Response || header.RCode != dnsmessage.RCodeSuccess {
+		return
+	}
+	if !dns.answered(dnsQuery{id: header.ID, server: string(p.Src.To16()), port: p.DstPort}, now) {
+		return
+	}
+	var apps []string
+	for {
+		q, err := parser.Question()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		}
+		if err != nil {
+			return
+		}
+		apps = append(apps, t.domainApps(q.Name.String())...)
+	}
+
+	for {
+		h, err := parser.AnswerHeader()
+		if err != nil {
+			return
+		}
+		var ip net.IP
+		switch h.Type {
+		case dnsmessage.TypeA:
+			r, err := parser.AResource()
+			if err != nil {
+				return
+			}
+			ip = net.IP(r.A[:])
+		case dnsmessage.TypeAAAA:
+			r, err := parser.AAAAResource()
+			if err != nil {
+				return
+			}
+			ip = net.IP(r.AAAA[:])
+		default:
+			if err := parser.SkipAnswer(); err != nil {
+				return
+			}
+			continue
+		}
+
+		// The answers of a CNAME chain belong to the domain asked for
+		ids := append(t.domainApps(h.Name.String()), apps...)
+		ttl := time.Duration(h.TTL) * time.Second
+		if ttl < minDNSTTL {
+			ttl = minDNSTTL
+		}
+		for _, id := range ids {
+			dns.learn(id, ip, now.Add(ttl), now)
+		}
+	}
+}
+
+// domainApps returns the applications of a domain and of the domains it is
+// a subdomain of
+func (t *appTable) domainApps(name string) []string {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	var ids []string
+	for name != "" {
+		ids = append(ids, t.domains[name]...)
+		_, parent, ok := strings.Cut(name, ".")
+		if !ok {
+			break
+		}
+		name = parent
+	}
+	return ids
+}
+
+// learn records an address of an application until it expires, dropping
+// expired addresses when the application has too many
+func (dns *sessionDNS) learn(appID string, ip net.IP, expires, now time.Time) {
+	key := string(ip.To16())
+
+	dns.mu.Lock()
+	defer dns.mu.Unlock()
+	if dns.learnt == nil {
+		dns.learnt = make(map[string]map[string]time.Time)
+	}
+	addrs, ok := dns.learnt[appID]
+	if !ok {
+		addrs = make(map[string]time.Time)
+		dns.learnt[appID] = addrs
+	}
+	if _, ok := addrs[key]; !ok && len(addrs) >= maxLearntAddrs {
+		for k, e := range addrs {
+			if now.After(e) {
+				delete(addrs, k)
+			}
+		}
+		if len(addrs) >= maxLearntAddrs {
+			return
+		}
+	}
+	if expires.After(addrs[key]) {
+		addrs[key] = expires
+	}
+}
@@ -0,0 +1,157 @@
+package upf
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+	pfcpmsg "github.com/wmnsk/go-pfcp/message"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// udpPacket returns an IPv4 UDP packet
+func udpPacket(src, dst string, srcPort, dstPort uint16, payload []byte) []byte {
+	udp := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint16(udp[0:], srcPort)
+	binary.BigEndian.PutUint16(udp[2:], dstPort)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(payload)))
+	return ipv4Packet(src, dst, protoUDP, string(append(udp, payload...)))
+}
+
+// dnsQuery returns a query of a name's IPv4 addresses
+func dnsQueryMsg(t *testing.T, id uint16, name string) []byte {
+	t.Helper()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// dnsResponse returns a response resolving a name through a CNAME
+func dnsResponse(t *testing.T, id uint16, name, cname string, a net.IP, ttl uint32) []byte {
+	t.Helper()
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, Response: true, RCode: dnsmessage.RCodeSuccess})
+	b.EnableCompression()
+	b.StartQuestions()
+	b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name), Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET})
+	b.StartAnswers()
+	b.CNAMEResource(dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: ttl},
+		dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(cname)})
+	var addr [4]byte
+	copy(addr[:], a.To4())
+	b.AResource(dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(cname), Class: dnsmessage.ClassINET, TTL: ttl},
+		dnsmessage.AResource{A: addr})
+	msg, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+// appUPF returns the data plane UPF with a PDR dropping the uplink traffic
+// of an application
+func appUPF(t *testing.T, app Application) (*UPF, *fakeTUN) {
+	t.Helper()
+
+	u, tun := dataPlaneUPF(t, "127.0.0.1")
+	u.cfg.Applications = map[string]Application{"blocked": app}
+	if err := u.loadApplications(); err != nil {
+		t.Fatal(err)
+	}
+	session, _ := u.sessionByUE(net.ParseIP("10.0.0.1"))
+	_, err := session.modifyRules(pfcpmsg.NewSessionModificationRequest(0, 0, 1, 1, 0,
+		ie.NewCreatePDR(ie.NewPDRID(3), ie.NewPrecedence(10), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceAccess),
+			ie.NewFTEID(0x01, 100, net.ParseIP("192.0.2.1"), nil, 0),
+			ie.NewUEIPAddress(0x02, "10.0.0.1", "", 0, 0),
+			ie.NewApplicationID("blocked"),
+		), ie.NewFARID(3)),
+		ie.NewCreateFAR(ie.NewFARID(3), ie.NewApplyAction(ApplyActionDROP)),
+	), u.alloc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u, tun
+}
+
+func TestApplicationFlows(t *testing.T) {
+	u, tun := appUPF(t, Application{Flows: []string{
+		"permit out tcp from any 25,465,587 to assigned",
+		"permit out udp from 198.51.100.0/24 6000-6100 to assigned",
+	}})
+
+	u.handleTPDU(nil, 100, udpPacket("10.0.0.1", "198.51.100.7", 40000, 6050, nil))
+	u.handleTPDU(nil, 100, udpPacket("10.0.0.1", "203.0.113.7", 40000, 6050, nil))
+	u.handleTPDU(nil, 100, udpPacket("10.0.0.1", "198.51.100.7", 40000, 6200, nil))
+	if len(tun.written) != 2 {
+		t.Errorf("N6 got %d packets, want the 2 outside the application", len(tun.written))
+	}
+}
+
+func TestApplicationDomains(t *testing.T) {
+	u, tun := appUPF(t, Application{Domains: []string{"example.com"}})
+	session, _ := u.sessionByUE(net.ParseIP("10.0.0.1"))
+	ue := net.ParseIP("10.0.0.1")
+
+	// The UE resolves a subdomain, the CDN address is learnt
+	cdn := net.ParseIP("203.0.113.5")
+	u.handleTPDU(nil, 100, udpPacket("10.0.0.1", "8.8.8.8", 40000, dnsPort, dnsQueryMsg(t, 7, "video.example.com.")))
+	u.handleDownlink(nil, udpPacket("8.8.8.8", "10.0.0.1", dnsPort, 40000,
+		dnsResponse(t, 7, "video.example.com.", "edge.cdn.example.net.", cdn, 30)))
+	if !u.apps.match("blocked", &session.dns, protoTCP, cdn, ue, 443, 40000) {
+		t.Fatal("address of example.com not learnt")
+	}
+	if u.apps.match("blocked", &sessionDNS{}, protoTCP, cdn, ue, 443, 40000) {
+		t.Error("address learnt by another session")
+	}
+
+	tun.written = nil
+	u.handleTPDU(nil, 100, udpPacket("10.0.0.1", "203.0.113.5", 40000, 443, nil))
+	u.handleTPDU(nil, 100, udpPacket("10.0.0.1", "203.0.113.6", 40000, 443, nil))
+	if len(tun.written) != 1 {
+		t.Errorf("N6 got %d packets, want the 1 outside the application", len(tun.written))
+	}
+
+	// Responses to no query of the UE, from another server, to another
+	// port, repeated, of other domains or expired are not
+	now := time.Now()
+	query := func(id uint16, at time.Time) {
+		p := &Packet{Src: ue, Dst: net.ParseIP("8.8.8.8"), SrcPort: 40000}
+		u.apps.sniffQuery(&session.dns, p, udpPacket("10.0.0.1", "8.8.8.8", 40000, dnsPort, dnsQueryMsg(t, id, "www.example.com.")), at)
+	}
+	answer := func(server string, port, id uint16, name string, ip net.IP, at time.Time) {
+		p := &Packet{Src: net.ParseIP(server), Dst: ue, DstPort: port}
+		u.apps.sniffDNS(&session.dns, p, udpPacket(server, "10.0.0.1", dnsPort, port,
+			dnsResponse(t, id, name, "edge.cdn.example.net.", ip, 30)), at)
+	}
+	unsolicited, spoofed, otherPort, repeated := net.ParseIP("203.0.113.7"), net.ParseIP("203.0.113.8"), net.ParseIP("203.0.113.11"), net.ParseIP("203.0.113.12")
+	answer("8.8.8.8", 40000, 8, "www.example.com.", unsolicited, now)
+	query(9, now)
+	answer("192.0.2.66", 40000, 9, "www.example.com.", spoofed, now)
+	answer("8.8.8.8", 40001, 9, "www.example.com.", otherPort, now)
+	answered := net.ParseIP("203.0.113.13")
+	answer("8.8.8.8", 40000, 9, "www.example.com.", answered, now)
+	answer("8.8.8.8", 40000, 9, "www.example.com.", repeated, now)
+	if !u.apps.match("blocked", &session.dns, protoTCP, answered, ue, 443, 40000) {
+		t.Errorf("answer to the UE's query not learnt")
+	}
+	other := net.ParseIP("203.0.113.9")
+	query(10, now)
+	answer("8.8.8.8", 40000, 10, "example.org.", other, now)
+	stale := net.ParseIP("203.0.113.10")
+	query(11, now.Add(-time.Hour))
+	answer("8.8.8.8", 40000, 11, "www.example.com.", stale, now.Add(-time.Hour))
+	for _, ip := range []net.IP{unsolicited, spoofed, otherPort, repeated, other, stale} {
+		if u.apps.match("blocked", &session.dns, protoTCP, ip, ue, 443, 40000) {
+			t.Errorf("%s matches the application", ip)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package upf
+
+import (
+	"net"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// Limits of the packets buffered per session when none are configured
+const (
+	defaultBufferPackets = 64
+	defaultBufferBytes   = 128 * 1024
+)
+
+// farBuffer holds the packets buffered by a FAR while the UE is not
+// reachable, oldest first
+type farBuffer struct {
+	far      *FAR // FAR the packets were buffered with
+	packets  []bufferedPacket
+	bytes    int
+	dropped  uint64 // packets dropped with the buffer full
+	reported bool   // a Downlink Data Report was sent
+}
+
+type bufferedPacket struct {
+	p       Packet
+	payload []byte
+}
+
+// bufferPacket stores a packet of a rule whose FAR buffers and reports a
+// Downlink Data Report for the first one (TS 29.244 §5.2.4). A FAR with
+// NOCP only reports without buffering.
+func (u *UPF) bufferPacket(session *Session, rule *Rule, p *Packet, payload []byte) {
+	far := rule.FAR
+	maxPackets, maxBytes := u.bufferLimits()
+	notify := session.buffer(far, p, payload, maxPackets, maxBytes)
+	if !notify || far.ApplyAction&ApplyActionNOCP == 0 {
+		return
+	}
+
+	report := []*ie.IE{ie.NewPDRID(rule.PDR.ID)}
+	if qfi := rule.QFI(); qfi != 0 {
+		report = append(report, ie.NewDownlinkDataServiceInformation(false, true, 0, qfi))
+	}
+	if err := u.sendSessionReport(session,
+		ie.NewReportType(0, 0, 0, 1),
+		ie.NewDownlinkDataReport(report...),
+	); err != nil {
+		u.logger.Errorf("[UPF] Failed to send Downlink Data Report of session %d: %v", session.SEID, err)
+		return
+	}
+	u.logger.Infof("[UPF] Reported downlink data of session %d on PDR %d", session.SEID, rule.PDR.ID)
+}
+
+// bufferLimits returns the packets and bytes a session may buffer
+func (u *UPF) bufferLimits() (packets, bytes int) {
+	packets, bytes = u.cfg.Buffer.Packets, u.cfg.Buffer.Bytes
+	if packets == 0 {
+		packets = defaultBufferPackets
+	}
+	if bytes == 0 {
+		bytes = defaultBufferBytes
+	}
+	return packets, bytes
+}
+
+// buffer queues a copy of a packet when the FAR buffers and room is left,
+// and reports whether the SMF is to be notified: the first packet since the
+// FAR was installed or updated
+func (s *Session) buffer(far *FAR, p *Packet, payload []byte, maxPackets, maxBytes int) bool {
+	s.bufMu.Lock()
+	defer s.bufMu.Unlock()
+
+	if s.buffers == nil {
+		s.buffers = make(map[uint32]*farBuffer)
+	}
+	buf, ok := s.buffers[far.ID]
+	if !ok || buf.far != far {
+		if !ok {
+			buf = &farBuffer{}
+			s.buffers[far.ID] = buf
+		}
+		buf.far = far
+		buf.reported = false
+	}
+	if far.ApplyAction&ApplyActionBUFF != 0 {
+		if len(buf.packets) < maxPackets && buf.bytes+len(payload) <= maxBytes {
+			// The packet refers to the read buffer
+			copied := *p
+			copied.Src = append(net.IP(nil), p.Src...)
+			copied.Dst = append(net.IP(nil), p.Dst...)
+			buf.packets = append(buf.packets, bufferedPacket{p: copied, payload: append([]byte(nil), payload...)})
+			buf.bytes += len(payload)
+		} else {
+			buf.dropped++
+		}
+	}
+
+	notify := !buf.reported
+	buf.reported = true
+	return notify
+}
+
+// takeBuffered returns the buffered packets whose FAR forwards now, each
+// FAR's in the order they arrived, and how many were dropped with the buffer
+// full. Packets whose FAR was removed or drops are discarded, those of FARs
+// still buffering are kept.
+func (s *Session) takeBuffered() (packets []bufferedPacket, dropped uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.bufMu.Lock()
+	defer s.bufMu.Unlock()
+
+	for id, buf := range s.buffers {
+		far, ok := s.FARs[id]
+		switch {
+		case ok && far.ApplyAction&ApplyActionFORW != 0:
+			packets = append(packets, buf.packets...)
+			dropped += buf.dropped
+		case ok && far.ApplyAction&(ApplyActionBUFF|ApplyActionNOCP) != 0:
+			continue
+		}
+		delete(s.buffers, id)
+	}
+	return packets, dropped
+}
+
+// flushBuffers forwards the packets buffered for a session whose FARs were
+// updated to forward, once the UE is reachable again
+func (u *UPF) flushBuffers(session *Session) {
+	packets, dropped := session.takeBuffered()
+	if len(packets) == 0 {
+		return
+	}
+	for i := range packets {
+		u.forward(nil, session, &packets[i].p, packets[i].payload)
+	}
+	u.logger.Infof("[UPF] Flushed %d buffered packets of session %d, %d dropped with the buffer full", len(packets), session.SEID, dropped)
+}
@@ -0,0 +1,90 @@
+package upf
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+	pfcpmsg "github.com/wmnsk/go-pfcp/message"
+)
+
+func TestDownlinkBuffering(t *testing.T) {
+	u, _ := dataPlaneUPF(t, "127.0.0.1")
+	u.cfg.Buffer.Packets = 2
+
+	smf, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer smf.Close()
+	u.pfcpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.pfcpConn.Close()
+
+	session, _ := u.sessionByUE(net.ParseIP("10.0.0.1"))
+	session.cpAddr = smf.LocalAddr().(*net.UDPAddr)
+	idle := pfcpmsg.NewSessionModificationRequest(0, 0, 1, 1, 0,
+		ie.NewUpdateFAR(ie.NewFARID(2), ie.NewApplyAction(ApplyActionBUFF|ApplyActionNOCP)),
+	)
+	if _, err := session.modifyRules(idle, nil); err != nil {
+		t.Fatalf("modifyRules() error = %v", err)
+	}
+
+	first := ipv4Packet("8.8.8.8", "10.0.0.1", 17, "first")
+	u.handleDownlink(nil, first)
+	u.handleDownlink(nil, ipv4Packet("8.8.8.8", "10.0.0.1", 17, "second"))
+	u.handleDownlink(nil, ipv4Packet("8.8.8.8", "10.0.0.1", 17, "over the limit"))
+
+	buf := make([]byte, 1500)
+	smf.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := smf.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no Session Report Request received: %v", err)
+	}
+	msg, err := pfcpmsg.Parse(buf[:n])
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	report, ok := msg.(*pfcpmsg.SessionReportRequest)
+	if !ok || report.DownlinkDataReport == nil {
+		t.Fatalf("got %+v, want a Session Report Request with a Downlink Data Report", msg)
+	}
+	if id, err := report.DownlinkDataReport.PDRID(); err != nil || id != 2 {
+		t.Errorf("Downlink Data Report PDR ID = %d, %v, want 2", id, err)
+	}
+
+	// Only the first buffered packet is reported
+	smf.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := smf.ReadFromUDP(buf); err == nil {
+		t.Error("a second Downlink Data Report was sent")
+	}
+
+	// Nothing is flushed while the FAR buffers
+	if packets, _ := session.takeBuffered(); len(packets) != 0 {
+		t.Fatalf("takeBuffered() while buffering = %d packets", len(packets))
+	}
+
+	reachable := pfcpmsg.NewSessionModificationRequest(0, 0, 1, 2, 0,
+		ie.NewUpdateFAR(ie.NewFARID(2), ie.NewApplyAction(ApplyActionFORW), ie.NewUpdateForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceAccess),
+			ie.NewOuterHeaderCreation(0x0100, 400, "127.0.0.1", "", 0, 0, 0),
+		)),
+	)
+	if _, err := session.modifyRules(reachable, nil); err != nil {
+		t.Fatalf("modifyRules() error = %v", err)
+	}
+	packets, dropped := session.takeBuffered()
+	if len(packets) != 2 || dropped != 1 {
+		t.Fatalf("takeBuffered() = %d packets, %d dropped, want 2 and 1", len(packets), dropped)
+	}
+	if !bytes.Equal(packets[0].payload, first) || !packets[0].p.Dst.Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("first buffered packet = %+v, want %x", packets[0], first)
+	}
+	if packets, _ := session.takeBuffered(); len(packets) != 0 {
+		t.Errorf("takeBuffered() after the flush = %d packets", len(packets))
+	}
+}
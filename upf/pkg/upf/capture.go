@@ -0,0 +1,677 @@
+package upf
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// Bounds of packet captures. A capture stops after its packets or its
+// duration, whichever comes first.
+const (
+	defaultCapturePackets  = 10000
+	defaultCaptureDuration = time.Minute
+	maxCaptureDuration     = time.Hour
+	maxCaptures            = 8    // running at once
+	captureQueueLen        = 4096 // packets queued to the writer before dropping
+)
+
+// Reasons a capture stopped
+const (
+	captureStoppedPackets  = "packet limit reached"
+	captureStoppedDuration = "duration elapsed"
+	captureStoppedRequest  = "stopped"
+	captureStoppedClosed   = "UPF closed"
+)
+
+var (
+	errCaptureFilter  = errors.New("a capture needs a SEID, UE IP or TEID")
+	errTooManyCapture = fmt.Errorf("at most %d captures run at once", maxCaptures)
+)
+
+// CaptureFilter selects the sessions whose packets a capture records: the
+// session with SEID, the session of the UE with UEIP (an address of its
+// /64 for IPv6 UEs), and the session TEID is a local F-TEID of or a FAR of
+// tunnels into. The fields set must all match.
+type CaptureFilter struct {
+	SEID uint64 `json:"seid,omitempty"`
+	UEIP net.IP `json:"ue_ip,omitempty"`
+	TEID uint32 `json:"teid,omitempty"`
+}
+
+func (f CaptureFilter) String() string {
+	var parts []string
+	if f.SEID != 0 {
+		parts = append(parts, fmt.Sprintf("seid %d", f.SEID))
+	}
+	if f.UEIP != nil {
+		parts = append(parts, "ue "+f.UEIP.String())
+	}
+	if f.TEID != 0 {
+		parts = append(parts, fmt.Sprintf("teid %d", f.TEID))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// CaptureOptions are the filter and bounds of a capture
+type CaptureOptions struct {
+	Filter   CaptureFilter
+	Packets  int           // stop after this many packets, 10000 when 0
+	Duration time.Duration // stop after this long, 1m when 0, at most 1h
+}
+
+// CaptureInfo describes a capture
+type CaptureInfo struct {
+	ID       uint64        `json:"id"`
+	Filter   CaptureFilter `json:"filter"`
+	Limit    int64         `json:"limit"`
+	Duration string        `json:"duration"`
+	Packets  int64         `json:"packets"` // written
+	Dropped  uint64        `json:"dropped"` // lost with the queue full
+	Started  time.Time     `json:"started"`
+	Stopped  *time.Time    `json:"stopped,omitempty"`
+	Reason   string        `json:"reason,omitempty"` // why it stopped
+	File     string        `json:"file,omitempty"`
+}
+
+// Capture records the packets of the sessions matching a filter as pcapng,
+// G-PDUs with their outer IP, UDP and GTP-U headers and N6 packets as they
+// are. The data plane queues the packets; a goroutine writes them.
+type Capture struct {
+	id       uint64
+	filter   CaptureFilter
+	limit    int64
+	duration time.Duration
+	started  time.Time
+	file     string
+
+	queue    chan capturedPacket
+	matched  atomic.Int64 // packets queued, bounded by limit
+	written  atomic.Int64
+	dropped  atomic.Uint64
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	mu      sync.Mutex
+	stopped time.Time
+	reason  string
+}
+
+// ID returns the identifier of the capture in the capture API
+func (c *Capture) ID() uint64 { return c.id }
+
+// Done is closed once the capture stopped and its output is complete
+func (c *Capture) Done() <-chan struct{} { return c.done }
+
+// Stop stops the capture
+func (c *Capture) Stop() { c.finish(captureStoppedRequest) }
+
+func (c *Capture) finish(reason string) {
+	c.stopOnce.Do(func() {
+		c.mu.Lock()
+		c.reason = reason
+		c.mu.Unlock()
+		close(c.stop)
+	})
+}
+
+// Info describes the capture
+func (c *Capture) Info() CaptureInfo {
+	info := CaptureInfo{
+		ID:       c.id,
+		Filter:   c.filter,
+		Limit:    c.limit,
+		Duration: c.duration.String(),
+		Packets:  c.written.Load(),
+		Dropped:  c.dropped.Load(),
+		Started:  c.started,
+		File:     c.file,
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.stopped.IsZero() {
+		stopped := c.stopped
+		info.Stopped, info.Reason = &stopped, c.reason
+	}
+	return info
+}
+
+// add queues a packet unless the capture has all its packets
+func (c *Capture) add(p capturedPacket) {
+	n := c.matched.Add(1)
+	if n > c.limit {
+		return
+	}
+	select {
+	case c.queue <- p:
+	default:
+		c.matched.Add(-1)
+		c.dropped.Add(1)
+		return
+	}
+	if n == c.limit {
+		c.finish(captureStoppedPackets)
+	}
+}
+
+// StartCapture starts a capture written to w, or to a file in Capture.Dir
+// when w is nil. The capture stops after its packets or duration, on Stop,
+// when writing fails or when the UPF is closed. Sessions it matches are not
+// offloaded to XDP while it runs.
+func (u *UPF) StartCapture(opts CaptureOptions, w io.Writer) (*Capture, error) {
+	f := opts.Filter
+	if f.SEID == 0 && f.UEIP == nil && f.TEID == 0 {
+		return nil, errCaptureFilter
+	}
+	c := &Capture{
+		filter:   f,
+		limit:    int64(opts.Packets),
+		duration: opts.Duration,
+		started:  time.Now(),
+		queue:    make(chan capturedPacket, captureQueueLen),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if c.limit <= 0 {
+		c.limit = defaultCapturePackets
+	}
+	if c.duration <= 0 {
+		c.duration = defaultCaptureDuration
+	}
+	if c.duration > maxCaptureDuration {
+		c.duration = maxCaptureDuration
+	}
+
+	u.captureLock.Lock()
+	running := u.runningCaptures()
+	if len(running) >= maxCaptures {
+		u.captureLock.Unlock()
+		return nil, errTooManyCapture
+	}
+	u.nextCapture++
+	c.id = u.nextCapture
+
+	var out io.WriteCloser
+	if w == nil {
+		dir := u.cfg.Capture.Dir
+		if dir == "" {
+			dir = os.TempDir()
+		}
+		c.file = filepath.Join(dir, fmt.Sprintf("upf-capture-%d-%s.pcapng", c.id, c.started.Format("20060102T150405")))
+		err := os.MkdirAll(dir, 0o750)
+		var file *os.File
+		if err == nil {
+			file, err = os.OpenFile(c.file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		}
+		if err != nil {
+			u.captureLock.Unlock()
+			return nil, fmt.Errorf("failed to create capture file: %w", err)
+		}
+		out, w = file, file
+	}
+	u.captures[c.id] = c
+	u.capturing.Store(append(append([]*Capture(nil), running...), c))
+	u.captureLock.Unlock()
+
+	u.logger.Infof("[UPF] Capture %d started: %s, up to %d packets for %s", c.id, f, c.limit, c.duration)
+	u.offloadCaptured(c)
+	go u.runCapture(c, w, out)
+	return c, nil
+}
+
+// runCapture writes the packets of a capture until it stops, then closes
+// its file
+func (u *UPF) runCapture(c *Capture, w io.Writer, out io.Closer) {
+	timer := time.NewTimer(c.duration)
+	defer timer.Stop()
+
+	bw := bufio.NewWriter(w)
+	flush := func() error {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+		return nil
+	}
+	pw, err := newPCAPNGWriter(bw, c.filter.String())
+	if err == nil {
+		err = flush()
+	}
+loop:
+	for err == nil {
+		select {
+		case p := <-c.queue:
+			if err = pw.writePacket(&p); err == nil {
+				c.written.Add(1)
+				if len(c.queue) == 0 {
+					err = flush()
+				}
+			}
+		case <-timer.C:
+			c.finish(captureStoppedDuration)
+			break loop
+		case <-u.done:
+			c.finish(captureStoppedClosed)
+			break loop
+		case <-c.stop:
+			break loop
+		}
+	}
+	if err != nil {
+		c.finish("write failed: " + err.Error())
+	}
+
+	// Packets queued before the capture stopped are still written
+	for drained := false; err == nil && !drained; {
+		select {
+		case p := <-c.queue:
+			if err = pw.writePacket(&p); err == nil {
+				c.written.Add(1)
+			}
+		default:
+			drained = true
+		}
+	}
+	if err == nil {
+		flush()
+	}
+	if out != nil {
+		if err := out.Close(); err != nil {
+			u.logger.Errorf("[UPF] Failed to close capture file %s: %v", c.file, err)
+		}
+	}
+
+	c.mu.Lock()
+	c.stopped = time.Now()
+	reason := c.reason
+	c.mu.Unlock()
+
+	u.captureLock.Lock()
+	var running []*Capture
+	for _, r := range u.runningCaptures() {
+		if r != c {
+			running = append(running, r)
+		}
+	}
+	u.capturing.Store(running)
+	if c.file == "" {
+		// Streams are gone once their response ends
+		delete(u.captures, c.id)
+	}
+	u.captureLock.Unlock()
+
+	u.offloadCaptured(c)
+	u.logger.Infof("[UPF] Capture %d stopped (%s) with %d packets, %d dropped", c.id, reason, c.written.Load(), c.dropped.Load())
+	close(c.done)
+}
+
+// runningCaptures returns the running captures, nil when there are none
+func (u *UPF) runningCaptures() []*Capture {
+	running, _ := u.capturing.Load().([]*Capture)
+	return running
+}
+
+// Captures describes the running captures and the stopped ones whose file
+// is kept, by ID
+func (u *UPF) Captures() []CaptureInfo {
+	u.captureLock.Lock()
+	captures := make([]*Capture, 0, len(u.captures))
+	for _, c := range u.captures {
+		captures = append(captures, c)
+	}
+	u.captureLock.Unlock()
+
+	infos := make([]CaptureInfo, 0, len(captures))
+	for _, c := range captures {
+		infos = append(infos, c.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+func (u *UPF) capture(id uint64) (*Capture, bool) {
+	u.captureLock.Lock()
+	defer u.captureLock.Unlock()
+	c, ok := u.captures[id]
+	return c, ok
+}
+
+// RemoveCapture stops a capture and removes its file
+func (u *UPF) RemoveCapture(id uint64) bool {
+	c, ok := u.capture(id)
+	if !ok {
+		return false
+	}
+	c.Stop()
+	<-c.done
+
+	u.captureLock.Lock()
+	delete(u.captures, id)
+	u.captureLock.Unlock()
+	if c.file != "" {
+		if err := os.Remove(c.file); err != nil && !errors.Is(err, os.ErrNotExist) {
+			u.logger.Errorf("[UPF] Failed to remove capture file %s: %v", c.file, err)
+		}
+	}
+	return true
+}
+
+// captureMatches reports whether a capture filter selects a session
+func (u *UPF) captureMatches(f CaptureFilter, s *Session) bool {
+	if f.SEID != 0 && s.SEID != f.SEID {
+		return false
+	}
+	if f.UEIP != nil {
+		s.mu.RLock()
+		ok := f.UEIP.Equal(s.UEIP) || s.UEPrefix != nil && s.UEPrefix.Contains(f.UEIP)
+		s.mu.RUnlock()
+		if !ok {
+			return false
+		}
+	}
+	if f.TEID != 0 {
+		if ep, ok := u.tunnel(f.TEID); ok && ep.session == s {
+			return true
+		}
+		for _, t := range s.tunnels() {
+			if t.TEID == f.TEID {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// captured reports whether a running capture matches a session
+func (u *UPF) captured(s *Session) bool {
+	for _, c := range u.runningCaptures() {
+		if u.captureMatches(c.filter, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// offloadCaptured updates the XDP offload of the sessions of a capture that
+// started or stopped
+func (u *UPF) offloadCaptured(c *Capture) {
+	if u.xdp == nil {
+		return
+	}
+	for _, s := range u.sessionList() {
+		if u.captureMatches(c.filter, s) {
+			u.offloadSession(s)
+		}
+	}
+}
+
+// captureGPDU records a G-PDU of a session received from or sent to a
+// GTP-U peer, with the IP and UDP headers it is carried in
+func (u *UPF) captureGPDU(s *Session, gpdu []byte, local, peer net.IP, outbound bool) {
+	running := u.runningCaptures()
+	if running == nil {
+		return
+	}
+	var data []byte
+	for _, c := range running {
+		if !u.captureMatches(c.filter, s) {
+			continue
+		}
+		if data == nil {
+			src, dst := peer, local
+			if outbound {
+				src, dst = local, peer
+			}
+			data = outerGPDU(src, dst, gpdu)
+		}
+		c.add(capturedPacket{iface: captureIfaceGTPU, outbound: outbound, time: time.Now(), data: data})
+	}
+}
+
+// captureN6 records a packet of a session read from or written to N6
+func (u *UPF) captureN6(s *Session, packet []byte, outbound bool) {
+	running := u.runningCaptures()
+	if running == nil {
+		return
+	}
+	var data []byte
+	for _, c := range running {
+		if !u.captureMatches(c.filter, s) {
+			continue
+		}
+		if data == nil {
+			data = append([]byte(nil), packet...)
+		}
+		c.add(capturedPacket{iface: captureIfaceN6, outbound: outbound, time: time.Now(), data: data})
+	}
+}
+
+// captureEgressGPDU records a G-PDU a FAR sends into a tunnel
+func (u *UPF) captureEgressGPDU(s *Session, far *FAR, gpdu []byte) {
+	if u.runningCaptures() == nil {
+		return
+	}
+	local := u.alloc.addrFor(ie.SrcInterfaceAccess)
+	if far.DestinationInterface != ie.DstInterfaceAccess {
+		local = u.alloc.addrFor(ie.SrcInterfaceCore)
+	}
+	u.captureGPDU(s, gpdu, local, far.OuterHeader.Addr, true)
+}
+
+// captureIngressGPDU records a G-PDU received on a local F-TEID
+func (u *UPF) captureIngressGPDU(teid uint32, gpdu []byte, peer *net.UDPAddr) {
+	if u.runningCaptures() == nil {
+		return
+	}
+	ep, ok := u.tunnel(teid)
+	if !ok {
+		return
+	}
+	var peerIP net.IP
+	if peer != nil {
+		peerIP = peer.IP
+	}
+	u.captureGPDU(ep.session, gpdu, u.alloc.addrFor(ep.sourceInterface), peerIP, false)
+}
+
+// captureAPIPath is the root of the capture API
+const captureAPIPath = "/upf/v1/captures"
+
+// captureRequest starts a capture in the capture API
+type captureRequest struct {
+	SEID     uint64 `json:"seid"`
+	UEIP     string `json:"ue_ip"`
+	TEID     uint32 `json:"teid"`
+	Packets  int    `json:"packets"`
+	Duration string `json:"duration"` // such as "30s"
+}
+
+func (r *captureRequest) options() (CaptureOptions, error) {
+	opts := CaptureOptions{
+		Filter:  CaptureFilter{SEID: r.SEID, TEID: r.TEID},
+		Packets: r.Packets,
+	}
+	if r.UEIP != "" {
+		if opts.Filter.UEIP = net.ParseIP(r.UEIP); opts.Filter.UEIP == nil {
+			return opts, fmt.Errorf("invalid UE IP %q", r.UEIP)
+		}
+	}
+	if r.Duration != "" {
+		d, err := time.ParseDuration(r.Duration)
+		if err != nil {
+			return opts, fmt.Errorf("invalid duration %q", r.Duration)
+		}
+		opts.Duration = d
+	}
+	if r.Packets < 0 {
+		return opts, fmt.Errorf("invalid packet count %d", r.Packets)
+	}
+	return opts, nil
+}
+
+// CaptureHandler serves the capture API:
+//
+//	POST   /upf/v1/captures               start a capture to a file
+//	GET    /upf/v1/captures               list the captures
+//	GET    /upf/v1/captures/stream?seid=  stream a capture as pcapng
+//	GET    /upf/v1/captures/{id}          describe a capture
+//	GET    /upf/v1/captures/{id}/pcapng   download the file of a capture
+//	POST   /upf/v1/captures/{id}/stop     stop a capture
+//	DELETE /upf/v1/captures/{id}          stop a capture and remove its file
+//
+// Captures take seid, ue_ip and teid filters, a packets limit and a
+// duration, in the request body or the stream's query.
+func (u *UPF) CaptureHandler() http.Handler {
+	return http.HandlerFunc(u.serveCaptureAPI)
+}
+
+func (u *UPF) serveCaptureAPI(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(strings.TrimPrefix(r.URL.Path, captureAPIPath), "/")
+	if path == "" {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, u.Captures())
+		case http.MethodPost:
+			u.handleStartCapture(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+	if path == "stream" && r.Method == http.MethodGet {
+		u.handleStreamCapture(w, r)
+		return
+	}
+
+	idPart, action, _ := strings.Cut(path, "/")
+	id, err := strconv.ParseUint(idPart, 10, 64)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	c, ok := u.capture(id)
+	if !ok {
+		http.Error(w, "capture not found", http.StatusNotFound)
+		return
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, c.Info())
+	case action == "" && r.Method == http.MethodDelete:
+		u.RemoveCapture(id)
+		w.WriteHeader(http.StatusNoContent)
+	case action == "stop" && r.Method == http.MethodPost:
+		c.Stop()
+		<-c.done
+		writeJSON(w, http.StatusOK, c.Info())
+	case action == "pcapng" && r.Method == http.MethodGet && c.file != "":
+		file, err := os.Open(c.file)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+		w.Header().Set("Content-Type", "application/x-pcapng")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(c.file)))
+		io.Copy(w, file)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (u *UPF) handleStartCapture(w http.ResponseWriter, r *http.Request) {
+	var req captureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := req.options()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := u.StartCapture(opts, nil)
+	if err != nil {
+		writeCaptureError(w, err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("%s/%d", captureAPIPath, c.id))
+	writeJSON(w, http.StatusCreated, c.Info())
+}
+
+// handleStreamCapture writes a capture to the response as it runs, stopping
+// it when the client goes away
+func (u *UPF) handleStreamCapture(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	req := captureRequest{UEIP: q.Get("ue_ip"), Duration: q.Get("duration")}
+	var err error
+	if v := q.Get("seid"); v != "" {
+		req.SEID, err = strconv.ParseUint(v, 10, 64)
+	}
+	if v := q.Get("teid"); v != "" && err == nil {
+		var teid uint64
+		teid, err = strconv.ParseUint(v, 10, 32)
+		req.TEID = uint32(teid)
+	}
+	if v := q.Get("packets"); v != "" && err == nil {
+		req.Packets, err = strconv.Atoi(v)
+	}
+	if err != nil {
+		http.Error(w, "invalid query: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	opts, err := req.options()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-pcapng")
+	c, err := u.StartCapture(opts, w)
+	if err != nil {
+		w.Header().Del("Content-Type")
+		writeCaptureError(w, err)
+		return
+	}
+	select {
+	case <-c.done:
+	case <-r.Context().Done():
+		c.Stop()
+		<-c.done
+	}
+}
+
+func writeCaptureError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errCaptureFilter):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errTooManyCapture):
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
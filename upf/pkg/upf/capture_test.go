@@ -0,0 +1,194 @@
+package upf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// pcapngBlock is a block of a pcapng file and its body
+type pcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+func readPCAPNG(t *testing.T, b []byte) []pcapngBlock {
+	t.Helper()
+	var blocks []pcapngBlock
+	for len(b) > 0 {
+		if len(b) < 12 {
+			t.Fatalf("truncated block %x", b)
+		}
+		total := binary.LittleEndian.Uint32(b[4:])
+		if total%4 != 0 || int(total) > len(b) || binary.LittleEndian.Uint32(b[total-4:]) != total {
+			t.Fatalf("invalid block length %d", total)
+		}
+		blocks = append(blocks, pcapngBlock{binary.LittleEndian.Uint32(b), b[8 : total-4]})
+		b = b[total:]
+	}
+	return blocks
+}
+
+// packet returns the interface, flags and data of an Enhanced Packet Block
+func (b pcapngBlock) packet() (iface, flags uint32, data []byte) {
+	n := binary.LittleEndian.Uint32(b.body[12:])
+	data = b.body[20 : 20+n]
+	opts := b.body[20+(n+3)/4*4:]
+	if binary.LittleEndian.Uint16(opts) == pcapngOptEPBFlags {
+		flags = binary.LittleEndian.Uint32(opts[4:])
+	}
+	return binary.LittleEndian.Uint32(b.body), flags, data
+}
+
+// syncBuffer is a bytes.Buffer a capture writes to while the test waits
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func TestCaptureSession(t *testing.T) {
+	u, _ := dataPlaneUPF(t, "192.0.2.10")
+	defer u.Close()
+
+	out := &syncBuffer{}
+	c, err := u.StartCapture(CaptureOptions{Filter: CaptureFilter{UEIP: net.ParseIP("10.0.0.1")}, Packets: 2}, out)
+	if err != nil {
+		t.Fatalf("StartCapture() error = %v", err)
+	}
+
+	// Packets of other UEs are left out
+	u.handleDownlink(nil, ipv4Packet("8.8.8.8", "10.0.0.9", 17, "other UE"))
+	pkt := ipv4Packet("10.0.0.1", "8.8.8.8", 17, "uplink")
+	u.handleGPDU(nil, appendGPDU(nil, 100, pduTypeUL, 0, pkt), &net.UDPAddr{IP: net.ParseIP("192.0.2.10"), Port: gtpuPort})
+	u.handleDownlink(nil, ipv4Packet("8.8.8.8", "10.0.0.1", 17, "over the limit"))
+
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("capture did not stop after its packets")
+	}
+	if info := c.Info(); info.Packets != 2 || info.Reason != captureStoppedPackets {
+		t.Errorf("Info() = %+v, want 2 packets and the limit reached", info)
+	}
+
+	blocks := readPCAPNG(t, out.buf.Bytes())
+	if len(blocks) != 5 || blocks[0].blockType != pcapngSectionHeader || blocks[1].blockType != pcapngInterface || blocks[2].blockType != pcapngInterface {
+		t.Fatalf("blocks = %+v, want a section, 2 interfaces and 2 packets", blocks)
+	}
+
+	// The received G-PDU with its outer headers, then the packet sent to N6
+	iface, flags, data := blocks[3].packet()
+	if iface != captureIfaceGTPU || flags != pcapngFlagInbound {
+		t.Errorf("G-PDU on interface %d with flags %d", iface, flags)
+	}
+	if len(data) != 20+8+gtpuHeaderLen+len(pkt) || !net.IP(data[12:16]).Equal(net.ParseIP("192.0.2.10")) ||
+		binary.BigEndian.Uint16(data[22:]) != gtpuPort || binary.BigEndian.Uint32(data[32:]) != 100 || !bytes.Equal(data[36:], pkt) {
+		t.Errorf("G-PDU = %x", data)
+	}
+	if ipv4Checksum(data[:20]) != 0 {
+		t.Errorf("outer IPv4 header checksum is invalid")
+	}
+	iface, flags, data = blocks[4].packet()
+	if iface != captureIfaceN6 || flags != pcapngFlagOutbound || !bytes.Equal(data, pkt) {
+		t.Errorf("N6 packet on interface %d with flags %d = %x, want %x", iface, flags, data, pkt)
+	}
+
+	if len(u.runningCaptures()) != 0 || len(u.Captures()) != 0 {
+		t.Errorf("stopped stream still listed: %+v", u.Captures())
+	}
+}
+
+func TestCaptureAPI(t *testing.T) {
+	u, _ := dataPlaneUPF(t, "192.0.2.10")
+	defer u.Close()
+	u.cfg.Capture.Dir = t.TempDir()
+	server := httptest.NewServer(u.CaptureHandler())
+	defer server.Close()
+
+	post := func(path, body string) *http.Response {
+		t.Helper()
+		res, err := http.Post(server.URL+captureAPIPath+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+	for _, body := range []string{`{}`, `{"ue_ip": "10.0.0"}`, `{"seid": 1, "duration": "soon"}`} {
+		if res := post("", body); res.StatusCode != http.StatusBadRequest {
+			t.Errorf("POST %s = %s, want 400", body, res.Status)
+		}
+	}
+
+	res := post("", `{"seid": 1, "duration": "1m"}`)
+	var info CaptureInfo
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil || res.StatusCode != http.StatusCreated {
+		t.Fatalf("POST = %s, %v", res.Status, err)
+	}
+	u.handleDownlink(nil, ipv4Packet("8.8.8.8", "10.0.0.1", 17, "downlink"))
+
+	res = post("/1/stop", "")
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil || info.Reason != captureStoppedRequest || info.Stopped == nil {
+		t.Fatalf("stop = %+v, %v", info, err)
+	}
+
+	res, err := http.Get(server.URL + captureAPIPath + "/1/pcapng")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var file bytes.Buffer
+	file.ReadFrom(res.Body)
+	// The section, the interfaces and the downlink packet received on N6.
+	// Without GTP-U the UPF sends no G-PDU to the gNB.
+	if blocks := readPCAPNG(t, file.Bytes()); len(blocks) != 4 || res.Header.Get("Content-Type") != "application/x-pcapng" {
+		t.Errorf("downloaded %d blocks of %s", len(blocks), res.Header.Get("Content-Type"))
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, server.URL+captureAPIPath+"/1", nil)
+	if res, err := http.DefaultClient.Do(req); err != nil || res.StatusCode != http.StatusNoContent {
+		t.Fatalf("DELETE = %v, %v", res, err)
+	}
+	if _, err := os.Stat(info.File); !os.IsNotExist(err) {
+		t.Errorf("capture file %s kept after DELETE", info.File)
+	}
+	if res, _ := http.Get(server.URL + captureAPIPath + "/1"); res.StatusCode != http.StatusNotFound {
+		t.Errorf("GET after DELETE = %s", res.Status)
+	}
+}
+
+func TestCaptureStream(t *testing.T) {
+	u, _ := dataPlaneUPF(t, "192.0.2.10")
+	defer u.Close()
+	server := httptest.NewServer(u.CaptureHandler())
+	defer server.Close()
+
+	go func() {
+		// Sent once the capture runs
+		for len(u.runningCaptures()) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		u.handleTPDU(nil, 100, ipv4Packet("10.0.0.1", "8.8.8.8", 17, "uplink"))
+	}()
+	res, err := http.Get(server.URL + captureAPIPath + "/stream?teid=100&packets=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream bytes.Buffer
+	stream.ReadFrom(res.Body)
+	if blocks := readPCAPNG(t, stream.Bytes()); len(blocks) != 4 || blocks[3].blockType != pcapngEnhancedPacket {
+		t.Errorf("streamed %+v, want one packet", blocks)
+	}
+}
@@ -0,0 +1,354 @@
+package upf
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// maxPacketSize bounds the PFCP datagrams and the snapshot length of
+// captures
+const maxPacketSize = 65535
+
+// Packet buffers of the data plane hold a packet of the N6 MTU, 1500 when
+// left to the kernel, in a G-PDU with its extension headers
+const (
+	defaultMTU   = 1500
+	gtpuHeadroom = 64
+)
+
+// defaultTUNName is the N6 interface created when none is configured
+const defaultTUNName = "upfgtp"
+
+// packetBufferSize returns the size of the data plane's packet buffers.
+// Larger G-PDUs are truncated and dropped as invalid.
+func (u *UPF) packetBufferSize() int {
+	mtu := u.cfg.TUN.MTU
+	if mtu <= 0 {
+		mtu = defaultMTU
+	}
+	return mtu + gtpuHeadroom
+}
+
+// tunnelEndpoint is a local F-TEID and the interface its traffic comes from
+type tunnelEndpoint struct {
+	session         *Session
+	sourceInterface uint8
+}
+
+// startDataPlane opens the N6 TUN interface and forwards downlink packets
+// read from it. Uplink packets are forwarded as they arrive on GTP-U.
+func (u *UPF) startDataPlane() error {
+	if u.tun == nil {
+		name := u.cfg.TUN.Name
+		if name == "" {
+			name = defaultTUNName
+		}
+		tun, err := openTUN(name, u.cfg.TUN.MTU, u.cfg.TUN.Routes)
+		if err != nil {
+			return err
+		}
+		u.tun = tun
+		u.logger.Infof("[UPF] N6 interface %s up, routing %v", name, u.cfg.TUN.Routes)
+	}
+
+	go u.serveTUN()
+	return nil
+}
+
+// handleTPDU forwards a G-PDU received on a local F-TEID. G-PDUs it sends
+// are queued to tx, or sent at once when tx is nil.
+func (u *UPF) handleTPDU(tx *txBatch, teid uint32, payload []byte) {
+	ep, ok := u.tunnel(teid)
+	if !ok {
+		u.logger.Debugf("[UPF] Dropping G-PDU for unknown TEID %d", teid)
+		return
+	}
+	src, dst, proto, ok := parseIPHeader(payload)
+	if !ok {
+		u.logger.Debugf("[UPF] Dropping G-PDU with an invalid IP packet on TEID %d", teid)
+		return
+	}
+	srcPort, dstPort, _, _ := parseTransport(payload, proto)
+	u.forward(tx, ep.session, &Packet{
+		SourceInterface: ep.sourceInterface,
+		TEID:            teid,
+		Src:             src,
+		Dst:             dst,
+		Protocol:        proto,
+		SrcPort:         srcPort,
+		DstPort:         dstPort,
+	}, payload)
+}
+
+// handleDownlink forwards a packet read from the N6 interface to the
+// session of its destination UE
+func (u *UPF) handleDownlink(tx *txBatch, payload []byte) {
+	src, dst, proto, ok := parseIPHeader(payload)
+	if !ok {
+		return
+	}
+	session, ok := u.sessionByUE(dst)
+	if !ok {
+		u.logger.Debugf("[UPF] Dropping downlink packet for unknown UE %s", dst)
+		return
+	}
+	u.captureN6(session, payload, false)
+	srcPort, dstPort, _, _ := parseTransport(payload, proto)
+	u.forward(tx, session, &Packet{
+		SourceInterface: ie.SrcInterfaceCore,
+		Src:             src,
+		Dst:             dst,
+		Protocol:        proto,
+		SrcPort:         srcPort,
+		DstPort:         dstPort,
+	}, payload)
+}
+
+// forward applies the QERs, URRs and FAR of the highest precedence PDR
+// matching the packet. Packets with an outer header to create are tunnelled
+// with their QFI, the others leave through N6 marked with the DSCP of their
+// QFI. Packets of a URR whose quota is used up are dropped, those of a FAR
+// that buffers are kept until it forwards. A FAR that duplicates copies the
+// packets it forwards to the mediation functions.
+func (u *UPF) forward(tx *txBatch, session *Session, p *Packet, payload []byte) {
+	if p.Protocol == protoUDP {
+		switch {
+		case p.SourceInterface == ie.SrcInterfaceAccess && p.DstPort == dnsPort:
+			u.apps.sniffQuery(&session.dns, p, payload, time.Now())
+		case p.SourceInterface == ie.SrcInterfaceCore && p.SrcPort == dnsPort:
+			u.apps.sniffDNS(&session.dns, p, payload, time.Now())
+		}
+	}
+	p.apps, p.dns = u.apps, &session.dns
+	rule := session.Classify(p)
+	if rule == nil {
+		u.logger.Debugf("[UPF] Dropping packet %s -> %s of session %d matching no PDR", p.Src, p.Dst, session.SEID)
+		return
+	}
+	far := rule.FAR
+	if far.ApplyAction&ApplyActionFORW == 0 && far.ApplyAction&(ApplyActionBUFF|ApplyActionNOCP) != 0 {
+		u.bufferPacket(session, rule, p, payload)
+		return
+	}
+	if far.ApplyAction&ApplyActionFORW == 0 {
+		u.logger.Debugf("[UPF] Dropping packet of session %d, PDR %d FAR %d action %#02x", session.SEID, rule.PDR.ID, far.ID, far.ApplyAction)
+		return
+	}
+	if session.quotaExhausted(rule.URRs) {
+		u.logger.Debugf("[UPF] Dropping packet of session %d, the quota of PDR %d is used up", session.SEID, rule.PDR.ID)
+		return
+	}
+	uplink, now := p.SourceInterface == ie.SrcInterfaceAccess, time.Now()
+	if !session.enforceQoS(rule.QERs, uplink, len(payload), now) {
+		u.logger.Debugf("[UPF] Dropping packet of session %d policed by the QERs of PDR %d", session.SEID, rule.PDR.ID)
+		return
+	}
+	session.sawTraffic(now)
+	u.reportUsage(session, session.measureUsage(rule.URRs, uplink, len(payload), now))
+	if far.ApplyAction&ApplyActionDUPL != 0 {
+		u.x3.duplicate(far.Duplicates, uplink, payload)
+	}
+
+	qfi := rule.QFI()
+	if far.OuterHeader != nil {
+		pduType := pduTypeUL
+		if far.DestinationInterface == ie.DstInterfaceAccess {
+			pduType = pduTypeDL
+		}
+		if err := u.encapsulate(tx, session, far, pduType, qfi, payload); err != nil {
+			u.logger.Errorf("[UPF] Failed to tunnel packet of session %d: %v", session.SEID, err)
+		}
+		return
+	}
+	if far.DestinationInterface == ie.DstInterfaceAccess || u.tun == nil {
+		u.logger.Debugf("[UPF] Dropping packet of session %d, FAR %d has no tunnel", session.SEID, far.ID)
+		return
+	}
+	if dscp, ok := u.cfg.DSCP[qfi]; ok && qfi != 0 {
+		setDSCP(payload, dscp)
+	}
+	u.captureN6(session, payload, true)
+	if _, err := u.tun.Write(payload); err != nil {
+		u.logger.Errorf("[UPF] Failed to write packet of session %d to N6: %v", session.SEID, err)
+	}
+}
+
+// encapsulate sends a packet as a G-PDU into the GTP-U tunnel of a FAR,
+// queued to tx when it is set
+func (u *UPF) encapsulate(tx *txBatch, session *Session, far *FAR, pduType, qfi uint8, payload []byte) error {
+	if u.gtpuConn == nil {
+		return errors.New("GTP-U is disabled")
+	}
+	tunnel := far.OuterHeader
+	addr := &net.UDPAddr{IP: tunnel.Addr, Port: gtpuPort}
+	if tx != nil {
+		b := appendGPDU(tx.buffer(), tunnel.TEID, pduType, qfi, payload)
+		u.captureEgressGPDU(session, far, b)
+		return tx.queue(b, addr)
+	}
+	b := appendGPDU(make([]byte, 0, gtpuHeaderLen+8+len(payload)), tunnel.TEID, pduType, qfi, payload)
+	u.captureEgressGPDU(session, far, b)
+	if _, err := u.gtpuConn.WriteToUDP(b, addr); err != nil {
+		return err
+	}
+	u.stats.sent.Add(1)
+	return nil
+}
+
+// parseIPHeader returns the addresses and protocol of an IPv4 or IPv6
+// packet, reporting whether the header is valid. The protocol of IPv6
+// packets is the first Next Header.
+func parseIPHeader(b []byte) (src, dst net.IP, proto uint8, ok bool) {
+	if len(b) == 0 {
+		return nil, nil, 0, false
+	}
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 || int(b[0]&0x0f)*4 < 20 {
+			return nil, nil, 0, false
+		}
+		return net.IP(b[12:16]), net.IP(b[16:20]), b[9], true
+	case 6:
+		if len(b) < ipv6HeaderLen {
+			return nil, nil, 0, false
+		}
+		return net.IP(b[8:24]), net.IP(b[24:40]), b[6], true
+	}
+	return nil, nil, 0, false
+}
+
+// parseTransport returns the ports and payload of the TCP, UDP or SCTP
+// segment of an IP packet whose header parseIPHeader accepted, reporting
+// whether the packet has ports
+func parseTransport(b []byte, proto uint8) (src, dst uint16, payload []byte, ok bool) {
+	if !hasPorts(proto) {
+		return 0, 0, nil, false
+	}
+	offset := ipv6HeaderLen
+	if b[0]>>4 == 4 {
+		if binary.BigEndian.Uint16(b[6:8])&0x1fff != 0 {
+			// Later fragments carry no transport header
+			return 0, 0, nil, false
+		}
+		offset = int(b[0]&0x0f) * 4
+	}
+	if len(b) < offset+4 {
+		return 0, 0, nil, false
+	}
+	src, dst = binary.BigEndian.Uint16(b[offset:]), binary.BigEndian.Uint16(b[offset+2:])
+	if proto == protoUDP && len(b) >= offset+8 {
+		payload = b[offset+8:]
+	}
+	return src, dst, payload, true
+}
+
+// addSession stores an established session and indexes its local F-TEIDs
+// and UE addresses for the data plane
+func (u *UPF) addSession(session *Session) {
+	u.sessionLock.Lock()
+	defer u.sessionLock.Unlock()
+
+	u.nextSEID++
+	session.SEID = u.nextSEID
+	u.sessions[session.SEID] = session
+	u.indexLocked(session)
+}
+
+// indexSession updates the data plane indexes of a session whose PDRs changed
+func (u *UPF) indexSession(session *Session) {
+	u.sessionLock.Lock()
+	defer u.sessionLock.Unlock()
+	u.indexLocked(session)
+}
+
+// indexLocked indexes the local F-TEIDs and UE addresses of a session,
+// removing those it no longer has. Entries are replaced in place so packets
+// of a session being modified keep finding it. The caller holds
+// sessionLock.
+func (u *UPF) indexLocked(session *Session) {
+	session.mu.RLock()
+	teids := make(map[uint32]tunnelEndpoint)
+	for _, pdr := range session.PDRs {
+		if pdr.TEID != 0 {
+			teids[pdr.TEID] = tunnelEndpoint{session: session, sourceInterface: pdr.SourceInterface}
+		}
+	}
+	ues := make(map[ueKey]bool)
+	if key, ok := ueKeyOf(session.UEIP); ok {
+		ues[key] = true
+	}
+	if session.UEPrefix != nil {
+		if key, ok := ueKeyOf(session.UEPrefix.IP); ok {
+			ues[key] = true
+		}
+	}
+	session.mu.RUnlock()
+
+	for _, teid := range session.indexedTEIDs {
+		if _, ok := teids[teid]; !ok {
+			u.tunnels.update(teid, tunnelEndpoint{})
+		}
+	}
+	for _, key := range session.indexedUEs {
+		if !ues[key] {
+			u.ueSessions.update(key, nil)
+		}
+	}
+	session.indexedTEIDs, session.indexedUEs = session.indexedTEIDs[:0], session.indexedUEs[:0]
+	for teid, ep := range teids {
+		if current, ok := u.tunnels.load(teid); !ok || current != ep {
+			u.tunnels.update(teid, ep)
+		}
+		session.indexedTEIDs = append(session.indexedTEIDs, teid)
+	}
+	for key := range ues {
+		if current, ok := u.ueSessions.load(key); !ok || current != session {
+			u.ueSessions.update(key, session)
+		}
+		session.indexedUEs = append(session.indexedUEs, key)
+	}
+}
+
+// removeSession deletes a session and its data plane indexes
+func (u *UPF) removeSession(seid uint64) (*Session, bool) {
+	u.sessionLock.Lock()
+	defer u.sessionLock.Unlock()
+
+	session, ok := u.sessions[seid]
+	if !ok {
+		return nil, false
+	}
+	delete(u.sessions, seid)
+	u.unindexLocked(session)
+	return session, true
+}
+
+// unindexLocked removes a session from the data plane indexes. The caller
+// holds sessionLock.
+func (u *UPF) unindexLocked(session *Session) {
+	for _, teid := range session.indexedTEIDs {
+		u.tunnels.update(teid, tunnelEndpoint{})
+	}
+	for _, key := range session.indexedUEs {
+		u.ueSessions.update(key, nil)
+	}
+	session.indexedTEIDs, session.indexedUEs = nil, nil
+}
+
+// tunnel returns the session a local TEID belongs to
+func (u *UPF) tunnel(teid uint32) (tunnelEndpoint, bool) {
+	return u.tunnels.load(teid)
+}
+
+// sessionByUE returns the session of a UE address
+func (u *UPF) sessionByUE(ip net.IP) (*Session, bool) {
+	key, ok := ueKeyOf(ip)
+	if !ok {
+		return nil, false
+	}
+	return u.ueSessions.load(key)
+}
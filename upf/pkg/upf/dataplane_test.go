@@ -0,0 +1,161 @@
+package upf
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	gtpv1msg "github.com/wmnsk/go-gtp/gtpv1/message"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// fakeTUN records the packets written to the N6 interface
+type fakeTUN struct {
+	mu      sync.Mutex
+	written [][]byte
+}
+
+func (f *fakeTUN) Read(b []byte) (int, error) { select {} }
+func (f *fakeTUN) Close() error               { return nil }
+func (f *fakeTUN) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.written = append(f.written, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+// packets returns the packets written so far
+func (f *fakeTUN) packets() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.written
+}
+
+// ipv4Packet returns an IPv4 header without options followed by payload
+func ipv4Packet(src, dst string, proto uint8, payload string) []byte {
+	b := make([]byte, 20, 20+len(payload))
+	b[0] = 0x45
+	b[8] = 64
+	b[9] = proto
+	copy(b[12:16], net.ParseIP(src).To4())
+	copy(b[16:20], net.ParseIP(dst).To4())
+	return append(b, payload...)
+}
+
+// dataPlaneUPF returns a UPF with an IPv4 session whose access tunnel ends
+// on TEID 100 and whose downlink goes to TEID 300 at gnb
+func dataPlaneUPF(t testing.TB, gnb string) (*UPF, *fakeTUN) {
+	t.Helper()
+
+	pdrs := []*ie.IE{
+		ie.NewCreatePDR(ie.NewPDRID(1), ie.NewPrecedence(255), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceAccess),
+			ie.NewFTEID(0x01, 100, net.ParseIP("192.0.2.1"), nil, 0),
+			ie.NewUEIPAddress(0x02, "10.0.0.1", "", 0, 0),
+		), ie.NewOuterHeaderRemoval(0, 0), ie.NewFARID(1)),
+		ie.NewCreatePDR(ie.NewPDRID(2), ie.NewPrecedence(255), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceCore),
+			ie.NewUEIPAddress(0x06, "10.0.0.1", "", 0, 0),
+		), ie.NewFARID(2)),
+	}
+	fars := []*ie.IE{
+		ie.NewCreateFAR(ie.NewFARID(1), ie.NewApplyAction(ApplyActionFORW), ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceCore),
+		)),
+		ie.NewCreateFAR(ie.NewFARID(2), ie.NewApplyAction(ApplyActionFORW), ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceAccess),
+			ie.NewOuterHeaderCreation(0x0100, 300, gnb, "", 0, 0, 0),
+		)),
+	}
+
+	tun := &fakeTUN{}
+	u := NewUPF(&Config{})
+	u.tun = tun
+	session := &Session{}
+	if err := u.createRules(session, pdrs, fars, nil, nil); err != nil {
+		t.Fatalf("createRules() error = %v", err)
+	}
+	u.addSession(session)
+	return u, tun
+}
+
+func TestUplinkDecapsulation(t *testing.T) {
+	u, tun := dataPlaneUPF(t, "127.0.0.1")
+
+	pkt := ipv4Packet("10.0.0.1", "8.8.8.8", 17, "uplink")
+	u.handleTPDU(nil, 100, pkt)
+	if len(tun.written) != 1 || !bytes.Equal(tun.written[0], pkt) {
+		t.Fatalf("N6 got %x, want the inner packet %x", tun.written, pkt)
+	}
+
+	// Spoofed sources, unknown TEIDs and non-IP payloads are dropped
+	u.handleTPDU(nil, 100, ipv4Packet("10.0.0.2", "8.8.8.8", 17, "spoofed"))
+	u.handleTPDU(nil, 101, pkt)
+	u.handleTPDU(nil, 100, []byte{0x00, 0x01})
+	if len(tun.written) != 1 {
+		t.Errorf("N6 got %d packets, want 1", len(tun.written))
+	}
+
+	// Nothing is forwarded once the session is deleted
+	u.removeSession(1)
+	u.handleTPDU(nil, 100, pkt)
+	if len(tun.written) != 1 {
+		t.Errorf("N6 got %d packets after deletion, want 1", len(tun.written))
+	}
+}
+
+func TestDownlinkEncapsulation(t *testing.T) {
+	gnb, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: gtpuPort})
+	if err != nil {
+		t.Skipf("GTP-U port unavailable: %v", err)
+	}
+	defer gnb.Close()
+
+	u, _ := dataPlaneUPF(t, "127.0.0.1")
+	u.gtpuConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.gtpuConn.Close()
+
+	u.handleDownlink(nil, ipv4Packet("8.8.8.8", "10.0.0.9", 17, "other UE"))
+	pkt := ipv4Packet("8.8.8.8", "10.0.0.1", 17, "downlink")
+	u.handleDownlink(nil, pkt)
+
+	buf := make([]byte, maxPacketSize)
+	gnb.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := gnb.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no G-PDU received: %v", err)
+	}
+	msg, err := gtpv1msg.Parse(buf[:n])
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	tpdu, ok := msg.(*gtpv1msg.TPDU)
+	if !ok || tpdu.TEID() != 300 || !bytes.Equal(tpdu.Decapsulate(), pkt) {
+		t.Errorf("G-PDU = %+v, want TEID 300 carrying %x", msg, pkt)
+	}
+}
+
+func TestParseIPHeader(t *testing.T) {
+	src, dst, proto, ok := parseIPHeader(ipv4Packet("10.0.0.1", "10.0.0.2", 6, ""))
+	if !ok || !src.Equal(net.ParseIP("10.0.0.1")) || !dst.Equal(net.ParseIP("10.0.0.2")) || proto != 6 {
+		t.Errorf("IPv4: %s -> %s proto %d ok %v", src, dst, proto, ok)
+	}
+
+	v6 := make([]byte, ipv6HeaderLen)
+	v6[0], v6[6] = 0x60, 17
+	copy(v6[8:24], net.ParseIP("2001:db8:0:1::1"))
+	copy(v6[24:40], net.ParseIP("2001:4860::8888"))
+	src, dst, proto, ok = parseIPHeader(v6)
+	if !ok || !src.Equal(net.ParseIP("2001:db8:0:1::1")) || !dst.Equal(net.ParseIP("2001:4860::8888")) || proto != 17 {
+		t.Errorf("IPv6: %s -> %s proto %d ok %v", src, dst, proto, ok)
+	}
+
+	if _, _, _, ok := parseIPHeader(v6[:20]); ok {
+		t.Error("truncated IPv6 header parsed")
+	}
+}
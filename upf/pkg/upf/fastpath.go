@@ -0,0 +1,346 @@
+package upf
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"sync/atomic"
+
+	gtpv1msg "github.com/wmnsk/go-gtp/gtpv1/message"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// Defaults of the fast path
+const (
+	defaultBatchSize  = 64  // datagrams per recvmmsg/sendmmsg
+	workerQueueLength = 512 // packets queued per worker before dropping
+	gtpuHeaderLen     = 8
+)
+
+// batchConn reads and writes datagrams in batches, with recvmmsg and
+// sendmmsg on Linux
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+// newBatchConn wraps a UDP socket for batched I/O
+func newBatchConn(conn *net.UDPConn) batchConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil && !addr.IP.IsUnspecified() {
+		return ipv6.NewPacketConn(conn)
+	}
+	return ipv4.NewPacketConn(conn)
+}
+
+// DataPlaneStats counts the packets of the fast path
+type DataPlaneStats struct {
+	Received   uint64 `json:"received"`    // G-PDUs and N6 packets read
+	Sent       uint64 `json:"sent"`        // G-PDUs sent
+	QueueDrops uint64 `json:"queue_drops"` // packets dropped with a worker queue full
+}
+
+type dataPlaneCounters struct {
+	received   atomic.Uint64
+	sent       atomic.Uint64
+	queueDrops atomic.Uint64
+}
+
+// job is a packet handed from a reader to a worker. Its buffer comes from
+// the UPF's pool and goes back once the worker is done.
+type job struct {
+	buf      *[]byte
+	n        int
+	downlink bool
+	peer     *net.UDPAddr // GTP-U peer of G-PDUs
+}
+
+// worker forwards the packets of the TEIDs and UE addresses of its shard,
+// so the packets of a tunnel stay in order
+type worker struct {
+	jobs chan job
+	tx   *txBatch
+}
+
+// startWorkers starts a packet worker per CPU, or as many as configured
+func (u *UPF) startWorkers() {
+	n := u.cfg.FastPath.Workers
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	u.workers = make([]*worker, n)
+	for i := range u.workers {
+		w := &worker{jobs: make(chan job, workerQueueLength)}
+		if u.gtpuConn != nil {
+			w.tx = newTxBatch(newBatchConn(u.gtpuConn), u.batchSize(), u.packetBufferSize(), &u.stats.sent)
+		}
+		u.workers[i] = w
+		go u.runWorker(w)
+	}
+	u.logger.Infof("[UPF] Started %d packet workers", n)
+}
+
+func (u *UPF) batchSize() int {
+	if u.cfg.FastPath.Batch > 0 {
+		return u.cfg.FastPath.Batch
+	}
+	return defaultBatchSize
+}
+
+// runWorker forwards the packets queued for a worker, sending the G-PDUs it
+// produces in a batch whenever its queue runs empty
+func (u *UPF) runWorker(w *worker) {
+	for {
+		select {
+		case <-u.done:
+			return
+		case j := <-w.jobs:
+			b := (*j.buf)[:j.n]
+			if j.downlink {
+				u.handleDownlink(w.tx, b)
+			} else {
+				u.handleGPDU(w.tx, b, j.peer)
+			}
+			u.bufPool.Put(j.buf)
+
+			if len(w.jobs) == 0 && w.tx != nil {
+				if err := w.tx.flush(); err != nil {
+					u.logger.Errorf("[UPF] Failed to send G-PDUs: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// dispatch queues a packet to the worker of its shard, dropping it when the
+// worker is behind
+func (u *UPF) dispatch(shard uint32, j job) {
+	w := u.workers[shard%uint32(len(u.workers))]
+	select {
+	case w.jobs <- j:
+	default:
+		u.stats.queueDrops.Add(1)
+		u.bufPool.Put(j.buf)
+	}
+}
+
+// getBuffer returns a packet buffer from the pool
+func (u *UPF) getBuffer() *[]byte {
+	if b, ok := u.bufPool.Get().(*[]byte); ok {
+		return b
+	}
+	b := make([]byte, u.packetBufferSize())
+	return &b
+}
+
+// serveGTP reads GTP-U datagrams in batches. G-PDUs are sharded by TEID to
+// the workers; signalling is handled on the reading goroutine.
+func (u *UPF) serveGTP() {
+	conn := newBatchConn(u.gtpuConn)
+	msgs := make([]ipv4.Message, u.batchSize())
+	bufs := make([]*[]byte, len(msgs))
+	for i := range msgs {
+		bufs[i] = u.getBuffer()
+		msgs[i].Buffers = [][]byte{*bufs[i]}
+	}
+
+	for {
+		n, err := conn.ReadBatch(msgs, 0)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			u.logger.Errorf("[UPF] GTP-U read error: %v", err)
+			continue
+		}
+		u.stats.received.Add(uint64(n))
+
+		for i := 0; i < n; i++ {
+			b := (*bufs[i])[:msgs[i].N]
+			msgType, teid, _, ok := parseGTPUHeader(b)
+			if !ok {
+				u.logger.Debugf("[UPF] Dropping invalid GTP-U datagram from %s", msgs[i].Addr)
+				continue
+			}
+			if msgType != gtpv1msg.MsgTypeTPDU {
+				u.handleGTPSignalling(b, msgs[i].Addr)
+				continue
+			}
+			addr, _ := msgs[i].Addr.(*net.UDPAddr)
+			if _, ok := u.tunnel(teid); !ok {
+				u.sendErrorIndication(teid, addr)
+				continue
+			}
+			u.dispatch(teid, job{buf: bufs[i], n: msgs[i].N, peer: addr})
+			bufs[i] = u.getBuffer()
+			msgs[i].Buffers[0] = *bufs[i]
+		}
+	}
+}
+
+// handleGTPSignalling parses and handles a GTP-U message other than a G-PDU
+func (u *UPF) handleGTPSignalling(b []byte, addr net.Addr) {
+	remoteAddr, _ := addr.(*net.UDPAddr)
+	msg, err := gtpv1msg.Parse(b)
+	if err != nil {
+		u.logger.Errorf("[UPF] Failed to parse GTP-U message: %v", err)
+		return
+	}
+	u.handleGTP(msg, remoteAddr)
+}
+
+// handleGPDU forwards a G-PDU from a GTP-U peer, answering Router
+// Solicitations of IPv6 UEs
+func (u *UPF) handleGPDU(tx *txBatch, b []byte, peer *net.UDPAddr) {
+	_, teid, payload, ok := parseGTPUHeader(b)
+	if !ok {
+		return
+	}
+	u.captureIngressGPDU(teid, b, peer)
+	if src, ok := parseRouterSolicitation(payload); ok {
+		u.handleRouterSolicitation(teid, src)
+		return
+	}
+	u.handleTPDU(tx, teid, payload)
+}
+
+// serveTUN reads downlink packets from the N6 interface until it is closed
+// and shards them by UE to the workers
+func (u *UPF) serveTUN() {
+	for {
+		buf := u.getBuffer()
+		n, err := u.tun.Read(*buf)
+		if err != nil {
+			u.bufPool.Put(buf)
+			if errors.Is(err, os.ErrClosed) || errors.Is(err, io.EOF) {
+				return
+			}
+			u.logger.Errorf("[UPF] TUN read error: %v", err)
+			continue
+		}
+		u.stats.received.Add(1)
+
+		_, dst, _, ok := parseIPHeader((*buf)[:n])
+		key, valid := ueKeyOf(dst)
+		if !ok || !valid {
+			u.bufPool.Put(buf)
+			continue
+		}
+		u.dispatch(key.hash(), job{buf: buf, n: n, downlink: true})
+	}
+}
+
+// DataPlaneStats returns the packet counters of the fast path
+func (u *UPF) DataPlaneStats() DataPlaneStats {
+	return DataPlaneStats{
+		Received:   u.stats.received.Load(),
+		Sent:       u.stats.sent.Load(),
+		QueueDrops: u.stats.queueDrops.Load(),
+	}
+}
+
+// parseGTPUHeader returns the message type, TEID and payload of a GTP-U
+// message, skipping the optional fields and extension headers (TS 29.281
+// §5.1, §5.2), and reports whether the header is valid
+func parseGTPUHeader(b []byte) (msgType uint8, teid uint32, payload []byte, ok bool) {
+	// Version 1, protocol type GTP
+	if len(b) < gtpuHeaderLen || b[0]>>5 != 1 || b[0]&0x10 == 0 {
+		return 0, 0, nil, false
+	}
+	end := gtpuHeaderLen + int(binary.BigEndian.Uint16(b[2:4]))
+	if end > len(b) {
+		return 0, 0, nil, false
+	}
+	b = b[:end]
+	offset := gtpuHeaderLen
+	if b[0]&0x07 != 0 {
+		// Sequence number, N-PDU number and next extension header type
+		offset += 4
+		if offset > len(b) {
+			return 0, 0, nil, false
+		}
+		next := b[offset-1]
+		for b[0]&0x04 != 0 && next != 0 {
+			if offset >= len(b) {
+				return 0, 0, nil, false
+			}
+			n := int(b[offset]) * 4
+			if n == 0 || offset+n > len(b) {
+				return 0, 0, nil, false
+			}
+			next = b[offset+n-1]
+			offset += n
+		}
+	}
+	return b[1], binary.BigEndian.Uint32(b[4:8]), b[offset:], true
+}
+
+// appendGPDU appends a G-PDU carrying payload to dst. Packets of a QoS flow
+// carry its QFI in a PDU Session Container (TS 38.415 §5.5.2).
+func appendGPDU(dst []byte, teid uint32, pduType, qfi uint8, payload []byte) []byte {
+	start := len(dst)
+	if qfi == 0 {
+		dst = append(dst, 0x30, gtpv1msg.MsgTypeTPDU, 0, 0, 0, 0, 0, 0)
+	} else {
+		dst = append(dst, 0x34, gtpv1msg.MsgTypeTPDU, 0, 0, 0, 0, 0, 0,
+			0, 0, 0, gtpv1msg.ExtHeaderTypePDUSessionContainer,
+			1, pduType<<4, qfi&0x3f, gtpv1msg.ExtHeaderTypeNoMoreExtensionHeaders,
+		)
+	}
+	binary.BigEndian.PutUint16(dst[start+2:], uint16(len(dst)-start-gtpuHeaderLen+len(payload)))
+	binary.BigEndian.PutUint32(dst[start+4:], teid)
+	return append(dst, payload...)
+}
+
+// txBatch collects the G-PDUs a worker sends to write them with one
+// system call
+type txBatch struct {
+	conn batchConn
+	msgs []ipv4.Message
+	bufs [][]byte
+	n    int
+	sent *atomic.Uint64
+}
+
+func newTxBatch(conn batchConn, size, bufSize int, sent *atomic.Uint64) *txBatch {
+	t := &txBatch{conn: conn, msgs: make([]ipv4.Message, size), bufs: make([][]byte, size), sent: sent}
+	for i := range t.msgs {
+		t.bufs[i] = make([]byte, 0, bufSize)
+		t.msgs[i].Buffers = make([][]byte, 1)
+	}
+	return t
+}
+
+// buffer returns the empty buffer of the next datagram
+func (t *txBatch) buffer() []byte {
+	return t.bufs[t.n][:0]
+}
+
+// queue adds a datagram built in buffer(), writing the batch once full
+func (t *txBatch) queue(b []byte, addr *net.UDPAddr) error {
+	t.bufs[t.n] = b[:0]
+	t.msgs[t.n].Buffers[0] = b
+	t.msgs[t.n].Addr = addr
+	t.n++
+	if t.n == len(t.msgs) {
+		return t.flush()
+	}
+	return nil
+}
+
+// flush writes the queued datagrams
+func (t *txBatch) flush() error {
+	defer func() { t.n = 0 }()
+	for sent := 0; sent < t.n; {
+		n, err := t.conn.WriteBatch(t.msgs[sent:t.n], 0)
+		if err != nil {
+			return err
+		}
+		sent += n
+		t.sent.Add(uint64(n))
+	}
+	return nil
+}
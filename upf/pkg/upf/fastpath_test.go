@@ -0,0 +1,191 @@
+package upf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	gtpv1msg "github.com/wmnsk/go-gtp/gtpv1/message"
+	"golang.org/x/net/ipv4"
+)
+
+func TestParseGTPUHeader(t *testing.T) {
+	payload := ipv4Packet("10.0.0.1", "8.8.8.8", 17, "uplink")
+
+	for _, qfi := range []uint8{0, 9} {
+		msgType, teid, got, ok := parseGTPUHeader(appendGPDU(nil, 100, pduTypeUL, qfi, payload))
+		if !ok || msgType != gtpv1msg.MsgTypeTPDU || teid != 100 || !bytes.Equal(got, payload) {
+			t.Errorf("QFI %d: parseGTPUHeader() = %d, %d, %x, %v", qfi, msgType, teid, got, ok)
+		}
+	}
+
+	// Sequence numbers and trailing bytes beyond the length
+	b, err := gtpv1msg.NewTPDUWithSequence(200, 7, payload).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if _, teid, got, ok := parseGTPUHeader(append(b, 0, 0)); !ok || teid != 200 || !bytes.Equal(got, payload) {
+		t.Errorf("with a sequence number: %d, %x, %v", teid, got, ok)
+	}
+
+	echo, err := gtpv1msg.NewEchoRequest(0).Marshal()
+	if err != nil {
+		t.Fatalf("Marshal() error = %v", err)
+	}
+	if msgType, _, _, ok := parseGTPUHeader(echo); !ok || msgType != gtpv1msg.MsgTypeEchoRequest {
+		t.Errorf("Echo Request: type %d, ok %v", msgType, ok)
+	}
+
+	emptyExtension := append(appendGPDU(nil, 100, pduTypeUL, 9, nil)[:12], 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(emptyExtension[2:], 8)
+	invalid := map[string][]byte{
+		"truncated":          b[:6],
+		"GTPv2":              append([]byte{0x48}, b[1:]...),
+		"length beyond data": b[:len(b)-1],
+		"empty extension":    emptyExtension,
+	}
+	for name, b := range invalid {
+		if _, _, _, ok := parseGTPUHeader(b); ok {
+			t.Errorf("%s: parseGTPUHeader() ok", name)
+		}
+	}
+}
+
+// recordingConn records the batches written, accepting at most max
+// datagrams per call
+type recordingConn struct {
+	max     int
+	batches [][][]byte
+}
+
+func (c *recordingConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) { select {} }
+
+func (c *recordingConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	n := len(ms)
+	if n > c.max {
+		n = c.max
+	}
+	var batch [][]byte
+	for _, m := range ms[:n] {
+		batch = append(batch, append([]byte(nil), m.Buffers[0]...))
+	}
+	c.batches = append(c.batches, batch)
+	return n, nil
+}
+
+func TestTxBatch(t *testing.T) {
+	conn := &recordingConn{max: 2}
+	var sent dataPlaneCounters
+	tx := newTxBatch(conn, 3, defaultMTU+gtpuHeadroom, &sent.sent)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: gtpuPort}
+
+	for teid := uint32(1); teid <= 4; teid++ {
+		if err := tx.queue(appendGPDU(tx.buffer(), teid, pduTypeDL, 0, []byte("x")), addr); err != nil {
+			t.Fatalf("queue() error = %v", err)
+		}
+	}
+	// The full batch of three went out in two writes
+	if len(conn.batches) != 2 || len(conn.batches[0]) != 2 || len(conn.batches[1]) != 1 {
+		t.Fatalf("batches after 4 datagrams = %d", len(conn.batches))
+	}
+	if err := tx.flush(); err != nil {
+		t.Fatalf("flush() error = %v", err)
+	}
+	if err := tx.flush(); err != nil || len(conn.batches) != 3 {
+		t.Fatalf("batches after the flushes = %d, %v", len(conn.batches), err)
+	}
+	if _, teid, _, _ := parseGTPUHeader(conn.batches[2][0]); teid != 4 {
+		t.Errorf("last datagram TEID = %d, want 4", teid)
+	}
+	if n := sent.sent.Load(); n != 4 {
+		t.Errorf("sent = %d, want 4", n)
+	}
+}
+
+func TestFastPathUplink(t *testing.T) {
+	u, tun := dataPlaneUPF(t, "127.0.0.1")
+	u.cfg.FastPath.Workers = 2
+	var err error
+	u.gtpuConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	u.startWorkers()
+	go u.serveGTP()
+
+	gnb, err := net.DialUDP("udp", nil, u.gtpuConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer gnb.Close()
+
+	var want [][]byte
+	for _, s := range []string{"first", "second", "third"} {
+		pkt := ipv4Packet("10.0.0.1", "8.8.8.8", 17, s)
+		want = append(want, pkt)
+		if _, err := gnb.Write(appendGPDU(nil, 100, pduTypeUL, 9, pkt)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gnb.Write(appendGPDU(nil, 101, pduTypeUL, 0, ipv4Packet("10.0.0.1", "8.8.8.8", 17, "unknown TEID")))
+
+	deadline := time.Now().Add(time.Second)
+	for len(tun.packets()) < len(want) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	got := tun.packets()
+	if len(got) != len(want) {
+		t.Fatalf("N6 packets = %d, want %d", len(got), len(want))
+	}
+	// A TEID's packets stay in order
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("packet %d = %x, want %x", i, got[i], want[i])
+		}
+	}
+	if stats := u.DataPlaneStats(); stats.Received != 4 || stats.QueueDrops != 0 {
+		t.Errorf("DataPlaneStats() = %+v, want 4 received", stats)
+	}
+}
+
+// discardTUN drops the packets written to the N6 interface
+type discardTUN struct{}
+
+func (discardTUN) Read(b []byte) (int, error)  { select {} }
+func (discardTUN) Write(b []byte) (int, error) { return len(b), nil }
+func (discardTUN) Close() error                { return nil }
+
+func BenchmarkTunnelLookup(b *testing.B) {
+	u := NewUPF(&Config{})
+	session := &Session{}
+	for teid := uint32(1); teid <= 10000; teid++ {
+		u.tunnels.update(teid, tunnelEndpoint{session: session})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		teid := uint32(1)
+		for pb.Next() {
+			if _, ok := u.tunnels.load(teid); !ok {
+				b.Errorf("TEID %d not found", teid)
+				return
+			}
+			teid = teid%10000 + 1
+		}
+	})
+}
+
+func BenchmarkUplink(b *testing.B) {
+	u, _ := dataPlaneUPF(b, "127.0.0.1")
+	u.tun = discardTUN{}
+	gpdu := appendGPDU(nil, 100, pduTypeUL, 9, ipv4Packet("10.0.0.1", "8.8.8.8", 17, string(make([]byte, 1400))))
+
+	b.SetBytes(int64(len(gpdu)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		u.handleGPDU(nil, gpdu, nil)
+	}
+}
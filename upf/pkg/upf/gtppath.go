@@ -0,0 +1,442 @@
+package upf
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gtpv1ie "github.com/wmnsk/go-gtp/gtpv1/ie"
+	gtpv1msg "github.com/wmnsk/go-gtp/gtpv1/message"
+	"github.com/wmnsk/go-pfcp/ie"
+	pfcpmsg "github.com/wmnsk/go-pfcp/message"
+)
+
+// Path supervision of the GTP-U peers when none is configured: the Echo
+// interval, T3-RESPONSE and N3-REQUESTS
+const (
+	defaultEchoInterval = 60 * time.Second
+	defaultEchoTimeout  = 3 * time.Second
+	defaultEchoRetries  = 3
+)
+
+// Error Indications are sent at most errorIndicationRate per second to a
+// peer, in bursts of errorIndicationBurst, by a goroutine of their own
+// reading up to errorIndicationQueue of them. Up to maxErrorIndicationPeers
+// peers are tracked.
+const (
+	errorIndicationRate     = 10
+	errorIndicationBurst    = 20
+	errorIndicationQueue    = 1024
+	maxErrorIndicationPeers = 4096
+)
+
+// gtpuMsgTypeEndMarker is the End Marker message type (TS 29.281 §7.3.2),
+// which go-gtp does not define
+const gtpuMsgTypeEndMarker uint8 = 254
+
+// Node Report Type flags (TS 29.244 §8.2.69)
+const (
+	nodeReportUPFR uint8 = 0x01 // User Plane Path Failure Report
+	nodeReportUPRR uint8 = 0x02 // User Plane Path Recovery Report
+)
+
+// gtpPath is the state of the path to a remote GTP-U peer
+type gtpPath struct {
+	nextEcho      time.Time // when the next Echo Request is due
+	seq           uint16    // of the Echo Request waiting for its response
+	sent          time.Time // when it was last sent, zero when none waits
+	retransmitted int
+	failed        bool
+}
+
+// echoTimers returns the Echo interval, T3-RESPONSE and N3-REQUESTS
+func (u *UPF) echoTimers() (interval, timeout time.Duration, retries int) {
+	interval, timeout, retries = u.cfg.GTP.EchoInterval, u.cfg.GTP.EchoTimeout, u.cfg.GTP.EchoRetries
+	if interval <= 0 {
+		interval = defaultEchoInterval
+	}
+	if timeout <= 0 {
+		timeout = defaultEchoTimeout
+	}
+	if retries <= 0 {
+		retries = defaultEchoRetries
+	}
+	return interval, timeout, retries
+}
+
+// servePaths sends Echo Requests to the GTP-U peers of the sessions until
+// the UPF is closed (TS 29.281 §7.2.1)
+func (u *UPF) servePaths() {
+	_, timeout, _ := u.echoTimers()
+	ticker := time.NewTicker(timeout)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.done:
+			return
+		case now := <-ticker.C:
+			u.checkPaths(now)
+		}
+	}
+}
+
+// checkPaths sends the Echo Requests that are due and retransmits those
+// left unanswered for T3-RESPONSE. A path whose Echo Request is still
+// unanswered after N3-REQUESTS retransmissions is reported failed.
+func (u *UPF) checkPaths(now time.Time) {
+	interval, timeout, retries := u.echoTimers()
+	peers := u.gtpPeers()
+
+	type echo struct {
+		peer net.IP
+		seq  uint16
+	}
+	var failed []net.IP
+	var echoes []echo
+	u.pathMu.Lock()
+	for key := range u.paths {
+		if _, ok := peers[key]; !ok {
+			delete(u.paths, key)
+		}
+	}
+	for key, ip := range peers {
+		path, ok := u.paths[key]
+		if !ok {
+			path = &gtpPath{nextEcho: now}
+			u.paths[key] = path
+		}
+		switch {
+		case !path.sent.IsZero() && now.Sub(path.sent) < timeout:
+		case !path.sent.IsZero() && path.retransmitted < retries:
+			path.retransmitted++
+			path.sent = now
+			echoes = append(echoes, echo{ip, path.seq})
+		case !path.sent.IsZero():
+			path.sent = time.Time{}
+			if !path.failed {
+				path.failed = true
+				failed = append(failed, ip)
+			}
+		case !now.Before(path.nextEcho):
+			path.seq = u.nextGTPSequence()
+			path.sent, path.retransmitted, path.nextEcho = now, 0, now.Add(interval)
+			echoes = append(echoes, echo{ip, path.seq})
+		}
+	}
+	u.pathMu.Unlock()
+
+	for _, ip := range failed {
+		u.logger.Warnf("[UPF] GTP-U path to %s failed", ip)
+		u.reportPath(ip, nodeReportUPFR)
+	}
+	for _, e := range echoes {
+		u.sendGTP(gtpv1msg.NewEchoRequest(e.seq), &net.UDPAddr{IP: e.peer, Port: gtpuPort})
+	}
+}
+
+// gtpPeers returns the GTP-U peers the FARs of the sessions forward to by
+// address
+func (u *UPF) gtpPeers() map[string]net.IP {
+	peers := make(map[string]net.IP)
+	for _, session := range u.sessionList() {
+		for _, tunnel := range session.tunnels() {
+			peers[tunnel.Addr.String()] = tunnel.Addr
+		}
+	}
+	return peers
+}
+
+// sessionList returns the sessions of the UPF
+func (u *UPF) sessionList() []*Session {
+	u.sessionLock.RLock()
+	defer u.sessionLock.RUnlock()
+
+	sessions := make([]*Session, 0, len(u.sessions))
+	for _, session := range u.sessions {
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
+
+// tunnels returns the GTP-U tunnels the FARs of the session forward into
+func (s *Session) tunnels() []OuterHeader {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tunnels []OuterHeader
+	for _, far := range s.FARs {
+		if far.OuterHeader != nil && far.ApplyAction&ApplyActionFORW != 0 {
+			tunnels = append(tunnels, *far.OuterHeader)
+		}
+	}
+	return tunnels
+}
+
+// handleEchoRequest answers an Echo Request. The Recovery IE is kept for
+// backward compatibility and set to zero (TS 29.281 §8.2).
+func (u *UPF) handleEchoRequest(req *gtpv1msg.EchoRequest, remoteAddr *net.UDPAddr) {
+	u.sendGTP(gtpv1msg.NewEchoResponse(req.Sequence(), gtpv1ie.NewRecovery(0)), remoteAddr)
+}
+
+// handleEchoResponse marks the path to a peer alive, reporting its
+// recovery when it had failed
+func (u *UPF) handleEchoResponse(remoteAddr *net.UDPAddr) {
+	u.pathMu.Lock()
+	path, ok := u.paths[remoteAddr.IP.String()]
+	recovered := ok && path.failed
+	if ok {
+		path.sent = time.Time{}
+		path.failed = false
+	}
+	u.pathMu.Unlock()
+
+	if recovered {
+		u.logger.Infof("[UPF] GTP-U path to %s recovered", remoteAddr.IP)
+		u.reportPath(remoteAddr.IP, nodeReportUPRR)
+	}
+}
+
+// reportPath sends a Node Report Request with a User Plane Path Failure or
+// Recovery Report to the SMFs of the sessions tunnelled to a peer
+// (TS 29.244 §7.4.5.1)
+func (u *UPF) reportPath(peer net.IP, reportType uint8) {
+	if u.pfcpConn == nil {
+		return
+	}
+
+	smfs := make(map[string]*net.UDPAddr)
+	for _, session := range u.sessionList() {
+		if session.cpAddr == nil {
+			continue
+		}
+		for _, tunnel := range session.tunnels() {
+			if tunnel.Addr.Equal(peer) {
+				smfs[session.cpAddr.String()] = session.cpAddr
+				break
+			}
+		}
+	}
+
+	remote := ie.NewRemoteGTPUPeer(0x02, peer.String(), "", 0, "")
+	if peer.To4() == nil {
+		remote = ie.NewRemoteGTPUPeer(0x01, "", peer.String(), 0, "")
+	}
+	report := ie.NewUserPlanePathFailureReport(remote)
+	if reportType == nodeReportUPRR {
+		report = ie.NewUserPlanePathRecoveryReport(remote)
+	}
+	for _, smf := range smfs {
+		req := pfcpmsg.NewNodeReportRequest(u.nextSequence(),
+			u.nodeID(),
+			ie.NewNodeReportType(reportType),
+			report,
+		)
+		if err := u.sendPFCP(req, smf); err != nil {
+			u.logger.Errorf("[UPF] Failed to send Node Report Request to %s: %v", smf, err)
+		}
+	}
+}
+
+// handleNodeReportResponse logs a Node Report Request the SMF rejected
+func (u *UPF) handleNodeReportResponse(res *pfcpmsg.NodeReportResponse, remoteAddr *net.UDPAddr) {
+	if res.Cause == nil {
+		return
+	}
+	if cause, err := res.Cause.Cause(); err == nil && cause != ie.CauseRequestAccepted {
+		u.logger.Warnf("[UPF] Node Report rejected by %s with cause %d", remoteAddr, cause)
+	}
+}
+
+// errorIndication is an Error Indication waiting to be sent
+type errorIndication struct {
+	teid uint32
+	peer net.IP
+}
+
+// peerLimiter limits the Error Indications sent to each peer with a token
+// bucket
+type peerLimiter struct {
+	mu    sync.Mutex
+	peers map[string]*peerTokens
+}
+
+type peerTokens struct {
+	tokens float64
+	last   time.Time
+}
+
+// allow reports whether an Error Indication may be sent to a peer,
+// consuming a token when it may
+func (l *peerLimiter) allow(peer net.IP, now time.Time) bool {
+	key := string(peer.To16())
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.peers == nil {
+		l.peers = make(map[string]*peerTokens)
+	}
+	b, ok := l.peers[key]
+	if !ok {
+		if len(l.peers) >= maxErrorIndicationPeers {
+			for k, p := range l.peers {
+				if now.Sub(p.last) > errorIndicationBurst*time.Second/errorIndicationRate {
+					delete(l.peers, k)
+				}
+			}
+			if len(l.peers) >= maxErrorIndicationPeers {
+				return false
+			}
+		}
+		b = &peerTokens{tokens: errorIndicationBurst, last: now}
+		l.peers[key] = b
+	}
+	b.tokens = min(errorIndicationBurst, b.tokens+errorIndicationRate*now.Sub(b.last).Seconds())
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sendErrorIndication tells the sender of a G-PDU on an unknown TEID that
+// the tunnel does not exist (TS 29.281 §7.3.1). The Error Indication is
+// queued so the reader does not wait on the socket; those over the rate of
+// the peer or the queue are dropped.
+func (u *UPF) sendErrorIndication(teid uint32, remoteAddr *net.UDPAddr) {
+	if remoteAddr == nil || !u.errorLimiter.allow(remoteAddr.IP, time.Now()) {
+		return
+	}
+	select {
+	case u.errorIndications <- errorIndication{teid: teid, peer: append(net.IP(nil), remoteAddr.IP...)}:
+	default:
+	}
+}
+
+// serveErrorIndications sends the queued Error Indications until the UPF is
+// closed
+func (u *UPF) serveErrorIndications() {
+	for {
+		select {
+		case <-u.done:
+			return
+		case ind := <-u.errorIndications:
+			u.logger.Debugf("[UPF] Sending Error Indication for unknown TEID %d to %s", ind.teid, ind.peer)
+			u.sendGTP(gtpv1msg.NewErrorIndication(0, u.nextGTPSequence(),
+				gtpv1ie.NewTEIDDataI(ind.teid),
+				gtpv1ie.NewGSNAddressByIP(u.alloc.n3Addr),
+			), &net.UDPAddr{IP: ind.peer, Port: gtpuPort})
+		}
+	}
+}
+
+// handleErrorIndication reports the sessions forwarding into a tunnel the
+// peer no longer has to their SMFs with an Error Indication Report
+// (TS 29.244 §5.10)
+func (u *UPF) handleErrorIndication(msg *gtpv1msg.ErrorIndication, remoteAddr *net.UDPAddr) {
+	if msg.TEIDDataI == nil {
+		u.logger.Debugf("[UPF] Ignoring Error Indication without TEID from %s", remoteAddr)
+		return
+	}
+	teid, err := msg.TEIDDataI.TEID()
+	if err != nil {
+		u.logger.Debugf("[UPF] Ignoring Error Indication with an invalid TEID from %s: %v", remoteAddr, err)
+		return
+	}
+	peer := remoteAddr.IP
+	if msg.GTPUPeerAddress != nil {
+		if addr, err := msg.GTPUPeerAddress.GSNAddress(); err == nil {
+			if ip := net.ParseIP(addr); ip != nil {
+				peer = ip
+			}
+		}
+	}
+
+	fteid := ie.NewFTEID(0x01, teid, peer.To4(), nil, 0)
+	if peer.To4() == nil {
+		fteid = ie.NewFTEID(0x02, teid, nil, peer, 0)
+	}
+	for _, session := range u.sessionList() {
+		for _, tunnel := range session.tunnels() {
+			if tunnel.TEID != teid || !tunnel.Addr.Equal(peer) {
+				continue
+			}
+			u.logger.Infof("[UPF] Error Indication from %s for TEID %d of session %d", peer, teid, session.SEID)
+			if err := u.sendSessionReport(session,
+				ie.NewReportType(0, 1, 0, 0),
+				ie.NewErrorIndicationReport(fteid),
+			); err != nil {
+				u.logger.Errorf("[UPF] Failed to send Error Indication Report of session %d: %v", session.SEID, err)
+			}
+			break
+		}
+	}
+}
+
+// accessTunnels returns the tunnels of the FARs forwarding to the access
+// side by FAR ID
+func (s *Session) accessTunnels() map[uint32]OuterHeader {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	tunnels := make(map[uint32]OuterHeader)
+	for id, far := range s.FARs {
+		if far.DestinationInterface == ie.DstInterfaceAccess && far.OuterHeader != nil &&
+			far.ApplyAction&ApplyActionFORW != 0 {
+			tunnels[id] = *far.OuterHeader
+		}
+	}
+	return tunnels
+}
+
+// sendEndMarkers sends an End Marker into every access tunnel a Session
+// Modification switched away from, so the target RAN node knows the
+// source one has no more downlink packets (TS 29.281 §5.2.2, TS 23.502
+// §4.9.1.2)
+func (u *UPF) sendEndMarkers(session *Session, before map[uint32]OuterHeader) {
+	after := session.accessTunnels()
+	for id, old := range before {
+		tunnel, ok := after[id]
+		if !ok || (tunnel.TEID == old.TEID && tunnel.Addr.Equal(old.Addr)) {
+			continue
+		}
+		u.sendGTPU(newEndMarker(old.TEID), &net.UDPAddr{IP: old.Addr, Port: gtpuPort})
+		u.logger.Debugf("[UPF] Sent End Marker on TEID %d to %s for session %d", old.TEID, old.Addr, session.SEID)
+	}
+}
+
+// newEndMarker returns an End Marker for a tunnel
+func newEndMarker(teid uint32) []byte {
+	b := []byte{0x30, gtpuMsgTypeEndMarker, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(b[4:], teid)
+	return b
+}
+
+// nextGTPSequence returns the sequence number of a GTP-U message sent by
+// the UPF
+func (u *UPF) nextGTPSequence() uint16 {
+	return uint16(atomic.AddUint32(&u.gtpSeq, 1))
+}
+
+// sendGTP sends a GTP-U signalling message
+func (u *UPF) sendGTP(msg gtpv1msg.Message, remoteAddr *net.UDPAddr) {
+	b, err := gtpv1msg.Marshal(msg)
+	if err != nil {
+		u.logger.Errorf("[UPF] Failed to encode GTP-U %s: %v", msg.MessageTypeName(), err)
+		return
+	}
+	u.sendGTPU(b, remoteAddr)
+}
+
+// sendGTPU writes a GTP-U message to a peer
+func (u *UPF) sendGTPU(b []byte, remoteAddr *net.UDPAddr) {
+	if u.gtpuConn == nil {
+		return
+	}
+	if _, err := u.gtpuConn.WriteToUDP(b, remoteAddr); err != nil {
+		u.logger.Errorf("[UPF] Failed to send GTP-U message to %s: %v", remoteAddr, err)
+	}
+}
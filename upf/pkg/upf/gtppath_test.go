@@ -0,0 +1,239 @@
+package upf
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	gtpv1ie "github.com/wmnsk/go-gtp/gtpv1/ie"
+	gtpv1msg "github.com/wmnsk/go-gtp/gtpv1/message"
+	"github.com/wmnsk/go-pfcp/ie"
+	pfcpmsg "github.com/wmnsk/go-pfcp/message"
+)
+
+// pathUPF returns a UPF with a session tunnelled to a gNB on the loopback
+// GTP-U port and an SMF receiving its PFCP requests
+func pathUPF(t *testing.T) (u *UPF, gnb, smf *net.UDPConn) {
+	t.Helper()
+
+	gnb, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: gtpuPort})
+	if err != nil {
+		t.Skipf("GTP-U port unavailable: %v", err)
+	}
+	t.Cleanup(func() { gnb.Close() })
+	smf, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { smf.Close() })
+
+	u, _ = dataPlaneUPF(t, "127.0.0.1")
+	if u.gtpuConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { u.gtpuConn.Close() })
+	if u.pfcpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { u.pfcpConn.Close() })
+
+	session, _ := u.sessionByUE(net.ParseIP("10.0.0.1"))
+	session.cpAddr = smf.LocalAddr().(*net.UDPAddr)
+	session.cpNodeID = "127.0.0.1"
+	u.associate(session.cpNodeID, session.cpAddr, time.Now())
+	go u.serveErrorIndications()
+	t.Cleanup(u.Close)
+	return u, gnb, smf
+}
+
+// readGTP returns the next GTP-U message the connection receives
+func readGTP(t *testing.T, conn *net.UDPConn) gtpv1msg.Message {
+	t.Helper()
+
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no GTP-U message received: %v", err)
+	}
+	msg, err := gtpv1msg.Parse(buf[:n])
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	return msg
+}
+
+// readEcho checks the paths at now and returns the Echo Request the gNB
+// receives
+func readEcho(t *testing.T, u *UPF, gnb *net.UDPConn, now time.Time) (*gtpv1msg.EchoRequest, bool) {
+	t.Helper()
+
+	u.checkPaths(now)
+	req, ok := readGTP(t, gnb).(*gtpv1msg.EchoRequest)
+	return req, ok
+}
+
+// readPFCP returns the next PFCP message the connection receives
+func readPFCP(t *testing.T, conn *net.UDPConn) pfcpmsg.Message {
+	t.Helper()
+
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no PFCP message received: %v", err)
+	}
+	msg, err := pfcpmsg.Parse(buf[:n])
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	return msg
+}
+
+func TestEchoRequest(t *testing.T) {
+	u, gnb, _ := pathUPF(t)
+
+	req, _ := gtpv1msg.NewEchoRequest(7).Marshal()
+	if _, err := gnb.WriteToUDP(req, u.gtpuConn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1500)
+	u.gtpuConn.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := u.gtpuConn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.handleGTPSignalling(buf[:n], addr)
+
+	res, ok := readGTP(t, gnb).(*gtpv1msg.EchoResponse)
+	if !ok || res.Sequence() != 7 || res.Recovery == nil {
+		t.Errorf("got %+v, want an Echo Response with sequence 7 and Recovery", res)
+	}
+}
+
+func TestPathFailure(t *testing.T) {
+	u, gnb, smf := pathUPF(t)
+	u.cfg.GTP.EchoRetries = 2
+	now := time.Now()
+
+	// The Echo Request is retransmitted with its sequence number every
+	// T3-RESPONSE, not before
+	first, ok := readEcho(t, u, gnb, now)
+	if !ok {
+		t.Fatalf("gNB got no Echo Request")
+	}
+	u.checkPaths(now.Add(time.Second))
+	for i := 1; i <= 2; i++ {
+		now = now.Add(defaultEchoTimeout)
+		req, ok := readEcho(t, u, gnb, now)
+		if !ok || req.Sequence() != first.Sequence() {
+			t.Fatalf("retransmission %d = %+v, want sequence %d", i, req, first.Sequence())
+		}
+	}
+
+	// T3-RESPONSE after the last retransmission the path fails
+	u.checkPaths(now.Add(defaultEchoTimeout))
+	report, ok := readPFCP(t, smf).(*pfcpmsg.NodeReportRequest)
+	if !ok || report.UserPlanePathFailureReport == nil {
+		t.Fatalf("got %+v, want a Node Report Request with a User Plane Path Failure Report", report)
+	}
+	if !report.NodeReportType.HasUPFR() {
+		t.Errorf("Node Report Type = %x, want UPFR", report.NodeReportType.Payload)
+	}
+	peer, err := report.UserPlanePathFailureReport.RemoteGTPUPeer()
+	if err != nil || !peer.IPv4Address.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("Remote GTP-U Peer = %+v, %v, want 127.0.0.1", peer, err)
+	}
+
+	// An Echo Response recovers the path
+	u.handleGTP(gtpv1msg.NewEchoResponse(1, gtpv1ie.NewRecovery(0)), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: gtpuPort})
+	report, ok = readPFCP(t, smf).(*pfcpmsg.NodeReportRequest)
+	if !ok || report.UserPlanePathRecoveryReport == nil {
+		t.Fatalf("got %+v, want a Node Report Request with a User Plane Path Recovery Report", report)
+	}
+
+	// Paths no session uses any more are forgotten
+	u.removeSession(1)
+	u.checkPaths(now)
+	if len(u.paths) != 0 {
+		t.Errorf("paths = %v, want none", u.paths)
+	}
+}
+
+func TestErrorIndication(t *testing.T) {
+	u, gnb, smf := pathUPF(t)
+	gnbAddr := gnb.LocalAddr().(*net.UDPAddr)
+
+	// A G-PDU on an unknown TEID is answered with an Error Indication
+	u.handleGTP(gtpv1msg.NewTPDU(999, ipv4Packet("10.0.0.1", "8.8.8.8", 17, "stale")), gnbAddr)
+	ind, ok := readGTP(t, gnb).(*gtpv1msg.ErrorIndication)
+	if !ok || ind.TEIDDataI == nil || ind.GTPUPeerAddress == nil {
+		t.Fatalf("got %+v, want an Error Indication", ind)
+	}
+	if teid, err := ind.TEIDDataI.TEID(); err != nil || teid != 999 {
+		t.Errorf("TEID Data I = %d, %v, want 999", teid, err)
+	}
+
+	// A peer flooding unknown TEIDs is answered at the rate limit
+	for i := 0; i < 2*errorIndicationBurst; i++ {
+		u.handleGTP(gtpv1msg.NewTPDU(999, ipv4Packet("10.0.0.1", "8.8.8.8", 17, "stale")), gnbAddr)
+	}
+	sent := 0
+	buf := make([]byte, 1500)
+	for {
+		gnb.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, _, err := gnb.ReadFromUDP(buf); err != nil {
+			break
+		}
+		sent++
+	}
+	if sent < errorIndicationBurst-1 || sent > errorIndicationBurst+1 {
+		t.Errorf("sent %d Error Indications, want about %d", sent, errorIndicationBurst)
+	}
+
+	// An Error Indication for the session's downlink tunnel is reported
+	u.handleGTP(gtpv1msg.NewErrorIndication(0, 1,
+		gtpv1ie.NewTEIDDataI(300),
+		gtpv1ie.NewGSNAddressByIP(net.IPv4(127, 0, 0, 1)),
+	), gnbAddr)
+	report, ok := readPFCP(t, smf).(*pfcpmsg.SessionReportRequest)
+	if !ok || report.ErrorIndicationReport == nil || !report.ReportType.HasERIR() {
+		t.Fatalf("got %+v, want a Session Report Request with an Error Indication Report", report)
+	}
+	fteid, err := report.ErrorIndicationReport.FTEID()
+	if err != nil || fteid.TEID != 300 || !fteid.IPv4Address.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("F-TEID = %+v, %v, want TEID 300 of 127.0.0.1", fteid, err)
+	}
+}
+
+func TestEndMarker(t *testing.T) {
+	u, gnb, smf := pathUPF(t)
+
+	// Handover to another tunnel of the same gNB
+	req := pfcpmsg.NewSessionModificationRequest(0, 0, 1, 1, 0,
+		ie.NewUpdateFAR(ie.NewFARID(2), ie.NewUpdateForwardingParameters(
+			ie.NewOuterHeaderCreation(0x0100, 301, "127.0.0.1", "", 0, 0, 0),
+		)),
+	)
+	u.handleSessionModificationRequest(req, smf.LocalAddr().(*net.UDPAddr))
+	if res, ok := readPFCP(t, smf).(*pfcpmsg.SessionModificationResponse); !ok {
+		t.Fatalf("got %+v, want a Session Modification Response", res)
+	}
+
+	buf := make([]byte, 1500)
+	gnb.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := gnb.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no End Marker received: %v", err)
+	}
+	msgType, teid, payload, ok := parseGTPUHeader(buf[:n])
+	if !ok || msgType != gtpuMsgTypeEndMarker || teid != 300 || len(payload) != 0 {
+		t.Errorf("got %x, want an End Marker on TEID 300", buf[:n])
+	}
+
+	// Downlink packets then take the new tunnel
+	u.handleDownlink(nil, ipv4Packet("8.8.8.8", "10.0.0.1", 17, "downlink"))
+	if tpdu, ok := readGTP(t, gnb).(*gtpv1msg.TPDU); !ok || tpdu.TEID() != 301 {
+		t.Errorf("got %+v, want a G-PDU on TEID 301", tpdu)
+	}
+}
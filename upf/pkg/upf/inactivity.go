@@ -0,0 +1,60 @@
+package upf
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// parseInactivityTimer returns the User Plane Inactivity Timer of a Session
+// Establishment or Modification Request, nil when the request has none
+func parseInactivityTimer(i *ie.IE) (*time.Duration, error) {
+	if i == nil {
+		return nil, nil
+	}
+	timer, err := i.UserPlaneInactivityTimer()
+	if err != nil {
+		return nil, fmt.Errorf("invalid User Plane Inactivity Timer: %w", err)
+	}
+	return &timer, nil
+}
+
+// setInactivityTimer starts the session's User Plane Inactivity Timer, 0
+// stopping it (TS 29.244 §5.11.3)
+func (s *Session) setInactivityTimer(timer time.Duration, now time.Time) {
+	s.mu.Lock()
+	s.inactivityTimer = timer
+	s.mu.Unlock()
+	s.sawTraffic(now)
+}
+
+// sawTraffic restarts the User Plane Inactivity Timer on a forwarded packet
+func (s *Session) sawTraffic(now time.Time) {
+	s.lastPacket.Store(now.UnixNano())
+	if s.inactive.Load() {
+		s.inactive.Store(false)
+	}
+}
+
+// checkInactivity reports whether the User Plane Inactivity Timer expired
+// since the last packet, once until traffic resumes
+func (s *Session) checkInactivity(now time.Time) bool {
+	s.mu.RLock()
+	timer := s.inactivityTimer
+	s.mu.RUnlock()
+	if timer <= 0 || s.inactive.Load() || now.Sub(time.Unix(0, s.lastPacket.Load())) < timer {
+		return false
+	}
+	return s.inactive.CompareAndSwap(false, true)
+}
+
+// reportInactivity sends a Session Report Request with a User Plane
+// Inactivity Report to the SMF of a session
+func (u *UPF) reportInactivity(session *Session) {
+	if err := u.sendSessionReport(session, ie.NewReportType(1, 0, 0, 0)); err != nil {
+		u.logger.Errorf("[UPF] Failed to report inactivity of session %d: %v", session.SEID, err)
+		return
+	}
+	u.logger.Debugf("[UPF] Reported session %d without traffic", session.SEID)
+}
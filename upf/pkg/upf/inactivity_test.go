@@ -0,0 +1,41 @@
+package upf
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	pfcpmsg "github.com/wmnsk/go-pfcp/message"
+)
+
+func TestInactivityTimer(t *testing.T) {
+	u, _, smf := pathUPF(t)
+	session, _ := u.sessionByUE(net.ParseIP("10.0.0.1"))
+	now := time.Now()
+
+	if session.checkInactivity(now.Add(time.Hour)) {
+		t.Fatal("inactivity detected without a timer")
+	}
+	session.setInactivityTimer(30*time.Second, now)
+	if session.checkInactivity(now.Add(29 * time.Second)) {
+		t.Error("inactivity detected before the timer expired")
+	}
+	if !session.checkInactivity(now.Add(30 * time.Second)) {
+		t.Fatal("inactivity not detected once the timer expired")
+	}
+	if session.checkInactivity(now.Add(time.Minute)) {
+		t.Error("inactivity detected twice without traffic in between")
+	}
+
+	// Traffic restarts the timer
+	u.handleDownlink(nil, ipv4Packet("8.8.8.8", "10.0.0.1", 17, "downlink"))
+	if session.checkInactivity(time.Now().Add(29 * time.Second)) {
+		t.Error("inactivity detected right after traffic")
+	}
+
+	u.reportInactivity(session)
+	report, ok := readPFCP(t, smf).(*pfcpmsg.SessionReportRequest)
+	if !ok || !report.ReportType.HasUPIR() {
+		t.Errorf("got %+v, want a Session Report Request with a User Plane Inactivity Report", report)
+	}
+}
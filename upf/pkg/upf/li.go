@@ -0,0 +1,317 @@
+package upf
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// X2/X3 PDU header of ETSI TS 103 221-2 §5.2: version, PDU type, header
+// and payload lengths, payload format and direction, XID and Correlation ID,
+// followed by the conditional attributes
+const (
+	xpduVersion      uint16 = 5
+	xpduFixedLen            = 40
+	xpduTypeX3       uint16 = 2
+	xpduKeepalive    uint16 = 3
+	xpduKeepaliveAck uint16 = 4
+)
+
+// Payload formats (§5.2.4), directions (§5.2.5) and conditional attribute
+// types (§5.3) of the X3 PDUs the UPF sends
+const (
+	payloadFormatIPv4   uint16 = 5
+	payloadFormatIPv6   uint16 = 6
+	directionToTarget   uint16 = 2
+	directionFromTarget uint16 = 3
+	attrSequenceNumber  uint16 = 8
+	attrTimestamp       uint16 = 9
+)
+
+// Outer Header Creation descriptions of a Duplicating Parameters
+// (TS 29.244 §8.2.56)
+const (
+	outerHeaderUDPIPv4 uint16 = 0x0400
+	outerHeaderUDPIPv6 uint16 = 0x0800
+)
+
+// The X3 PDUs of a mediation function are queued up to x3QueueLen while
+// the connection to it is down or slow. Idle connections are kept alive
+// with Keepalive PDUs.
+const (
+	x3QueueLen          = 4096
+	x3DialTimeout       = 5 * time.Second
+	x3KeepaliveInterval = 30 * time.Second
+	x3MaxBackoff        = 30 * time.Second
+)
+
+// Duplicate is a Duplicating Parameters of a FAR towards the LI Function
+// (TS 29.244 §7.5.2.3): the packets the FAR forwards are copied as X3 PDUs
+// of an interception task to its mediation function. The Outer Header
+// Creation carries the address and port of the mediation function, the
+// Forwarding Policy Identifier "<XID>/<Correlation ID>" the task.
+type Duplicate struct {
+	Addr          net.IP
+	Port          uint16
+	XID           [16]byte
+	CorrelationID uint64
+}
+
+// parseDuplicatingParameters converts the children of a Duplicating
+// Parameters or Update Duplicating Parameters IE
+func parseDuplicatingParameters(children []*ie.IE) (*Duplicate, error) {
+	d := &Duplicate{}
+	var dest uint8 = 0xff
+	var policy string
+	for _, c := range children {
+		var err error
+		switch c.Type {
+		case ie.DestinationInterface:
+			dest, err = c.DestinationInterface()
+		case ie.OuterHeaderCreation:
+			var ohc *ie.OuterHeaderCreationFields
+			if ohc, err = c.OuterHeaderCreation(); err != nil {
+				break
+			}
+			switch {
+			case ohc.OuterHeaderCreationDescription&outerHeaderUDPIPv4 != 0:
+				d.Addr = ohc.IPv4Address
+			case ohc.OuterHeaderCreationDescription&outerHeaderUDPIPv6 != 0:
+				d.Addr = ohc.IPv6Address
+			default:
+				err = fmt.Errorf("unsupported outer header %#04x", ohc.OuterHeaderCreationDescription)
+			}
+			d.Port = ohc.PortNumber
+		case ie.ForwardingPolicy:
+			policy, err = c.ForwardingPolicyIdentifier()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if dest != ie.DstInterfaceLIFunction {
+		return nil, fmt.Errorf("duplication to destination interface %d is not supported", dest)
+	}
+	if d.Addr == nil || d.Port == 0 {
+		return nil, fmt.Errorf("duplicating parameters without the mediation address")
+	}
+
+	xid, cid, ok := strings.Cut(policy, "/")
+	b, err := hex.DecodeString(strings.ReplaceAll(xid, "-", ""))
+	if !ok || err != nil || len(b) != len(d.XID) {
+		return nil, fmt.Errorf("invalid interception forwarding policy %q", policy)
+	}
+	copy(d.XID[:], b)
+	if d.CorrelationID, err = strconv.ParseUint(cid, 10, 64); err != nil {
+		return nil, fmt.Errorf("invalid interception forwarding policy %q", policy)
+	}
+	return d, nil
+}
+
+// appendXPDU appends an X2/X3 PDU carrying a sequence number and timestamp
+func appendXPDU(dst []byte, pduType, format, direction uint16, xid [16]byte, cid uint64, seq uint32, now time.Time, payload []byte) []byte {
+	const attrsLen = 8 + 12
+	dst = binary.BigEndian.AppendUint16(dst, xpduVersion)
+	dst = binary.BigEndian.AppendUint16(dst, pduType)
+	dst = binary.BigEndian.AppendUint32(dst, xpduFixedLen+attrsLen)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(payload)))
+	dst = binary.BigEndian.AppendUint16(dst, format)
+	dst = binary.BigEndian.AppendUint16(dst, direction)
+	dst = append(dst, xid[:]...)
+	dst = binary.BigEndian.AppendUint64(dst, cid)
+
+	dst = binary.BigEndian.AppendUint16(dst, attrSequenceNumber)
+	dst = binary.BigEndian.AppendUint16(dst, 4)
+	dst = binary.BigEndian.AppendUint32(dst, seq)
+	dst = binary.BigEndian.AppendUint16(dst, attrTimestamp)
+	dst = binary.BigEndian.AppendUint16(dst, 8)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(now.Unix()))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(now.Nanosecond()))
+	return append(dst, payload...)
+}
+
+// keepalivePDU returns a Keepalive or Keepalive Acknowledgement PDU
+func keepalivePDU(pduType uint16, seq uint64) []byte {
+	b := make([]byte, 0, xpduFixedLen)
+	b = binary.BigEndian.AppendUint16(b, xpduVersion)
+	b = binary.BigEndian.AppendUint16(b, pduType)
+	b = binary.BigEndian.AppendUint32(b, xpduFixedLen)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = append(b, make([]byte, 16)...)
+	return binary.BigEndian.AppendUint64(b, seq)
+}
+
+// x3Delivery sends the X3 PDUs of the duplicated packets, over one TCP
+// connection per mediation function
+type x3Delivery struct {
+	logger *logrus.Logger
+	done   <-chan struct{}
+
+	mu    sync.Mutex
+	conns map[string]*mdfConn
+	seq   map[[16]byte]uint32 // last sequence number by XID
+}
+
+// mdfConn is the connection to a mediation function and its queue of PDUs
+type mdfConn struct {
+	addr    string
+	queue   chan []byte
+	dropped atomic.Uint64
+}
+
+func newX3Delivery(logger *logrus.Logger, done <-chan struct{}) *x3Delivery {
+	return &x3Delivery{
+		logger: logger,
+		done:   done,
+		conns:  make(map[string]*mdfConn),
+		seq:    make(map[[16]byte]uint32),
+	}
+}
+
+// duplicate queues a copy of a packet for each interception task of a FAR.
+// Uplink packets are sent from the target, downlink packets to it.
+func (x *x3Delivery) duplicate(dups []*Duplicate, uplink bool, packet []byte) {
+	if len(packet) == 0 {
+		return
+	}
+	format := payloadFormatIPv4
+	if packet[0]>>4 == 6 {
+		format = payloadFormatIPv6
+	}
+	direction := directionToTarget
+	if uplink {
+		direction = directionFromTarget
+	}
+	now := time.Now()
+	for _, d := range dups {
+		addr := net.JoinHostPort(d.Addr.String(), strconv.Itoa(int(d.Port)))
+		x.mu.Lock()
+		c := x.conn(addr)
+		x.seq[d.XID]++
+		seq := x.seq[d.XID]
+		x.mu.Unlock()
+
+		pdu := appendXPDU(make([]byte, 0, xpduFixedLen+20+len(packet)), xpduTypeX3, format, direction, d.XID, d.CorrelationID, seq, now, packet)
+		select {
+		case c.queue <- pdu:
+		default:
+			c.dropped.Add(1)
+		}
+	}
+}
+
+// conn returns the connection to a mediation function, starting it on first
+// use. Called with mu held.
+func (x *x3Delivery) conn(addr string) *mdfConn {
+	c, ok := x.conns[addr]
+	if !ok {
+		c = &mdfConn{addr: addr, queue: make(chan []byte, x3QueueLen)}
+		x.conns[addr] = c
+		go x.run(c)
+	}
+	return c
+}
+
+// run keeps a connection to a mediation function up and writes its queued
+// PDUs, reconnecting with backoff until the UPF is closed
+func (x *x3Delivery) run(c *mdfConn) {
+	backoff := time.Second
+	var pending []byte
+	for {
+		conn, err := net.DialTimeout("tcp", c.addr, x3DialTimeout)
+		if err == nil {
+			backoff = time.Second
+			x.logger.Infof("[UPF] Connected to X3 mediation function %s", c.addr)
+			pending, err = x.serve(c, conn, pending)
+			conn.Close()
+		}
+		if err != nil {
+			x.logger.Warnf("[UPF] X3 delivery to %s failed: %v", c.addr, err)
+		}
+
+		select {
+		case <-x.done:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > x3MaxBackoff {
+			backoff = x3MaxBackoff
+		}
+	}
+}
+
+// serve writes the queued PDUs to a connection, starting with one whose
+// write failed before, and returns the PDU it failed to write
+func (x *x3Delivery) serve(c *mdfConn, conn net.Conn, pending []byte) ([]byte, error) {
+	acks := make(chan uint64, 1)
+	closed := make(chan error, 1)
+	go readXPDUs(conn, acks, closed)
+
+	keepalive := time.NewTicker(x3KeepaliveInterval)
+	defer keepalive.Stop()
+	var keepaliveSeq uint64
+	for {
+		if pending != nil {
+			if _, err := conn.Write(pending); err != nil {
+				return pending, err
+			}
+			pending = nil
+		}
+		select {
+		case <-x.done:
+			return nil, nil
+		case err := <-closed:
+			return nil, err
+		case pending = <-c.queue:
+		case seq := <-acks:
+			pending = keepalivePDU(xpduKeepaliveAck, seq)
+		case <-keepalive.C:
+			if n := c.dropped.Swap(0); n > 0 {
+				x.logger.Warnf("[UPF] Dropped %d X3 PDUs to %s with the queue full", n, c.addr)
+			}
+			keepaliveSeq++
+			pending = keepalivePDU(xpduKeepalive, keepaliveSeq)
+		}
+	}
+}
+
+// readXPDUs reads the PDUs a mediation function sends, passing on the
+// Keepalives to acknowledge, until the connection fails
+func readXPDUs(conn net.Conn, acks chan<- uint64, closed chan<- error) {
+	header := make([]byte, xpduFixedLen)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			closed <- err
+			return
+		}
+		pduType := binary.BigEndian.Uint16(header[2:])
+		headerLen := binary.BigEndian.Uint32(header[4:])
+		payloadLen := binary.BigEndian.Uint32(header[8:])
+		if headerLen < xpduFixedLen {
+			closed <- fmt.Errorf("invalid PDU header length %d", headerLen)
+			return
+		}
+		if _, err := io.CopyN(io.Discard, conn, int64(headerLen-xpduFixedLen)+int64(payloadLen)); err != nil {
+			closed <- err
+			return
+		}
+		if pduType == xpduKeepalive {
+			select {
+			case acks <- binary.BigEndian.Uint64(header[32:]):
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package upf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+	pfcpmsg "github.com/wmnsk/go-pfcp/message"
+)
+
+const testXID = "5b2f3c8e-1f4a-4d6b-9c2e-7a1b3c5d7e9f"
+
+// duplicatingParameters returns the Duplicating Parameters of a task
+// delivered to a mediation function at 127.0.0.1:port
+func duplicatingParameters(port uint16, policy string) []*ie.IE {
+	return []*ie.IE{
+		ie.NewDestinationInterface(ie.DstInterfaceLIFunction),
+		ie.NewOuterHeaderCreation(outerHeaderUDPIPv4, 0, "127.0.0.1", "", port, 0, 0),
+		ie.NewForwardingPolicy(policy),
+	}
+}
+
+func TestParseDuplicatingParameters(t *testing.T) {
+	far, err := parseCreateFAR(ie.NewCreateFAR(
+		ie.NewFARID(1),
+		ie.NewApplyAction(ApplyActionFORW|ApplyActionDUPL),
+		ie.NewForwardingParameters(ie.NewDestinationInterface(ie.DstInterfaceCore)),
+		ie.NewDuplicatingParameters(duplicatingParameters(9000, testXID+"/42")...),
+	))
+	if err != nil {
+		t.Fatalf("parseCreateFAR() error = %v", err)
+	}
+	if len(far.Duplicates) != 1 {
+		t.Fatalf("Duplicates = %v, want 1", far.Duplicates)
+	}
+	d := far.Duplicates[0]
+	if !d.Addr.Equal(net.ParseIP("127.0.0.1")) || d.Port != 9000 || d.CorrelationID != 42 || d.XID[0] != 0x5b || d.XID[15] != 0x9f {
+		t.Errorf("Duplicate = %+v", d)
+	}
+
+	// Without DUPL the Apply Action no longer duplicates
+	if err := applyUpdateFARChildren([]*ie.IE{ie.NewApplyAction(ApplyActionFORW)}, far); err != nil {
+		t.Fatal(err)
+	}
+	if far.Duplicates != nil {
+		t.Errorf("Duplicates = %v after removing DUPL, want none", far.Duplicates)
+	}
+
+	for _, params := range [][]*ie.IE{
+		duplicatingParameters(9000, "42"),
+		duplicatingParameters(9000, "not-a-xid/42"),
+		duplicatingParameters(9000, testXID+"/x"),
+		duplicatingParameters(0, testXID+"/42"),
+		append([]*ie.IE{ie.NewDestinationInterface(ie.DstInterfaceCore)}, duplicatingParameters(9000, testXID+"/42")[1:]...),
+	} {
+		if _, err := parseDuplicatingParameters(params); err == nil {
+			t.Errorf("parseDuplicatingParameters(%v) succeeded, want an error", params)
+		}
+	}
+}
+
+func TestX3Duplication(t *testing.T) {
+	mdf, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mdf.Close()
+
+	u, tun := dataPlaneUPF(t, "127.0.0.1")
+	defer u.Close()
+	session, _ := u.sessionByUE(net.ParseIP("10.0.0.1"))
+	_, err = session.modifyRules(pfcpmsg.NewSessionModificationRequest(0, 0, 1, 1, 0,
+		ie.NewUpdateFAR(
+			ie.NewFARID(1),
+			ie.NewApplyAction(ApplyActionFORW|ApplyActionDUPL),
+			ie.NewUpdateDuplicatingParameters(duplicatingParameters(uint16(mdf.Addr().(*net.TCPAddr).Port), testXID+"/7")...),
+		),
+	), u.alloc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pkt := ipv4Packet("10.0.0.1", "8.8.8.8", 17, "uplink")
+	u.handleTPDU(nil, 100, pkt)
+	if len(tun.packets()) != 1 {
+		t.Fatalf("N6 got %d packets, want the forwarded one", len(tun.packets()))
+	}
+
+	mdf.SetDeadline(time.Now().Add(5 * time.Second))
+	conn, err := mdf.Accept()
+	if err != nil {
+		t.Fatalf("no X3 connection: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, xpduFixedLen+20)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("no X3 PDU: %v", err)
+	}
+	payload := make([]byte, binary.BigEndian.Uint32(header[8:]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []struct {
+		name      string
+		got, want uint64
+	}{
+		{"version", uint64(binary.BigEndian.Uint16(header[0:])), uint64(xpduVersion)},
+		{"PDU type", uint64(binary.BigEndian.Uint16(header[2:])), uint64(xpduTypeX3)},
+		{"header length", uint64(binary.BigEndian.Uint32(header[4:])), xpduFixedLen + 20},
+		{"payload format", uint64(binary.BigEndian.Uint16(header[12:])), uint64(payloadFormatIPv4)},
+		{"direction", uint64(binary.BigEndian.Uint16(header[14:])), uint64(directionFromTarget)},
+		{"XID", uint64(header[16]), 0x5b},
+		{"correlation ID", binary.BigEndian.Uint64(header[32:]), 7},
+		{"sequence number", uint64(binary.BigEndian.Uint32(header[44:])), 1},
+	} {
+		if f.got != f.want {
+			t.Errorf("%s = %d, want %d", f.name, f.got, f.want)
+		}
+	}
+	if !bytes.Equal(payload, pkt) {
+		t.Errorf("X3 payload = %x, want the packet %x", payload, pkt)
+	}
+}
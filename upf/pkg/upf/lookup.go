@@ -0,0 +1,104 @@
+package upf
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// lookupShards is the number of copy-on-write shards of the data plane
+// lookup tables
+const lookupShards = 256
+
+// teidTable maps local TEIDs to their tunnel endpoints. Packets look up a
+// shard's map without locking; writers, serialized by sessionLock, replace
+// the map of the shard they change so a session change copies a fraction
+// of the table.
+type teidTable struct {
+	shards [lookupShards]atomic.Value // map[uint32]tunnelEndpoint
+}
+
+func (t *teidTable) shard(teid uint32) *atomic.Value {
+	return &t.shards[(teid^teid>>8^teid>>16^teid>>24)%lookupShards]
+}
+
+func (t *teidTable) load(teid uint32) (tunnelEndpoint, bool) {
+	m, _ := t.shard(teid).Load().(map[uint32]tunnelEndpoint)
+	ep, ok := m[teid]
+	return ep, ok
+}
+
+// update sets, or deletes when ep has no session, the endpoint of a TEID.
+// The caller holds sessionLock.
+func (t *teidTable) update(teid uint32, ep tunnelEndpoint) {
+	shard := t.shard(teid)
+	old, _ := shard.Load().(map[uint32]tunnelEndpoint)
+	m := make(map[uint32]tunnelEndpoint, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+	if ep.session == nil {
+		delete(m, teid)
+	} else {
+		m[teid] = ep
+	}
+	shard.Store(m)
+}
+
+// ueKey indexes IPv4 UEs by address and IPv6 UEs by the /64 they are
+// delegated, the prefix length the SMF allocates
+type ueKey [net.IPv6len]byte
+
+// ueKeyOf returns the key of a UE address, false for an invalid address
+func ueKeyOf(ip net.IP) (ueKey, bool) {
+	var key ueKey
+	if v4 := ip.To4(); v4 != nil {
+		copy(key[:], v4.To16())
+		return key, true
+	}
+	if len(ip) != net.IPv6len {
+		return key, false
+	}
+	copy(key[:8], ip[:8])
+	return key, true
+}
+
+// hash spreads UE keys over the table shards and packet workers (FNV-1a)
+func (k ueKey) hash() uint32 {
+	h := uint32(2166136261)
+	for _, b := range k {
+		h = (h ^ uint32(b)) * 16777619
+	}
+	return h
+}
+
+// ueTable maps UE keys to their sessions, sharded like teidTable
+type ueTable struct {
+	shards [lookupShards]atomic.Value // map[ueKey]*Session
+}
+
+func (t *ueTable) shard(key ueKey) *atomic.Value {
+	return &t.shards[key.hash()%lookupShards]
+}
+
+func (t *ueTable) load(key ueKey) (*Session, bool) {
+	m, _ := t.shard(key).Load().(map[ueKey]*Session)
+	session, ok := m[key]
+	return session, ok
+}
+
+// update sets, or deletes when session is nil, the session of a UE key.
+// The caller holds sessionLock.
+func (t *ueTable) update(key ueKey, session *Session) {
+	shard := t.shard(key)
+	old, _ := shard.Load().(map[ueKey]*Session)
+	m := make(map[ueKey]*Session, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+	if session == nil {
+		delete(m, key)
+	} else {
+		m[key] = session
+	}
+	shard.Store(m)
+}
@@ -0,0 +1,301 @@
+package upf
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+	pfcpmsg "github.com/wmnsk/go-pfcp/message"
+)
+
+// modifyRules applies the Remove, Create and Update rule IEs of a Session
+// Modification Request, in that order, and returns the created PDRs. The
+// changes are made to copies and installed together once every PDR refers
+// to existing rules, so a failed request leaves the session's rules
+// unchanged. F-TEIDs and UE addresses are chosen for the created PDRs only
+// then, and those of removed PDRs are released. Changed rules are replaced
+// rather than modified so packets already matched keep a consistent copy.
+func (s *Session) modifyRules(req *pfcpmsg.SessionModificationRequest, alloc *allocator) ([]*PDR, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pdrs := make(map[uint16]*PDR, len(s.PDRs))
+	for _, pdr := range s.PDRs {
+		pdrs[pdr.ID] = pdr
+	}
+	fars := make(map[uint32]*FAR, len(s.FARs))
+	for id, far := range s.FARs {
+		fars[id] = far
+	}
+	qers := make(map[uint32]*QER, len(s.QERs))
+	for id, qer := range s.QERs {
+		qers[id] = qer
+	}
+	urrs := make(map[uint32]*URR, len(s.URRs))
+	for id, urr := range s.URRs {
+		urrs[id] = urr
+	}
+
+	// Remove
+	for _, i := range req.RemovePDR {
+		id, err := removedRuleID(i, ie.PDRID)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := pdrs[uint16(id)]; !ok {
+			return nil, failedRule(ie.RuleIDTypePDR, id, fmt.Errorf("cannot remove unknown PDR %d", id))
+		}
+		delete(pdrs, uint16(id))
+	}
+	for _, i := range req.RemoveFAR {
+		id, err := removedRuleID(i, ie.FARID)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := fars[id]; !ok {
+			return nil, failedRule(ie.RuleIDTypeFAR, id, fmt.Errorf("cannot remove unknown FAR %d", id))
+		}
+		delete(fars, id)
+	}
+	for _, i := range req.RemoveQER {
+		id, err := removedRuleID(i, ie.QERID)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := qers[id]; !ok {
+			return nil, failedRule(ie.RuleIDTypeQER, id, fmt.Errorf("cannot remove unknown QER %d", id))
+		}
+		delete(qers, id)
+	}
+	for _, i := range req.RemoveURR {
+		id, err := removedRuleID(i, ie.URRID)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := urrs[id]; !ok {
+			return nil, failedRule(ie.RuleIDTypeURR, id, fmt.Errorf("cannot remove unknown URR %d", id))
+		}
+		delete(urrs, id)
+	}
+
+	// Create
+	var created []*PDR
+	for _, i := range req.CreatePDR {
+		pdr, err := parseCreatePDR(i)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := pdrs[pdr.ID]; ok {
+			return nil, failedRule(ie.RuleIDTypePDR, uint32(pdr.ID), fmt.Errorf("PDR %d already exists", pdr.ID))
+		}
+		pdrs[pdr.ID] = pdr
+		created = append(created, pdr)
+	}
+	for _, i := range req.CreateFAR {
+		far, err := parseCreateFAR(i)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := fars[far.ID]; ok {
+			return nil, failedRule(ie.RuleIDTypeFAR, far.ID, fmt.Errorf("FAR %d already exists", far.ID))
+		}
+		fars[far.ID] = far
+	}
+	for _, i := range req.CreateQER {
+		qer, err := parseCreateQER(i)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := qers[qer.ID]; ok {
+			return nil, failedRule(ie.RuleIDTypeQER, qer.ID, fmt.Errorf("QER %d already exists", qer.ID))
+		}
+		qers[qer.ID] = qer
+	}
+	for _, i := range req.CreateURR {
+		urr, err := parseCreateURR(i)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := urrs[urr.ID]; ok {
+			return nil, failedRule(ie.RuleIDTypeURR, urr.ID, fmt.Errorf("URR %d already exists", urr.ID))
+		}
+		urrs[urr.ID] = urr
+	}
+
+	// Update
+	for _, i := range req.UpdatePDR {
+		children, err := i.UpdatePDR()
+		if err != nil {
+			return nil, fmt.Errorf("invalid Update PDR: %w", err)
+		}
+		id, err := childRuleID(children, ie.PDRID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Update PDR: %w", err)
+		}
+		pdr, ok := pdrs[uint16(id)]
+		if !ok {
+			return nil, failedRule(ie.RuleIDTypePDR, id, fmt.Errorf("cannot update unknown PDR %d", id))
+		}
+		updated := *pdr
+		if err := applyPDR(children, &updated); err != nil {
+			return nil, failedRule(ie.RuleIDTypePDR, id, fmt.Errorf("invalid Update PDR: %w", err))
+		}
+		pdrs[updated.ID] = &updated
+	}
+	for _, i := range req.UpdateFAR {
+		children, err := i.UpdateFAR()
+		if err != nil {
+			return nil, fmt.Errorf("invalid Update FAR: %w", err)
+		}
+		id, err := childRuleID(children, ie.FARID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Update FAR: %w", err)
+		}
+		far, ok := fars[id]
+		if !ok {
+			return nil, failedRule(ie.RuleIDTypeFAR, id, fmt.Errorf("cannot update unknown FAR %d", id))
+		}
+		updated := *far
+		if err := applyUpdateFARChildren(children, &updated); err != nil {
+			return nil, failedRule(ie.RuleIDTypeFAR, id, fmt.Errorf("invalid Update FAR: %w", err))
+		}
+		fars[id] = &updated
+	}
+	for _, i := range req.UpdateQER {
+		children, err := i.UpdateQER()
+		if err != nil {
+			return nil, fmt.Errorf("invalid Update QER: %w", err)
+		}
+		id, err := childRuleID(children, ie.QERID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Update QER: %w", err)
+		}
+		qer, ok := qers[id]
+		if !ok {
+			return nil, failedRule(ie.RuleIDTypeQER, id, fmt.Errorf("cannot update unknown QER %d", id))
+		}
+		updated := *qer
+		if err := applyQER(children, &updated); err != nil {
+			return nil, failedRule(ie.RuleIDTypeQER, id, fmt.Errorf("invalid Update QER: %w", err))
+		}
+		qers[id] = &updated
+	}
+	var requoted []uint32
+	for _, i := range req.UpdateURR {
+		children, err := i.UpdateURR()
+		if err != nil {
+			return nil, fmt.Errorf("invalid Update URR: %w", err)
+		}
+		id, err := childRuleID(children, ie.URRID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Update URR: %w", err)
+		}
+		urr, ok := urrs[id]
+		if !ok {
+			return nil, failedRule(ie.RuleIDTypeURR, id, fmt.Errorf("cannot update unknown URR %d", id))
+		}
+		updated := *urr
+		if err := applyURR(children, &updated); err != nil {
+			return nil, failedRule(ie.RuleIDTypeURR, id, fmt.Errorf("invalid Update URR: %w", err))
+		}
+		urrs[id] = &updated
+		if hasQuota(children) {
+			requoted = append(requoted, id)
+		}
+	}
+
+	// PDRs of equal precedence keep their order, created ones come last
+	sorted := make([]*PDR, 0, len(pdrs))
+	for _, pdr := range s.PDRs {
+		if current, ok := pdrs[pdr.ID]; ok && !containsPDR(created, pdr.ID) {
+			sorted = append(sorted, current)
+		}
+	}
+	for i, pdr := range created {
+		created[i] = pdrs[pdr.ID]
+		sorted = append(sorted, created[i])
+	}
+	if err := checkReferences(sorted, fars, qers, urrs); err != nil {
+		return nil, err
+	}
+	if err := alloc.assign(s, created); err != nil {
+		return nil, err
+	}
+	alloc.releaseUnused(s, sorted)
+	sortPDRs(sorted)
+
+	s.learnAddresses(sorted)
+	s.PDRs = sorted
+	s.FARs = fars
+	s.QERs = qers
+	s.URRs = urrs
+	s.pruneMeters()
+	for _, id := range requoted {
+		s.resetQuota(id, time.Now())
+	}
+	return created, nil
+}
+
+// hasQuota reports whether an Update URR provisions a new volume or time
+// quota
+func hasQuota(children []*ie.IE) bool {
+	for _, c := range children {
+		if c.Type == ie.VolumeQuota || c.Type == ie.TimeQuota {
+			return true
+		}
+	}
+	return false
+}
+
+// removedRuleID returns the rule ID of a Remove PDR, FAR, QER or URR IE
+func removedRuleID(i *ie.IE, typ uint16) (uint32, error) {
+	var children []*ie.IE
+	var err error
+	switch typ {
+	case ie.PDRID:
+		children, err = i.RemovePDR()
+	case ie.FARID:
+		children, err = i.RemoveFAR()
+	case ie.QERID:
+		children, err = i.RemoveQER()
+	case ie.URRID:
+		children, err = i.RemoveURR()
+	}
+	if err == nil {
+		var id uint32
+		if id, err = childRuleID(children, typ); err == nil {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid Remove IE: %w", err)
+}
+
+// childRuleID returns the rule ID among the children of a grouped rule IE
+func childRuleID(children []*ie.IE, typ uint16) (uint32, error) {
+	for _, c := range children {
+		if c.Type != typ {
+			continue
+		}
+		switch typ {
+		case ie.PDRID:
+			id, err := c.PDRID()
+			return uint32(id), err
+		case ie.FARID:
+			return c.FARID()
+		case ie.QERID:
+			return c.QERID()
+		case ie.URRID:
+			return c.URRID()
+		}
+	}
+	return 0, &mandatoryIEError{ieType: typ}
+}
+
+func containsPDR(pdrs []*PDR, id uint16) bool {
+	for _, pdr := range pdrs {
+		if pdr.ID == id {
+			return true
+		}
+	}
+	return false
+}
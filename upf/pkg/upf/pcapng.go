@@ -0,0 +1,153 @@
+package upf
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// pcapng block types and options (draft-ietf-opsawg-pcapng §4)
+const (
+	pcapngSectionHeader    uint32 = 0x0a0d0d0a
+	pcapngInterface        uint32 = 1
+	pcapngEnhancedPacket   uint32 = 6
+	pcapngByteOrderMagic   uint32 = 0x1a2b3c4d
+	pcapngOptComment       uint16 = 1
+	pcapngOptUserAppl      uint16 = 4
+	pcapngOptIfName        uint16 = 2
+	pcapngOptIfTsresol     uint16 = 9
+	pcapngOptEPBFlags      uint16 = 2
+	pcapngFlagInbound      uint32 = 1
+	pcapngFlagOutbound     uint32 = 2
+	linkTypeRaw            uint16 = 101 // raw IPv4 or IPv6 packets
+	pcapngTimestampNanosec uint8  = 9
+)
+
+// Interfaces of a capture: G-PDUs with their outer IP, UDP and GTP-U
+// headers on N3/N9, the inner packets on N6
+const (
+	captureIfaceGTPU uint32 = 0
+	captureIfaceN6   uint32 = 1
+)
+
+// pcapngWriter writes a pcapng section with the interfaces of a capture
+type pcapngWriter struct {
+	w         io.Writer
+	body, buf []byte
+}
+
+// newPCAPNGWriter writes the section header and interface blocks
+func newPCAPNGWriter(w io.Writer, comment string) (*pcapngWriter, error) {
+	p := &pcapngWriter{w: w}
+
+	opts := appendOption(nil, pcapngOptUserAppl, []byte("openmvcore-upf"))
+	if comment != "" {
+		opts = appendOption(opts, pcapngOptComment, []byte(comment))
+	}
+	body := binary.LittleEndian.AppendUint32(nil, pcapngByteOrderMagic)
+	body = binary.LittleEndian.AppendUint16(body, 1) // version 1.0
+	body = binary.LittleEndian.AppendUint16(body, 0)
+	body = binary.LittleEndian.AppendUint64(body, ^uint64(0)) // section length not given
+	p.buf = appendBlock(p.buf[:0], pcapngSectionHeader, append(body, appendOptionEnd(opts)...))
+
+	for _, name := range []string{"n3n9", "n6"} {
+		body = binary.LittleEndian.AppendUint16(body[:0], linkTypeRaw)
+		body = binary.LittleEndian.AppendUint16(body, 0)
+		body = binary.LittleEndian.AppendUint32(body, maxPacketSize)
+		opts = appendOption(nil, pcapngOptIfName, []byte(name))
+		opts = appendOption(opts, pcapngOptIfTsresol, []byte{pcapngTimestampNanosec})
+		p.buf = appendBlock(p.buf, pcapngInterface, append(body, appendOptionEnd(opts)...))
+	}
+	if _, err := w.Write(p.buf); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// writePacket writes an Enhanced Packet Block
+func (p *pcapngWriter) writePacket(c *capturedPacket) error {
+	ts := uint64(c.time.UnixNano())
+	body := binary.LittleEndian.AppendUint32(p.body[:0], c.iface)
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts>>32))
+	body = binary.LittleEndian.AppendUint32(body, uint32(ts))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(c.data)))
+	body = binary.LittleEndian.AppendUint32(body, uint32(len(c.data)))
+	body = appendPadded(body, c.data)
+	flags := pcapngFlagInbound
+	if c.outbound {
+		flags = pcapngFlagOutbound
+	}
+	p.body = appendOptionEnd(appendOption(body, pcapngOptEPBFlags, binary.LittleEndian.AppendUint32(nil, flags)))
+
+	p.buf = appendBlock(p.buf[:0], pcapngEnhancedPacket, p.body)
+	_, err := p.w.Write(p.buf)
+	return err
+}
+
+// appendBlock appends a block with its type and total length around body,
+// which must be 32-bit aligned
+func appendBlock(dst []byte, blockType uint32, body []byte) []byte {
+	total := uint32(12 + len(body))
+	dst = binary.LittleEndian.AppendUint32(dst, blockType)
+	dst = binary.LittleEndian.AppendUint32(dst, total)
+	dst = append(dst, body...)
+	return binary.LittleEndian.AppendUint32(dst, total)
+}
+
+func appendOption(dst []byte, code uint16, value []byte) []byte {
+	dst = binary.LittleEndian.AppendUint16(dst, code)
+	dst = binary.LittleEndian.AppendUint16(dst, uint16(len(value)))
+	return appendPadded(dst, value)
+}
+
+func appendOptionEnd(dst []byte) []byte {
+	return append(dst, 0, 0, 0, 0)
+}
+
+// appendPadded appends b padded to 32 bits
+func appendPadded(dst, b []byte) []byte {
+	dst = append(dst, b...)
+	for n := len(b); n%4 != 0; n++ {
+		dst = append(dst, 0)
+	}
+	return dst
+}
+
+// capturedPacket is a packet queued to the writer of a capture
+type capturedPacket struct {
+	iface    uint32
+	outbound bool
+	time     time.Time
+	data     []byte
+}
+
+// outerGPDU returns a copy of a G-PDU with the IP and UDP headers it was
+// carried in between the local and peer GTP-U addresses. The UDP checksum
+// is left out.
+func outerGPDU(src, dst net.IP, gpdu []byte) []byte {
+	udpLen := 8 + len(gpdu)
+	var b []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		b = make([]byte, 20, 20+udpLen)
+		b[0] = 0x45
+		binary.BigEndian.PutUint16(b[2:], uint16(20+udpLen))
+		binary.BigEndian.PutUint16(b[6:], 0x4000) // DF
+		b[8], b[9] = 64, protoUDP
+		copy(b[12:16], src4)
+		copy(b[16:20], dst4)
+		binary.BigEndian.PutUint16(b[10:], ipv4Checksum(b))
+	} else {
+		b = make([]byte, ipv6HeaderLen, ipv6HeaderLen+udpLen)
+		b[0] = 0x60
+		binary.BigEndian.PutUint16(b[4:], uint16(udpLen))
+		b[6], b[7] = protoUDP, 64
+		copy(b[8:24], src.To16())
+		copy(b[24:40], dst.To16())
+	}
+	b = binary.BigEndian.AppendUint16(b, gtpuPort)
+	b = binary.BigEndian.AppendUint16(b, gtpuPort)
+	b = binary.BigEndian.AppendUint16(b, uint16(udpLen))
+	b = append(b, 0, 0)
+	return append(b, gpdu...)
+}
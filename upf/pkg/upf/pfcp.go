@@ -0,0 +1,329 @@
+package upf
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+	pfcpmsg "github.com/wmnsk/go-pfcp/message"
+)
+
+// transactionTTL is how long the response to a request is kept to answer
+// its retransmissions, longer than the N1 x T1 an SMF retransmits for
+// (TS 29.244 §6.4)
+const transactionTTL = 30 * time.Second
+
+// association is a PFCP association with a CP function, which owns the
+// sessions it establishes (TS 29.244 §6.2.6)
+type association struct {
+	nodeID   string
+	addr     *net.UDPAddr
+	recovery time.Time // Recovery Time Stamp of the CP function
+}
+
+// transactionKey identifies a request by its sender and sequence number
+type transactionKey struct {
+	addr string
+	seq  uint32
+}
+
+// pfcpTransaction is a request received from a peer and its encoded
+// response, nil while the request is handled
+type pfcpTransaction struct {
+	res     []byte
+	expires time.Time
+}
+
+// ruleError is a rule a request could not create, update or remove,
+// reported in a Failed Rule ID IE (TS 29.244 §8.2.80)
+type ruleError struct {
+	ruleType uint8
+	id       uint32
+	err      error
+}
+
+func (e *ruleError) Error() string { return e.err.Error() }
+func (e *ruleError) Unwrap() error { return e.err }
+
+// failedRule wraps the error of a rule with its type and ID
+func failedRule(ruleType uint8, id uint32, err error) error {
+	return &ruleError{ruleType: ruleType, id: id, err: err}
+}
+
+// mandatoryIEError is a mandatory IE a request or grouped IE lacks, or
+// one that could not be decoded, reported in an Offending IE
+type mandatoryIEError struct {
+	ieType uint16
+	err    error // nil when the IE is missing
+}
+
+func (e *mandatoryIEError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("missing mandatory IE type %d", e.ieType)
+	}
+	return fmt.Sprintf("invalid mandatory IE type %d: %v", e.ieType, e.err)
+}
+
+// requireIEs returns an error for the first of the IE types missing from
+// the children of a grouped IE
+func requireIEs(children []*ie.IE, types ...uint16) error {
+	for _, typ := range types {
+		found := false
+		for _, c := range children {
+			if c.Type == typ {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return &mandatoryIEError{ieType: typ}
+		}
+	}
+	return nil
+}
+
+// rejection returns the cause of a request the UPF could not apply and
+// the Offending IE or Failed Rule ID identifying what failed
+// (TS 29.244 §7.2.3.3)
+func rejection(err error) (uint8, []*ie.IE) {
+	var mandatory *mandatoryIEError
+	if errors.As(err, &mandatory) {
+		cause := ie.CauseMandatoryIEMissing
+		if mandatory.err != nil {
+			cause = ie.CauseMandatoryIEIncorrect
+		}
+		return cause, []*ie.IE{ie.NewOffendingIE(mandatory.ieType)}
+	}
+	if errors.Is(err, errNoResources) {
+		return ie.CauseNoResourcesAvailable, nil
+	}
+	var rule *ruleError
+	if errors.As(err, &rule) {
+		return ie.CauseRuleCreationModificationFailure, []*ie.IE{ie.NewFailedRuleID(rule.ruleType, rule.id)}
+	}
+	return ie.CauseRuleCreationModificationFailure, nil
+}
+
+// parseNodeID returns the Node ID of a request, which is mandatory
+func parseNodeID(i *ie.IE) (string, error) {
+	if i == nil {
+		return "", &mandatoryIEError{ieType: ie.NodeID}
+	}
+	nodeID, err := i.NodeID()
+	if err != nil {
+		return "", &mandatoryIEError{ieType: ie.NodeID, err: err}
+	}
+	return nodeID, nil
+}
+
+// parseAssociationSetup returns the Node ID and Recovery Time Stamp of an
+// Association Setup Request (TS 29.244 §7.4.4.1)
+func parseAssociationSetup(req *pfcpmsg.AssociationSetupRequest) (string, time.Time, error) {
+	nodeID, err := parseNodeID(req.NodeID)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if req.RecoveryTimeStamp == nil {
+		return "", time.Time{}, &mandatoryIEError{ieType: ie.RecoveryTimeStamp}
+	}
+	recovery, err := req.RecoveryTimeStamp.RecoveryTimeStamp()
+	if err != nil {
+		return "", time.Time{}, &mandatoryIEError{ieType: ie.RecoveryTimeStamp, err: err}
+	}
+	return nodeID, recovery, nil
+}
+
+// parseEstablishment returns the Node ID and CP SEID of a Session
+// Establishment Request and checks its other mandatory IEs
+// (TS 29.244 §7.5.2)
+func parseEstablishment(req *pfcpmsg.SessionEstablishmentRequest) (string, uint64, error) {
+	var cpSEID uint64
+	if req.CPFSEID != nil {
+		fseid, err := req.CPFSEID.FSEID()
+		if err != nil {
+			return "", 0, &mandatoryIEError{ieType: ie.FSEID, err: err}
+		}
+		cpSEID = fseid.SEID
+	}
+	nodeID, err := parseNodeID(req.NodeID)
+	switch {
+	case err != nil:
+		return "", cpSEID, err
+	case req.CPFSEID == nil:
+		return "", cpSEID, &mandatoryIEError{ieType: ie.FSEID}
+	case len(req.CreatePDR) == 0:
+		return "", cpSEID, &mandatoryIEError{ieType: ie.CreatePDR}
+	case len(req.CreateFAR) == 0:
+		return "", cpSEID, &mandatoryIEError{ieType: ie.CreateFAR}
+	}
+	return nodeID, cpSEID, nil
+}
+
+// nodeID returns the Node ID of the UPF: the configured FQDN or address,
+// else the address put in F-SEIDs
+func (u *UPF) nodeID() *ie.IE {
+	if u.cfg.NodeID != "" && net.ParseIP(u.cfg.NodeID) == nil {
+		return ie.NewNodeID("", "", u.cfg.NodeID)
+	}
+	ip := u.nodeAddr
+	if u.cfg.NodeID != "" {
+		ip = net.ParseIP(u.cfg.NodeID)
+	}
+	if ip.To4() != nil {
+		return ie.NewNodeID(ip.String(), "", "")
+	}
+	return ie.NewNodeID("", ip.String(), "")
+}
+
+// associate records the association of a CP function and returns the
+// sessions of its previous association when the CP function restarted
+func (u *UPF) associate(nodeID string, addr *net.UDPAddr, recovery time.Time) []*Session {
+	a := &association{nodeID: nodeID, addr: addr, recovery: recovery}
+	u.assocLock.Lock()
+	old, ok := u.associations[nodeID]
+	u.associations[nodeID] = a
+	u.assocLock.Unlock()
+	u.saveAssociation(nodeID, a)
+
+	if !ok || old.recovery.Equal(recovery) {
+		return nil
+	}
+	return u.associationSessions(nodeID)
+}
+
+// releaseAssociation removes the association of a CP function and
+// returns its sessions, reporting whether it existed
+func (u *UPF) releaseAssociation(nodeID string) ([]*Session, bool) {
+	u.assocLock.Lock()
+	_, ok := u.associations[nodeID]
+	delete(u.associations, nodeID)
+	u.assocLock.Unlock()
+	u.saveAssociation(nodeID, nil)
+
+	if !ok {
+		return nil, false
+	}
+	return u.associationSessions(nodeID), true
+}
+
+// association returns the association of a CP function
+func (u *UPF) association(nodeID string) (*association, bool) {
+	u.assocLock.RLock()
+	defer u.assocLock.RUnlock()
+	a, ok := u.associations[nodeID]
+	return a, ok
+}
+
+// associationSessions returns the sessions a CP function owns
+func (u *UPF) associationSessions(nodeID string) []*Session {
+	var sessions []*Session
+	for _, session := range u.sessionList() {
+		if session.cpNodeID == nodeID {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions
+}
+
+// ownedSession returns the session of a SEID if it belongs to the
+// association of the peer a request came from
+func (u *UPF) ownedSession(seid uint64, remoteAddr *net.UDPAddr) (*Session, bool) {
+	u.sessionLock.RLock()
+	session, ok := u.sessions[seid]
+	u.sessionLock.RUnlock()
+	if !ok {
+		return nil, false
+	}
+	a, ok := u.association(session.cpNodeID)
+	if !ok || !a.addr.IP.Equal(remoteAddr.IP) {
+		return nil, false
+	}
+	return session, true
+}
+
+// releaseSessions deletes sessions without a request from their SMF, as
+// when it restarted or released its association
+func (u *UPF) releaseSessions(sessions []*Session) {
+	for _, session := range sessions {
+		if s, ok := u.removeSession(session.SEID); ok {
+			u.deleteStored(s.SEID)
+			u.releaseSession(s)
+			u.logger.Infof("[UPF] Released session %d of %s", s.SEID, s.cpNodeID)
+		}
+	}
+}
+
+// releaseSession frees what a removed session holds and publishes its
+// final usage, which it returns
+func (u *UPF) releaseSession(session *Session) []*UsageReport {
+	u.unoffloadSession(session)
+	u.alloc.release(session)
+	reports := session.finalUsage(true, time.Now())
+	u.publishUsage(session, reports)
+	return reports
+}
+
+// receivedRequest records a request and reports whether it is new. The
+// response to a retransmitted request is sent again if it was already
+// answered.
+func (u *UPF) receivedRequest(msg pfcpmsg.Message, remoteAddr *net.UDPAddr) bool {
+	key := transactionKey{addr: remoteAddr.String(), seq: msg.Sequence()}
+	now := time.Now()
+
+	u.txLock.Lock()
+	if now.After(u.nextPrune) {
+		for k, t := range u.transactions {
+			if now.After(t.expires) {
+				delete(u.transactions, k)
+			}
+		}
+		u.nextPrune = now.Add(transactionTTL)
+	}
+	t, ok := u.transactions[key]
+	if ok && now.Before(t.expires) {
+		res := t.res
+		u.txLock.Unlock()
+		if res != nil {
+			u.logger.Debugf("[UPF] Resending response to retransmitted %s %d from %s", msg.MessageTypeName(), key.seq, remoteAddr)
+			if _, err := u.pfcpConn.WriteToUDP(res, remoteAddr); err != nil {
+				u.logger.Errorf("[UPF] Failed to resend PFCP response: %v", err)
+			}
+		}
+		return false
+	}
+	u.transactions[key] = &pfcpTransaction{expires: now.Add(transactionTTL)}
+	u.txLock.Unlock()
+	return true
+}
+
+// answered keeps the encoded response to a request for its
+// retransmissions
+func (u *UPF) answered(res []byte, seq uint32, remoteAddr *net.UDPAddr) {
+	u.txLock.Lock()
+	defer u.txLock.Unlock()
+	if t, ok := u.transactions[transactionKey{addr: remoteAddr.String(), seq: seq}]; ok {
+		t.res = res
+	}
+}
+
+// isPFCPRequest reports whether a message type is a request, whose
+// response has the next type
+func isPFCPRequest(msgType uint8) bool {
+	switch msgType {
+	case pfcpmsg.MsgTypeHeartbeatRequest,
+		pfcpmsg.MsgTypePFDManagementRequest,
+		pfcpmsg.MsgTypeAssociationSetupRequest,
+		pfcpmsg.MsgTypeAssociationUpdateRequest,
+		pfcpmsg.MsgTypeAssociationReleaseRequest,
+		pfcpmsg.MsgTypeNodeReportRequest,
+		pfcpmsg.MsgTypeSessionSetDeletionRequest,
+		pfcpmsg.MsgTypeSessionEstablishmentRequest,
+		pfcpmsg.MsgTypeSessionModificationRequest,
+		pfcpmsg.MsgTypeSessionDeletionRequest,
+		pfcpmsg.MsgTypeSessionReportRequest:
+		return true
+	}
+	return false
+}
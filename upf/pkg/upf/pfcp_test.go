@@ -0,0 +1,262 @@
+package upf
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+	pfcpmsg "github.com/wmnsk/go-pfcp/message"
+)
+
+// pfcpUPF returns a UPF serving PFCP on the loopback and an SMF socket
+func pfcpUPF(t *testing.T) (u *UPF, smf *net.UDPConn) {
+	t.Helper()
+
+	u = NewUPF(&Config{NodeID: "upf.example.org"})
+	var err error
+	if u.pfcpConn, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	go u.servePFCP()
+	t.Cleanup(u.Close)
+
+	if smf, err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { smf.Close() })
+	return u, smf
+}
+
+// exchange sends a request to the UPF and returns its response
+func exchange(t *testing.T, u *UPF, smf *net.UDPConn, req pfcpmsg.Message) pfcpmsg.Message {
+	t.Helper()
+
+	b := make([]byte, req.MarshalLen())
+	if err := req.MarshalTo(b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := smf.WriteToUDP(b, u.pfcpConn.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+	res := readPFCP(t, smf)
+	if res.Sequence() != req.Sequence() {
+		t.Errorf("%s sequence = %d, want %d", res.MessageTypeName(), res.Sequence(), req.Sequence())
+	}
+	return res
+}
+
+func responseCause(t *testing.T, i *ie.IE) uint8 {
+	t.Helper()
+
+	if i == nil {
+		t.Fatal("response without Cause")
+	}
+	cause, err := i.Cause()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cause
+}
+
+func failedRuleID(t *testing.T, i *ie.IE) (uint8, uint32) {
+	t.Helper()
+
+	if i == nil {
+		t.Fatal("response without Failed Rule ID")
+	}
+	typ, err := i.RuleIDType()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := i.FailedRuleID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return typ, id
+}
+
+func associationSetup(seq uint32, recovery time.Time) *pfcpmsg.AssociationSetupRequest {
+	return pfcpmsg.NewAssociationSetupRequest(seq,
+		ie.NewNodeID("127.0.0.1", "", ""),
+		ie.NewRecoveryTimeStamp(recovery),
+	)
+}
+
+func establishment(seq uint32, ies ...*ie.IE) *pfcpmsg.SessionEstablishmentRequest {
+	ies = append([]*ie.IE{
+		ie.NewNodeID("127.0.0.1", "", ""),
+		ie.NewFSEID(0x1000+uint64(seq), net.ParseIP("127.0.0.1"), nil),
+	}, ies...)
+	return pfcpmsg.NewSessionEstablishmentRequest(0, 0, 0, seq, 0, ies...)
+}
+
+func sessionRules() []*ie.IE {
+	return []*ie.IE{
+		ie.NewCreatePDR(ie.NewPDRID(1), ie.NewPrecedence(255), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceAccess),
+			ie.NewFTEID(0x01, 100, net.ParseIP("192.0.2.1"), nil, 0),
+			ie.NewUEIPAddress(0x02, "10.0.0.1", "", 0, 0),
+		), ie.NewOuterHeaderRemoval(0, 0), ie.NewFARID(1)),
+		ie.NewCreateFAR(ie.NewFARID(1), ie.NewApplyAction(ApplyActionFORW), ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceCore),
+		)),
+	}
+}
+
+func TestPFCPAssociationBoundSessions(t *testing.T) {
+	u, smf := pfcpUPF(t)
+
+	// Sessions need an association
+	res := exchange(t, u, smf, establishment(1, sessionRules()...)).(*pfcpmsg.SessionEstablishmentResponse)
+	if cause := responseCause(t, res.Cause); cause != ie.CauseNoEstablishedPFCPAssociation {
+		t.Fatalf("cause without association = %d, want %d", cause, ie.CauseNoEstablishedPFCPAssociation)
+	}
+
+	recovery := time.Now().Add(-time.Hour).Truncate(time.Second)
+	setup := exchange(t, u, smf, associationSetup(2, recovery)).(*pfcpmsg.AssociationSetupResponse)
+	if cause := responseCause(t, setup.Cause); cause != ie.CauseRequestAccepted {
+		t.Fatalf("Association Setup cause = %d", cause)
+	}
+	if nodeID, err := setup.NodeID.NodeID(); err != nil || nodeID != "upf.example.org" {
+		t.Errorf("Node ID = %q, %v, want upf.example.org", nodeID, err)
+	}
+
+	res = exchange(t, u, smf, establishment(3, sessionRules()...)).(*pfcpmsg.SessionEstablishmentResponse)
+	if cause := responseCause(t, res.Cause); cause != ie.CauseRequestAccepted {
+		t.Fatalf("Session Establishment cause = %d", cause)
+	}
+	if res.SEID() != 0x1003 {
+		t.Errorf("response SEID = %#x, want the CP SEID 0x1003", res.SEID())
+	}
+	fseid, _ := res.UPFSEID.FSEID()
+
+	// Another peer cannot modify or delete the session
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)})
+	if err != nil {
+		t.Skipf("127.0.0.2 unavailable: %v", err)
+	}
+	defer other.Close()
+	del := exchange(t, u, other, pfcpmsg.NewSessionDeletionRequest(0, 0, fseid.SEID, 4, 0)).(*pfcpmsg.SessionDeletionResponse)
+	if cause := responseCause(t, del.Cause); cause != ie.CauseSessionContextNotFound || del.SEID() != 0 {
+		t.Errorf("deletion by another peer = cause %d, SEID %d, want %d and 0", cause, del.SEID(), ie.CauseSessionContextNotFound)
+	}
+	if u.GetSessionCount() != 1 {
+		t.Fatalf("sessions = %d, want 1", u.GetSessionCount())
+	}
+
+	// The same association keeps its sessions, a restarted SMF loses them
+	exchange(t, u, smf, associationSetup(5, recovery))
+	if u.GetSessionCount() != 1 {
+		t.Fatalf("sessions after re-association = %d, want 1", u.GetSessionCount())
+	}
+	exchange(t, u, smf, associationSetup(6, recovery.Add(time.Minute)))
+	if u.GetSessionCount() != 0 {
+		t.Errorf("sessions after the SMF restarted = %d, want 0", u.GetSessionCount())
+	}
+
+	// Releasing the association releases its sessions
+	exchange(t, u, smf, establishment(7, sessionRules()...))
+	release := exchange(t, u, smf, pfcpmsg.NewAssociationReleaseRequest(8, ie.NewNodeID("127.0.0.1", "", ""))).(*pfcpmsg.AssociationReleaseResponse)
+	if cause := responseCause(t, release.Cause); cause != ie.CauseRequestAccepted || u.GetSessionCount() != 0 {
+		t.Errorf("Association Release = cause %d with %d sessions left", cause, u.GetSessionCount())
+	}
+}
+
+func TestPFCPErrorCauses(t *testing.T) {
+	u, smf := pfcpUPF(t)
+	exchange(t, u, smf, associationSetup(1, time.Now()))
+
+	// Mandatory IEs
+	res := exchange(t, u, smf, establishment(2, sessionRules()[0])).(*pfcpmsg.SessionEstablishmentResponse)
+	if cause := responseCause(t, res.Cause); cause != ie.CauseMandatoryIEMissing || res.OffendingIE == nil {
+		t.Fatalf("establishment without FAR = cause %d, Offending IE %v", cause, res.OffendingIE)
+	}
+	if typ, _ := res.OffendingIE.OffendingIE(); typ != ie.CreateFAR {
+		t.Errorf("Offending IE = %d, want Create FAR", typ)
+	}
+	res = exchange(t, u, smf, establishment(3,
+		ie.NewCreatePDR(ie.NewPDRID(1), ie.NewFARID(1)),
+		sessionRules()[1],
+	)).(*pfcpmsg.SessionEstablishmentResponse)
+	if typ, _ := res.OffendingIE.OffendingIE(); responseCause(t, res.Cause) != ie.CauseMandatoryIEMissing || typ != ie.Precedence {
+		t.Errorf("Create PDR without precedence = cause %d, Offending IE %d", responseCause(t, res.Cause), typ)
+	}
+
+	// Rules referring to missing rules fail with their ID
+	res = exchange(t, u, smf, establishment(4, sessionRules()...)).(*pfcpmsg.SessionEstablishmentResponse)
+	fseid, err := res.UPFSEID.FSEID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mod := exchange(t, u, smf, pfcpmsg.NewSessionModificationRequest(0, 0, fseid.SEID, 5, 0,
+		ie.NewUpdatePDR(ie.NewPDRID(1), ie.NewFARID(9)),
+	)).(*pfcpmsg.SessionModificationResponse)
+	if cause := responseCause(t, mod.Cause); cause != ie.CauseRuleCreationModificationFailure || mod.FailedRuleID == nil {
+		t.Fatalf("modification to an unknown FAR = cause %d, Failed Rule ID %v", cause, mod.FailedRuleID)
+	}
+	if typ, id := failedRuleID(t, mod.FailedRuleID); typ != ie.RuleIDTypePDR || id != 1 {
+		t.Errorf("Failed Rule ID = %d %d, want PDR 1", typ, id)
+	}
+	mod = exchange(t, u, smf, pfcpmsg.NewSessionModificationRequest(0, 0, fseid.SEID, 6, 0,
+		ie.NewRemoveFAR(ie.NewFARID(7)),
+	)).(*pfcpmsg.SessionModificationResponse)
+	if typ, id := failedRuleID(t, mod.FailedRuleID); typ != ie.RuleIDTypeFAR || id != 7 {
+		t.Errorf("Failed Rule ID = %d %d, want FAR 7", typ, id)
+	}
+
+	// Unknown sessions
+	mod = exchange(t, u, smf, pfcpmsg.NewSessionModificationRequest(0, 0, 0xdead, 7, 0)).(*pfcpmsg.SessionModificationResponse)
+	if cause := responseCause(t, mod.Cause); cause != ie.CauseSessionContextNotFound || mod.SEID() != 0 {
+		t.Errorf("modification of an unknown session = cause %d, SEID %d", cause, mod.SEID())
+	}
+}
+
+func TestPFCPRetransmission(t *testing.T) {
+	u, smf := pfcpUPF(t)
+	exchange(t, u, smf, associationSetup(1, time.Now()))
+
+	req := establishment(2, sessionRules()...)
+	first := exchange(t, u, smf, req)
+	second := exchange(t, u, smf, req)
+
+	b1 := make([]byte, first.MarshalLen())
+	first.MarshalTo(b1)
+	b2 := make([]byte, second.MarshalLen())
+	second.MarshalTo(b2)
+	if !bytes.Equal(b1, b2) {
+		t.Errorf("retransmission answered with %x, want the first response %x", b2, b1)
+	}
+	if u.GetSessionCount() != 1 {
+		t.Errorf("sessions = %d, want 1", u.GetSessionCount())
+	}
+
+	// A new sequence number is a new request
+	exchange(t, u, smf, establishment(3, sessionRules()...))
+	if u.GetSessionCount() != 2 {
+		t.Errorf("sessions = %d, want 2", u.GetSessionCount())
+	}
+}
+
+func TestPFCPUnsupportedRequests(t *testing.T) {
+	u, smf := pfcpUPF(t)
+	node := ie.NewNodeID("127.0.0.1", "", "")
+
+	update := exchange(t, u, smf, pfcpmsg.NewAssociationUpdateRequest(1, node)).(*pfcpmsg.AssociationUpdateResponse)
+	if cause := responseCause(t, update.Cause); cause != ie.CauseRequestRejected || update.NodeID == nil {
+		t.Errorf("Association Update = cause %d, Node ID %v", cause, update.NodeID)
+	}
+	report := exchange(t, u, smf, pfcpmsg.NewNodeReportRequest(2, node, ie.NewNodeReportType(0x01))).(*pfcpmsg.NodeReportResponse)
+	if cause := responseCause(t, report.Cause); cause != ie.CauseRequestRejected {
+		t.Errorf("Node Report = cause %d, want Request rejected", cause)
+	}
+	pfd := exchange(t, u, smf, pfcpmsg.NewPFDManagementRequest(3)).(*pfcpmsg.PFDManagementResponse)
+	if cause := responseCause(t, pfd.Cause); cause != ie.CauseServiceNotSupported {
+		t.Errorf("PFD Management = cause %d, want Service not supported", cause)
+	}
+	deletion := exchange(t, u, smf, pfcpmsg.NewSessionSetDeletionRequest(4, node, nil)).(*pfcpmsg.SessionSetDeletionResponse)
+	if cause := responseCause(t, deletion.Cause); cause != ie.CauseServiceNotSupported {
+		t.Errorf("Session Set Deletion = cause %d, want Service not supported", cause)
+	}
+}
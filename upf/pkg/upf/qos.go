@@ -0,0 +1,206 @@
+package upf
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Policing burst: a bucket holds burstDuration worth of its rate, and at
+// least minBurstBytes so full sized packets pass at low rates
+const (
+	burstDuration = 100 * time.Millisecond
+	minBurstBytes = 3000
+)
+
+// PDU Session Container PDU types (TS 38.415 §5.5.2)
+const (
+	pduTypeDL uint8 = 0
+	pduTypeUL uint8 = 1
+)
+
+// QERStats counts the packets a QER let through and dropped
+type QERStats struct {
+	ID            uint32 `json:"id"`
+	PassedPackets uint64 `json:"passed_packets"`
+	PassedBytes   uint64 `json:"passed_bytes"`
+	GateDrops     uint64 `json:"gate_drops"` // packets dropped by a closed gate
+	RateDrops     uint64 `json:"rate_drops"` // packets dropped above the MBR
+	DroppedBytes  uint64 `json:"dropped_bytes"`
+}
+
+// qerMeter polices the traffic of a QER with a token bucket per direction.
+// Meters are kept per QER ID so updating a QER changes its rates without
+// resetting its buckets and counters.
+type qerMeter struct {
+	mu    sync.Mutex
+	ul    tokenBucket
+	dl    tokenBucket
+	stats QERStats
+}
+
+// tokenBucket is filled at the MBR of its direction
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take reports whether a packet of size bytes conforms to a rate in kbps,
+// consuming its tokens when it does
+func (b *tokenBucket) take(kbps uint64, size int, now time.Time) bool {
+	rate := float64(kbps) * 1000 / 8
+	burst := max(rate*burstDuration.Seconds(), minBurstBytes)
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens = min(burst, b.tokens+rate*now.Sub(b.last).Seconds())
+	}
+	b.last = now
+	if b.tokens < float64(size) {
+		return false
+	}
+	b.tokens -= float64(size)
+	return true
+}
+
+// enforceQoS applies the gates and maximum bit rates of the QERs of a
+// matched rule to a packet and reports whether it may be forwarded. QERs
+// without a QFI carry the Session-AMBR, which does not apply to GBR flows.
+func (s *Session) enforceQoS(qers []*QER, uplink bool, size int, now time.Time) bool {
+	gbr := false
+	for _, qer := range qers {
+		if qer.QFI != 0 && (uplink && qer.GBRUL > 0 || !uplink && qer.GBRDL > 0) {
+			gbr = true
+		}
+	}
+
+	for _, qer := range qers {
+		if qer.QFI == 0 && gbr {
+			continue
+		}
+		if !s.meter(qer.ID).police(qer, uplink, size, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// police counts a packet against the gate and MBR of a QER in the packet's
+// direction and reports whether it passes
+func (m *qerMeter) police(qer *QER, uplink bool, size int, now time.Time) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	gate, mbr, bucket := qer.GateDL, qer.MBRDL, &m.dl
+	if uplink {
+		gate, mbr, bucket = qer.GateUL, qer.MBRUL, &m.ul
+	}
+	switch {
+	case gate == GateClosed:
+		m.stats.GateDrops++
+	case mbr > 0 && !bucket.take(mbr, size, now):
+		m.stats.RateDrops++
+	default:
+		m.stats.PassedPackets++
+		m.stats.PassedBytes += uint64(size)
+		return true
+	}
+	m.stats.DroppedBytes += uint64(size)
+	return false
+}
+
+// meter returns the meter of a QER, creating it on first use
+func (s *Session) meter(id uint32) *qerMeter {
+	s.meterMu.Lock()
+	defer s.meterMu.Unlock()
+
+	if s.meters == nil {
+		s.meters = make(map[uint32]*qerMeter)
+	}
+	m, ok := s.meters[id]
+	if !ok {
+		m = &qerMeter{stats: QERStats{ID: id}}
+		s.meters[id] = m
+	}
+	return m
+}
+
+// pruneMeters drops the meters of QERs the session no longer has. The
+// caller holds s.mu.
+func (s *Session) pruneMeters() {
+	s.meterMu.Lock()
+	defer s.meterMu.Unlock()
+
+	for id := range s.meters {
+		if _, ok := s.QERs[id]; !ok {
+			delete(s.meters, id)
+		}
+	}
+}
+
+// QERStats returns the counters of the session's QERs ordered by ID
+func (s *Session) QERStats() []QERStats {
+	s.meterMu.Lock()
+	meters := make([]*qerMeter, 0, len(s.meters))
+	for _, m := range s.meters {
+		meters = append(meters, m)
+	}
+	s.meterMu.Unlock()
+
+	stats := make([]QERStats, 0, len(meters))
+	for _, m := range meters {
+		m.mu.Lock()
+		stats = append(stats, m.stats)
+		m.mu.Unlock()
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return stats
+}
+
+// QFI returns the QoS Flow Identifier the rule's QERs mark packets with, 0
+// when none sets one
+func (r *Rule) QFI() uint8 {
+	for _, qer := range r.QERs {
+		if qer.QFI != 0 {
+			return qer.QFI
+		}
+	}
+	return 0
+}
+
+// setDSCP rewrites the DSCP of an IPv4 or IPv6 packet, keeping its ECN bits
+func setDSCP(b []byte, dscp uint8) {
+	if len(b) == 0 {
+		return
+	}
+	switch b[0] >> 4 {
+	case 4:
+		ihl := int(b[0]&0x0f) * 4
+		if len(b) < 20 || ihl < 20 || len(b) < ihl {
+			return
+		}
+		b[1] = dscp<<2 | b[1]&0x03
+		b[10], b[11] = 0, 0
+		binary.BigEndian.PutUint16(b[10:12], ipv4Checksum(b[:ihl]))
+	case 6:
+		if len(b) < ipv6HeaderLen {
+			return
+		}
+		tc := dscp<<2 | (b[1]>>4)&0x03
+		b[0] = 0x60 | tc>>4
+		b[1] = tc<<4 | b[1]&0x0f
+	}
+}
+
+// ipv4Checksum returns the checksum of an IPv4 header
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i : i+2]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
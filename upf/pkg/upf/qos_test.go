@@ -0,0 +1,100 @@
+package upf
+
+import (
+	"testing"
+	"time"
+
+	gtpv1msg "github.com/wmnsk/go-gtp/gtpv1/message"
+)
+
+func TestEnforceQoSPolicing(t *testing.T) {
+	session := &Session{}
+	// 80 kbps is 10000 bytes/s, the bucket holds the 3000 byte minimum
+	ambr := &QER{ID: 1, MBRUL: 80, MBRDL: 80}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !session.enforceQoS([]*QER{ambr}, true, 1000, now) {
+			t.Fatalf("packet %d within the burst dropped", i)
+		}
+	}
+	if session.enforceQoS([]*QER{ambr}, true, 1000, now) {
+		t.Error("packet above the burst passed")
+	}
+	if !session.enforceQoS([]*QER{ambr}, false, 1000, now) {
+		t.Error("downlink packet dropped by the uplink bucket")
+	}
+	if !session.enforceQoS([]*QER{ambr}, true, 1000, now.Add(100*time.Millisecond)) {
+		t.Error("packet dropped after the bucket refilled")
+	}
+
+	stats := session.QERStats()
+	if len(stats) != 1 || stats[0].PassedPackets != 5 || stats[0].RateDrops != 1 || stats[0].DroppedBytes != 1000 {
+		t.Errorf("QERStats() = %+v, want 5 passed and 1 rate drop", stats)
+	}
+}
+
+func TestEnforceQoSGateAndGBR(t *testing.T) {
+	session := &Session{}
+	ambr := &QER{ID: 1, MBRUL: 8, MBRDL: 8}
+	gated := &QER{ID: 2, QFI: 9, GateUL: GateOpen, GateDL: GateClosed}
+	gbr := &QER{ID: 3, QFI: 1, MBRDL: 8000, GBRDL: 8000}
+	now := time.Now()
+
+	if !session.enforceQoS([]*QER{ambr, gated}, true, 100, now) {
+		t.Error("uplink packet dropped by an open gate")
+	}
+	if session.enforceQoS([]*QER{ambr, gated}, false, 100, now) {
+		t.Error("downlink packet passed a closed gate")
+	}
+
+	// The Session-AMBR of 8 kbps would drop 10 kB at once, the GBR flow is
+	// only bound by its own MBR
+	for i := 0; i < 10; i++ {
+		if !session.enforceQoS([]*QER{ambr, gbr}, false, 1000, now) {
+			t.Fatalf("GBR packet %d dropped", i)
+		}
+	}
+	for _, st := range session.QERStats() {
+		if st.ID == 2 && st.GateDrops != 1 {
+			t.Errorf("QER 2 gate drops = %d, want 1", st.GateDrops)
+		}
+	}
+}
+
+func TestPDUSessionContainer(t *testing.T) {
+	payload := ipv4Packet("8.8.8.8", "10.0.0.1", 17, "downlink")
+	msg, err := gtpv1msg.Parse(appendGPDU(nil, 300, pduTypeDL, 9, payload))
+	if err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	tpdu := msg.(*gtpv1msg.TPDU)
+	if len(tpdu.ExtensionHeaders) != 1 {
+		t.Fatalf("extension headers = %v, want a PDU Session Container", tpdu.ExtensionHeaders)
+	}
+	if c := tpdu.ExtensionHeaders[0].Content; c[0]>>4 != pduTypeDL || c[1]&0x3f != 9 {
+		t.Errorf("PDU Session Container = %x, want DL with QFI 9", c)
+	}
+	if string(tpdu.Decapsulate()) != string(payload) {
+		t.Errorf("payload = %x, want %x", tpdu.Decapsulate(), payload)
+	}
+}
+
+func TestSetDSCP(t *testing.T) {
+	v4 := ipv4Packet("10.0.0.1", "8.8.8.8", 17, "x")
+	v4[1] = 0x01 // ECT(1)
+	setDSCP(v4, 46)
+	if v4[1] != 46<<2|0x01 {
+		t.Errorf("IPv4 TOS = %#02x, want EF with ECN kept", v4[1])
+	}
+	if sum := ipv4Checksum(v4[:20]); sum != 0 {
+		t.Errorf("IPv4 checksum does not verify: %#04x", sum)
+	}
+
+	v6 := make([]byte, ipv6HeaderLen)
+	v6[0], v6[1] = 0x60, 0x1a // ECN 01, flow label nibble 0xa
+	setDSCP(v6, 46)
+	if tc := v6[0]&0x0f<<4 | v6[1]>>4; tc != 46<<2|0x01 || v6[0]>>4 != 6 || v6[1]&0x0f != 0x0a {
+		t.Errorf("IPv6 header = %x, want traffic class EF with ECN and flow label kept", v6[:4])
+	}
+}
@@ -0,0 +1,93 @@
+package upf
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// ICMPv6 messages and options of IPv6 stateless autoconfiguration (RFC 4861)
+const (
+	icmpv6NextHeader            = 58
+	icmpv6RouterSolicitation    = 133
+	icmpv6RouterAdvertisement   = 134
+	ndOptionPrefixInformation   = 3
+	ndOptionMTU                 = 5
+	prefixFlagAutonomous        = 0x40
+	routerAdvertisementLifetime = 1800 // seconds
+	ipv6HeaderLen               = 40
+)
+
+// upfLinkLocal is the link-local address Router Advertisements are sent
+// from. Every PDN connection is its own point-to-point link.
+var upfLinkLocal = net.ParseIP("fe80::1")
+
+// allNodes is the destination of unsolicited Router Advertisements
+var allNodes = net.ParseIP("ff02::1")
+
+// parseRouterSolicitation returns the source of an IPv6 Router
+// Solicitation, reporting whether the packet is one
+func parseRouterSolicitation(b []byte) (net.IP, bool) {
+	if len(b) < ipv6HeaderLen+8 || b[0]>>4 != 6 || b[6] != icmpv6NextHeader {
+		return nil, false
+	}
+	// Neighbour Discovery is only accepted from the link itself
+	if b[7] != 255 || b[ipv6HeaderLen] != icmpv6RouterSolicitation {
+		return nil, false
+	}
+	return net.IP(append([]byte(nil), b[8:24]...)), true
+}
+
+// newRouterAdvertisement builds the Router Advertisement delegating a /64
+// to the UE for SLAAC. The prefix is advertised off-link with the
+// autonomous flag so the UE builds its address from it (TS 29.061
+// §11.2.1.3.4). The MTU option is left out when mtu is 0.
+func newRouterAdvertisement(prefix *net.IPNet, dst net.IP, mtu uint16) []byte {
+	icmp := []byte{
+		icmpv6RouterAdvertisement, 0, 0, 0, // type, code, checksum
+		64, 0, // current hop limit, no managed or other configuration
+	}
+	icmp = binary.BigEndian.AppendUint16(icmp, routerAdvertisementLifetime)
+	icmp = append(icmp, 0, 0, 0, 0, 0, 0, 0, 0) // reachable time, retrans timer
+
+	ones, _ := prefix.Mask.Size()
+	icmp = append(icmp, ndOptionPrefixInformation, 4, uint8(ones), prefixFlagAutonomous)
+	icmp = append(icmp, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff) // valid, preferred lifetime
+	icmp = append(icmp, 0, 0, 0, 0)
+	icmp = append(icmp, prefix.IP.To16()...)
+	if mtu != 0 {
+		icmp = append(icmp, ndOptionMTU, 1, 0, 0)
+		icmp = binary.BigEndian.AppendUint32(icmp, uint32(mtu))
+	}
+
+	pkt := make([]byte, ipv6HeaderLen, ipv6HeaderLen+len(icmp))
+	pkt[0] = 0x60
+	binary.BigEndian.PutUint16(pkt[4:], uint16(len(icmp)))
+	pkt[6] = icmpv6NextHeader
+	pkt[7] = 255
+	copy(pkt[8:24], upfLinkLocal.To16())
+	copy(pkt[24:40], dst.To16())
+	binary.BigEndian.PutUint16(icmp[2:], icmpv6Checksum(upfLinkLocal, dst, icmp))
+	return append(pkt, icmp...)
+}
+
+// icmpv6Checksum computes the checksum of an ICMPv6 message over the IPv6
+// pseudo-header (RFC 8200 §8.1)
+func icmpv6Checksum(src, dst net.IP, msg []byte) uint16 {
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 == 1 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(src.To16())
+	add(dst.To16())
+	sum += uint32(len(msg)) + icmpv6NextHeader
+	add(msg)
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
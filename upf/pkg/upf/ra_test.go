@@ -0,0 +1,109 @@
+package upf
+
+import (
+	"net"
+	"testing"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+func TestRouterAdvertisement(t *testing.T) {
+	_, prefix, _ := net.ParseCIDR("2001:db8:0:1::/64")
+	ue := net.ParseIP("fe80::a:b:c:d")
+	ra := newRouterAdvertisement(prefix, ue, 1400)
+
+	if len(ra) != ipv6HeaderLen+16+32+8 {
+		t.Fatalf("len(ra) = %d, want %d", len(ra), ipv6HeaderLen+16+32+8)
+	}
+	if ra[6] != icmpv6NextHeader || ra[7] != 255 || !net.IP(ra[24:40]).Equal(ue) {
+		t.Errorf("IPv6 header = %x", ra[:ipv6HeaderLen])
+	}
+	icmp := ra[ipv6HeaderLen:]
+	if icmp[0] != icmpv6RouterAdvertisement {
+		t.Errorf("ICMPv6 type = %d, want %d", icmp[0], icmpv6RouterAdvertisement)
+	}
+	if sum := icmpv6Checksum(upfLinkLocal, ue, icmp); sum != 0 {
+		t.Errorf("checksum does not verify: %#04x", sum)
+	}
+	opt := icmp[16:]
+	if opt[0] != ndOptionPrefixInformation || opt[2] != 64 || opt[3] != prefixFlagAutonomous ||
+		!net.IP(opt[16:32]).Equal(prefix.IP) {
+		t.Errorf("prefix information = %x", opt[:32])
+	}
+	if mtu := icmp[48:]; mtu[0] != ndOptionMTU || mtu[6] != 0x05 || mtu[7] != 0x78 {
+		t.Errorf("MTU option = %x", mtu)
+	}
+
+	// A solicitation from the UE is recognized, the advertisement is not
+	rs := append([]byte(nil), ra...)
+	copy(rs[8:24], ue.To16())
+	rs[ipv6HeaderLen] = icmpv6RouterSolicitation
+	if src, ok := parseRouterSolicitation(rs); !ok || !src.Equal(ue) {
+		t.Errorf("parseRouterSolicitation() = %s, %v, want %s, true", src, ok, ue)
+	}
+	if _, ok := parseRouterSolicitation(ra); ok {
+		t.Error("parseRouterSolicitation() accepted a Router Advertisement")
+	}
+}
+
+func TestSessionMatchDualStack(t *testing.T) {
+	pdrs := []*ie.IE{
+		ie.NewCreatePDR(ie.NewPDRID(1), ie.NewPrecedence(255), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceAccess),
+			ie.NewFTEID(0x01, 100, net.ParseIP("192.0.2.1"), nil, 0),
+			ie.NewUEIPAddress(0x43, "10.0.0.1", "2001:db8:0:1::5", 0, 64),
+		), ie.NewFARID(1)),
+		ie.NewCreatePDR(ie.NewPDRID(2), ie.NewPrecedence(255), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceCore),
+			ie.NewUEIPAddress(0x47, "10.0.0.1", "2001:db8:0:1::5", 0, 64),
+		), ie.NewFARID(2)),
+	}
+	fars := []*ie.IE{
+		ie.NewCreateFAR(ie.NewFARID(1), ie.NewApplyAction(ApplyActionFORW), ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceCore),
+		)),
+		ie.NewCreateFAR(ie.NewFARID(2), ie.NewApplyAction(ApplyActionFORW), ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceAccess),
+			ie.NewOuterHeaderCreation(0x0100, 300, "192.0.2.9", "", 0, 0, 0),
+		)),
+	}
+
+	u := &UPF{sessions: make(map[uint64]*Session)}
+	session := &Session{}
+	if err := u.createRules(session, pdrs, fars, nil, nil); err != nil {
+		t.Fatalf("createRules() error = %v", err)
+	}
+	if session.UEPrefix.String() != "2001:db8:0:1::/64" {
+		t.Fatalf("session prefix = %s, want 2001:db8:0:1::/64", session.UEPrefix)
+	}
+	if tunnel := session.downlinkTunnel(); tunnel == nil || tunnel.TEID != 300 {
+		t.Errorf("downlinkTunnel() = %+v, want TEID 300", tunnel)
+	}
+
+	tests := []struct {
+		name    string
+		pkt     *Packet
+		wantPDR uint16
+	}{
+		{"uplink IPv4", &Packet{SourceInterface: ie.SrcInterfaceAccess, TEID: 100,
+			Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("8.8.8.8")}, 1},
+		{"uplink SLAAC address", &Packet{SourceInterface: ie.SrcInterfaceAccess, TEID: 100,
+			Src: net.ParseIP("2001:db8:0:1:1234::1"), Dst: net.ParseIP("2001:4860::8888")}, 1},
+		{"downlink IPv6", &Packet{SourceInterface: ie.SrcInterfaceCore,
+			Src: net.ParseIP("2001:4860::8888"), Dst: net.ParseIP("2001:db8:0:1::77")}, 2},
+		{"downlink other prefix", &Packet{SourceInterface: ie.SrcInterfaceCore,
+			Src: net.ParseIP("2001:4860::8888"), Dst: net.ParseIP("2001:db8:0:2::77")}, 0},
+		{"downlink other IPv4", &Packet{SourceInterface: ie.SrcInterfaceCore,
+			Src: net.ParseIP("8.8.8.8"), Dst: net.ParseIP("10.0.0.2")}, 0},
+	}
+	for _, tt := range tests {
+		pdr, _ := session.Match(tt.pkt)
+		var got uint16
+		if pdr != nil {
+			got = pdr.ID
+		}
+		if got != tt.wantPDR {
+			t.Errorf("%s: Match() = PDR %d, want %d", tt.name, got, tt.wantPDR)
+		}
+	}
+}
@@ -0,0 +1,631 @@
+package upf
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// Apply Action flags (TS 29.244 §8.2.26)
+const (
+	ApplyActionDROP uint8 = 0x01
+	ApplyActionFORW uint8 = 0x02
+	ApplyActionBUFF uint8 = 0x04
+	ApplyActionNOCP uint8 = 0x08
+	ApplyActionDUPL uint8 = 0x10
+)
+
+// PDR is a Packet Detection Rule of a session
+type PDR struct {
+	ID              uint16
+	Precedence      uint32
+	SourceInterface uint8
+
+	// Local F-TEID the traffic arrives on, 0 when the PDI has none.
+	// ChooseTEID asks the UPF to allocate it, PDRs with the same non-zero
+	// ChooseID share the allocated F-TEID.
+	TEID       uint32
+	TEIDAddr   net.IP
+	ChooseTEID bool
+	ChooseID   uint8
+	// UE address, matched against the destination when UEIPIsDestination is
+	// set. IPv6 sessions are matched on the prefix delegated to the UE.
+	UEIP              net.IP
+	UEPrefix          *net.IPNet
+	UEIPIsDestination bool
+	ChooseUEIPv4      bool
+	ChooseUEIPv6      bool
+
+	SDFFilters []*SDFFilter
+	AppID      string
+
+	OuterHeaderRemoval bool
+	FARID              uint32
+	QERIDs             []uint32
+	URRIDs             []uint32
+}
+
+// FAR is a Forwarding Action Rule of a session
+type FAR struct {
+	ID                   uint32
+	ApplyAction          uint8
+	DestinationInterface uint8
+	NetworkInstance      string
+
+	// OuterHeader is the GTP-U tunnel to forward into, nil to forward the
+	// inner packet. A FAR towards Core with an outer header chains the
+	// session to another UPF over N9.
+	OuterHeader *OuterHeader
+
+	// Duplicates are where DUPL copies the forwarded packets
+	Duplicates []*Duplicate
+}
+
+// OuterHeader is the GTP-U encapsulation added by a FAR
+type OuterHeader struct {
+	TEID uint32
+	Addr net.IP
+}
+
+// Gate Status values (TS 29.244 §8.2.7)
+const (
+	GateOpen   uint8 = 0
+	GateClosed uint8 = 1
+)
+
+// QER is a QoS Enforcement Rule of a session. Bit rates are in kbps, 0 when
+// not enforced.
+type QER struct {
+	ID     uint32
+	QFI    uint8
+	GateUL uint8
+	GateDL uint8
+	MBRUL  uint64
+	MBRDL  uint64
+	GBRUL  uint64
+	GBRDL  uint64
+}
+
+// URR is a Usage Reporting Rule of a session
+type URR struct {
+	ID                uint32
+	MeasurementMethod uint8  // DURAT 0x01, VOLUM 0x02, EVENT 0x04
+	ReportingTriggers []byte // octets 5 and 6 of the Reporting Triggers IE
+
+	VolumeThreshold   uint64 // total bytes
+	VolumeQuota       uint64
+	TimeThreshold     time.Duration
+	TimeQuota         time.Duration
+	QuotaHoldingTime  time.Duration
+	MeasurementPeriod time.Duration
+}
+
+// Rule is what applies to a packet: the matching PDR and the FAR, QERs and
+// URRs it refers to
+type Rule struct {
+	PDR  *PDR
+	FAR  *FAR
+	QERs []*QER
+	URRs []*URR
+}
+
+// Packet holds the fields rules are matched on
+type Packet struct {
+	SourceInterface uint8
+	TEID            uint32 // GTP-U TEID the packet was received on, 0 for N6
+	Src             net.IP
+	Dst             net.IP
+	Protocol        uint8
+	SrcPort         uint16 // 0 unless the protocol has ports
+	DstPort         uint16
+	// AppID is the application the packet is known to belong to. Otherwise
+	// PDRs match it against the definitions of their application.
+	AppID string
+	apps  *appTable
+	dns   *sessionDNS // what the packet's session learnt from DNS
+}
+
+// parseCreatePDR converts a Create PDR IE into a PDR
+func parseCreatePDR(i *ie.IE) (*PDR, error) {
+	children, err := i.CreatePDR()
+	if err != nil {
+		return nil, err
+	}
+	if err := requireIEs(children, ie.PDRID, ie.Precedence, ie.PDI); err != nil {
+		return nil, fmt.Errorf("invalid Create PDR: %w", err)
+	}
+
+	pdr := &PDR{}
+	if err := applyPDR(children, pdr); err != nil {
+		return nil, failedRule(ie.RuleIDTypePDR, uint32(pdr.ID), fmt.Errorf("invalid Create PDR: %w", err))
+	}
+	return pdr, nil
+}
+
+// applyPDR sets the fields of a PDR from the children of a Create PDR or
+// Update PDR IE. A PDI replaces the previous one, QER and URR IDs replace
+// the previous lists.
+func applyPDR(children []*ie.IE, pdr *PDR) error {
+	var qerIDs, urrIDs []uint32
+	for _, c := range children {
+		var err error
+		switch c.Type {
+		case ie.PDRID:
+			pdr.ID, err = c.PDRID()
+		case ie.Precedence:
+			pdr.Precedence, err = c.Precedence()
+		case ie.FARID:
+			pdr.FARID, err = c.FARID()
+		case ie.QERID:
+			var id uint32
+			if id, err = c.QERID(); err == nil {
+				qerIDs = append(qerIDs, id)
+			}
+		case ie.URRID:
+			var id uint32
+			if id, err = c.URRID(); err == nil {
+				urrIDs = append(urrIDs, id)
+			}
+		case ie.OuterHeaderRemoval:
+			pdr.OuterHeaderRemoval = true
+		case ie.PDI:
+			pdr.TEID, pdr.TEIDAddr, pdr.ChooseTEID, pdr.ChooseID = 0, nil, false, 0
+			pdr.UEIP, pdr.UEPrefix, pdr.UEIPIsDestination = nil, nil, false
+			pdr.ChooseUEIPv4, pdr.ChooseUEIPv6 = false, false
+			pdr.SDFFilters, pdr.AppID = nil, ""
+			err = parsePDI(c, pdr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if qerIDs != nil {
+		pdr.QERIDs = qerIDs
+	}
+	if urrIDs != nil {
+		pdr.URRIDs = urrIDs
+	}
+	return nil
+}
+
+// parsePDI fills the Packet Detection Information of a PDR
+func parsePDI(i *ie.IE, pdr *PDR) error {
+	children, err := i.PDI()
+	if err != nil {
+		return err
+	}
+	for _, c := range children {
+		switch c.Type {
+		case ie.SourceInterface:
+			pdr.SourceInterface, err = c.SourceInterface()
+		case ie.FTEID:
+			var fteid *ie.FTEIDFields
+			if fteid, err = c.FTEID(); err == nil {
+				pdr.TEID = fteid.TEID
+				pdr.TEIDAddr = fteid.IPv4Address
+				if pdr.TEIDAddr == nil {
+					pdr.TEIDAddr = fteid.IPv6Address
+				}
+				pdr.ChooseTEID = fteid.HasCh()
+				if fteid.HasChID() {
+					pdr.ChooseID = fteid.ChooseID
+				}
+			}
+		case ie.UEIPAddress:
+			var ueip *ie.UEIPAddressFields
+			if ueip, err = c.UEIPAddress(); err == nil {
+				pdr.UEIP = ueip.IPv4Address
+				pdr.UEPrefix = uePrefix(ueip)
+				pdr.UEIPIsDestination = c.HasSD()
+				pdr.ChooseUEIPv4 = c.HasCHV4()
+				pdr.ChooseUEIPv6 = c.HasCHV6()
+			}
+		case ie.SDFFilter:
+			var sdf *ie.SDFFilterFields
+			if sdf, err = c.SDFFilter(); err == nil && sdf.FlowDescription != "" {
+				var filter *SDFFilter
+				if filter, err = ParseFlowDescription(sdf.FlowDescription); err == nil {
+					pdr.SDFFilters = append(pdr.SDFFilters, filter)
+				}
+			}
+		case ie.ApplicationID:
+			pdr.AppID, err = c.ApplicationID()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// uePrefix returns the IPv6 prefix of a UE IP Address IE, a /64 unless
+// the IE carries a prefix length
+func uePrefix(ueip *ie.UEIPAddressFields) *net.IPNet {
+	if ueip.IPv6Address == nil {
+		return nil
+	}
+	length := 64
+	if ueip.Flags&0x40 != 0 && ueip.IPv6PrefixLength != 0 {
+		length = int(ueip.IPv6PrefixLength)
+	}
+	mask := net.CIDRMask(length, 128)
+	return &net.IPNet{IP: ueip.IPv6Address.Mask(mask), Mask: mask}
+}
+
+// parseCreateFAR converts a Create FAR IE into a FAR
+func parseCreateFAR(i *ie.IE) (*FAR, error) {
+	children, err := i.CreateFAR()
+	if err != nil {
+		return nil, err
+	}
+	if err := requireIEs(children, ie.FARID, ie.ApplyAction); err != nil {
+		return nil, fmt.Errorf("invalid Create FAR: %w", err)
+	}
+
+	far := &FAR{}
+	for _, c := range children {
+		switch c.Type {
+		case ie.FARID:
+			far.ID, err = c.FARID()
+		case ie.ApplyAction:
+			var flags []byte
+			if flags, err = c.ApplyAction(); err == nil && len(flags) > 0 {
+				far.ApplyAction = flags[0]
+			}
+		case ie.ForwardingParameters:
+			var params []*ie.IE
+			if params, err = c.ForwardingParameters(); err == nil {
+				err = applyForwardingParameters(params, far)
+			}
+		case ie.DuplicatingParameters:
+			var params []*ie.IE
+			if params, err = c.DuplicatingParameters(); err == nil {
+				var d *Duplicate
+				if d, err = parseDuplicatingParameters(params); err == nil {
+					far.Duplicates = append(far.Duplicates, d)
+				}
+			}
+		}
+		if err != nil {
+			return nil, failedRule(ie.RuleIDTypeFAR, far.ID, fmt.Errorf("invalid Create FAR: %w", err))
+		}
+	}
+	if far.ApplyAction&ApplyActionDUPL == 0 {
+		far.Duplicates = nil
+	}
+	return far, nil
+}
+
+// applyForwardingParameters sets the forwarding target of a FAR from the
+// children of a Forwarding Parameters or Update Forwarding Parameters IE
+func applyForwardingParameters(children []*ie.IE, far *FAR) error {
+	var err error
+	for _, c := range children {
+		switch c.Type {
+		case ie.DestinationInterface:
+			far.DestinationInterface, err = c.DestinationInterface()
+		case ie.NetworkInstance:
+			far.NetworkInstance, err = c.NetworkInstance()
+		case ie.OuterHeaderCreation:
+			var ohc *ie.OuterHeaderCreationFields
+			if ohc, err = c.OuterHeaderCreation(); err == nil {
+				far.OuterHeader = &OuterHeader{TEID: ohc.TEID, Addr: ohc.IPv4Address}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyUpdateFARChildren sets the fields of a FAR from the children of an
+// Update FAR IE. Update Duplicating Parameters replace all the duplicates of
+// the FAR, which are dropped once the Apply Action no longer duplicates.
+func applyUpdateFARChildren(children []*ie.IE, far *FAR) error {
+	var err error
+	var dups []*Duplicate
+	for _, c := range children {
+		switch c.Type {
+		case ie.ApplyAction:
+			var flags []byte
+			if flags, err = c.ApplyAction(); err == nil && len(flags) > 0 {
+				far.ApplyAction = flags[0]
+			}
+		case ie.UpdateForwardingParameters:
+			var params []*ie.IE
+			if params, err = c.UpdateForwardingParameters(); err == nil {
+				err = applyForwardingParameters(params, far)
+			}
+		case ie.UpdateDuplicatingParameters:
+			var params []*ie.IE
+			if params, err = c.UpdateDuplicatingParameters(); err == nil {
+				var d *Duplicate
+				if d, err = parseDuplicatingParameters(params); err == nil {
+					dups = append(dups, d)
+				}
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if dups != nil {
+		far.Duplicates = dups
+	}
+	if far.ApplyAction&ApplyActionDUPL == 0 {
+		far.Duplicates = nil
+	}
+	return nil
+}
+
+// parseCreateQER converts a Create QER IE into a QER
+func parseCreateQER(i *ie.IE) (*QER, error) {
+	children, err := i.CreateQER()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := requireIEs(children, ie.QERID, ie.GateStatus); err != nil {
+		return nil, fmt.Errorf("invalid Create QER: %w", err)
+	}
+
+	qer := &QER{}
+	if err := applyQER(children, qer); err != nil {
+		return nil, failedRule(ie.RuleIDTypeQER, qer.ID, fmt.Errorf("invalid Create QER: %w", err))
+	}
+	return qer, nil
+}
+
+// applyQER sets the fields of a QER from the children of a Create QER or
+// Update QER IE
+func applyQER(children []*ie.IE, qer *QER) error {
+	var err error
+	for _, c := range children {
+		switch c.Type {
+		case ie.QERID:
+			qer.ID, err = c.QERID()
+		case ie.QFI:
+			qer.QFI, err = c.QFI()
+		case ie.GateStatus:
+			qer.GateUL, qer.GateDL, err = c.GateStatusULDL()
+		case ie.MBR:
+			if qer.MBRUL, err = c.MBRUL(); err == nil {
+				qer.MBRDL, err = c.MBRDL()
+			}
+		case ie.GBR:
+			if qer.GBRUL, err = c.GBRUL(); err == nil {
+				qer.GBRDL, err = c.GBRDL()
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseCreateURR converts a Create URR IE into a URR
+func parseCreateURR(i *ie.IE) (*URR, error) {
+	children, err := i.CreateURR()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := requireIEs(children, ie.URRID, ie.MeasurementMethod, ie.ReportingTriggers); err != nil {
+		return nil, fmt.Errorf("invalid Create URR: %w", err)
+	}
+
+	urr := &URR{}
+	if err := applyURR(children, urr); err != nil {
+		return nil, failedRule(ie.RuleIDTypeURR, urr.ID, fmt.Errorf("invalid Create URR: %w", err))
+	}
+	return urr, nil
+}
+
+// applyURR sets the fields of a URR from the children of a Create URR or
+// Update URR IE
+func applyURR(children []*ie.IE, urr *URR) error {
+	var err error
+	for _, c := range children {
+		switch c.Type {
+		case ie.URRID:
+			urr.ID, err = c.URRID()
+		case ie.MeasurementMethod:
+			urr.MeasurementMethod, err = c.MeasurementMethod()
+		case ie.ReportingTriggers:
+			var triggers []byte
+			if triggers, err = c.ReportingTriggers(); err == nil {
+				urr.ReportingTriggers = append([]byte(nil), triggers...)
+			}
+		case ie.VolumeThreshold:
+			var vol *ie.VolumeThresholdFields
+			if vol, err = c.VolumeThreshold(); err == nil {
+				urr.VolumeThreshold = vol.TotalVolume
+			}
+		case ie.VolumeQuota:
+			var vol *ie.VolumeQuotaFields
+			if vol, err = c.VolumeQuota(); err == nil {
+				urr.VolumeQuota = vol.TotalVolume
+			}
+		case ie.TimeThreshold:
+			urr.TimeThreshold, err = c.TimeThreshold()
+		case ie.TimeQuota:
+			urr.TimeQuota, err = c.TimeQuota()
+		case ie.QuotaHoldingTime:
+			urr.QuotaHoldingTime, err = c.QuotaHoldingTime()
+		case ie.MeasurementPeriod:
+			urr.MeasurementPeriod, err = c.MeasurementPeriod()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// installRules replaces the session's rules, keeping PDRs in precedence order
+func (s *Session) installRules(pdrs []*PDR, fars []*FAR, qers []*QER, urrs []*URR) error {
+	farsByID := make(map[uint32]*FAR, len(fars))
+	for _, far := range fars {
+		farsByID[far.ID] = far
+	}
+	qersByID := make(map[uint32]*QER, len(qers))
+	for _, qer := range qers {
+		qersByID[qer.ID] = qer
+	}
+	urrsByID := make(map[uint32]*URR, len(urrs))
+	for _, urr := range urrs {
+		urrsByID[urr.ID] = urr
+	}
+	if err := checkReferences(pdrs, farsByID, qersByID, urrsByID); err != nil {
+		return err
+	}
+	sortPDRs(pdrs)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.PDRs = pdrs
+	s.FARs = farsByID
+	s.QERs = qersByID
+	s.URRs = urrsByID
+	return nil
+}
+
+// checkReferences verifies that every rule a PDR refers to exists
+func checkReferences(pdrs []*PDR, fars map[uint32]*FAR, qers map[uint32]*QER, urrs map[uint32]*URR) error {
+	for _, pdr := range pdrs {
+		if _, ok := fars[pdr.FARID]; !ok {
+			return failedRule(ie.RuleIDTypePDR, uint32(pdr.ID), fmt.Errorf("PDR %d references unknown FAR %d", pdr.ID, pdr.FARID))
+		}
+		for _, id := range pdr.QERIDs {
+			if _, ok := qers[id]; !ok {
+				return failedRule(ie.RuleIDTypePDR, uint32(pdr.ID), fmt.Errorf("PDR %d references unknown QER %d", pdr.ID, id))
+			}
+		}
+		for _, id := range pdr.URRIDs {
+			if _, ok := urrs[id]; !ok {
+				return failedRule(ie.RuleIDTypePDR, uint32(pdr.ID), fmt.Errorf("PDR %d references unknown URR %d", pdr.ID, id))
+			}
+		}
+	}
+	return nil
+}
+
+// sortPDRs orders PDRs by precedence, lowest value first
+func sortPDRs(pdrs []*PDR) {
+	sort.SliceStable(pdrs, func(i, j int) bool {
+		return pdrs[i].Precedence < pdrs[j].Precedence
+	})
+}
+
+// Match returns the highest precedence PDR matching the packet and its FAR
+func (s *Session) Match(p *Packet) (*PDR, *FAR) {
+	r := s.Classify(p)
+	if r == nil {
+		return nil, nil
+	}
+	return r.PDR, r.FAR
+}
+
+// Classify returns the rule of the highest precedence PDR matching the
+// packet, nil when none matches
+func (s *Session) Classify(p *Packet) *Rule {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, pdr := range s.PDRs {
+		if !pdr.matches(p) {
+			continue
+		}
+		r := &Rule{PDR: pdr, FAR: s.FARs[pdr.FARID]}
+		for _, id := range pdr.QERIDs {
+			r.QERs = append(r.QERs, s.QERs[id])
+		}
+		for _, id := range pdr.URRIDs {
+			r.URRs = append(r.URRs, s.URRs[id])
+		}
+		return r
+	}
+	return nil
+}
+
+// matches reports whether the packet satisfies the PDR's PDI
+func (pdr *PDR) matches(p *Packet) bool {
+	if pdr.SourceInterface != p.SourceInterface {
+		return false
+	}
+	if pdr.TEID != 0 && pdr.TEID != p.TEID {
+		return false
+	}
+
+	// Uplink packets come from the UE, downlink packets go to it
+	ue, remote := p.Src, p.Dst
+	uePort, remotePort := p.SrcPort, p.DstPort
+	if p.SourceInterface != ie.SrcInterfaceAccess {
+		ue, remote = p.Dst, p.Src
+		uePort, remotePort = p.DstPort, p.SrcPort
+	}
+	if !pdr.matchesUE(ue) {
+		return false
+	}
+	if pdr.AppID != "" && pdr.AppID != p.AppID &&
+		!p.apps.match(pdr.AppID, p.dns, p.Protocol, remote, ue, remotePort, uePort) {
+		return false
+	}
+	if len(pdr.SDFFilters) == 0 {
+		return true
+	}
+	for _, f := range pdr.SDFFilters {
+		if f.Match(p.Protocol, remote, ue, remotePort, uePort) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesUE reports whether an address belongs to the UE of the PDR. PDRs
+// of dual-stack sessions match either address family.
+func (pdr *PDR) matchesUE(ip net.IP) bool {
+	if pdr.UEIP == nil && pdr.UEPrefix == nil {
+		return true
+	}
+	if ip.To4() != nil {
+		return pdr.UEIP != nil && pdr.UEIP.Equal(ip)
+	}
+	return pdr.UEPrefix != nil && pdr.UEPrefix.Contains(ip)
+}
+
+// learnAddresses records the UE address and access TEID of the session from
+// its PDRs, keeping those already known
+func (s *Session) learnAddresses(pdrs []*PDR) {
+	for _, pdr := range pdrs {
+		if pdr.SourceInterface == ie.SrcInterfaceAccess && s.TEID == 0 {
+			s.TEID = pdr.TEID
+		}
+		if s.UEIP == nil {
+			s.UEIP = pdr.UEIP
+		}
+		if s.UEPrefix == nil {
+			s.UEPrefix = pdr.UEPrefix
+		}
+	}
+}
+
+// downlinkTunnel returns the access tunnel downlink traffic of the session
+// is sent into, nil while the access side is unknown
+func (s *Session) downlinkTunnel() *OuterHeader {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, far := range s.FARs {
+		if far.DestinationInterface == ie.DstInterfaceAccess && far.OuterHeader != nil &&
+			far.ApplyAction&ApplyActionFORW != 0 {
+			return far.OuterHeader
+		}
+	}
+	return nil
+}
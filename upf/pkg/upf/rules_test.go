@@ -0,0 +1,204 @@
+package upf
+
+import (
+	"net"
+	"testing"
+
+	"github.com/wmnsk/go-pfcp/ie"
+	pfcpmsg "github.com/wmnsk/go-pfcp/message"
+)
+
+// classifierSession installs the rules an SMF pushes to an uplink classifier
+// with a local breakout for 10.100.0.0/16 and a default PSA over N9
+func classifierSession(t *testing.T) *Session {
+	t.Helper()
+
+	accessPDI := func(extra ...*ie.IE) *ie.IE {
+		return ie.NewPDI(append([]*ie.IE{
+			ie.NewSourceInterface(ie.SrcInterfaceAccess),
+			ie.NewFTEID(0x01, 100, net.ParseIP("192.0.2.1"), nil, 0),
+			ie.NewUEIPAddress(0x02, "10.0.0.1", "", 0, 0),
+		}, extra...)...)
+	}
+	pdrs := []*ie.IE{
+		ie.NewCreatePDR(ie.NewPDRID(1), ie.NewPrecedence(255), accessPDI(), ie.NewOuterHeaderRemoval(0, 0), ie.NewFARID(10)),
+		ie.NewCreatePDR(ie.NewPDRID(10), ie.NewPrecedence(100),
+			accessPDI(ie.NewSDFFilter("permit out ip from 10.100.0.0/16 to assigned", "", "", "", 0)),
+			ie.NewOuterHeaderRemoval(0, 0), ie.NewFARID(11)),
+		ie.NewCreatePDR(ie.NewPDRID(11), ie.NewPrecedence(101),
+			accessPDI(ie.NewApplicationID("video-cache")),
+			ie.NewOuterHeaderRemoval(0, 0), ie.NewFARID(11)),
+	}
+	fars := []*ie.IE{
+		ie.NewCreateFAR(ie.NewFARID(10), ie.NewApplyAction(ApplyActionFORW), ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceCore),
+			ie.NewOuterHeaderCreation(0x0100, 200, "192.0.2.2", "", 0, 0, 0),
+		)),
+		ie.NewCreateFAR(ie.NewFARID(11), ie.NewApplyAction(ApplyActionFORW), ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceCore),
+			ie.NewNetworkInstance("internet"),
+		)),
+	}
+
+	u := &UPF{sessions: make(map[uint64]*Session)}
+	session := &Session{}
+	if err := u.createRules(session, pdrs, fars, nil, nil); err != nil {
+		t.Fatalf("createRules() error = %v", err)
+	}
+	return session
+}
+
+func TestSessionMatchULCL(t *testing.T) {
+	session := classifierSession(t)
+	if session.TEID != 100 || !session.UEIP.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("session TEID/UEIP = %d/%s, want 100/10.0.0.1", session.TEID, session.UEIP)
+	}
+
+	uplink := func(dst, app string) *Packet {
+		return &Packet{
+			SourceInterface: ie.SrcInterfaceAccess,
+			TEID:            100,
+			Src:             net.ParseIP("10.0.0.1"),
+			Dst:             net.ParseIP(dst),
+			AppID:           app,
+		}
+	}
+	tests := []struct {
+		name    string
+		packet  *Packet
+		wantPDR uint16
+		wantN9  bool
+	}{
+		{"local breakout by prefix", uplink("10.100.1.1", ""), 10, false},
+		{"local breakout by application", uplink("8.8.8.8", "video-cache"), 11, false},
+		{"default PSA over N9", uplink("8.8.8.8", ""), 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pdr, far := session.Match(tt.packet)
+			if pdr == nil || far == nil {
+				t.Fatal("Match() found no rule")
+			}
+			if pdr.ID != tt.wantPDR {
+				t.Errorf("Match() PDR = %d, want %d", pdr.ID, tt.wantPDR)
+			}
+			if got := far.OuterHeader != nil; got != tt.wantN9 {
+				t.Errorf("Match() FAR %d chained over N9 = %v, want %v", far.ID, got, tt.wantN9)
+			}
+		})
+	}
+
+	// Traffic on another tunnel is not matched
+	other := uplink("8.8.8.8", "")
+	other.TEID = 101
+	if pdr, _ := session.Match(other); pdr != nil {
+		t.Errorf("Match() on unknown TEID = PDR %d, want none", pdr.ID)
+	}
+}
+
+func TestSessionModifyRules(t *testing.T) {
+	session := classifierSession(t)
+
+	modify := func(ies ...*ie.IE) error {
+		_, err := session.modifyRules(pfcpmsg.NewSessionModificationRequest(0, 0, 1, 1, 0, ies...), nil)
+		return err
+	}
+	err := modify(
+		ie.NewRemovePDR(ie.NewPDRID(11)),
+		ie.NewCreateQER(ie.NewQERID(1), ie.NewQFI(9), ie.NewGateStatus(GateOpen, GateClosed), ie.NewMBR(10000, 50000)),
+		ie.NewCreateURR(ie.NewURRID(1), ie.NewMeasurementMethod(0, 1, 0), ie.NewReportingTriggers(0x01, 0x00),
+			ie.NewVolumeQuota(0x01, 1000000, 0, 0)),
+		ie.NewUpdatePDR(ie.NewPDRID(1), ie.NewQERID(1), ie.NewURRID(1)),
+		ie.NewUpdateFAR(ie.NewFARID(11), ie.NewApplyAction(ApplyActionDROP)),
+	)
+	if err != nil {
+		t.Fatalf("modifyRules() error = %v", err)
+	}
+
+	rule := session.Classify(&Packet{SourceInterface: ie.SrcInterfaceAccess, TEID: 100,
+		Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("8.8.8.8"), AppID: "video-cache"})
+	if rule == nil || rule.PDR.ID != 1 {
+		t.Fatalf("Classify() = %+v, want PDR 1 once PDR 11 is removed", rule)
+	}
+	if len(rule.QERs) != 1 || rule.QERs[0].QFI != 9 || rule.QERs[0].GateDL != GateClosed || rule.QERs[0].MBRDL != 50000 {
+		t.Errorf("Classify() QERs = %+v", rule.QERs)
+	}
+	if len(rule.URRs) != 1 || rule.URRs[0].VolumeQuota != 1000000 || rule.URRs[0].MeasurementMethod != 0x02 {
+		t.Errorf("Classify() URRs = %+v", rule.URRs)
+	}
+	if _, far := session.Match(&Packet{SourceInterface: ie.SrcInterfaceAccess, TEID: 100,
+		Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("10.100.0.1")}); far == nil || far.ApplyAction != ApplyActionDROP {
+		t.Errorf("Match() FAR = %+v, want the updated DROP FAR", far)
+	}
+
+	// A request that leaves a dangling reference changes nothing
+	if err := modify(ie.NewRemoveQER(ie.NewQERID(1))); err == nil {
+		t.Error("modifyRules() removing a referenced QER error = nil")
+	}
+	if err := modify(ie.NewRemovePDR(ie.NewPDRID(10)), ie.NewUpdateURR(ie.NewURRID(7))); err == nil {
+		t.Error("modifyRules() updating an unknown URR error = nil")
+	}
+	if len(session.PDRs) != 2 || len(session.QERs) != 1 {
+		t.Errorf("session has %d PDRs and %d QERs after failed requests, want 2 and 1", len(session.PDRs), len(session.QERs))
+	}
+}
+
+func TestParseFlowDescription(t *testing.T) {
+	f, err := ParseFlowDescription("permit out 17 from 192.0.2.0/24 to assigned")
+	if err != nil {
+		t.Fatalf("ParseFlowDescription() error = %v", err)
+	}
+	if !f.Match(17, net.ParseIP("192.0.2.7"), net.ParseIP("10.0.0.1"), 53, 1024) {
+		t.Error("Match() = false for UDP from 192.0.2.7")
+	}
+	if f.Match(6, net.ParseIP("192.0.2.7"), net.ParseIP("10.0.0.1"), 53, 1024) {
+		t.Error("Match() = true for TCP")
+	}
+
+	if _, err := ParseFlowDescription("deny in ip from any to any"); err == nil {
+		t.Error("ParseFlowDescription(deny) error = nil")
+	}
+}
+
+func TestFlowDescriptionPorts(t *testing.T) {
+	f, err := ParseFlowDescription("permit out tcp from 192.0.2.0/24 80,443,8000-8080 to assigned 1024-65535")
+	if err != nil {
+		t.Fatalf("ParseFlowDescription() error = %v", err)
+	}
+	remote, ue := net.ParseIP("192.0.2.7"), net.ParseIP("10.0.0.1")
+	for _, tc := range []struct {
+		protocol           uint8
+		remotePort, uePort uint16
+		want               bool
+	}{
+		{6, 443, 40000, true},
+		{6, 8080, 1024, true},
+		{6, 8081, 40000, false},
+		{6, 443, 1023, false},
+		{17, 443, 40000, false},
+	} {
+		if got := f.Match(tc.protocol, remote, ue, tc.remotePort, tc.uePort); got != tc.want {
+			t.Errorf("Match(%d, %d, %d) = %v, want %v", tc.protocol, tc.remotePort, tc.uePort, got, tc.want)
+		}
+	}
+
+	// Ports with any protocol only match protocols with ports
+	f, err = ParseFlowDescription("permit out ip from any 53 to assigned")
+	if err != nil {
+		t.Fatalf("ParseFlowDescription() error = %v", err)
+	}
+	if !f.Match(17, remote, ue, 53, 40000) || f.Match(1, remote, ue, 0, 0) {
+		t.Error("port 53 of any protocol matches ICMP or misses UDP")
+	}
+
+	for _, fd := range []string{
+		"permit out icmp from any 80 to assigned",
+		"permit out tcp from any 80-70 to assigned",
+		"permit out tcp from any 70000 to assigned",
+		"permit out tcp from any to assigned established",
+	} {
+		if _, err := ParseFlowDescription(fd); err == nil {
+			t.Errorf("ParseFlowDescription(%q) error = nil", fd)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package upf
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// IP protocol numbers of the transport protocols with ports
+const (
+	protoTCP  uint8 = 6
+	protoUDP  uint8 = 17
+	protoSCTP uint8 = 132
+)
+
+// protocolNames are the protocols flow descriptions may name instead of
+// giving their number
+var protocolNames = map[string]uint8{
+	"icmp":      1,
+	"tcp":       protoTCP,
+	"udp":       protoUDP,
+	"ipv6-icmp": 58,
+	"sctp":      protoSCTP,
+}
+
+// SDFFilter is a parsed IPFilterRule of an SDF filter (TS 29.212 §5.4.2,
+// RFC 6733 §4.3). The rule is written in the downlink direction: "from" is
+// the remote side, "to" is the UE.
+type SDFFilter struct {
+	Protocol    uint8 // 0 matches any protocol
+	Remote      *net.IPNet
+	Local       *net.IPNet  // nil matches any address, including "assigned"
+	RemotePorts []PortRange // empty matches any port
+	LocalPorts  []PortRange
+}
+
+// PortRange is an inclusive range of transport ports
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+// ParseFlowDescription parses a flow description such as
+// "permit out 17 from 10.0.0.0/8 53,5353 to assigned 1024-65535"
+func ParseFlowDescription(fd string) (*SDFFilter, error) {
+	fields := strings.Fields(fd)
+	if len(fields) < 7 || fields[0] != "permit" || fields[1] != "out" {
+		return nil, fmt.Errorf("unsupported flow description %q", fd)
+	}
+
+	f := &SDFFilter{}
+	switch proto := fields[2]; proto {
+	case "ip", "any":
+	default:
+		if n, ok := protocolNames[proto]; ok {
+			f.Protocol = n
+			break
+		}
+		n, err := strconv.ParseUint(proto, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protocol %q", proto)
+		}
+		f.Protocol = uint8(n)
+	}
+
+	if fields[3] != "from" {
+		return nil, fmt.Errorf("unsupported flow description %q", fd)
+	}
+	rest := fields[4:]
+	var err error
+	if f.Remote, f.RemotePorts, rest, err = parseFilterEndpoint(rest); err != nil {
+		return nil, err
+	}
+	if len(rest) == 0 || rest[0] != "to" {
+		return nil, fmt.Errorf("unsupported flow description %q", fd)
+	}
+	if f.Local, f.LocalPorts, rest, err = parseFilterEndpoint(rest[1:]); err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("unsupported options %q in flow description", strings.Join(rest, " "))
+	}
+	if (f.RemotePorts != nil || f.LocalPorts != nil) && f.Protocol != 0 && !hasPorts(f.Protocol) {
+		return nil, fmt.Errorf("ports of protocol %d in flow description %q", f.Protocol, fd)
+	}
+	return f, nil
+}
+
+// parseFilterEndpoint parses the address and optional ports of one side of
+// a rule and returns the fields after them
+func parseFilterEndpoint(fields []string) (*net.IPNet, []PortRange, []string, error) {
+	if len(fields) == 0 {
+		return nil, nil, nil, fmt.Errorf("missing address in flow description")
+	}
+	prefix, err := parseFilterAddr(fields[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	fields = fields[1:]
+	if len(fields) == 0 || fields[0] == "to" || !isPortList(fields[0]) {
+		return prefix, nil, fields, nil
+	}
+	ports, err := parsePorts(fields[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return prefix, ports, fields[1:], nil
+}
+
+// isPortList reports whether a field is a port list rather than an option
+func isPortList(s string) bool {
+	return s != "" && s[0] >= '0' && s[0] <= '9'
+}
+
+// parsePorts parses a comma separated list of ports and port ranges such
+// as "80,443,8000-8080"
+func parsePorts(s string) ([]PortRange, error) {
+	var ports []PortRange
+	for _, item := range strings.Split(s, ",") {
+		first, last, isRange := strings.Cut(item, "-")
+		lo, err := strconv.ParseUint(first, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", item)
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.ParseUint(last, 10, 16); err != nil || hi < lo {
+				return nil, fmt.Errorf("invalid port range %q", item)
+			}
+		}
+		ports = append(ports, PortRange{First: uint16(lo), Last: uint16(hi)})
+	}
+	return ports, nil
+}
+
+// parseFilterAddr parses an address or prefix, "any" and "assigned" match all
+func parseFilterAddr(s string) (*net.IPNet, error) {
+	if s == "any" || s == "assigned" {
+		return nil, nil
+	}
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", s)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prefix %q", s)
+	}
+	return prefix, nil
+}
+
+// hasPorts reports whether a protocol carries transport ports
+func hasPorts(protocol uint8) bool {
+	return protocol == protoTCP || protocol == protoUDP || protocol == protoSCTP
+}
+
+// Match reports whether a packet between the remote and UE addresses and
+// ports matches. Packets without ports never match a filter with ports.
+func (f *SDFFilter) Match(protocol uint8, remote, local net.IP, remotePort, localPort uint16) bool {
+	if f.Protocol != 0 && f.Protocol != protocol {
+		return false
+	}
+	if f.Remote != nil && (remote == nil || !f.Remote.Contains(remote)) {
+		return false
+	}
+	if f.Local != nil && (local == nil || !f.Local.Contains(local)) {
+		return false
+	}
+	if f.RemotePorts == nil && f.LocalPorts == nil {
+		return true
+	}
+	if !hasPorts(protocol) {
+		return false
+	}
+	return portsMatch(f.RemotePorts, remotePort) && portsMatch(f.LocalPorts, localPort)
+}
+
+// portsMatch reports whether a port is in one of the ranges, any port
+// matching an empty list
+func portsMatch(ranges []PortRange, port uint16) bool {
+	if len(ranges) == 0 {
+		return true
+	}
+	for _, r := range ranges {
+		if port >= r.First && port <= r.Last {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,213 @@
+package upf
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Store persists the associations and the forwarding state of the
+// sessions, so a restarted UPF keeps forwarding the traffic of the
+// sessions the SMFs established. Usage measured since the last report and
+// buffered packets are not kept.
+type Store interface {
+	// Load returns the state saved by the previous run, empty on the first
+	Load() (*State, error)
+	SaveRecoveryTime(t time.Time) error
+	SaveAssociation(a *AssociationState) error
+	DeleteAssociation(nodeID string) error
+	SaveSession(s *SessionState) error
+	DeleteSession(seid uint64) error
+}
+
+// State is what a UPF restores on start
+type State struct {
+	// RecoveryTime is the Recovery Time Stamp of the run that saved the
+	// sessions. It is kept so the SMFs do not take the restart for a loss
+	// of state and release the sessions (TS 29.244 §19A).
+	RecoveryTime time.Time
+	Associations []*AssociationState
+	Sessions     []*SessionState
+}
+
+// AssociationState is the persisted form of a PFCP association
+type AssociationState struct {
+	NodeID   string    `json:"node_id"`
+	Addr     string    `json:"addr"`
+	Recovery time.Time `json:"recovery"`
+}
+
+// SessionState is the persisted form of a session: its identifiers, its
+// rules and what the UPF allocated to it
+type SessionState struct {
+	SEID      uint64     `json:"seid"`
+	CPSEID    uint64     `json:"cp_seid"`
+	CPNodeID  string     `json:"cp_node_id"`
+	CPAddr    string     `json:"cp_addr"`
+	UEIP      net.IP     `json:"ue_ip,omitempty"`
+	UEPrefix  *net.IPNet `json:"ue_prefix,omitempty"`
+	TEID      uint32     `json:"teid"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+
+	PDRs []*PDR `json:"pdrs"`
+	FARs []*FAR `json:"fars"`
+	QERs []*QER `json:"qers,omitempty"`
+	URRs []*URR `json:"urrs,omitempty"`
+
+	InactivityTimer time.Duration `json:"inactivity_timer,omitempty"`
+
+	ChosenTEIDs    []uint32   `json:"chosen_teids,omitempty"`
+	ChosenUEIP     net.IP     `json:"chosen_ue_ip,omitempty"`
+	ChosenUEPrefix *net.IPNet `json:"chosen_ue_prefix,omitempty"`
+}
+
+// state returns the persisted form of the session. Rules are replaced
+// rather than modified, so the state shares them with the session.
+func (s *Session) state() *SessionState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	st := &SessionState{
+		SEID:           s.SEID,
+		CPSEID:         s.CPSEID,
+		CPNodeID:       s.cpNodeID,
+		UEIP:           s.UEIP,
+		UEPrefix:       s.UEPrefix,
+		TEID:           s.TEID,
+		CreatedAt:      s.CreatedAt,
+		UpdatedAt:      s.UpdatedAt,
+		PDRs:           s.PDRs,
+		ChosenTEIDs:    s.chosenTEIDs,
+		ChosenUEIP:     s.chosenUEIP,
+		ChosenUEPrefix: s.chosenUEPrefix,
+
+		InactivityTimer: s.inactivityTimer,
+	}
+	if s.cpAddr != nil {
+		st.CPAddr = s.cpAddr.String()
+	}
+	for _, far := range s.FARs {
+		st.FARs = append(st.FARs, far)
+	}
+	for _, qer := range s.QERs {
+		st.QERs = append(st.QERs, qer)
+	}
+	for _, urr := range s.URRs {
+		st.URRs = append(st.URRs, urr)
+	}
+	return st
+}
+
+// restoredSession returns the session of a persisted state
+func restoredSession(st *SessionState) (*Session, error) {
+	session := &Session{
+		SEID:           st.SEID,
+		CPSEID:         st.CPSEID,
+		cpNodeID:       st.CPNodeID,
+		UEIP:           st.UEIP,
+		UEPrefix:       st.UEPrefix,
+		TEID:           st.TEID,
+		CreatedAt:      st.CreatedAt,
+		UpdatedAt:      st.UpdatedAt,
+		State:          "ESTABLISHED",
+		chosenTEIDs:    st.ChosenTEIDs,
+		chosenUEIP:     st.ChosenUEIP,
+		chosenUEPrefix: st.ChosenUEPrefix,
+	}
+	if st.CPAddr != "" {
+		addr, err := net.ResolveUDPAddr("udp", st.CPAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMF address %q: %w", st.CPAddr, err)
+		}
+		session.cpAddr = addr
+	}
+	if err := session.installRules(st.PDRs, st.FARs, st.QERs, st.URRs); err != nil {
+		return nil, err
+	}
+	session.setInactivityTimer(st.InactivityTimer, time.Now())
+	return session, nil
+}
+
+// restore loads the associations and sessions of the previous run and
+// indexes the sessions for the data plane. Sessions that cannot be
+// restored are dropped from the store.
+func (u *UPF) restore() error {
+	state, err := u.cfg.Store.Load()
+	if err != nil {
+		return fmt.Errorf("failed to load state: %w", err)
+	}
+	if !state.RecoveryTime.IsZero() {
+		u.recoveryTime = state.RecoveryTime
+	} else if err := u.cfg.Store.SaveRecoveryTime(u.recoveryTime); err != nil {
+		return fmt.Errorf("failed to save recovery time: %w", err)
+	}
+
+	u.assocLock.Lock()
+	for _, a := range state.Associations {
+		addr, err := net.ResolveUDPAddr("udp", a.Addr)
+		if err != nil {
+			u.logger.Errorf("[UPF] Dropping association with %s: invalid address %q", a.NodeID, a.Addr)
+			continue
+		}
+		u.associations[a.NodeID] = &association{nodeID: a.NodeID, addr: addr, recovery: a.Recovery}
+	}
+	u.assocLock.Unlock()
+
+	for _, st := range state.Sessions {
+		session, err := restoredSession(st)
+		if err == nil {
+			err = u.alloc.reserve(session)
+		}
+		if err != nil {
+			u.logger.Errorf("[UPF] Dropping session %d: %v", st.SEID, err)
+			u.deleteStored(st.SEID)
+			continue
+		}
+		u.sessionLock.Lock()
+		u.sessions[session.SEID] = session
+		if session.SEID > u.nextSEID {
+			u.nextSEID = session.SEID
+		}
+		u.indexLocked(session)
+		u.sessionLock.Unlock()
+	}
+	u.logger.Infof("[UPF] Restored %d associations and %d sessions", len(state.Associations), u.GetSessionCount())
+	return nil
+}
+
+// saveSession persists the state of a session after a change
+func (u *UPF) saveSession(session *Session) {
+	if u.cfg.Store == nil {
+		return
+	}
+	if err := u.cfg.Store.SaveSession(session.state()); err != nil {
+		u.logger.Errorf("[UPF] Failed to save session %d: %v", session.SEID, err)
+	}
+}
+
+// deleteStored removes a session from the store
+func (u *UPF) deleteStored(seid uint64) {
+	if u.cfg.Store == nil {
+		return
+	}
+	if err := u.cfg.Store.DeleteSession(seid); err != nil {
+		u.logger.Errorf("[UPF] Failed to delete stored session %d: %v", seid, err)
+	}
+}
+
+// saveAssociation persists an association, or its removal when a is nil
+func (u *UPF) saveAssociation(nodeID string, a *association) {
+	if u.cfg.Store == nil {
+		return
+	}
+	var err error
+	if a == nil {
+		err = u.cfg.Store.DeleteAssociation(nodeID)
+	} else {
+		err = u.cfg.Store.SaveAssociation(&AssociationState{NodeID: a.nodeID, Addr: a.addr.String(), Recovery: a.recovery})
+	}
+	if err != nil {
+		u.logger.Errorf("[UPF] Failed to save association with %s: %v", nodeID, err)
+	}
+}
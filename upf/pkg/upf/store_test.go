@@ -0,0 +1,164 @@
+package upf
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+	pfcpmsg "github.com/wmnsk/go-pfcp/message"
+)
+
+// memoryStore keeps the state JSON encoded, as a store outside the
+// process would
+type memoryStore struct {
+	mu           sync.Mutex
+	recovery     time.Time
+	associations map[string][]byte
+	sessions     map[uint64][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{associations: make(map[string][]byte), sessions: make(map[uint64][]byte)}
+}
+
+func (m *memoryStore) Load() (*State, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	state := &State{RecoveryTime: m.recovery}
+	for _, data := range m.associations {
+		a := &AssociationState{}
+		if err := json.Unmarshal(data, a); err != nil {
+			return nil, err
+		}
+		state.Associations = append(state.Associations, a)
+	}
+	for _, data := range m.sessions {
+		s := &SessionState{}
+		if err := json.Unmarshal(data, s); err != nil {
+			return nil, err
+		}
+		state.Sessions = append(state.Sessions, s)
+	}
+	return state, nil
+}
+
+func (m *memoryStore) SaveRecoveryTime(t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.recovery = t
+	return nil
+}
+
+func (m *memoryStore) SaveAssociation(a *AssociationState) error {
+	data, err := json.Marshal(a)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.associations[a.NodeID] = data
+	return err
+}
+
+func (m *memoryStore) DeleteAssociation(nodeID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.associations, nodeID)
+	return nil
+}
+
+func (m *memoryStore) SaveSession(s *SessionState) error {
+	data, err := json.Marshal(s)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessions[s.SEID] = data
+	return err
+}
+
+func (m *memoryStore) DeleteSession(seid uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.sessions, seid)
+	return nil
+}
+
+func TestStoreRestoresSessions(t *testing.T) {
+	store := newMemoryStore()
+	u, smf := pfcpUPF(t)
+	u.cfg.Store = store
+	u.cfg.UEPools = []string{"10.45.0.0/24"}
+	if err := u.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.alloc.addPools(u.cfg.UEPools); err != nil {
+		t.Fatal(err)
+	}
+	exchange(t, u, smf, associationSetup(1, time.Now()))
+
+	// A session whose F-TEID and UE address the UPF chose
+	rules := []*ie.IE{
+		ie.NewCreatePDR(ie.NewPDRID(1), ie.NewPrecedence(255), ie.NewPDI(
+			ie.NewSourceInterface(ie.SrcInterfaceAccess),
+			ie.NewFTEID(0x05, 0, nil, nil, 0),
+			ie.NewUEIPAddress(0x12, "", "", 0, 0),
+		), ie.NewOuterHeaderRemoval(0, 0), ie.NewFARID(1)),
+		ie.NewCreateFAR(ie.NewFARID(1), ie.NewApplyAction(ApplyActionFORW), ie.NewForwardingParameters(
+			ie.NewDestinationInterface(ie.DstInterfaceCore),
+		)),
+	}
+	res := exchange(t, u, smf, establishment(2, rules...)).(*pfcpmsg.SessionEstablishmentResponse)
+	if cause := responseCause(t, res.Cause); cause != ie.CauseRequestAccepted {
+		t.Fatalf("Session Establishment cause = %d", cause)
+	}
+	exchange(t, u, smf, establishment(3, sessionRules()...))
+	fseid, _ := res.UPFSEID.FSEID()
+	session, _ := u.sessionByUE(net.ParseIP("10.0.0.1"))
+	deleted := session.SEID
+	exchange(t, u, smf, pfcpmsg.NewSessionDeletionRequest(0, 0, deleted, 4, 0))
+	u.sessionLock.RLock()
+	original := u.sessions[fseid.SEID]
+	u.sessionLock.RUnlock()
+
+	// A new UPF on the same store
+	restarted := NewUPF(&Config{NodeID: "upf.example.org", Store: store, UEPools: u.cfg.UEPools})
+	if err := restarted.alloc.addPools(restarted.cfg.UEPools); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.recoveryTime.Equal(u.recoveryTime) {
+		t.Errorf("recovery time = %v, want %v", restarted.recoveryTime, u.recoveryTime)
+	}
+	if restarted.GetSessionCount() != 1 {
+		t.Fatalf("restored sessions = %d, want 1", restarted.GetSessionCount())
+	}
+	session, ok := restarted.sessionByTEID(original.TEID)
+	if !ok || session.SEID != fseid.SEID || !session.UEIP.Equal(original.UEIP) {
+		t.Fatalf("TEID %d finds %+v, want session %d of %s", original.TEID, session, fseid.SEID, original.UEIP)
+	}
+	if _, ok := restarted.sessionByUE(original.UEIP); !ok {
+		t.Errorf("UE %s not indexed", original.UEIP)
+	}
+	if far, ok := session.FARs[1]; !ok || far.ApplyAction != ApplyActionFORW {
+		t.Errorf("FAR 1 = %+v", far)
+	}
+
+	// What the session holds is not handed out again, nor its SEID
+	if ip, _ := restarted.alloc.allocateUE(false); ip.Equal(original.UEIP) {
+		t.Errorf("restored UE address %s allocated again", ip)
+	}
+	if !restarted.alloc.teids[original.TEID] {
+		t.Errorf("restored TEID %d not reserved", original.TEID)
+	}
+	restarted.addSession(&Session{})
+	if restarted.nextSEID <= fseid.SEID {
+		t.Errorf("next SEID %d reuses restored ones", restarted.nextSEID)
+	}
+
+	// The restored association owns the session
+	if _, ok := restarted.ownedSession(fseid.SEID, smf.LocalAddr().(*net.UDPAddr)); !ok {
+		t.Errorf("session %d not owned by its SMF after the restart", fseid.SEID)
+	}
+}
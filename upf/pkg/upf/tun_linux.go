@@ -0,0 +1,68 @@
+//go:build linux
+
+package upf
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// TUN ioctl and flags (linux/if_tun.h)
+const (
+	tunCloneDevice = "/dev/net/tun"
+	tunSetIff      = 0x400454ca
+	iffTUN         = 0x0001
+	iffNoPI        = 0x1000
+)
+
+// ifReq is the struct ifreq TUNSETIFF takes
+type ifReq struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	_     [22]byte
+}
+
+// openTUN creates the TUN interface, brings it up and routes the UE pools
+// into it. Packets are read and written without the packet information
+// header.
+func openTUN(name string, mtu int, routes []string) (io.ReadWriteCloser, error) {
+	fd, err := syscall.Open(tunCloneDevice, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", tunCloneDevice, err)
+	}
+
+	var req ifReq
+	copy(req.Name[:syscall.IFNAMSIZ-1], name)
+	req.Flags = iffTUN | iffNoPI
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIff, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to create TUN interface %s: %w", name, errno)
+	}
+	// Non-blocking so reads go through the poller and Close interrupts them
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("failed to set TUN interface %s non-blocking: %w", name, err)
+	}
+	tun := os.NewFile(uintptr(fd), tunCloneDevice)
+
+	link := []string{"link", "set", "dev", name, "up"}
+	if mtu > 0 {
+		link = append(link, "mtu", strconv.Itoa(mtu))
+	}
+	cmds := [][]string{link}
+	for _, route := range routes {
+		cmds = append(cmds, []string{"route", "replace", route, "dev", name})
+	}
+	for _, args := range cmds {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			tun.Close()
+			return nil, fmt.Errorf("ip %v: %w: %s", args, err, out)
+		}
+	}
+	return tun, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package upf
+
+import (
+	"errors"
+	"io"
+)
+
+// openTUN is only supported on Linux
+func openTUN(name string, mtu int, routes []string) (io.ReadWriteCloser, error) {
+	return nil, errors.New("TUN interfaces are only supported on Linux")
+}
@@ -1,17 +1,24 @@
 package upf
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/nats-io/nats.go"
 	"github.com/sirupsen/logrus"
 	gtpv1msg "github.com/wmnsk/go-gtp/gtpv1/message"
 	"github.com/wmnsk/go-pfcp/ie"
 	pfcpmsg "github.com/wmnsk/go-pfcp/message"
 )
 
+// gtpuPort is the registered GTP-U port (TS 29.281 §4.4.2)
+const gtpuPort = 2152
+
 // UPF represents a User Plane Function instance
 type UPF struct {
 	cfg *Config
@@ -24,9 +31,74 @@ type UPF struct {
 	gtpuConn *net.UDPConn
 	gtpuAddr *net.UDPAddr
 
-	// Session management
+	// N6 interface of the data plane
+	tun io.ReadWriteCloser
+
+	// Address of the F-SEIDs and allocator of the F-TEIDs and UE addresses
+	// the UPF chooses
+	nodeAddr net.IP
+	alloc    *allocator
+
+	// Session management, indexed by local TEID and UE address for the
+	// data plane
 	sessions    map[uint64]*Session
+	tunnels     teidTable
+	ueSessions  ueTable
 	sessionLock sync.RWMutex
+	nextSEID    uint64
+
+	// Associations of the CP functions by Node ID, and the requests
+	// received recently with their responses for retransmissions
+	associations map[string]*association
+	assocLock    sync.RWMutex
+	transactions map[transactionKey]*pfcpTransaction
+	nextPrune    time.Time
+	txLock       sync.Mutex
+
+	// Recovery Time Stamp sent to the CP functions
+	recoveryTime time.Time
+
+	// Sequence numbers of the PFCP requests and GTP-U messages the UPF
+	// sends
+	seq    uint32
+	gtpSeq uint32
+
+	// Echo state of the paths to the GTP-U peers by address
+	paths  map[string]*gtpPath
+	pathMu sync.Mutex
+
+	// Error Indications for unknown TEIDs waiting to be sent, limited per
+	// peer
+	errorIndications chan errorIndication
+	errorLimiter     peerLimiter
+
+	// Usage records are published on NATS when connected
+	usageConn *nats.Conn
+
+	// Definitions of the Application IDs of PDRs, nil when none are
+	// configured
+	apps *appTable
+
+	// Delivery of the packets duplicated for lawful interception
+	x3 *x3Delivery
+
+	// Packet captures by ID, and the running ones the data plane reads
+	// without locking
+	captures    map[uint64]*Capture
+	capturing   atomic.Value // []*Capture
+	captureLock sync.Mutex
+	nextCapture uint64
+
+	// Stops the background tasks on Close
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Packet workers of the fast path, their pooled buffers and counters,
+	// and the XDP offload when enabled
+	workers []*worker
+	bufPool sync.Pool
+	stats   dataPlaneCounters
+	xdp     *xdpOffload
 
 	// Logging
 	logger *logrus.Logger
@@ -39,22 +111,142 @@ type Config struct {
 	}
 	GTP struct {
 		Addr string
+
+		// EchoInterval is how often the GTP-U peers are sent an Echo
+		// Request, 60s when 0. Unanswered requests are retransmitted
+		// every EchoTimeout (T3-RESPONSE, 3s) and the path fails after
+		// EchoRetries (N3-REQUESTS, 3) retransmissions.
+		EchoInterval time.Duration
+		EchoTimeout  time.Duration
+		EchoRetries  int
+	}
+	// TUN is the N6 interface uplink packets leave through and downlink
+	// packets to UEs arrive on
+	TUN struct {
+		Name   string   // "upfgtp" when empty
+		MTU    int      // left to the kernel default when 0
+		Routes []string // UE address pools routed into the interface
 	}
 	EnableGTP    bool
 	EnablePFCP   bool
 	EnableUPlane bool
 	ReportNotify bool
 	LogLevel     string
+
+	// LinkMTU is advertised to IPv6 UEs in Router Advertisements, 0 to
+	// leave the MTU option out
+	LinkMTU uint16
+
+	// NodeID is the FQDN or address the UPF identifies itself with, by
+	// default NodeAddr.
+	// NodeAddr is the address put in F-SEIDs, by default the PFCP address.
+	// N3Addr and N9Addr are put in the F-TEIDs the UPF chooses, by default
+	// the GTP-U address.
+	NodeID   string
+	NodeAddr string
+	N3Addr   string
+	N9Addr   string
+	// UEPools are the IPv4 CIDRs and IPv6 CIDRs (delegated as /64s) UE
+	// addresses are allocated from when the SMF asks the UPF to choose them
+	UEPools []string
+
+	// DSCP marks uplink packets leaving through N6 by QFI
+	DSCP map[uint8]uint8
+
+	// Applications define the traffic of the Application IDs PDRs detect,
+	// by ID
+	Applications map[string]Application
+
+	// FastPath sizes the packet workers and I/O batches of the data plane
+	// and offloads simple sessions to XDP
+	FastPath struct {
+		Workers int // one per CPU when 0
+		Batch   int // datagrams per recvmmsg/sendmmsg, 64 when 0
+
+		// XDP loads bpf/upf_xdp.c, compiled to Object, onto the N3 and N6
+		// Devices with bpftool. Disabled when Object is empty.
+		XDP struct {
+			Object  string
+			Devices []string
+			PinPath string // bpffs directory, "/sys/fs/bpf/upf" when empty
+			Mode    string // xdp, xdpdrv or xdpgeneric, "xdp" when empty
+		}
+	}
+
+	// Buffer bounds the downlink packets buffered per session while its UE
+	// is idle, 64 packets and 128 KiB when 0
+	Buffer struct {
+		Packets int
+		Bytes   int
+	}
+
+	// NATS is where usage records are published for offline charging,
+	// disabled when URL is empty
+	NATS struct {
+		URL          string
+		UsageSubject string // "upf.usage" when empty
+	}
+
+	// Capture is where captures started without a writer are written,
+	// os.TempDir() when Dir is empty
+	Capture struct {
+		Dir string
+	}
+
+	// Store persists the associations and sessions, restored by Run. Not
+	// persisted when nil.
+	Store Store
 }
 
 // Session represents a PFCP session
 type Session struct {
 	SEID      uint64
+	CPSEID    uint64
+	cpNodeID  string       // Node ID of the association owning the session
+	cpAddr    *net.UDPAddr // where Session Report Requests go
 	UEIP      net.IP
+	UEPrefix  *net.IPNet // /64 delegated to the UE of IPv6 sessions
 	TEID      uint32
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	State     string
+
+	// Packet detection, forwarding, QoS and usage reporting rules, PDRs in
+	// precedence order
+	PDRs []*PDR
+	FARs map[uint32]*FAR
+	QERs map[uint32]*QER
+	URRs map[uint32]*URR
+	mu   sync.RWMutex
+
+	// Local TEIDs and UE keys the data plane finds the session by,
+	// maintained under the UPF's sessionLock
+	indexedTEIDs []uint32
+	indexedUEs   []ueKey
+
+	// User Plane Inactivity Timer, under mu, and the time of the last
+	// forwarded packet in Unix nanoseconds
+	inactivityTimer time.Duration
+	lastPacket      atomic.Int64
+	inactive        atomic.Bool // reported without traffic since
+
+	// F-TEIDs and UE addresses the UPF allocated to the session
+	chosenTEIDs    []uint32
+	chosenUEIP     net.IP
+	chosenUEPrefix *net.IPNet
+
+	// Policing state and counters of the QERs, usage measurement of the URRs
+	meters  map[uint32]*qerMeter
+	usage   map[uint32]*urrMeter
+	meterMu sync.Mutex
+
+	// Packets buffered by FAR ID while the UE is not reachable
+	buffers map[uint32]*farBuffer
+	bufMu   sync.Mutex
+
+	// DNS queries of the UE and the application addresses their answers
+	// resolved
+	dns sessionDNS
 }
 
 // NewUPF creates a new UPF instance
@@ -72,19 +264,74 @@ func NewUPF(cfg *Config) *UPF {
 	}
 	logger.SetLevel(level)
 
+	nodeAddr := hostAddr(cfg.NodeAddr, cfg.PFCP.Addr, "127.0.0.1")
+	n3 := hostAddr(cfg.N3Addr, cfg.GTP.Addr, nodeAddr.String())
+	var n9 net.IP
+	if cfg.N9Addr != "" {
+		n9 = net.ParseIP(cfg.N9Addr)
+	}
+
+	done := make(chan struct{})
 	return &UPF{
 		cfg:      cfg,
+		nodeAddr: nodeAddr,
+		alloc:    newAllocator(n3, n9),
 		sessions: make(map[uint64]*Session),
-		logger:   logger,
+		paths:    make(map[string]*gtpPath),
+		captures: make(map[uint64]*Capture),
+
+		errorIndications: make(chan errorIndication, errorIndicationQueue),
+
+		associations: make(map[string]*association),
+		transactions: make(map[transactionKey]*pfcpTransaction),
+		recoveryTime: time.Now(),
+		x3:           newX3Delivery(logger, done),
+		done:         done,
+		logger:       logger,
 	}
 }
 
+// hostAddr returns addr, else the host of listen when it is a specific
+// address, else fallback
+func hostAddr(addr, listen, fallback string) net.IP {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(listen); err == nil {
+		if ip := net.ParseIP(host); ip != nil && !ip.IsUnspecified() {
+			return ip
+		}
+	}
+	return net.ParseIP(fallback)
+}
+
 // Run starts the UPF services
 func (u *UPF) Run() error {
+	if err := u.alloc.addPools(u.cfg.UEPools); err != nil {
+		return err
+	}
+	if err := u.loadApplications(); err != nil {
+		return err
+	}
+	if u.cfg.Store != nil {
+		if err := u.restore(); err != nil {
+			return err
+		}
+	}
+
+	// Before PFCP, so established sessions are offloaded
+	if u.cfg.FastPath.XDP.Object != "" {
+		if err := u.startXDP(); err != nil {
+			return fmt.Errorf("failed to start XDP offload: %w", err)
+		}
+	}
+
 	if u.cfg.EnablePFCP {
 		if err := u.startPFCP(); err != nil {
 			return fmt.Errorf("failed to start PFCP: %w", err)
 		}
+		u.connectUsage()
+		go u.serveUsage()
 	}
 
 	if u.cfg.EnableGTP {
@@ -93,17 +340,42 @@ func (u *UPF) Run() error {
 		}
 	}
 
+	if u.cfg.EnableGTP || u.cfg.EnableUPlane {
+		u.startWorkers()
+		if u.gtpuConn != nil {
+			go u.serveGTP()
+			go u.servePaths()
+			go u.serveErrorIndications()
+		}
+	}
+
+	if u.cfg.EnableUPlane {
+		if err := u.startDataPlane(); err != nil {
+			return fmt.Errorf("failed to start data plane: %w", err)
+		}
+	}
+
 	return nil
 }
 
 // Close shuts down the UPF
 func (u *UPF) Close() {
+	u.closeOnce.Do(func() { close(u.done) })
+	if u.usageConn != nil {
+		u.usageConn.Close()
+	}
 	if u.pfcpConn != nil {
 		u.pfcpConn.Close()
 	}
 	if u.gtpuConn != nil {
 		u.gtpuConn.Close()
 	}
+	if u.tun != nil {
+		u.tun.Close()
+	}
+	if u.xdp != nil {
+		u.xdp.close()
+	}
 }
 
 // GetSessionCount returns the number of active sessions
@@ -144,48 +416,34 @@ func (u *UPF) startGTP() error {
 		return fmt.Errorf("failed to listen on GTP: %w", err)
 	}
 
-	go u.serveGTP()
 	u.logger.Infof("[UPF] GTP-U server listening on %s", u.gtpuAddr)
 	return nil
 }
 
 // servePFCP handles incoming PFCP messages
 func (u *UPF) servePFCP() {
-	buf := make([]byte, 1500)
+	buf := make([]byte, maxPacketSize)
 	for {
 		n, remoteAddr, err := u.pfcpConn.ReadFromUDP(buf)
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			u.logger.Errorf("[UPF] PFCP read error: %v", err)
 			continue
 		}
 
-		msg, err := pfcpmsg.Parse(buf[:n])
+		// Parsed IEs refer to the datagram, which outlives this read
+		msg, err := pfcpmsg.Parse(append([]byte(nil), buf[:n]...))
 		if err != nil {
 			u.logger.Errorf("[UPF] Failed to parse PFCP message: %v", err)
 			continue
 		}
-
-		go u.handlePFCP(msg, remoteAddr)
-	}
-}
-
-// serveGTP handles incoming GTP-U messages
-func (u *UPF) serveGTP() {
-	buf := make([]byte, 1500)
-	for {
-		n, remoteAddr, err := u.gtpuConn.ReadFromUDP(buf)
-		if err != nil {
-			u.logger.Errorf("[UPF] GTP-U read error: %v", err)
+		if isPFCPRequest(msg.MessageType()) && !u.receivedRequest(msg, remoteAddr) {
 			continue
 		}
 
-		msg, err := gtpv1msg.Parse(buf[:n])
-		if err != nil {
-			u.logger.Errorf("[UPF] Failed to parse GTP-U message: %v", err)
-			continue
-		}
-
-		go u.handleGTP(msg, remoteAddr)
+		go u.handlePFCP(msg, remoteAddr)
 	}
 }
 
@@ -196,12 +454,21 @@ func (u *UPF) handlePFCP(msg pfcpmsg.Message, remoteAddr *net.UDPAddr) {
 		u.handleHeartbeatRequest(m, remoteAddr)
 	case *pfcpmsg.AssociationSetupRequest:
 		u.handleAssociationSetupRequest(m, remoteAddr)
+	case *pfcpmsg.AssociationReleaseRequest:
+		u.handleAssociationReleaseRequest(m, remoteAddr)
 	case *pfcpmsg.SessionEstablishmentRequest:
 		u.handleSessionEstablishmentRequest(m, remoteAddr)
 	case *pfcpmsg.SessionModificationRequest:
 		u.handleSessionModificationRequest(m, remoteAddr)
 	case *pfcpmsg.SessionDeletionRequest:
 		u.handleSessionDeletionRequest(m, remoteAddr)
+	case *pfcpmsg.SessionReportResponse:
+		u.handleSessionReportResponse(m, remoteAddr)
+	case *pfcpmsg.NodeReportResponse:
+		u.handleNodeReportResponse(m, remoteAddr)
+	case *pfcpmsg.AssociationUpdateRequest, *pfcpmsg.PFDManagementRequest,
+		*pfcpmsg.NodeReportRequest, *pfcpmsg.SessionSetDeletionRequest:
+		u.rejectRequest(m, remoteAddr)
 	default:
 		u.logger.Warnf("[UPF] Unhandled PFCP message type: %T", msg)
 	}
@@ -209,15 +476,82 @@ func (u *UPF) handlePFCP(msg pfcpmsg.Message, remoteAddr *net.UDPAddr) {
 
 // handleGTP processes GTP-U messages
 func (u *UPF) handleGTP(msg gtpv1msg.Message, remoteAddr *net.UDPAddr) {
-	// TODO: Implement GTP-U packet handling
-	u.logger.Debugf("[UPF] Received GTP-U message from %s: %+v", remoteAddr, msg)
+	var tpdu *gtpv1msg.TPDU
+	switch m := msg.(type) {
+	case *gtpv1msg.TPDU:
+		tpdu = m
+	case *gtpv1msg.EchoRequest:
+		u.handleEchoRequest(m, remoteAddr)
+		return
+	case *gtpv1msg.EchoResponse:
+		u.handleEchoResponse(remoteAddr)
+		return
+	case *gtpv1msg.ErrorIndication:
+		u.handleErrorIndication(m, remoteAddr)
+		return
+	default:
+		u.logger.Debugf("[UPF] Received GTP-U message from %s: %+v", remoteAddr, msg)
+		return
+	}
+
+	if _, ok := u.tunnel(tpdu.TEID()); !ok {
+		u.sendErrorIndication(tpdu.TEID(), remoteAddr)
+		return
+	}
+	payload := tpdu.Decapsulate()
+	if src, ok := parseRouterSolicitation(payload); ok {
+		u.handleRouterSolicitation(tpdu.TEID(), src)
+		return
+	}
+	u.handleTPDU(nil, tpdu.TEID(), payload)
+}
+
+// handleRouterSolicitation answers a UE's Router Solicitation with the
+// prefix of its session
+func (u *UPF) handleRouterSolicitation(teid uint32, src net.IP) {
+	session, ok := u.sessionByTEID(teid)
+	if !ok || session.UEPrefix == nil {
+		u.logger.Debugf("[UPF] Ignoring Router Solicitation on TEID %d without an IPv6 session", teid)
+		return
+	}
+	dst := src
+	if dst.IsUnspecified() {
+		dst = allNodes
+	}
+	u.sendRouterAdvertisement(session, dst)
+}
+
+// sendRouterAdvertisement sends the Router Advertisement of an IPv6
+// session down its access tunnel
+func (u *UPF) sendRouterAdvertisement(session *Session, dst net.IP) {
+	tunnel := session.downlinkTunnel()
+	if tunnel == nil || u.gtpuConn == nil {
+		return
+	}
+	ra := newRouterAdvertisement(session.UEPrefix, dst, u.cfg.LinkMTU)
+	b, err := gtpv1msg.NewTPDU(tunnel.TEID, ra).Marshal()
+	if err != nil {
+		u.logger.Errorf("[UPF] Failed to encode Router Advertisement: %v", err)
+		return
+	}
+	if _, err := u.gtpuConn.WriteToUDP(b, &net.UDPAddr{IP: tunnel.Addr, Port: gtpuPort}); err != nil {
+		u.logger.Errorf("[UPF] Failed to send Router Advertisement for session %d: %v", session.SEID, err)
+		return
+	}
+	u.logger.Debugf("[UPF] Sent Router Advertisement of %s for session %d", session.UEPrefix, session.SEID)
+}
+
+// sessionByTEID returns the session a tunnel ends on at the TEID
+func (u *UPF) sessionByTEID(teid uint32) (*Session, bool) {
+	ep, ok := u.tunnel(teid)
+	return ep.session, ok
 }
 
 // handleHeartbeatRequest processes PFCP Heartbeat Request
 func (u *UPF) handleHeartbeatRequest(req *pfcpmsg.HeartbeatRequest, remoteAddr *net.UDPAddr) {
 	res := pfcpmsg.NewHeartbeatResponse(
 		req.SequenceNumber,
-		ie.NewRecoveryTimeStamp(time.Now()),
+		ie.NewRecoveryTimeStamp(u.recoveryTime),
 	)
 
 	if err := u.sendPFCP(res, remoteAddr); err != nil {
@@ -225,80 +559,251 @@ func (u *UPF) handleHeartbeatRequest(req *pfcpmsg.HeartbeatRequest, remoteAddr *
 	}
 }
 
-// handleAssociationSetupRequest processes PFCP Association Setup Request
+// handleAssociationSetupRequest processes PFCP Association Setup Request.
+// The sessions of a CP function that restarted are released
+// (TS 29.244 §6.2.6.2.2).
 func (u *UPF) handleAssociationSetupRequest(req *pfcpmsg.AssociationSetupRequest, remoteAddr *net.UDPAddr) {
-	res := pfcpmsg.NewAssociationSetupResponse(
-		req.SequenceNumber,
-		ie.NewNodeID("upf.local", "", ""),
-		ie.NewCause(ie.CauseRequestAccepted),
-		ie.NewRecoveryTimeStamp(time.Now()),
-	)
+	ies := []*ie.IE{u.nodeID()}
+	nodeID, recovery, err := parseAssociationSetup(req)
+	if err != nil {
+		u.logger.Errorf("[UPF] Rejecting Association Setup Request from %s: %v", remoteAddr, err)
+		cause, offending := rejection(err)
+		ies = append(ies, ie.NewCause(cause))
+		ies = append(ies, offending...)
+	} else {
+		if stale := u.associate(nodeID, remoteAddr, recovery); len(stale) > 0 {
+			u.logger.Infof("[UPF] %s restarted, releasing its %d sessions", nodeID, len(stale))
+			u.releaseSessions(stale)
+		}
+		u.logger.Infof("[UPF] Associated with %s (%s)", nodeID, remoteAddr)
+		ies = append(ies, ie.NewCause(ie.CauseRequestAccepted))
+	}
+	ies = append(ies, ie.NewRecoveryTimeStamp(u.recoveryTime))
 
+	res := pfcpmsg.NewAssociationSetupResponse(req.SequenceNumber, ies...)
 	if err := u.sendPFCP(res, remoteAddr); err != nil {
 		u.logger.Errorf("[UPF] Failed to send Association Setup Response: %v", err)
 	}
 }
 
-// handleSessionEstablishmentRequest processes PFCP Session Establishment Request
-func (u *UPF) handleSessionEstablishmentRequest(req *pfcpmsg.SessionEstablishmentRequest, remoteAddr *net.UDPAddr) {
-	// Extract session information
-	seid := req.SEID()
+// handleAssociationReleaseRequest processes PFCP Association Release
+// Request, releasing the sessions of the association
+func (u *UPF) handleAssociationReleaseRequest(req *pfcpmsg.AssociationReleaseRequest, remoteAddr *net.UDPAddr) {
+	cause := ie.CauseRequestAccepted
+	var offending []*ie.IE
+	nodeID, err := parseNodeID(req.NodeID)
+	if err != nil {
+		u.logger.Errorf("[UPF] Rejecting Association Release Request from %s: %v", remoteAddr, err)
+		cause, offending = rejection(err)
+	} else if sessions, ok := u.releaseAssociation(nodeID); !ok {
+		cause = ie.CauseNoEstablishedPFCPAssociation
+	} else {
+		u.releaseSessions(sessions)
+		u.logger.Infof("[UPF] Released association with %s and its %d sessions", nodeID, len(sessions))
+	}
 
-	// Create new session
+	res := pfcpmsg.NewAssociationReleaseResponse(req.SequenceNumber, u.nodeID(), ie.NewCause(cause), offending...)
+	if err := u.sendPFCP(res, remoteAddr); err != nil {
+		u.logger.Errorf("[UPF] Failed to send Association Release Response: %v", err)
+	}
+}
+
+// rejectRequest answers the node related requests the UPF does not
+// implement, so the CP function stops retransmitting them: Association
+// Update and Node Report are rejected, PFD Management and Session Set
+// Deletion are not supported
+func (u *UPF) rejectRequest(msg pfcpmsg.Message, remoteAddr *net.UDPAddr) {
+	seq := msg.Sequence()
+	var res pfcpmsg.Message
+	switch msg.(type) {
+	case *pfcpmsg.AssociationUpdateRequest:
+		res = pfcpmsg.NewAssociationUpdateResponse(seq, u.nodeID(), ie.NewCause(ie.CauseRequestRejected))
+	case *pfcpmsg.NodeReportRequest:
+		res = pfcpmsg.NewNodeReportResponse(seq, u.nodeID(), ie.NewCause(ie.CauseRequestRejected), nil)
+	case *pfcpmsg.PFDManagementRequest:
+		res = pfcpmsg.NewPFDManagementResponse(seq, ie.NewCause(ie.CauseServiceNotSupported), nil)
+	case *pfcpmsg.SessionSetDeletionRequest:
+		res = pfcpmsg.NewSessionSetDeletionResponse(seq, u.nodeID(), ie.NewCause(ie.CauseServiceNotSupported), nil)
+	default:
+		return
+	}
+
+	u.logger.Warnf("[UPF] Rejecting %s from %s", msg.MessageTypeName(), remoteAddr)
+	if err := u.sendPFCP(res, remoteAddr); err != nil {
+		u.logger.Errorf("[UPF] Failed to send %s: %v", res.MessageTypeName(), err)
+	}
+}
+
+// handleSessionEstablishmentRequest processes PFCP Session Establishment
+// Request. Sessions belong to the association of the CP function in the
+// Node ID.
+func (u *UPF) handleSessionEstablishmentRequest(req *pfcpmsg.SessionEstablishmentRequest, remoteAddr *net.UDPAddr) {
+	nodeID, cpSEID, err := parseEstablishment(req)
+	var timer *time.Duration
+	if err == nil {
+		timer, err = parseInactivityTimer(req.UserPlaneInactivityTimer)
+	}
 	session := &Session{
-		SEID:      seid,
+		CPSEID:    cpSEID,
+		cpNodeID:  nodeID,
+		cpAddr:    remoteAddr,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 		State:     "ESTABLISHED",
 	}
 
-	u.sessionLock.Lock()
-	u.sessions[seid] = session
-	u.sessionLock.Unlock()
+	cause := ie.CauseRequestAccepted
+	var failed []*ie.IE
+	if err == nil {
+		if _, ok := u.association(nodeID); !ok {
+			u.logger.Errorf("[UPF] Rejecting session of CP SEID %d: no association with %s", cpSEID, nodeID)
+			cause = ie.CauseNoEstablishedPFCPAssociation
+		} else if err = u.createRules(session, req.CreatePDR, req.CreateFAR, req.CreateQER, req.CreateURR); err != nil {
+			u.alloc.release(session)
+		} else if timer != nil {
+			session.setInactivityTimer(*timer, session.CreatedAt)
+		}
+	}
+	if err != nil {
+		u.logger.Errorf("[UPF] Rejecting session of CP SEID %d: %v", cpSEID, err)
+		cause, failed = rejection(err)
+	}
 
-	// Send response
-	res := pfcpmsg.NewSessionEstablishmentResponse(
-		uint8(req.SequenceNumber&0xFF),
-		uint8(req.MessagePriority),
-		seid,
-		req.SequenceNumber,
-		uint8(req.MessagePriority),
-		ie.NewNodeID("upf.local", "", ""),
-		ie.NewCause(ie.CauseRequestAccepted),
-		ie.NewRecoveryTimeStamp(time.Now()),
-		ie.NewFSEID(seid, net.ParseIP("127.0.0.1"), nil),
-	)
+	ies := []*ie.IE{
+		u.nodeID(),
+		ie.NewCause(cause),
+	}
+	if cause == ie.CauseRequestAccepted {
+		u.addSession(session)
+		u.offloadSession(session)
+		u.saveSession(session)
+		ies = append(ies, u.fseid(session.SEID))
+		ies = append(ies, createdPDRs(session.PDRs)...)
+		u.logger.Infof("[UPF] Session %d established with %d PDRs for UE %s", session.SEID, len(session.PDRs), session.UEIP)
+	}
+	ies = append(ies, failed...)
 
+	res := pfcpmsg.NewSessionEstablishmentResponse(0, 0, cpSEID, req.SequenceNumber, 0, ies...)
 	if err := u.sendPFCP(res, remoteAddr); err != nil {
 		u.logger.Errorf("[UPF] Failed to send Session Establishment Response: %v", err)
 	}
+	if cause == ie.CauseRequestAccepted && session.UEPrefix != nil {
+		u.sendRouterAdvertisement(session, allNodes)
+	}
+}
+
+// createRules installs the session's PDRs, FARs, QERs and URRs and records
+// the UE address and access TEID of its uplink PDR
+func (u *UPF) createRules(session *Session, createPDRs, createFARs, createQERs, createURRs []*ie.IE) error {
+	pdrs := make([]*PDR, 0, len(createPDRs))
+	for _, i := range createPDRs {
+		pdr, err := parseCreatePDR(i)
+		if err != nil {
+			return err
+		}
+		pdrs = append(pdrs, pdr)
+	}
+	if err := u.alloc.assign(session, pdrs); err != nil {
+		return err
+	}
+	session.learnAddresses(pdrs)
+
+	fars := make([]*FAR, 0, len(createFARs))
+	for _, i := range createFARs {
+		far, err := parseCreateFAR(i)
+		if err != nil {
+			return err
+		}
+		fars = append(fars, far)
+	}
+
+	qers := make([]*QER, 0, len(createQERs))
+	for _, i := range createQERs {
+		qer, err := parseCreateQER(i)
+		if err != nil {
+			return err
+		}
+		qers = append(qers, qer)
+	}
+
+	urrs := make([]*URR, 0, len(createURRs))
+	for _, i := range createURRs {
+		urr, err := parseCreateURR(i)
+		if err != nil {
+			return err
+		}
+		urrs = append(urrs, urr)
+	}
+
+	return session.installRules(pdrs, fars, qers, urrs)
 }
 
 // handleSessionModificationRequest processes PFCP Session Modification Request
 func (u *UPF) handleSessionModificationRequest(req *pfcpmsg.SessionModificationRequest, remoteAddr *net.UDPAddr) {
 	seid := req.SEID()
 
-	u.sessionLock.Lock()
-	session, exists := u.sessions[seid]
-	if exists {
-		session.UpdatedAt = time.Now()
+	session, exists := u.ownedSession(seid, remoteAddr)
+	if !exists {
+		u.logger.Errorf("[UPF] Session %d of %s not found", seid, remoteAddr)
+		res := pfcpmsg.NewSessionModificationResponse(0, 0, 0, req.SequenceNumber, 0,
+			ie.NewCause(ie.CauseSessionContextNotFound),
+		)
+		if err := u.sendPFCP(res, remoteAddr); err != nil {
+			u.logger.Errorf("[UPF] Failed to send Session Modification Response: %v", err)
+		}
+		return
 	}
+	u.sessionLock.Lock()
+	session.UpdatedAt = time.Now()
 	u.sessionLock.Unlock()
 
-	if !exists {
-		u.logger.Errorf("[UPF] Session %d not found", seid)
-		return
+	cause := ie.CauseRequestAccepted
+	var failed []*ie.IE
+	hadTunnel := session.downlinkTunnel() != nil
+	tunnels := session.accessTunnels()
+	timer, err := parseInactivityTimer(req.UserPlaneInactivityTimer)
+	var created []*PDR
+	if err == nil {
+		created, err = session.modifyRules(req, u.alloc)
+	}
+	if err == nil && timer != nil {
+		session.setInactivityTimer(*timer, time.Now())
+	}
+	if err != nil {
+		u.logger.Errorf("[UPF] Failed to modify rules of session %d: %v", seid, err)
+		cause, failed = rejection(err)
+	} else {
+		u.indexSession(session)
+		u.offloadSession(session)
+		u.saveSession(session)
+		u.sendEndMarkers(session, tunnels)
+		u.flushBuffers(session)
 	}
 
-	res := pfcpmsg.NewSessionModificationResponse(
-		uint8(req.SequenceNumber&0xFF),
-		uint8(req.MessagePriority),
-		seid,
-		req.SequenceNumber,
-		uint8(req.MessagePriority),
-		ie.NewNodeID("upf.local", "", ""),
-		ie.NewCause(ie.CauseRequestAccepted),
-	)
+	// IPv6 UEs learn their prefix once the access tunnel is known, without
+	// waiting for a Router Solicitation
+	if cause == ie.CauseRequestAccepted && session.UEPrefix != nil && !hadTunnel {
+		u.sendRouterAdvertisement(session, allNodes)
+	}
+
+	ies := []*ie.IE{ie.NewCause(cause)}
+	ies = append(ies, failed...)
+	if cause == ie.CauseRequestAccepted {
+		ies = append(ies, createdPDRs(created)...)
+
+		// Removed URRs report their last usage, queried ones their
+		// usage so far
+		now := time.Now()
+		reports := session.finalUsage(false, now)
+		if ids, query := queriedURRs(req); query {
+			reports = append(reports, session.queryUsage(ids, now)...)
+		}
+		for _, r := range reports {
+			ies = append(ies, ie.NewUsageReportWithinSessionModificationResponse(r.ies()...))
+		}
+		u.publishUsage(session, reports)
+	}
+	res := pfcpmsg.NewSessionModificationResponse(0, 0, session.CPSEID, req.SequenceNumber, 0, ies...)
 
 	if err := u.sendPFCP(res, remoteAddr); err != nil {
 		u.logger.Errorf("[UPF] Failed to send Session Modification Response: %v", err)
@@ -309,29 +814,60 @@ func (u *UPF) handleSessionModificationRequest(req *pfcpmsg.SessionModificationR
 func (u *UPF) handleSessionDeletionRequest(req *pfcpmsg.SessionDeletionRequest, remoteAddr *net.UDPAddr) {
 	seid := req.SEID()
 
-	u.sessionLock.Lock()
-	delete(u.sessions, seid)
-	u.sessionLock.Unlock()
-
-	res := pfcpmsg.NewSessionDeletionResponse(
-		uint8(req.SequenceNumber&0xFF),
-		uint8(req.MessagePriority),
-		seid,
-		req.SequenceNumber,
-		uint8(req.MessagePriority),
-		ie.NewNodeID("upf.local", "", ""),
-		ie.NewCause(ie.CauseRequestAccepted),
-	)
+	var res *pfcpmsg.SessionDeletionResponse
+	if session, ok := u.ownedSession(seid, remoteAddr); !ok {
+		u.logger.Errorf("[UPF] Session %d of %s not found", seid, remoteAddr)
+		res = pfcpmsg.NewSessionDeletionResponse(0, 0, 0, req.SequenceNumber, 0,
+			ie.NewCause(ie.CauseSessionContextNotFound),
+		)
+	} else {
+		ies := []*ie.IE{ie.NewCause(ie.CauseRequestAccepted)}
+		if _, ok := u.removeSession(seid); ok {
+			u.deleteStored(seid)
+			for _, r := range u.releaseSession(session) {
+				ies = append(ies, ie.NewUsageReportWithinSessionDeletionResponse(r.ies()...))
+			}
+		}
+		res = pfcpmsg.NewSessionDeletionResponse(0, 0, session.CPSEID, req.SequenceNumber, 0, ies...)
+	}
 
 	if err := u.sendPFCP(res, remoteAddr); err != nil {
 		u.logger.Errorf("[UPF] Failed to send Session Deletion Response: %v", err)
 	}
 }
 
-// sendPFCP sends a PFCP message to the specified address
+// fseid returns the UPF's F-SEID of a session
+func (u *UPF) fseid(seid uint64) *ie.IE {
+	if v4 := u.nodeAddr.To4(); v4 != nil {
+		return ie.NewFSEID(seid, v4, nil)
+	}
+	return ie.NewFSEID(seid, nil, u.nodeAddr)
+}
+
+// sendSessionReport sends a Session Report Request to the SMF of a session
+func (u *UPF) sendSessionReport(session *Session, ies ...*ie.IE) error {
+	if u.pfcpConn == nil || session.cpAddr == nil {
+		return nil
+	}
+	req := pfcpmsg.NewSessionReportRequest(0, 0, session.CPSEID, u.nextSequence(), 0, ies...)
+	return u.sendPFCP(req, session.cpAddr)
+}
+
+// nextSequence returns the sequence number of a PFCP request sent by the UPF
+func (u *UPF) nextSequence() uint32 {
+	return atomic.AddUint32(&u.seq, 1) & 0xffffff
+}
+
+// sendPFCP sends a PFCP message to the specified address. Responses are
+// kept to answer retransmissions of their request.
 func (u *UPF) sendPFCP(msg pfcpmsg.Message, remoteAddr *net.UDPAddr) error {
 	buf := make([]byte, msg.MarshalLen())
-	msg.MarshalTo(buf)
+	if err := msg.MarshalTo(buf); err != nil {
+		return fmt.Errorf("failed to encode PFCP message: %w", err)
+	}
+	if !isPFCPRequest(msg.MessageType()) {
+		u.answered(buf, msg.Sequence(), remoteAddr)
+	}
 
 	_, err := u.pfcpConn.WriteToUDP(buf, remoteAddr)
 	if err != nil {
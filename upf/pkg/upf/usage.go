@@ -0,0 +1,528 @@
+package upf
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/wmnsk/go-pfcp/ie"
+	pfcpmsg "github.com/wmnsk/go-pfcp/message"
+)
+
+// Measurement Method flags (TS 29.244 §8.2.40)
+const (
+	measureDURAT uint8 = 0x01
+	measureVOLUM uint8 = 0x02
+)
+
+// Reporting Triggers the UPF acts on (TS 29.244 §8.2.19)
+const (
+	reportingPERIO uint8 = 0x01 // octet 5
+	reportingVOLTH uint8 = 0x02 // octet 5
+	reportingTIMTH uint8 = 0x04 // octet 5
+	reportingQUHTI uint8 = 0x08 // octet 5
+	reportingSTART uint8 = 0x10 // octet 5
+	reportingVOLQU uint8 = 0x01 // octet 6
+	reportingTIMQU uint8 = 0x02 // octet 6
+)
+
+// Usage Report Trigger flags (TS 29.244 §8.2.41)
+const (
+	usagePERIO uint8 = 0x01 // octet 5
+	usageVOLTH uint8 = 0x02 // octet 5
+	usageTIMTH uint8 = 0x04 // octet 5
+	usageQUHTI uint8 = 0x08 // octet 5
+	usageSTART uint8 = 0x10 // octet 5
+	usageIMMER uint8 = 0x80 // octet 5
+	usageVOLQU uint8 = 0x01 // octet 6
+	usageTIMQU uint8 = 0x02 // octet 6
+	usageTERMR uint8 = 0x08 // octet 6
+)
+
+// volumeMeasurementFlags reports the total, uplink and downlink volumes and
+// packet counts
+const volumeMeasurementFlags uint8 = 0x3f
+
+// smReqFlagQAURR asks for the usage of every URR of a session in a Session
+// Modification Response (TS 29.244 §8.2.44)
+const smReqFlagQAURR uint8 = 0x04
+
+// usageCheckInterval is how often time based triggers are checked
+const usageCheckInterval = time.Second
+
+// defaultUsageSubject is the NATS subject usage records are published on
+// when none is configured
+const defaultUsageSubject = "upf.usage"
+
+// UsageReport is the usage a URR measured between two reports
+type UsageReport struct {
+	URRID           uint32
+	URSEQN          uint32
+	Trigger         [2]byte // octets 5 and 6 of the Usage Report Trigger IE
+	StartTime       time.Time
+	EndTime         time.Time
+	UplinkVolume    uint64 // bytes
+	DownlinkVolume  uint64
+	UplinkPackets   uint64
+	DownlinkPackets uint64
+	Duration        time.Duration
+
+	method uint8
+}
+
+// urrMeter measures the traffic of a URR. Volumes and the duration count
+// from the last report and are reset by each report, the quota counts from
+// the last quota the SMF provisioned. Meters are kept per URR ID so updating
+// a URR keeps its measurement.
+type urrMeter struct {
+	mu  sync.Mutex
+	urr *URR
+
+	seqn            uint32
+	start           time.Time // start of the measurement
+	periodStart     time.Time
+	lastPacket      time.Time
+	started         bool // traffic was seen
+	idle            bool // the quota holding time expired without traffic
+	uplinkVolume    uint64
+	downlinkVolume  uint64
+	uplinkPackets   uint64
+	downlinkPackets uint64
+
+	quotaStart  time.Time
+	quotaVolume uint64
+	exhausted   bool // the volume or time quota is used up
+}
+
+// triggered reports whether a Reporting Triggers flag of octet 5 or 6 is set
+func (urr *URR) triggered(octet int, flag uint8) bool {
+	return len(urr.ReportingTriggers) > octet && urr.ReportingTriggers[octet]&flag != 0
+}
+
+// usageMeter returns the meter of a URR, creating it on first use
+func (s *Session) usageMeter(urr *URR, now time.Time) *urrMeter {
+	s.meterMu.Lock()
+	defer s.meterMu.Unlock()
+
+	if s.usage == nil {
+		s.usage = make(map[uint32]*urrMeter)
+	}
+	m, ok := s.usage[urr.ID]
+	if !ok {
+		m = &urrMeter{start: now, periodStart: now, lastPacket: now, quotaStart: now}
+		s.usage[urr.ID] = m
+	}
+	m.mu.Lock()
+	m.urr = urr
+	m.mu.Unlock()
+	return m
+}
+
+// quotaExhausted reports whether the quota of one of the URRs is used up,
+// in which case the packet is not forwarded
+func (s *Session) quotaExhausted(urrs []*URR) bool {
+	now := time.Now()
+	for _, urr := range urrs {
+		m := s.usageMeter(urr, now)
+		m.mu.Lock()
+		exhausted := m.exhausted
+		m.mu.Unlock()
+		if exhausted {
+			return true
+		}
+	}
+	return false
+}
+
+// measureUsage counts a forwarded packet in the URRs of its rule and
+// returns the reports the volume and start of traffic triggers raise
+func (s *Session) measureUsage(urrs []*URR, uplink bool, size int, now time.Time) []*UsageReport {
+	var reports []*UsageReport
+	for _, urr := range urrs {
+		if r := s.usageMeter(urr, now).measure(uplink, size, now); r != nil {
+			reports = append(reports, r)
+		}
+	}
+	return reports
+}
+
+func (m *urrMeter) measure(uplink bool, size int, now time.Time) *UsageReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	urr := m.urr
+	if uplink {
+		m.uplinkVolume += uint64(size)
+		m.uplinkPackets++
+	} else {
+		m.downlinkVolume += uint64(size)
+		m.downlinkPackets++
+	}
+	m.quotaVolume += uint64(size)
+	m.lastPacket = now
+	m.idle = false
+
+	var trigger [2]byte
+	if !m.started {
+		m.started = true
+		if urr.triggered(0, reportingSTART) {
+			trigger[0] |= usageSTART
+		}
+	}
+	if urr.MeasurementMethod&measureVOLUM != 0 {
+		if urr.VolumeThreshold > 0 && urr.triggered(0, reportingVOLTH) && m.uplinkVolume+m.downlinkVolume >= urr.VolumeThreshold {
+			trigger[0] |= usageVOLTH
+		}
+		if urr.VolumeQuota > 0 && m.quotaVolume >= urr.VolumeQuota {
+			m.exhausted = true
+			if urr.triggered(1, reportingVOLQU) {
+				trigger[1] |= usageVOLQU
+			}
+		}
+	}
+	if trigger == [2]byte{} {
+		return nil
+	}
+	return m.reportLocked(trigger, now)
+}
+
+// checkUsage returns the reports of the session's URRs raised by the
+// time threshold and quota, the measurement period and the quota holding
+// time
+func (s *Session) checkUsage(now time.Time) []*UsageReport {
+	s.mu.RLock()
+	urrs := make([]*URR, 0, len(s.URRs))
+	for _, urr := range s.URRs {
+		urrs = append(urrs, urr)
+	}
+	s.mu.RUnlock()
+
+	var reports []*UsageReport
+	for _, urr := range urrs {
+		if r := s.usageMeter(urr, now).check(now); r != nil {
+			reports = append(reports, r)
+		}
+	}
+	sortUsageReports(reports)
+	return reports
+}
+
+func (m *urrMeter) check(now time.Time) *UsageReport {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	urr := m.urr
+	var trigger [2]byte
+	if urr.MeasurementMethod&measureDURAT != 0 {
+		if urr.TimeThreshold > 0 && urr.triggered(0, reportingTIMTH) && now.Sub(m.start) >= urr.TimeThreshold {
+			trigger[0] |= usageTIMTH
+		}
+		if urr.TimeQuota > 0 && !m.exhausted && now.Sub(m.quotaStart) >= urr.TimeQuota {
+			m.exhausted = true
+			if urr.triggered(1, reportingTIMQU) {
+				trigger[1] |= usageTIMQU
+			}
+		}
+	}
+	if urr.MeasurementPeriod > 0 && urr.triggered(0, reportingPERIO) && now.Sub(m.periodStart) >= urr.MeasurementPeriod {
+		m.periodStart = now
+		trigger[0] |= usagePERIO
+	}
+	if urr.QuotaHoldingTime > 0 && urr.triggered(0, reportingQUHTI) && !m.idle && now.Sub(m.lastPacket) >= urr.QuotaHoldingTime {
+		m.idle = true
+		trigger[0] |= usageQUHTI
+	}
+	if trigger == [2]byte{} {
+		return nil
+	}
+	return m.reportLocked(trigger, now)
+}
+
+// reportLocked returns the usage measured since the last report and starts
+// a new measurement. The caller holds m.mu.
+func (m *urrMeter) reportLocked(trigger [2]byte, now time.Time) *UsageReport {
+	m.seqn++
+	r := &UsageReport{
+		URRID:           m.urr.ID,
+		URSEQN:          m.seqn,
+		Trigger:         trigger,
+		StartTime:       m.start,
+		EndTime:         now,
+		UplinkVolume:    m.uplinkVolume,
+		DownlinkVolume:  m.downlinkVolume,
+		UplinkPackets:   m.uplinkPackets,
+		DownlinkPackets: m.downlinkPackets,
+		Duration:        now.Sub(m.start),
+		method:          m.urr.MeasurementMethod,
+	}
+	m.start = now
+	m.uplinkVolume, m.downlinkVolume = 0, 0
+	m.uplinkPackets, m.downlinkPackets = 0, 0
+	return r
+}
+
+// queryUsage returns the immediate reports of the URRs with the given IDs,
+// of every URR when ids is nil
+func (s *Session) queryUsage(ids []uint32, now time.Time) []*UsageReport {
+	s.mu.RLock()
+	var urrs []*URR
+	for id, urr := range s.URRs {
+		if ids == nil || containsID(ids, id) {
+			urrs = append(urrs, urr)
+		}
+	}
+	s.mu.RUnlock()
+
+	var reports []*UsageReport
+	for _, urr := range urrs {
+		m := s.usageMeter(urr, now)
+		m.mu.Lock()
+		reports = append(reports, m.reportLocked([2]byte{usageIMMER, 0}, now))
+		m.mu.Unlock()
+	}
+	sortUsageReports(reports)
+	return reports
+}
+
+// resetQuota starts counting a newly provisioned quota of a URR, allowing
+// traffic again
+func (s *Session) resetQuota(id uint32, now time.Time) {
+	s.meterMu.Lock()
+	m, ok := s.usage[id]
+	s.meterMu.Unlock()
+	if !ok {
+		return
+	}
+	m.mu.Lock()
+	m.quotaStart = now
+	m.quotaVolume = 0
+	m.exhausted = false
+	m.mu.Unlock()
+}
+
+// finalUsage returns the termination reports of the meters whose URR is
+// gone, of every meter when all is set, and drops them
+func (s *Session) finalUsage(all bool, now time.Time) []*UsageReport {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.meterMu.Lock()
+	defer s.meterMu.Unlock()
+
+	if all {
+		for _, urr := range s.URRs {
+			if _, ok := s.usage[urr.ID]; !ok {
+				if s.usage == nil {
+					s.usage = make(map[uint32]*urrMeter)
+				}
+				s.usage[urr.ID] = &urrMeter{urr: urr, start: now}
+			}
+		}
+	}
+
+	var reports []*UsageReport
+	for id, m := range s.usage {
+		if _, ok := s.URRs[id]; ok && !all {
+			continue
+		}
+		m.mu.Lock()
+		reports = append(reports, m.reportLocked([2]byte{0, usageTERMR}, now))
+		m.mu.Unlock()
+		delete(s.usage, id)
+	}
+	sortUsageReports(reports)
+	return reports
+}
+
+func sortUsageReports(reports []*UsageReport) {
+	sort.Slice(reports, func(i, j int) bool { return reports[i].URRID < reports[j].URRID })
+}
+
+func containsID(ids []uint32, id uint32) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+// queriedURRs returns the URR IDs of the Query URR IEs of a Session
+// Modification Request, nil for all URRs when the QAURR flag is set
+func queriedURRs(req *pfcpmsg.SessionModificationRequest) (ids []uint32, query bool) {
+	if req.PFCPSMReqFlags != nil {
+		if flags, err := req.PFCPSMReqFlags.PFCPSMReqFlags(); err == nil && flags&smReqFlagQAURR != 0 {
+			return nil, true
+		}
+	}
+	for _, i := range req.QueryURR {
+		children, err := i.QueryURR()
+		if err != nil {
+			continue
+		}
+		if id, err := childRuleID(children, ie.URRID); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, len(ids) > 0
+}
+
+// ies returns the children of the Usage Report IE of the report
+func (r *UsageReport) ies() []*ie.IE {
+	ies := []*ie.IE{
+		ie.NewURRID(r.URRID),
+		ie.NewURSEQN(r.URSEQN),
+		ie.NewUsageReportTrigger(r.Trigger[0], r.Trigger[1], 0),
+		ie.NewStartTime(r.StartTime),
+		ie.NewEndTime(r.EndTime),
+	}
+	if r.method&measureVOLUM != 0 {
+		ies = append(ies, ie.NewVolumeMeasurement(volumeMeasurementFlags,
+			r.UplinkVolume+r.DownlinkVolume, r.UplinkVolume, r.DownlinkVolume,
+			r.UplinkPackets+r.DownlinkPackets, r.UplinkPackets, r.DownlinkPackets,
+		))
+	}
+	if r.method&measureDURAT != 0 {
+		ies = append(ies, ie.NewDurationMeasurement(r.Duration))
+	}
+	return ies
+}
+
+// serveUsage checks the time based triggers and the User Plane Inactivity
+// Timer of every session until the UPF is closed
+func (u *UPF) serveUsage() {
+	ticker := time.NewTicker(usageCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-u.done:
+			return
+		case now := <-ticker.C:
+			u.sessionLock.RLock()
+			sessions := make([]*Session, 0, len(u.sessions))
+			for _, session := range u.sessions {
+				sessions = append(sessions, session)
+			}
+			u.sessionLock.RUnlock()
+
+			for _, session := range sessions {
+				u.reportUsage(session, session.checkUsage(now))
+				if session.checkInactivity(now) {
+					u.reportInactivity(session)
+				}
+			}
+		}
+	}
+}
+
+// reportUsage sends usage reports to the SMF in a Session Report Request
+// and publishes them
+func (u *UPF) reportUsage(session *Session, reports []*UsageReport) {
+	if len(reports) == 0 {
+		return
+	}
+	u.publishUsage(session, reports)
+
+	ies := []*ie.IE{ie.NewReportType(0, 0, 1, 0)}
+	for _, r := range reports {
+		ies = append(ies, ie.NewUsageReportWithinSessionReportRequest(r.ies()...))
+	}
+	if err := u.sendSessionReport(session, ies...); err != nil {
+		u.logger.Errorf("[UPF] Failed to send Session Report Request of session %d: %v", session.SEID, err)
+		return
+	}
+	u.logger.Debugf("[UPF] Reported usage of %d URRs of session %d", len(reports), session.SEID)
+}
+
+// handleSessionReportResponse logs a Session Report Request the SMF rejected
+func (u *UPF) handleSessionReportResponse(res *pfcpmsg.SessionReportResponse, remoteAddr *net.UDPAddr) {
+	if res.Cause == nil {
+		return
+	}
+	if cause, err := res.Cause.Cause(); err == nil && cause != ie.CauseRequestAccepted {
+		u.logger.Warnf("[UPF] Session Report of SEID %d rejected by %s with cause %d", res.SEID(), remoteAddr, cause)
+	}
+}
+
+// connectUsage connects to the NATS server usage records are published
+// on. The UPF runs without publishing them when it is unset or unreachable.
+func (u *UPF) connectUsage() {
+	if u.cfg.NATS.URL == "" {
+		return
+	}
+	nc, err := nats.Connect(u.cfg.NATS.URL)
+	if err != nil {
+		u.logger.Errorf("[UPF] Failed to connect to NATS at %s, usage records disabled: %v", u.cfg.NATS.URL, err)
+		return
+	}
+	u.usageConn = nc
+}
+
+// publishUsage publishes usage reports as records for offline charging
+func (u *UPF) publishUsage(session *Session, reports []*UsageReport) {
+	if u.usageConn == nil {
+		return
+	}
+	subject := u.cfg.NATS.UsageSubject
+	if subject == "" {
+		subject = defaultUsageSubject
+	}
+	for _, r := range reports {
+		record := map[string]interface{}{
+			"event":            "usage.report",
+			"seid":             session.SEID,
+			"cp_seid":          session.CPSEID,
+			"urr_id":           r.URRID,
+			"ur_seqn":          r.URSEQN,
+			"triggers":         r.triggerNames(),
+			"start_time":       r.StartTime,
+			"end_time":         r.EndTime,
+			"uplink_volume":    r.UplinkVolume,
+			"downlink_volume":  r.DownlinkVolume,
+			"uplink_packets":   r.UplinkPackets,
+			"downlink_packets": r.DownlinkPackets,
+			"duration":         r.Duration.Seconds(),
+			"timestamp":        time.Now(),
+		}
+		if session.UEIP != nil {
+			record["ue_ip"] = session.UEIP.String()
+		}
+		data, err := json.Marshal(record)
+		if err != nil {
+			u.logger.Errorf("[UPF] Failed to marshal usage record: %v", err)
+			continue
+		}
+		if err := u.usageConn.Publish(subject, data); err != nil {
+			u.logger.Errorf("[UPF] Failed to publish usage record of session %d: %v", session.SEID, err)
+		}
+	}
+}
+
+// triggerNames returns the names of the report's Usage Report Trigger flags
+func (r *UsageReport) triggerNames() []string {
+	flags := []struct {
+		octet int
+		flag  uint8
+		name  string
+	}{
+		{0, usagePERIO, "PERIO"},
+		{0, usageVOLTH, "VOLTH"},
+		{0, usageTIMTH, "TIMTH"},
+		{0, usageQUHTI, "QUHTI"},
+		{0, usageSTART, "START"},
+		{0, usageIMMER, "IMMER"},
+		{1, usageVOLQU, "VOLQU"},
+		{1, usageTIMQU, "TIMQU"},
+		{1, usageTERMR, "TERMR"},
+	}
+	var names []string
+	for _, f := range flags {
+		if r.Trigger[f.octet]&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,142 @@
+package upf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+func TestMeasureUsageVolume(t *testing.T) {
+	urr := &URR{
+		ID:                1,
+		MeasurementMethod: measureVOLUM,
+		ReportingTriggers: []byte{reportingVOLTH, reportingVOLQU},
+		VolumeThreshold:   2000,
+		VolumeQuota:       3000,
+	}
+	session := &Session{URRs: map[uint32]*URR{1: urr}}
+	now := time.Now()
+
+	if reports := session.measureUsage([]*URR{urr}, true, 1000, now); len(reports) != 0 {
+		t.Fatalf("reports below the threshold = %+v", reports)
+	}
+	reports := session.measureUsage([]*URR{urr}, false, 1000, now)
+	if len(reports) != 1 || reports[0].Trigger != [2]byte{usageVOLTH, 0} {
+		t.Fatalf("reports at the threshold = %+v, want a VOLTH report", reports)
+	}
+	if r := reports[0]; r.UplinkVolume != 1000 || r.DownlinkVolume != 1000 || r.UplinkPackets != 1 || r.URSEQN != 1 {
+		t.Errorf("VOLTH report = %+v, want 1000 bytes each way", r)
+	}
+
+	// The quota counts across reports
+	reports = session.measureUsage([]*URR{urr}, true, 1000, now)
+	if len(reports) != 1 || reports[0].Trigger != [2]byte{0, usageVOLQU} || reports[0].UplinkVolume != 1000 {
+		t.Fatalf("reports at the quota = %+v, want a VOLQU report of 1000 bytes", reports)
+	}
+	if !session.quotaExhausted([]*URR{urr}) {
+		t.Error("quotaExhausted() = false after the quota was used")
+	}
+	session.resetQuota(1, now)
+	if session.quotaExhausted([]*URR{urr}) {
+		t.Error("quotaExhausted() = true after a new quota")
+	}
+}
+
+func TestCheckUsageTimeTriggers(t *testing.T) {
+	start := time.Now()
+	periodic := &URR{
+		ID:                1,
+		MeasurementMethod: measureDURAT,
+		ReportingTriggers: []byte{reportingPERIO | reportingTIMTH, reportingTIMQU},
+		MeasurementPeriod: 10 * time.Second,
+		TimeThreshold:     time.Minute,
+		TimeQuota:         90 * time.Second,
+	}
+	inactivity := &URR{
+		ID:                2,
+		MeasurementMethod: measureDURAT,
+		ReportingTriggers: []byte{reportingQUHTI, 0},
+		QuotaHoldingTime:  30 * time.Second,
+	}
+	session := &Session{URRs: map[uint32]*URR{1: periodic, 2: inactivity}}
+	session.checkUsage(start)
+
+	reports := session.checkUsage(start.Add(10 * time.Second))
+	if len(reports) != 1 || reports[0].URRID != 1 || reports[0].Trigger != [2]byte{usagePERIO, 0} || reports[0].Duration != 10*time.Second {
+		t.Fatalf("reports after a period = %+v, want a 10s PERIO report of URR 1", reports)
+	}
+
+	reports = session.checkUsage(start.Add(30 * time.Second))
+	if len(reports) != 2 || reports[1].URRID != 2 || reports[1].Trigger != [2]byte{usageQUHTI, 0} {
+		t.Fatalf("reports after 30s without traffic = %+v, want a QUHTI report of URR 2", reports)
+	}
+	if reports := session.checkUsage(start.Add(31 * time.Second)); len(reports) != 0 {
+		t.Errorf("inactivity reported again: %+v", reports)
+	}
+
+	reports = session.checkUsage(start.Add(90 * time.Second))
+	if len(reports) != 1 || reports[0].Trigger[1] != usageTIMQU || !session.quotaExhausted([]*URR{periodic}) {
+		t.Errorf("reports at the time quota = %+v, want a TIMQU report", reports)
+	}
+}
+
+func TestFinalUsage(t *testing.T) {
+	urr := &URR{ID: 7, MeasurementMethod: measureVOLUM | measureDURAT}
+	session := &Session{URRs: map[uint32]*URR{7: urr, 8: {ID: 8}}}
+	now := time.Now()
+	session.measureUsage([]*URR{urr}, true, 1500, now)
+
+	queried := session.queryUsage([]uint32{7}, now.Add(time.Second))
+	if len(queried) != 1 || queried[0].Trigger != [2]byte{usageIMMER, 0} || queried[0].UplinkVolume != 1500 {
+		t.Fatalf("queryUsage() = %+v, want an IMMER report of 1500 bytes", queried)
+	}
+
+	// A removed URR reports its last usage with the next modification
+	session.measureUsage([]*URR{urr}, false, 500, now)
+	delete(session.URRs, 7)
+	reports := session.finalUsage(false, now.Add(2*time.Second))
+	if len(reports) != 1 || reports[0].URRID != 7 || reports[0].Trigger != [2]byte{0, usageTERMR} || reports[0].DownlinkVolume != 500 {
+		t.Fatalf("finalUsage(false) = %+v, want the TERMR report of URR 7", reports)
+	}
+
+	reports = session.finalUsage(true, now.Add(3*time.Second))
+	if len(reports) != 1 || reports[0].URRID != 8 {
+		t.Errorf("finalUsage(true) = %+v, want the report of URR 8", reports)
+	}
+}
+
+func TestUsageReportIE(t *testing.T) {
+	start := time.Now().Truncate(time.Second)
+	r := &UsageReport{
+		URRID:           1,
+		URSEQN:          3,
+		Trigger:         [2]byte{usageVOLTH, 0},
+		StartTime:       start,
+		EndTime:         start.Add(time.Minute),
+		UplinkVolume:    1000,
+		DownlinkVolume:  4000,
+		UplinkPackets:   2,
+		DownlinkPackets: 5,
+		Duration:        time.Minute,
+		method:          measureVOLUM | measureDURAT,
+	}
+	i := ie.NewUsageReportWithinSessionReportRequest(r.ies()...)
+
+	vol, err := i.VolumeMeasurement()
+	if err != nil {
+		t.Fatalf("VolumeMeasurement() error = %v", err)
+	}
+	if vol.TotalVolume != 5000 || vol.UplinkVolume != 1000 || vol.DownlinkNumberOfPackets != 5 {
+		t.Errorf("Volume Measurement = %+v", vol)
+	}
+	if d, err := i.DurationMeasurement(); err != nil || d != time.Minute {
+		t.Errorf("DurationMeasurement() = %v, %v, want 1m", d, err)
+	}
+	if trigger, err := i.UsageReportTrigger(); err != nil || trigger[0] != usageVOLTH {
+		t.Errorf("UsageReportTrigger() = %x, %v, want VOLTH", trigger, err)
+	}
+	if names := r.triggerNames(); len(names) != 1 || names[0] != "VOLTH" {
+		t.Errorf("triggerNames() = %v", names)
+	}
+}
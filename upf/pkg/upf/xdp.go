@@ -0,0 +1,298 @@
+package upf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/wmnsk/go-pfcp/ie"
+)
+
+// Maps of bpf/upf_xdp.c
+const (
+	xdpUplinkMap   = "uplink_teids"
+	xdpDownlinkMap = "downlink_ues"
+
+	defaultXDPPinPath = "/sys/fs/bpf/upf"
+)
+
+// xdpKey is an entry of the XDP maps, keyed by TEID or UE address in
+// network byte order
+type xdpKey struct {
+	table string
+	key   [4]byte
+}
+
+// xdpOffload is the XDP GTP-U offload, loaded and attached with bpftool.
+// Sessions it can forward on its own are written to its maps through
+// bpf(2); the packets of the others are passed to the kernel and reach the
+// UPF's data plane.
+type xdpOffload struct {
+	pinPath string
+	devices []string
+	maps    map[string]*bpfMap
+
+	mu       sync.Mutex
+	sessions map[uint64]map[xdpKey]string // entries written per SEID
+}
+
+// startXDP loads the XDP program, pins its maps and attaches it to the N3
+// and N6 devices
+func (u *UPF) startXDP() error {
+	cfg := u.cfg.FastPath.XDP
+	x := &xdpOffload{
+		pinPath:  cfg.PinPath,
+		devices:  cfg.Devices,
+		maps:     make(map[string]*bpfMap),
+		sessions: make(map[uint64]map[xdpKey]string),
+	}
+	if x.pinPath == "" {
+		x.pinPath = defaultXDPPinPath
+	}
+	mode := cfg.Mode
+	if mode == "" {
+		mode = "xdp"
+	}
+
+	// A previous run may have left its pins
+	if err := os.RemoveAll(x.pinPath); err != nil {
+		return err
+	}
+	if err := bpftool("prog", "load", cfg.Object, x.pinProg(), "type", "xdp", "pinmaps", x.pinPath); err != nil {
+		return err
+	}
+	for _, name := range []string{xdpUplinkMap, xdpDownlinkMap} {
+		m, err := openBPFMap(filepath.Join(x.pinPath, name))
+		if err != nil {
+			x.close()
+			return err
+		}
+		x.maps[name] = m
+	}
+	for _, dev := range x.devices {
+		if err := bpftool("net", "attach", mode, "pinned", x.pinProg(), "dev", dev, "overwrite"); err != nil {
+			x.close()
+			return err
+		}
+	}
+	u.xdp = x
+	u.logger.Infof("[UPF] XDP offload %s attached to %v", cfg.Object, x.devices)
+	return nil
+}
+
+func (x *xdpOffload) pinProg() string {
+	return filepath.Join(x.pinPath, "prog")
+}
+
+// close detaches the program and removes its pins
+func (x *xdpOffload) close() {
+	for _, m := range x.maps {
+		m.close()
+	}
+	for _, dev := range x.devices {
+		bpftool("net", "detach", "xdp", "dev", dev)
+	}
+	os.RemoveAll(x.pinPath)
+}
+
+func bpftool(args ...string) error {
+	if out, err := exec.Command("bpftool", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("bpftool %s: %w: %s", strings.Join(args, " "), err, out)
+	}
+	return nil
+}
+
+// offloadSession writes the XDP map entries of a session, removing those of
+// rules it no longer has, or all of them once it cannot be offloaded or is
+// being captured
+func (u *UPF) offloadSession(session *Session) {
+	if u.xdp == nil {
+		return
+	}
+	entries := xdpEntries(session, u.alloc.n3Addr, u.cfg.DSCP)
+	if entries != nil && u.captured(session) {
+		// Captured sessions need all their packets in user space
+		entries = nil
+	}
+	if err := u.xdp.update(session.SEID, entries); err != nil {
+		u.logger.Errorf("[UPF] Failed to offload session %d to XDP: %v", session.SEID, err)
+		return
+	}
+	if len(entries) != 0 {
+		u.logger.Debugf("[UPF] Offloaded session %d to XDP with %d entries", session.SEID, len(entries))
+	}
+}
+
+// unoffloadSession removes the XDP map entries of a deleted session
+func (u *UPF) unoffloadSession(session *Session) {
+	if u.xdp == nil {
+		return
+	}
+	if err := u.xdp.update(session.SEID, nil); err != nil {
+		u.logger.Errorf("[UPF] Failed to remove session %d from XDP: %v", session.SEID, err)
+	}
+}
+
+// xdpBatch is the keys and values written to or deleted from a map in one
+// batch
+type xdpBatch struct {
+	keys, values []byte
+	count        int
+}
+
+// update writes the changed entries of a session and deletes those it no
+// longer has, a batch per map
+func (x *xdpOffload) update(seid uint64, entries map[xdpKey]string) error {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	old := x.sessions[seid]
+	deletes := make(map[string]*xdpBatch)
+	for k := range old {
+		if _, ok := entries[k]; !ok {
+			deletes[k.table] = deletes[k.table].add(k, "")
+		}
+	}
+	updates := make(map[string]*xdpBatch)
+	for k, v := range entries {
+		if old[k] != v {
+			updates[k.table] = updates[k.table].add(k, v)
+		}
+	}
+
+	for table, b := range deletes {
+		if err := x.maps[table].delete(b.keys, b.count); err != nil {
+			return fmt.Errorf("failed to delete %d entries of %s: %w", b.count, table, err)
+		}
+	}
+	for k := range old {
+		if _, ok := entries[k]; !ok {
+			delete(old, k)
+		}
+	}
+	for table, b := range updates {
+		if err := x.maps[table].update(b.keys, b.values, b.count); err != nil {
+			return fmt.Errorf("failed to update %d entries of %s: %w", b.count, table, err)
+		}
+	}
+	if len(entries) == 0 {
+		delete(x.sessions, seid)
+	} else {
+		x.sessions[seid] = entries
+	}
+	return nil
+}
+
+func (b *xdpBatch) add(k xdpKey, v string) *xdpBatch {
+	if b == nil {
+		b = &xdpBatch{}
+	}
+	b.keys = append(b.keys, k.key[:]...)
+	b.values = append(b.values, v...)
+	b.count++
+	return b
+}
+
+// xdpEntries returns the XDP map entries forwarding an IPv4 session, nil
+// when a rule needs the UPF: SDF filters and application detection,
+// usage reporting, policing and gates, buffering, duplication, N9
+// chaining or DSCP marking. Values are laid out like struct uplink_tunnel
+// and struct downlink_tunnel of bpf/upf_xdp.c.
+func xdpEntries(s *Session, n3Addr net.IP, dscp map[uint8]uint8) map[xdpKey]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ue := s.UEIP.To4()
+	if ue == nil {
+		return nil
+	}
+	var key [4]byte
+	copy(key[:], ue)
+	local := n3Addr.To4()
+
+	entries := make(map[xdpKey]string)
+	var downlink *PDR
+	for _, pdr := range s.PDRs {
+		far := s.FARs[pdr.FARID]
+		if far == nil || far.ApplyAction != ApplyActionFORW ||
+			len(pdr.SDFFilters) != 0 || pdr.AppID != "" || len(pdr.URRIDs) != 0 {
+			return nil
+		}
+		qfi, ok := xdpQFI(s, pdr)
+		if !ok {
+			return nil
+		}
+
+		switch pdr.SourceInterface {
+		case ie.SrcInterfaceAccess:
+			if pdr.TEID == 0 || !pdr.OuterHeaderRemoval || far.OuterHeader != nil ||
+				far.DestinationInterface != ie.DstInterfaceCore {
+				return nil
+			}
+			if _, marked := dscp[qfi]; marked {
+				return nil
+			}
+			addr := local
+			if v4 := pdr.TEIDAddr.To4(); v4 != nil {
+				addr, local = v4, v4
+			}
+			if addr == nil {
+				return nil
+			}
+			k := xdpKey{table: xdpUplinkMap}
+			binary.BigEndian.PutUint32(k.key[:], pdr.TEID)
+			if _, ok := entries[k]; !ok {
+				entries[k] = string(key[:]) + string(addr)
+			}
+		case ie.SrcInterfaceCore:
+			if pdr.TEID != 0 || far.OuterHeader == nil || far.OuterHeader.Addr.To4() == nil ||
+				far.DestinationInterface != ie.DstInterfaceAccess {
+				return nil
+			}
+			// PDRs are in precedence order, the first applies
+			if downlink == nil {
+				downlink = pdr
+			}
+		default:
+			return nil
+		}
+	}
+	if downlink != nil {
+		if local == nil {
+			return nil
+		}
+		tunnel := s.FARs[downlink.FARID].OuterHeader
+		qfi, _ := xdpQFI(s, downlink)
+		v := make([]byte, 16)
+		binary.BigEndian.PutUint32(v, tunnel.TEID)
+		copy(v[4:8], tunnel.Addr.To4())
+		copy(v[8:12], local)
+		v[12] = qfi
+		entries[xdpKey{table: xdpDownlinkMap, key: key}] = string(v)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	return entries
+}
+
+// xdpQFI returns the QFI the QERs of a PDR mark, false when they enforce a
+// gate or bit rate
+func xdpQFI(s *Session, pdr *PDR) (uint8, bool) {
+	var qfi uint8
+	for _, id := range pdr.QERIDs {
+		qer := s.QERs[id]
+		if qer == nil || qer.GateUL != GateOpen || qer.GateDL != GateOpen || qer.MBRUL != 0 || qer.MBRDL != 0 {
+			return 0, false
+		}
+		if qfi == 0 {
+			qfi = qer.QFI
+		}
+	}
+	return qfi, true
+}
@@ -0,0 +1,144 @@
+//go:build linux
+
+package upf
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// errnoENOTSUPP is returned by kernels before 5.6, which have no batch
+// operations on hash maps
+const errnoENOTSUPP = unix.Errno(524)
+
+// bpfObjAttr is the union bpf_attr of BPF_OBJ_GET
+type bpfObjAttr struct {
+	pathname  uint64
+	bpfFD     uint32
+	fileFlags uint32
+}
+
+// bpfElemAttr is the union bpf_attr of the element commands
+type bpfElemAttr struct {
+	mapFD uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+// bpfBatchAttr is the union bpf_attr of the batch commands
+type bpfBatchAttr struct {
+	inBatch   uint64
+	outBatch  uint64
+	keys      uint64
+	values    uint64
+	count     uint32
+	mapFD     uint32
+	elemFlags uint64
+	flags     uint64
+}
+
+// bpfMap is a pinned BPF map the control plane writes through bpf(2)
+type bpfMap struct {
+	fd int
+}
+
+// openBPFMap opens a map pinned at path
+func openBPFMap(path string) (*bpfMap, error) {
+	name, err := unix.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	attr := bpfObjAttr{pathname: uint64(uintptr(unsafe.Pointer(name)))}
+	fd, err := bpf(unix.BPF_OBJ_GET, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open BPF map %s: %w", path, err)
+	}
+	return &bpfMap{fd: fd}, nil
+}
+
+func (m *bpfMap) close() error {
+	return unix.Close(m.fd)
+}
+
+// update writes count entries, keys and values laid out back to back, in
+// one system call, or one per entry on kernels without batch operations
+func (m *bpfMap) update(keys, values []byte, count int) error {
+	if count == 0 {
+		return nil
+	}
+	attr := bpfBatchAttr{
+		keys:   uint64(uintptr(unsafe.Pointer(&keys[0]))),
+		values: uint64(uintptr(unsafe.Pointer(&values[0]))),
+		count:  uint32(count),
+		mapFD:  uint32(m.fd),
+	}
+	_, err := bpf(unix.BPF_MAP_UPDATE_BATCH, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(keys)
+	runtime.KeepAlive(values)
+	if !unsupportedBatch(err) {
+		return err
+	}
+
+	keySize, valueSize := len(keys)/count, len(values)/count
+	for i := 0; i < count; i++ {
+		elem := bpfElemAttr{
+			mapFD: uint32(m.fd),
+			key:   uint64(uintptr(unsafe.Pointer(&keys[i*keySize]))),
+			value: uint64(uintptr(unsafe.Pointer(&values[i*valueSize]))),
+		}
+		_, err := bpf(unix.BPF_MAP_UPDATE_ELEM, unsafe.Pointer(&elem), unsafe.Sizeof(elem))
+		runtime.KeepAlive(keys)
+		runtime.KeepAlive(values)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete removes count entries whose keys are laid out back to back
+func (m *bpfMap) delete(keys []byte, count int) error {
+	if count == 0 {
+		return nil
+	}
+	attr := bpfBatchAttr{
+		keys:  uint64(uintptr(unsafe.Pointer(&keys[0]))),
+		count: uint32(count),
+		mapFD: uint32(m.fd),
+	}
+	_, err := bpf(unix.BPF_MAP_DELETE_BATCH, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(keys)
+	if !unsupportedBatch(err) {
+		return err
+	}
+
+	keySize := len(keys) / count
+	for i := 0; i < count; i++ {
+		elem := bpfElemAttr{mapFD: uint32(m.fd), key: uint64(uintptr(unsafe.Pointer(&keys[i*keySize])))}
+		_, err := bpf(unix.BPF_MAP_DELETE_ELEM, unsafe.Pointer(&elem), unsafe.Sizeof(elem))
+		runtime.KeepAlive(keys)
+		if err != nil && !errors.Is(err, unix.ENOENT) {
+			return err
+		}
+	}
+	return nil
+}
+
+func unsupportedBatch(err error) bool {
+	return errors.Is(err, errnoENOTSUPP) || errors.Is(err, unix.EINVAL)
+}
+
+func bpf(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package upf
+
+import "errors"
+
+// bpfMap is only supported on Linux
+type bpfMap struct{}
+
+func openBPFMap(path string) (*bpfMap, error) {
+	return nil, errors.New("XDP offload is only supported on Linux")
+}
+
+func (m *bpfMap) close() error { return nil }
+
+func (m *bpfMap) update(keys, values []byte, count int) error { return nil }
+
+func (m *bpfMap) delete(keys []byte, count int) error { return nil }
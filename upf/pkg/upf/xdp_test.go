@@ -0,0 +1,62 @@
+package upf
+
+import (
+	"net"
+	"testing"
+)
+
+func TestXDPEntries(t *testing.T) {
+	u, _ := dataPlaneUPF(t, "198.51.100.7")
+	session, _ := u.sessionByUE(net.ParseIP("10.0.0.1"))
+
+	entries := xdpEntries(session, u.alloc.n3Addr, nil)
+	uplink := entries[xdpKey{table: xdpUplinkMap, key: [4]byte{0, 0, 0, 100}}]
+	if uplink != "\x0a\x00\x00\x01\xc0\x00\x02\x01" {
+		t.Errorf("uplink entry = %x, want UE 10.0.0.1 on 192.0.2.1", uplink)
+	}
+	downlink := entries[xdpKey{table: xdpDownlinkMap, key: [4]byte{10, 0, 0, 1}}]
+	if downlink != "\x00\x00\x01\x2c\xc6\x33\x64\x07\xc0\x00\x02\x01\x00\x00\x00\x00" {
+		t.Errorf("downlink entry = %x, want TEID 300 to 198.51.100.7 from 192.0.2.1", downlink)
+	}
+	if len(entries) != 2 {
+		t.Errorf("entries = %d, want 2", len(entries))
+	}
+
+	session.mu.Lock()
+	session.QERs = map[uint32]*QER{1: {ID: 1, QFI: 9}}
+	session.PDRs[0].QERIDs = []uint32{1}
+	session.PDRs[1].QERIDs = []uint32{1}
+	session.mu.Unlock()
+	entries = xdpEntries(session, u.alloc.n3Addr, nil)
+	downlink = entries[xdpKey{table: xdpDownlinkMap, key: [4]byte{10, 0, 0, 1}}]
+	if len(entries) != 2 || downlink[12] != 9 {
+		t.Fatalf("entries with a QFI marking QER = %x, want downlink QFI 9", entries)
+	}
+
+	// Uplink packets marked with DSCP, policed or reported need the UPF
+	if entries := xdpEntries(session, u.alloc.n3Addr, map[uint8]uint8{9: 46}); entries != nil {
+		t.Errorf("entries with DSCP marking = %x", entries)
+	}
+	session.mu.Lock()
+	session.QERs[1].MBRUL = 1000
+	session.mu.Unlock()
+	if entries := xdpEntries(session, u.alloc.n3Addr, nil); entries != nil {
+		t.Errorf("entries with an MBR = %x", entries)
+	}
+	session.mu.Lock()
+	session.QERs[1].MBRUL = 0
+	session.PDRs[0].URRIDs = []uint32{1}
+	session.mu.Unlock()
+	if entries := xdpEntries(session, u.alloc.n3Addr, nil); entries != nil {
+		t.Errorf("entries with a URR = %x", entries)
+	}
+}
+
+func TestXDPBatch(t *testing.T) {
+	var b *xdpBatch
+	b = b.add(xdpKey{table: xdpUplinkMap, key: [4]byte{0, 0, 0, 100}}, "\x0a\x00\x00\x01\xc0\x00\x02\x01")
+	b = b.add(xdpKey{table: xdpUplinkMap, key: [4]byte{0, 0, 0, 101}}, "\x0a\x00\x00\x02\xc0\x00\x02\x01")
+	if b.count != 2 || string(b.keys) != "\x00\x00\x00\x64\x00\x00\x00\x65" || len(b.values) != 16 || b.values[11] != 2 {
+		t.Errorf("batch = %d entries, keys %x, values %x", b.count, b.keys, b.values)
+	}
+}
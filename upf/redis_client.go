@@ -2,25 +2,166 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
 	"log"
+	"strconv"
+	"time"
 
+	"github.com/openmvcore/upf/pkg/upf"
 	"github.com/redis/go-redis/v9"
 )
 
+// redisTimeout bounds every Redis operation, so a slow Redis delays the
+// PFCP responses without blocking them
+const redisTimeout = 2 * time.Second
+
 var (
 	RedisClient *redis.Client
 	RedisCtx    = context.Background()
 )
 
-func InitRedis() {
+func InitRedis(cfg RedisConfig) error {
 	RedisClient = redis.NewClient(&redis.Options{
-		Addr:     "redis:6379",
-		Password: "",
-		DB:       0,
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
 	})
 	_, err := RedisClient.Ping(RedisCtx).Result()
 	if err != nil {
-		log.Fatalf("❌ Redis connection failed: %v", err)
+		return fmt.Errorf("redis connection failed: %w", err)
 	}
 	log.Println("✅ Connected to Redis")
+	return nil
+}
+
+// redisStore persists the UPF state in Redis: the recovery time stamp, the
+// associations in a hash by Node ID and every session as JSON under its
+// SEID, listed in a set
+type redisStore struct {
+	redis  *redis.Client
+	prefix string
+}
+
+func newRedisStore(client *redis.Client, prefix string) *redisStore {
+	if prefix == "" {
+		prefix = "upf:"
+	}
+	return &redisStore{redis: client, prefix: prefix}
+}
+
+func (s *redisStore) recoveryKey() string     { return s.prefix + "recovery" }
+func (s *redisStore) associationsKey() string { return s.prefix + "associations" }
+func (s *redisStore) sessionIndexKey() string { return s.prefix + "sessions" }
+func (s *redisStore) sessionKey(seid uint64) string {
+	return s.prefix + "session:" + strconv.FormatUint(seid, 10)
+}
+
+// Load returns the persisted state
+func (s *redisStore) Load() (*upf.State, error) {
+	ctx, cancel := context.WithTimeout(RedisCtx, 5*redisTimeout)
+	defer cancel()
+
+	state := &upf.State{}
+	recovery, err := s.redis.Get(ctx, s.recoveryKey()).Result()
+	if err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to get recovery time: %w", err)
+	}
+	if recovery != "" {
+		if state.RecoveryTime, err = time.Parse(time.RFC3339Nano, recovery); err != nil {
+			return nil, fmt.Errorf("invalid recovery time %q: %w", recovery, err)
+		}
+	}
+
+	associations, err := s.redis.HGetAll(ctx, s.associationsKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get associations: %w", err)
+	}
+	for nodeID, data := range associations {
+		a := &upf.AssociationState{}
+		if err := json.Unmarshal([]byte(data), a); err != nil {
+			log.Printf("⚠️ Skipping association with %s: %v", nodeID, err)
+			continue
+		}
+		state.Associations = append(state.Associations, a)
+	}
+
+	ids, err := s.redis.SMembers(ctx, s.sessionIndexKey()).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	for _, id := range ids {
+		seid, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			s.redis.SRem(ctx, s.sessionIndexKey(), id)
+			continue
+		}
+		data, err := s.redis.Get(ctx, s.sessionKey(seid)).Bytes()
+		if err == redis.Nil {
+			// Index entry of a session deleted midway
+			s.redis.SRem(ctx, s.sessionIndexKey(), id)
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to get session %d: %w", seid, err)
+		}
+		session := &upf.SessionState{}
+		if err := json.Unmarshal(data, session); err != nil {
+			log.Printf("⚠️ Skipping session %d: %v", seid, err)
+			continue
+		}
+		state.Sessions = append(state.Sessions, session)
+	}
+	return state, nil
+}
+
+// SaveRecoveryTime writes the recovery time stamp of the UPF
+func (s *redisStore) SaveRecoveryTime(t time.Time) error {
+	ctx, cancel := context.WithTimeout(RedisCtx, redisTimeout)
+	defer cancel()
+	return s.redis.Set(ctx, s.recoveryKey(), t.Format(time.RFC3339Nano), 0).Err()
+}
+
+// SaveAssociation writes an association
+func (s *redisStore) SaveAssociation(a *upf.AssociationState) error {
+	data, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("failed to marshal association: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(RedisCtx, redisTimeout)
+	defer cancel()
+	return s.redis.HSet(ctx, s.associationsKey(), a.NodeID, data).Err()
+}
+
+// DeleteAssociation removes an association
+func (s *redisStore) DeleteAssociation(nodeID string) error {
+	ctx, cancel := context.WithTimeout(RedisCtx, redisTimeout)
+	defer cancel()
+	return s.redis.HDel(ctx, s.associationsKey(), nodeID).Err()
+}
+
+// SaveSession writes the state of a session
+func (s *redisStore) SaveSession(session *upf.SessionState) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(RedisCtx, redisTimeout)
+	defer cancel()
+	pipe := s.redis.TxPipeline()
+	pipe.Set(ctx, s.sessionKey(session.SEID), data, 0)
+	pipe.SAdd(ctx, s.sessionIndexKey(), strconv.FormatUint(session.SEID, 10))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// DeleteSession removes a session
+func (s *redisStore) DeleteSession(seid uint64) error {
+	ctx, cancel := context.WithTimeout(RedisCtx, redisTimeout)
+	defer cancel()
+	pipe := s.redis.TxPipeline()
+	pipe.Del(ctx, s.sessionKey(seid))
+	pipe.SRem(ctx, s.sessionIndexKey(), strconv.FormatUint(seid, 10))
+	_, err := pipe.Exec(ctx)
+	return err
 }
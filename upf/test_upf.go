@@ -23,7 +23,9 @@ type TestPFCPTunnel struct {
 
 func TestRedisPFCPStorage(t *testing.T) {
 	// Initialize Redis
-	InitRedis()
+	if err := InitRedis(RedisConfig{Addr: "redis:6379"}); err != nil {
+		t.Skip(err)
+	}
 	defer RedisClient.Close()
 
 	// Test data
@@ -1,8 +0,0 @@
-package main
-
-import "log"
-
-func SetupTunnels() {
-	log.Println("🚀 Setting up GTP tunnels... (stub)")
-	// Tunnel setup stub
-}